@@ -1,32 +1,231 @@
 package config
 
 import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"log"
+	"message-center/pkg/configuration"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 内部通讯协议
+const (
+	PROTOCOL_HTTP = "http"
+	PROTOCOL_GRPC = "grpc"
+)
+
+// message server的HTTP接口协议
+const (
+	SCHEME_HTTP  = "http"
+	SCHEME_HTTPS = "https"
 )
 
 type MessageServerConfig struct {
 	Hostname string `json:"hostname"`
-	Port     int    `json:"port"`
+	Port     int    `json:"port"`     // HTTP端口, 房间订阅同步总是使用HTTP
+	Protocol string `json:"protocol"` // 推送协议: http(默认), grpc
+	GrpcPort int    `json:"grpcPort"` // gRPC端口, protocol为grpc时使用
+	Scheme   string `json:"scheme"`   // HTTP接口协议: http(默认), https; https时gRPC也使用TLS
+}
+
+// hostname:port, 唯一标识一个message server
+func (serverConfig *MessageServerConfig) Address() string {
+	return net.JoinHostPort(serverConfig.Hostname, strconv.Itoa(serverConfig.Port))
+}
+
+func (serverConfig *MessageServerConfig) GrpcAddress() string {
+	return net.JoinHostPort(serverConfig.Hostname, strconv.Itoa(serverConfig.GrpcPort))
+}
+
+// 是否使用gRPC推送
+func (serverConfig *MessageServerConfig) UseGrpc() bool {
+	return serverConfig.Protocol == PROTOCOL_GRPC
+}
+
+// 是否使用TLS
+func (serverConfig *MessageServerConfig) UseTLS() bool {
+	return serverConfig.Scheme == SCHEME_HTTPS
+}
+
+// HTTP接口地址前缀, 如http://hostname:port
+func (serverConfig *MessageServerConfig) BaseUrl() string {
+	if serverConfig.UseTLS() {
+		return SCHEME_HTTPS + "://" + serverConfig.Address()
+	}
+	return SCHEME_HTTP + "://" + serverConfig.Address()
+}
+
+// message server发现配置
+type DiscoveryConfig struct {
+	Type            string `json:"type"`            // static/file/dns
+	File            string `json:"file"`            // file: 监听的json文件
+	DnsName         string `json:"dnsName"`         // dns: 域名, 如k8s headless service
+	DnsSrv          bool   `json:"dnsSrv"`          // dns: 是否解析SRV记录
+	DnsPort         int    `json:"dnsPort"`         // dns: 非SRV记录时message server的端口
+	RefreshInterval int    `json:"refreshInterval"` // dns: 解析间隔, 单位秒
+	Scheme          string `json:"scheme"`          // dns: 解析出的message server使用的协议, http或https
+}
+
+// 调用方的api key及其权限
+type ApiKeyConfig struct {
+	Key       string   `json:"key"`
+	Secret    string   `json:"secret"`    // 不为空时请求必须签名
+	Rooms     []string `json:"rooms"`     // 允许推送的房间, 以*结尾表示前缀, 单独的*表示所有房间
+	Broadcast bool     `json:"broadcast"` // 是否允许全量推送
+	Users     bool     `json:"users"`     // 是否允许用户推送
+	Admin     bool     `json:"admin"`     // 是否允许查询发送记录等管理接口
+}
+
+// 房间是否在权限范围内
+func (apiKey *ApiKeyConfig) AllowRoom(room string) bool {
+	var (
+		pattern string
+	)
+	for _, pattern = range apiKey.Rooms {
+		if pattern == room || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(room, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// 消息处理渠道配置, 对应MessageCenter.Channel中的值
+type ChannelConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`        // 群机器人渠道的类型: dingtalk, wecom, slack, 启动时按此注册, 内置渠道为空
+	Disabled    bool   `json:"disabled"`    // 停用后该渠道的消息记录为停用, 不发送
+	Concurrency int    `json:"concurrency"` // 同时执行的发送任务数
+	// 以下用于通过http发送的渠道, 如webhook
+	Timeout         int `json:"timeout"`         // 单次请求超时, 单位毫秒
+	Retry           int `json:"retry"`           // 最多尝试次数, 网络错误、5xx和429时重试
+	RetryBackoff    int `json:"retryBackoff"`    // 第一次重试前的等待时间, 之后每次翻倍, 单位毫秒
+	RetryMaxBackoff int `json:"retryMaxBackoff"` // 重试等待时间的上限, 单位毫秒
+	// 发送失败的收件人重新排队处理的次数和间隔, 用完后进入死信
+	RequeueLimit    int   `json:"requeueLimit"`    // 为0时失败直接进入死信
+	RequeueSchedule []int `json:"requeueSchedule"` // 第n次重新处理前的等待时间, 超出长度时使用最后一个, 为空时60, 单位秒
+	// 以下用于群机器人渠道
+	Url       string `json:"url"`       // 机器人的webhook地址
+	Secret    string `json:"secret"`    // 加签密钥, 目前只有钉钉使用
+	RateLimit int    `json:"rateLimit"` // 每分钟最多发送的消息数, 为0时不限制
+}
+
+// 未配置的渠道使用的默认值
+const (
+	DefaultChannelConcurrency = 4
+	DefaultChannelTimeout     = 3000
+)
+
+// 渠道配置, 未配置时使用默认值
+func (c *Config) Channel(name string) ChannelConfig {
+	for _, channelConfig := range c.ProcessChannels {
+		if channelConfig.Name == name {
+			if channelConfig.Concurrency <= 0 {
+				channelConfig.Concurrency = DefaultChannelConcurrency
+			}
+			if channelConfig.Timeout <= 0 {
+				channelConfig.Timeout = DefaultChannelTimeout
+			}
+			if channelConfig.Retry <= 0 {
+				channelConfig.Retry = 1
+			}
+			return channelConfig
+		}
+	}
+	return ChannelConfig{Name: name, Concurrency: DefaultChannelConcurrency, Timeout: DefaultChannelTimeout, Retry: 1}
+}
+
+// 已重新排队requeued次后, 下一次重新处理前的等待时间, 单位秒
+func (channelConfig *ChannelConfig) RequeueDelay(requeued int) int {
+	if len(channelConfig.RequeueSchedule) == 0 {
+		return 60
+	}
+	if requeued >= len(channelConfig.RequeueSchedule) {
+		requeued = len(channelConfig.RequeueSchedule) - 1
+	}
+	return channelConfig.RequeueSchedule[requeued]
 }
 
 // 程序配置
+// 标记reload:"true"的字段支持热更新, 修改config.json后无需重启, 其余字段修改后需要重启才能生效
 type Config struct {
 	ServicePort                      int                   `json:"servicePort"`
 	ServiceReadTimeout               int                   `json:"serviceReadTimeout"`
+	ServiceMaxBodySize               int                   `json:"serviceMaxBodySize" reload:"true"` // 请求体最大字节数
 	ServiceWriteTimeout              int                   `json:"serviceWriteTimeout"`
-	MessageServerList                []MessageServerConfig `json:"messageServerList"`
+	ApiKeys                          []ApiKeyConfig        `json:"apiKeys" reload:"true"` // 为空时不校验调用方
+	ApiSignWindow                    int                   `json:"apiSignWindow" reload:"true"`
+	PushIdempotencyWindow            int                   `json:"pushIdempotencyWindow" reload:"true"` // 幂等key的保留时间, 单位秒
+	PushWaitTimeout                  int                   `json:"pushWaitTimeout" reload:"true"`       // wait=true时等待送达的最长时间, 单位毫秒, 不超过serviceWriteTimeout
+	ScheduleInterval                 int                   `json:"scheduleInterval" reload:"true"`      // 查找到期定时推送的间隔, 单位毫秒
+	ScheduleLeaseTime                int                   `json:"scheduleLeaseTime" reload:"true"`     // 分发定时推送的租约时间, 单位秒
+	ScheduleBatchSize                int                   `json:"scheduleBatchSize" reload:"true"`
+	MessageServerList                []MessageServerConfig `json:"messageServerList" reload:"true"`
+	MessageServerDiscovery           DiscoveryConfig       `json:"messageServerDiscovery"`
 	MessageServerMaxConnection       int                   `json:"messageServerMaxConnection"`
 	MessageServerTimeout             int                   `json:"messageServerTimeout"`
 	MessageServerIdleTimeout         int                   `json:"messageServerIdleTimeout"`
 	MessageServerDispatchWorkerCount int                   `json:"messageServerDispatchWorkerCount"`
 	MessageServerDispatchChannelSize int                   `json:"messageServerDispatchChannelSize"`
 	MessageServerMaxPendingCount     int                   `json:"messageServerMaxPendingCount"`
-	MessageServerPushRetry           int                   `json:"messageServerPushRetry"`
+	MessageServerPushRetry           int                   `json:"messageServerPushRetry" reload:"true"`
+	MessageServerRetryBackoff        int                   `json:"messageServerRetryBackoff" reload:"true"`
+	MessageServerRetryMaxBackoff     int                   `json:"messageServerRetryMaxBackoff" reload:"true"`
+	MessageServerRetryDeadline       int                   `json:"messageServerRetryDeadline" reload:"true"`
+	MessageServerRoomRouting         bool                  `json:"messageServerRoomRouting"`
+	MessageServerRoomSyncWait        int                   `json:"messageServerRoomSyncWait"`
+	MessageServerGrpcTLS             bool                  `json:"messageServerGrpcTLS"` // message server的gRPC服务是否启用了TLS
+	MessageServerCa                  string                `json:"messageServerCa"`      // 校验message server证书的CA, 为空时使用系统根证书
+	MessageServerClientCert          string                `json:"messageServerClientCert"`
+	MessageServerClientKey           string                `json:"messageServerClientKey"`
+	MessageServerProbeInterval       int                   `json:"messageServerProbeInterval" reload:"true"`
+	MessageServerBreakerThreshold    int                   `json:"messageServerBreakerThreshold" reload:"true"`
+	MessageServerBreakerOpenTime     int                   `json:"messageServerBreakerOpenTime" reload:"true"`
+	MessageServerBatchWindow         int                   `json:"messageServerBatchWindow" reload:"true"` // 批量推送窗口, 单位毫秒, 启动时为0则不开启
+	MessageServerBatchSize           int                   `json:"messageServerBatchSize" reload:"true"`
+	MessageServerSpillDir            string                `json:"messageServerSpillDir"` // 溢出队列目录, 为空时不开启, 积压的推送直接丢弃
+	MessageServerSpillSegmentSize    int                   `json:"messageServerSpillSegmentSize"`
+	MessageServerSpillReplayInterval int                   `json:"messageServerSpillReplayInterval" reload:"true"`
+	Backbone                         string                `json:"backbone"` // 推送通道: http(默认), inprocess, stomp
+	BackboneStompAddress             string                `json:"backboneStompAddress"`
+	BackboneStompUsername            string                `json:"backboneStompUsername"`
+	BackboneStompPassword            string                `json:"backboneStompPassword"`
+	BackboneStompTopic               string                `json:"backboneStompTopic"`
+	ProcessWatch                     bool                  `json:"processWatch"`                      // 通过change stream监听新消息, mongodb不是副本集时回退到轮询
+	ProcessPollInterval              int                   `json:"processPollInterval" reload:"true"` // 轮询未处理消息的间隔, 单位秒
+	ProcessWatchRetry                int                   `json:"processWatchRetry" reload:"true"`   // change stream中断后重新监听的间隔, 单位秒
+	ProcessBatchSize                 int                   `json:"processBatchSize" reload:"true"`    // 每页抢占的消息数
+	ProcessLeaseTime                 int                   `json:"processLeaseTime" reload:"true"`    // 处理消息的租约时间, 处理期间续约, 单位秒
+	ProcessWorkers                   int                   `json:"processWorkers"`                    // 所有渠道同时执行的发送任务数
+	ProcessChannels                  []ChannelConfig       `json:"processChannels" reload:"true"`
+}
+
+var (
+	// 当前生效的配置, 热更新时整体替换
+	globalLogicConfig atomic.Value
+
+	// 热更新回调
+	reloadMutex     sync.Mutex
+	reloadListeners []func(oldConfig, newConfig *Config)
+)
+
+// 当前生效的配置, 调用方不要修改返回的对象
+func GlobalLogicConfig() *Config {
+	return globalLogicConfig.Load().(*Config)
 }
 
-var GlobalLogicConfig *Config
+// 注册热更新回调, 用于需要重建运行状态的配置项, 如message server列表
+func OnReload(listener func(oldConfig, newConfig *Config)) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	reloadListeners = append(reloadListeners, listener)
+}
 
 func LoadConfig() error {
 	configPath := os.Getenv("CONFIG")
@@ -36,10 +235,22 @@ func LoadConfig() error {
 			Port:     7788,
 		}}
 		c := Config{
-			ServicePort:                      7799,
-			ServiceReadTimeout:               2000,
-			ServiceWriteTimeout:              2000,
-			MessageServerList:                msc,
+			ServicePort:           7799,
+			ServiceReadTimeout:    2000,
+			ServiceMaxBodySize:    4 << 20,
+			ServiceWriteTimeout:   2000,
+			ApiSignWindow:         300,
+			PushIdempotencyWindow: 600,
+			PushWaitTimeout:       1500,
+			ScheduleInterval:      1000,
+			ScheduleLeaseTime:     30,
+			ScheduleBatchSize:     100,
+			MessageServerList:     msc,
+			MessageServerDiscovery: DiscoveryConfig{
+				Type:            "static",
+				DnsPort:         7788,
+				RefreshInterval: 10,
+			},
 			MessageServerMaxConnection:       4,
 			MessageServerTimeout:             300,
 			MessageServerIdleTimeout:         60,
@@ -47,8 +258,34 @@ func LoadConfig() error {
 			MessageServerDispatchChannelSize: 1000,
 			MessageServerMaxPendingCount:     20,
 			MessageServerPushRetry:           3,
+			MessageServerRetryBackoff:        50,
+			MessageServerRetryMaxBackoff:     1000,
+			MessageServerRetryDeadline:       3000,
+			MessageServerRoomRouting:         false,
+			MessageServerRoomSyncWait:        800,
+			MessageServerProbeInterval:       1000,
+			MessageServerBreakerThreshold:    3,
+			MessageServerBreakerOpenTime:     5000,
+			MessageServerBatchWindow:         0,
+			MessageServerBatchSize:           64,
+			MessageServerSpillSegmentSize:    64,
+			MessageServerSpillReplayInterval: 1000,
+			Backbone:                         "http",
+			BackboneStompTopic:               "message-center-push",
+			ProcessWatch:                     true,
+			ProcessPollInterval:              60,
+			ProcessWatchRetry:                30,
+			ProcessBatchSize:                 100,
+			ProcessLeaseTime:                 300,
+			ProcessWorkers:                   16,
+			ProcessChannels: []ChannelConfig{
+				{Name: "email", Concurrency: 4, RequeueLimit: 3, RequeueSchedule: []int{60, 300, 1800}},
+				{Name: "mq", Concurrency: 4, RequeueLimit: 3, RequeueSchedule: []int{60, 300, 1800}},
+				{Name: "message", Concurrency: 16},
+				{Name: "webhook", Concurrency: 8, Timeout: 3000, Retry: 3, RetryBackoff: 500, RetryMaxBackoff: 5000, RequeueLimit: 3, RequeueSchedule: []int{60, 300, 1800}},
+			},
 		}
-		GlobalLogicConfig = &c
+		globalLogicConfig.Store(&c)
 		return nil
 	}
 	config := viper.New()
@@ -62,6 +299,44 @@ func LoadConfig() error {
 	if err := config.Unmarshal(&c); err != nil {
 		log.Fatal(err)
 	}
-	GlobalLogicConfig = &c
+	globalLogicConfig.Store(&c)
+
+	// 监听配置文件变化, 热更新
+	config.OnConfigChange(func(event fsnotify.Event) {
+		reloadConfig(config)
+	})
+	config.WatchConfig()
 	return nil
 }
+
+func reloadConfig(config *viper.Viper) {
+	var (
+		c               Config
+		oldConfig       *Config
+		reloaded        []string
+		restartRequired []string
+		listener        func(oldConfig, newConfig *Config)
+	)
+	if err := config.Unmarshal(&c); err != nil {
+		logrus.Warn("解析配置文件失败, 忽略本次修改：" + err.Error())
+		return
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	oldConfig = GlobalLogicConfig()
+	reloaded, restartRequired = configuration.MergeReloadable(oldConfig, &c)
+	if len(restartRequired) > 0 {
+		logrus.Warn("以下配置需要重启才能生效：" + strings.Join(restartRequired, ","))
+	}
+	if len(reloaded) == 0 {
+		return
+	}
+	globalLogicConfig.Store(&c)
+	logrus.Info("配置已热更新：" + strings.Join(reloaded, ","))
+
+	for _, listener = range reloadListeners {
+		listener(oldConfig, &c)
+	}
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 从临时目录的config.json读取配置
+func readTestConfig(t *testing.T, content string) *viper.Viper {
+	dir, err := ioutil.TempDir("", "logic-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := viper.New()
+	config.AddConfigPath(dir)
+	config.SetConfigName("config")
+	config.SetConfigType("json")
+	if err = config.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestReloadConfig(t *testing.T) {
+	var (
+		calls []*Config // 每次回调收到的旧配置和新配置
+	)
+	OnReload(func(oldConfig, newConfig *Config) {
+		calls = append(calls, oldConfig, newConfig)
+	})
+	defer func() {
+		reloadListeners = nil
+	}()
+
+	cases := []struct {
+		name         string
+		content      string
+		wantPort     int
+		wantInterval int
+		wantNotified bool
+	}{
+		{"热更新字段生效并通知回调", `{"servicePort": 7799, "processPollInterval": 30}`, 7799, 30, true},
+		{"需要重启的字段保持旧值", `{"servicePort": 8000, "processPollInterval": 10}`, 7799, 10, true},
+		{"只修改需要重启的字段时不替换配置也不通知", `{"servicePort": 8000, "processPollInterval": 60}`, 7799, 60, false},
+	}
+	for _, c := range cases {
+		oldConfig := &Config{ServicePort: 7799, ProcessPollInterval: 60}
+		globalLogicConfig.Store(oldConfig)
+		calls = nil
+
+		reloadConfig(readTestConfig(t, c.content))
+		if got := GlobalLogicConfig(); got.ServicePort != c.wantPort || got.ProcessPollInterval != c.wantInterval {
+			t.Errorf("%s: port=%d interval=%d", c.name, got.ServicePort, got.ProcessPollInterval)
+		}
+		if !c.wantNotified {
+			if len(calls) != 0 || GlobalLogicConfig() != oldConfig {
+				t.Errorf("%s: 不应替换配置和通知回调", c.name)
+			}
+			continue
+		}
+		if len(calls) != 2 || calls[0] != oldConfig || calls[1] != GlobalLogicConfig() || calls[1].ProcessPollInterval != c.wantInterval {
+			t.Errorf("%s: 回调参数%v", c.name, calls)
+		}
+	}
+}
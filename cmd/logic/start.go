@@ -63,6 +63,11 @@ func start() {
 	mc := mongodb.MongoDBController{}
 	mc.Initialize(&dcl)
 
+	logrus.Info("初始化定时推送")
+	if err = push.InitScheduler(&mc); err != nil {
+		logrus.Error("初始化定时推送失败, 定时推送不可用：" + err.Error())
+	}
+
 	logrus.Info("初始化email连接")
 	ec := email_client.EmailClientImpl{}
 	ec.Initialize(&dcl)
@@ -71,6 +76,9 @@ func start() {
 	pm := process_message.ProcessMessageImpl{}
 	pm.Initialize(&mc, &mqc, &ec)
 	pm.Run()
+	push.GlobalHttpServer.HandleAdminFunc("/deliveries", pm.HandleDeliveries)
+	push.GlobalHttpServer.HandleAdminFunc("/deadletters", pm.HandleDeadLetters)
+	push.GlobalHttpServer.HandleAdminFunc("/deadletters/redrive", pm.HandleRedrive)
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -78,6 +86,9 @@ func start() {
 		select {
 		case <-sigCh:
 			logrus.Info("logic系统关闭")
+			if push.GlobalScheduler != nil {
+				push.GlobalScheduler.Close()
+			}
 			mc.Close()
 			pm.Close()
 			push.HttpServerClose()
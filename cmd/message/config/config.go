@@ -1,37 +1,59 @@
 package config
 
 import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"log"
+	"message-center/pkg/configuration"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
 // socket服务启动配置
+// 标记reload:"true"的字段支持热更新, 修改config.json后无需重启, 其余字段修改后需要重启才能生效
 type Config struct {
 	WsPort               int    `json:"wsPort"`
 	WsReadTimeout        int    `json:"wsReadTimeout"`
 	WsWriteTimeout       int    `json:"wsWriteTimeout"`
 	WsInChannelSize      int    `json:"wsInChannelSize"`
 	WsOutChannelSize     int    `json:"wsOutChannelSize"`
-	WsHeartbeatInterval  int    `json:"wsHeartbeatInterval"`
-	MaxMergerDelay       int    `json:"maxMergerDelay"`
-	MaxMergerBatchSize   int    `json:"maxMergerBatchSize"`
+	WsHeartbeatInterval  int    `json:"wsHeartbeatInterval" reload:"true"`
+	MaxMergerDelay       int    `json:"maxMergerDelay" reload:"true"`
+	MaxMergerBatchSize   int    `json:"maxMergerBatchSize" reload:"true"`
 	MergerWorkerCount    int    `json:"mergerWorkerCount"`
 	MergerChannelSize    int    `json:"mergerChannelSize"`
 	ServicePort          int    `json:"servicePort"`
 	ServiceReadTimeout   int    `json:"serviceReadTimeout"`
 	ServiceWriteTimeout  int    `json:"serviceWriteTimeout"`
+	GrpcPort             int    `json:"grpcPort"`         // 内部通讯gRPC端口, 0表示不启动
+	GrpcDedupeWindow     int    `json:"grpcDedupeWindow"` // 单位毫秒, 窗口内相同推送ID的gRPC推送只处理一次
 	ServerPem            string `json:"serverPem"`
 	ServerKey            string `json:"serverKey"`
+	ClientCa             string `json:"clientCa"` // 校验logic客户端证书的CA, 为空时不要求客户端证书
 	BucketCount          int    `json:"bucketCount"`
-	MaxJoinRoom          int    `json:"maxJoinRoom"`
+	MaxJoinRoom          int    `json:"maxJoinRoom" reload:"true"`
 	DispatchChannelSize  int    `json:"dispatchChannelSize"`
 	DispatchWorkerCount  int    `json:"dispatchWorkerCount"`
 	BucketJobChannelSize int    `json:"bucketJobChannelSize"`
 	BucketJobWorkerCount int    `json:"bucketJobWorkerCount"`
+	BucketJobOrdered     bool   `json:"bucketJobOrdered"` // 只保证单房间和单用户推送的顺序
+	// logic推送通道: http(默认), inprocess, stomp
+	Backbone              string `json:"backbone"`
+	BackboneStompAddress  string `json:"backboneStompAddress"`
+	BackboneStompUsername string `json:"backboneStompUsername"`
+	BackboneStompPassword string `json:"backboneStompPassword"`
+	BackboneStompTopic    string `json:"backboneStompTopic"`
 }
 
-var GlobalServerConfig *Config
+// 当前生效的配置, 热更新时整体替换
+var globalServerConfig atomic.Value
+
+// 当前生效的配置, 调用方不要修改返回的对象
+func GlobalServerConfig() *Config {
+	return globalServerConfig.Load().(*Config)
+}
 
 func LoadConfig() error {
 	configPath := os.Getenv("CONFIG")
@@ -50,16 +72,22 @@ func LoadConfig() error {
 			ServicePort:          7788,
 			ServiceReadTimeout:   2000,
 			ServiceWriteTimeout:  2000,
+			GrpcPort:             7789,
+			GrpcDedupeWindow:     10000,
 			ServerPem:            "",
 			ServerKey:            "",
+			ClientCa:             "",
 			BucketCount:          16,
 			MaxJoinRoom:          5,
 			DispatchChannelSize:  1000,
 			DispatchWorkerCount:  16,
 			BucketJobChannelSize: 1000,
 			BucketJobWorkerCount: 2,
+			BucketJobOrdered:     false,
+			Backbone:             "http",
+			BackboneStompTopic:   "message-center-push",
 		}
-		GlobalServerConfig = &c
+		globalServerConfig.Store(&c)
 		return nil
 	}
 	config := viper.New()
@@ -73,6 +101,33 @@ func LoadConfig() error {
 	if err := config.Unmarshal(&c); err != nil {
 		log.Fatal(err)
 	}
-	GlobalServerConfig = &c
+	globalServerConfig.Store(&c)
+
+	// 监听配置文件变化, 热更新
+	config.OnConfigChange(func(event fsnotify.Event) {
+		reloadConfig(config)
+	})
+	config.WatchConfig()
 	return nil
 }
+
+func reloadConfig(config *viper.Viper) {
+	var (
+		c               Config
+		reloaded        []string
+		restartRequired []string
+	)
+	if err := config.Unmarshal(&c); err != nil {
+		logrus.Warn("解析配置文件失败, 忽略本次修改：" + err.Error())
+		return
+	}
+	reloaded, restartRequired = configuration.MergeReloadable(GlobalServerConfig(), &c)
+	if len(restartRequired) > 0 {
+		logrus.Warn("以下配置需要重启才能生效：" + strings.Join(restartRequired, ","))
+	}
+	if len(reloaded) == 0 {
+		return
+	}
+	globalServerConfig.Store(&c)
+	logrus.Info("配置已热更新：" + strings.Join(reloaded, ","))
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 )
 
@@ -60,6 +61,18 @@ func start() {
 		log.Fatal("启动HTTP服务失败：" + err.Error())
 	}
 
+	logrus.Info("启动gRPC服务：" + strconv.Itoa(config.GlobalServerConfig().GrpcPort))
+	err = message_server.InitGrpcService()
+	if err != nil {
+		log.Fatal("启动gRPC服务失败：" + err.Error())
+	}
+
+	logrus.Info("初始化推送通道：" + config.GlobalServerConfig().Backbone)
+	err = message_server.InitBackbone()
+	if err != nil {
+		log.Fatal("初始化推送通道失败：" + err.Error())
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	for {
@@ -67,6 +80,8 @@ func start() {
 		case <-sigCh:
 			logrus.Info("logic系统关闭")
 			message_server.HttpServerClose()
+			message_server.GrpcServerClose()
+			message_server.BackboneClose()
 			web_socket.SocketConnectClose()
 			web_socket.GlobalMessageMergeServer.MergeClose()
 			web_socket.GlobalSocketConnectionManager.ConnectManagerClose()
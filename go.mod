@@ -3,8 +3,10 @@ module message-center
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
 	github.com/go-stomp/stomp v2.0.6+incompatible
+	github.com/golang/protobuf v1.3.3
 	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/common v0.4.0
 	github.com/shima-park/agollo v1.2.7
@@ -12,4 +14,5 @@ require (
 	github.com/spf13/viper v1.7.1
 	github.com/urfave/cli v1.22.4
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	google.golang.org/grpc v1.29.1
 )
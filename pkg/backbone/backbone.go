@@ -0,0 +1,42 @@
+package backbone
+
+import (
+	"message-center/pkg/types"
+	"sync"
+)
+
+// logic与message server之间的推送通道
+// http: logic向每个message server分别发送HTTP请求(默认)
+// inprocess: logic与message server运行在同一进程时直接调用
+// stomp: logic向消息队列topic发布一次, 所有message server订阅该topic
+const (
+	BACKBONE_HTTP      = "http"
+	BACKBONE_INPROCESS = "inprocess"
+	BACKBONE_STOMP     = "stomp"
+)
+
+// 推送接收方, 由message server实现
+type Receiver interface {
+	Receive(envelope *types.PushEnvelope) *types.PushResponse
+}
+
+var (
+	rwMutex   sync.RWMutex
+	inProcess Receiver
+)
+
+// message server启动时注册, 供同进程的logic直接调用
+func RegisterInProcess(receiver Receiver) {
+	rwMutex.Lock()
+	defer rwMutex.Unlock()
+
+	inProcess = receiver
+}
+
+// 同进程的message server, 未注册时返回nil
+func InProcess() Receiver {
+	rwMutex.RLock()
+	defer rwMutex.RUnlock()
+
+	return inProcess
+}
@@ -0,0 +1,195 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"message-center/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+// 检查证书文件是否变化的间隔
+const reloadInterval = 10 * time.Second
+
+// 证书热更新: 定时检查证书、密钥和CA文件的修改时间, 变化后重新加载, 加载失败时继续使用旧证书
+// 通过回调提供证书和CA, 已建立的连接不受影响, 新的握手使用新证书
+type Reloader struct {
+	certFile string // 本端证书, 为空时不提供证书
+	keyFile  string
+	caFile   string // 校验对端证书的CA, 为空时服务端不校验客户端, 客户端用系统根证书校验服务端
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes [3]time.Time // certFile, keyFile, caFile的修改时间
+	stopChan chan byte
+}
+
+// 加载证书和CA, 任一文件不合法时返回utils.CertInvalid
+func NewReloader(certFile string, keyFile string, caFile string) (reloader *Reloader, err error) {
+	reloader = &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		stopChan: make(chan byte),
+	}
+	if _, err = reloader.reload(); err != nil {
+		return nil, err
+	}
+	go reloader.watchMain()
+	return
+}
+
+// 文件有变化时重新加载, 返回是否加载了新文件
+func (reloader *Reloader) reload() (reloaded bool, err error) {
+	var (
+		modTimes [3]time.Time
+		cert     tls.Certificate
+		caPem    []byte
+		caPool   *x509.CertPool
+	)
+	for fileIdx, file := range []string{reloader.certFile, reloader.keyFile, reloader.caFile} {
+		if file == "" {
+			continue
+		}
+		fileInfo, statErr := os.Stat(file)
+		if statErr != nil {
+			return false, statErr
+		}
+		modTimes[fileIdx] = fileInfo.ModTime()
+	}
+
+	reloader.mutex.RLock()
+	reloaded = modTimes != reloader.modTimes
+	reloader.mutex.RUnlock()
+	if !reloaded {
+		return
+	}
+
+	if reloader.certFile != "" {
+		if cert, err = tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile); err != nil {
+			return false, utils.CertInvalid
+		}
+	}
+	if reloader.caFile != "" {
+		if caPem, err = ioutil.ReadFile(reloader.caFile); err != nil {
+			return false, err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caPem) {
+			return false, utils.CertInvalid
+		}
+	}
+
+	reloader.mutex.Lock()
+	if reloader.certFile != "" {
+		reloader.cert = &cert
+	}
+	reloader.caPool = caPool
+	reloader.modTimes = modTimes
+	reloader.mutex.Unlock()
+	return
+}
+
+func (reloader *Reloader) watchMain() {
+	for {
+		select {
+		case <-reloader.stopChan:
+			return
+		case <-time.After(reloadInterval):
+		}
+		if reloaded, err := reloader.reload(); err != nil {
+			logrus.Warn("重新加载证书失败, 继续使用旧证书：" + err.Error())
+		} else if reloaded {
+			logrus.Info("证书已更新：" + reloader.certFile + " " + reloader.caFile)
+		}
+	}
+}
+
+func (reloader *Reloader) certificate() *tls.Certificate {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.cert
+}
+
+// 用当前的CA校验对端证书链; 未配置CA时systemRoots为true用系统根证书校验, 否则不校验
+func (reloader *Reloader) verify(rawCerts [][]byte, dnsName string, usage x509.ExtKeyUsage, systemRoots bool) (err error) {
+	var (
+		caPool     *x509.CertPool
+		certs      []*x509.Certificate
+		cert       *x509.Certificate
+		rawCert    []byte
+		verifyOpts x509.VerifyOptions
+	)
+	reloader.mutex.RLock()
+	caPool = reloader.caPool
+	reloader.mutex.RUnlock()
+	if caPool == nil && !systemRoots {
+		return
+	}
+	if len(rawCerts) == 0 {
+		return errors.New("peer certificate missing")
+	}
+
+	for _, rawCert = range rawCerts {
+		if cert, err = x509.ParseCertificate(rawCert); err != nil {
+			return
+		}
+		certs = append(certs, cert)
+	}
+	// Roots为nil时使用系统根证书
+	verifyOpts = x509.VerifyOptions{
+		Roots:         caPool,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       dnsName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert = range certs[1:] {
+		verifyOpts.Intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(verifyOpts)
+	return
+}
+
+// 服务端TLS配置: 提供当前证书, 配置了CA时要求并校验客户端证书
+func (reloader *Reloader) ServerConfig() (tlsConfig *tls.Config) {
+	tlsConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.certificate(), nil
+		},
+	}
+	if reloader.caFile != "" {
+		// 由VerifyPeerCertificate用热更新后的CA校验, 标准库只负责要求客户端出示证书
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return reloader.verify(rawCerts, "", x509.ExtKeyUsageClientAuth, false)
+		}
+	}
+	return
+}
+
+// 客户端TLS配置: 配置了证书时作为客户端证书出示, 用配置的CA校验服务端证书和主机名, 未配置CA时用系统根证书校验
+func (reloader *Reloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		// 由VerifyPeerCertificate用热更新后的CA校验
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := reloader.certificate(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return reloader.verify(rawCerts, serverName, x509.ExtKeyUsageServerAuth, true)
+		},
+	}
+}
+
+func (reloader *Reloader) Close() {
+	close(reloader.stopChan)
+}
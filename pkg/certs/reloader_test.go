@@ -0,0 +1,274 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"message-center/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 测试用的证书和私钥
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+var testSerial int64
+
+// parent为nil时生成自签名CA, 否则由parent签发
+func newTestCert(t *testing.T, parent *testCert, commonName string, usage x509.ExtKeyUsage, dnsNames ...string) *testCert {
+	var (
+		issued = &testCert{}
+		signer *ecdsa.PrivateKey
+		err    error
+	)
+	if issued.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+		parent, signer = &testCert{cert: template}, issued.key
+	} else {
+		signer = parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.cert, &issued.key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(issued.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued.certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	issued.keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return issued
+}
+
+// 写入证书、私钥和CA文件, 返回文件路径; cert或ca为nil时对应路径为空
+func writeTestCert(t *testing.T, dir string, name string, cert *testCert, ca *testCert) (certFile string, keyFile string, caFile string) {
+	write := func(file string, content []byte) string {
+		file = filepath.Join(dir, file)
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	if cert != nil {
+		certFile, keyFile = write(name+".pem", cert.certPem), write(name+".key", cert.keyPem)
+	}
+	if ca != nil {
+		caFile = write(name+"-ca.pem", ca.certPem)
+	}
+	return
+}
+
+// 经过本地TCP连接握手, 返回服务端和客户端的错误
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (serverErr error, clientErr error) {
+	var (
+		listener    net.Listener
+		conn        *tls.Conn
+		err         error
+		serverErrCh = make(chan error, 1)
+	)
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		rawConn, err := listener.Accept()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer rawConn.Close()
+		serverConn := tls.Server(rawConn, serverConfig)
+		_ = serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+		serverErrCh <- serverConn.Handshake()
+	}()
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	if conn, clientErr = tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), clientConfig); clientErr == nil {
+		conn.Close()
+	}
+	serverErr = <-serverErrCh
+	return
+}
+
+func TestReloaderHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ca          = newTestCA(t, "ca")
+		otherCa     = newTestCA(t, "other-ca")
+		server      = newTestCert(t, ca, "server", x509.ExtKeyUsageServerAuth, "message.local")
+		otherServer = newTestCert(t, otherCa, "other-server", x509.ExtKeyUsageServerAuth, "message.local")
+		client      = newTestCert(t, ca, "client", x509.ExtKeyUsageClientAuth)
+		otherClient = newTestCert(t, otherCa, "other-client", x509.ExtKeyUsageClientAuth)
+	)
+	cases := []struct {
+		name       string
+		server     *testCert
+		clientCa   *testCert // 服务端校验客户端证书的CA, nil表示不要求客户端证书
+		client     *testCert // nil表示不出示客户端证书
+		serverCa   *testCert // 客户端校验服务端证书的CA
+		serverName string
+		wantOk     bool
+	}{
+		{"客户端证书由配置的CA签发", server, ca, client, ca, "message.local", true},
+		{"客户端证书由其他CA签发", server, ca, otherClient, ca, "message.local", false},
+		{"要求客户端证书但未出示", server, ca, nil, ca, "message.local", false},
+		{"服务端未配置CA时不要求客户端证书", server, nil, nil, ca, "message.local", true},
+		{"服务端证书由其他CA签发", otherServer, ca, client, ca, "message.local", false},
+		{"服务端证书主机名不匹配", server, ca, client, ca, "other.local", false},
+	}
+	for caseIdx, c := range cases {
+		var (
+			name           = "case" + strconv.Itoa(caseIdx)
+			serverReloader *Reloader
+			clientReloader *Reloader
+		)
+		certFile, keyFile, caFile := writeTestCert(t, dir, name+"-server", c.server, c.clientCa)
+		if serverReloader, err = NewReloader(certFile, keyFile, caFile); err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile, caFile = writeTestCert(t, dir, name+"-client", c.client, c.serverCa)
+		if clientReloader, err = NewReloader(certFile, keyFile, caFile); err != nil {
+			t.Fatal(err)
+		}
+
+		serverErr, clientErr := handshake(t, serverReloader.ServerConfig(), clientReloader.ClientConfig(c.serverName))
+		if ok := serverErr == nil && clientErr == nil; ok != c.wantOk {
+			t.Errorf("%s: 握手成功=%v, want %v (server: %v, client: %v)", c.name, ok, c.wantOk, serverErr, clientErr)
+		}
+		serverReloader.Close()
+		clientReloader.Close()
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ca        = newTestCA(t, "ca")
+		newCa     = newTestCA(t, "new-ca")
+		server    = newTestCert(t, ca, "server", x509.ExtKeyUsageServerAuth, "message.local")
+		newServer = newTestCert(t, newCa, "new-server", x509.ExtKeyUsageServerAuth, "message.local")
+		client    = newTestCert(t, ca, "client", x509.ExtKeyUsageClientAuth)
+		newClient = newTestCert(t, newCa, "new-client", x509.ExtKeyUsageClientAuth)
+		modTime   = time.Now()
+		reloader  *Reloader
+		reloaded  bool
+	)
+	certFile, keyFile, caFile := writeTestCert(t, dir, "server", server, ca)
+	if reloader, err = NewReloader(certFile, keyFile, caFile); err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Close()
+
+	// 每一步改写服务端文件后重新加载, 检查当前证书以及两个客户端能否握手
+	cases := []struct {
+		name         string
+		cert         *testCert // 改写的服务端证书, nil表示不改写
+		ca           *testCert // 改写的CA, nil表示不改写
+		certPem      []byte    // 不为nil时直接写入证书文件
+		wantReloaded bool
+		wantErr      error
+		wantSerial   *big.Int
+		wantClient   *testCert // 能握手成功的客户端
+	}{
+		{"文件未变化", nil, nil, nil, false, nil, server.cert.SerialNumber, client},
+		{"证书和CA更新", newServer, newCa, nil, true, nil, newServer.cert.SerialNumber, newClient},
+		{"证书不合法时继续使用旧证书", nil, nil, []byte("invalid"), false, utils.CertInvalid, newServer.cert.SerialNumber, newClient},
+		{"恢复合法证书", server, ca, nil, true, nil, server.cert.SerialNumber, client},
+	}
+	for _, c := range cases {
+		if c.cert != nil || c.ca != nil || c.certPem != nil {
+			if c.cert != nil {
+				writeTestCert(t, dir, "server", c.cert, c.ca)
+			}
+			if c.certPem != nil {
+				if err = ioutil.WriteFile(certFile, c.certPem, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 修改时间变化才会重新加载, 避免同一时刻写入时修改时间相同
+			modTime = modTime.Add(time.Second)
+			for _, file := range []string{certFile, keyFile, caFile} {
+				_ = os.Chtimes(file, modTime, modTime)
+			}
+		}
+		reloaded, err = reloader.reload()
+		if reloaded != c.wantReloaded || err != c.wantErr {
+			t.Errorf("%s: reloaded=%v err=%v, want %v %v", c.name, reloaded, err, c.wantReloaded, c.wantErr)
+		}
+		current, parseErr := x509.ParseCertificate(reloader.certificate().Certificate[0])
+		if parseErr != nil || current.SerialNumber.Cmp(c.wantSerial) != 0 {
+			t.Errorf("%s: 当前证书serial=%v, want %v", c.name, current.SerialNumber, c.wantSerial)
+		}
+		// 客户端用签发当前服务端证书的CA校验服务端, 服务端用热更新后的CA校验客户端
+		for _, candidate := range []*testCert{client, newClient} {
+			clientCert, clientKey, clientCa := writeTestCert(t, dir, "client", candidate, c.wantClient.issuer(ca, newCa))
+			clientReloader, err := NewReloader(clientCert, clientKey, clientCa)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverErr, clientErr := handshake(t, reloader.ServerConfig(), clientReloader.ClientConfig("message.local"))
+			if ok := serverErr == nil && clientErr == nil; ok != (candidate == c.wantClient) {
+				t.Errorf("%s: 客户端%s握手成功=%v (server: %v, client: %v)", c.name, candidate.cert.Subject.CommonName, ok, serverErr, clientErr)
+			}
+			clientReloader.Close()
+		}
+	}
+}
+
+func newTestCA(t *testing.T, commonName string) *testCert {
+	return newTestCert(t, nil, commonName, 0)
+}
+
+// 在候选CA中找到签发该证书的CA
+func (cert *testCert) issuer(candidates ...*testCert) *testCert {
+	for _, candidate := range candidates {
+		if cert.cert.CheckSignatureFrom(candidate.cert) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package configuration
+
+import (
+	"reflect"
+)
+
+// 配置热更新
+// 支持热更新的字段用`reload:"true"`标记, 其余字段变更后需要重启才能生效
+
+// 比较新旧配置, 将不支持热更新的字段还原为旧值, 使运行中的状态与配置保持一致
+// oldConfig与newConfig必须是同一结构体类型的指针
+// 返回已热更新的字段名, 以及变更了但需要重启才能生效的字段名
+func MergeReloadable(oldConfig, newConfig interface{}) (reloaded []string, restartRequired []string) {
+	var (
+		oldValue   = reflect.ValueOf(oldConfig).Elem()
+		newValue   = reflect.ValueOf(newConfig).Elem()
+		configType = oldValue.Type()
+		fieldIdx   int
+		field      reflect.StructField
+	)
+	for fieldIdx = 0; fieldIdx < configType.NumField(); fieldIdx++ {
+		field = configType.Field(fieldIdx)
+		if reflect.DeepEqual(oldValue.Field(fieldIdx).Interface(), newValue.Field(fieldIdx).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "true" {
+			reloaded = append(reloaded, field.Name)
+			continue
+		}
+		restartRequired = append(restartRequired, field.Name)
+		newValue.Field(fieldIdx).Set(oldValue.Field(fieldIdx))
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package configuration
+
+import "testing"
+
+type testConfig struct {
+	Port     int      `json:"port"`
+	Timeout  int      `json:"timeout" reload:"true"`
+	Servers  []string `json:"servers" reload:"true"`
+	Protocol string   `json:"protocol"`
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMergeReloadable(t *testing.T) {
+	var (
+		oldConfig = testConfig{Port: 80, Timeout: 100, Servers: []string{"a"}, Protocol: "http"}
+	)
+	cases := []struct {
+		name                string
+		newConfig           testConfig
+		wantReloaded        []string
+		wantRestartRequired []string
+		want                testConfig // 合并后的新配置
+	}{
+		{"没有变化", oldConfig, nil, nil, oldConfig},
+		{"只修改了热更新字段", testConfig{Port: 80, Timeout: 200, Servers: []string{"a", "b"}, Protocol: "http"},
+			[]string{"Timeout", "Servers"}, nil, testConfig{Port: 80, Timeout: 200, Servers: []string{"a", "b"}, Protocol: "http"}},
+		{"只修改了需要重启的字段, 还原为旧值", testConfig{Port: 8080, Timeout: 100, Servers: []string{"a"}, Protocol: "grpc"},
+			nil, []string{"Port", "Protocol"}, oldConfig},
+		{"同时修改, 只保留热更新字段的新值", testConfig{Port: 8080, Timeout: 200, Servers: []string{"a"}, Protocol: "http"},
+			[]string{"Timeout"}, []string{"Port"}, testConfig{Port: 80, Timeout: 200, Servers: []string{"a"}, Protocol: "http"}},
+	}
+	for _, c := range cases {
+		newConfig := c.newConfig
+		reloaded, restartRequired := MergeReloadable(&oldConfig, &newConfig)
+		if !equalStrings(reloaded, c.wantReloaded) || !equalStrings(restartRequired, c.wantRestartRequired) {
+			t.Errorf("%s: reloaded=%v restartRequired=%v", c.name, reloaded, restartRequired)
+		}
+		if newConfig.Port != c.want.Port || newConfig.Timeout != c.want.Timeout || !equalStrings(newConfig.Servers, c.want.Servers) || newConfig.Protocol != c.want.Protocol {
+			t.Errorf("%s: 合并后%+v, want %+v", c.name, newConfig, c.want)
+		}
+	}
+	if oldConfig.Port != 80 || oldConfig.Timeout != 100 || oldConfig.Protocol != "http" {
+		t.Errorf("旧配置不应被修改: %+v", oldConfig)
+	}
+}
@@ -0,0 +1,324 @@
+package process_message
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 群机器人类型, 对应ChannelConfig.Type
+const (
+	BOT_TYPE_DINGTALK = "dingtalk"
+	BOT_TYPE_WECOM    = "wecom"
+	BOT_TYPE_SLACK    = "slack"
+)
+
+// 消息结果对应的级别, 决定渲染的颜色
+const (
+	resultLevelSuccess = iota
+	resultLevelFailure
+	resultLevelOther
+)
+
+func resultLevel(result string) int {
+	switch strings.ToLower(result) {
+	case "success", "pass", "complete":
+		return resultLevelSuccess
+	case "failed", "reject":
+		return resultLevelFailure
+	}
+	return resultLevelOther
+}
+
+// 消息来源, 优先使用中文名称
+func messageSource(ms *MessageCenter) string {
+	if ms.SourceCH != "" {
+		return ms.SourceCH
+	}
+	return ms.Source
+}
+
+// 群机器人的消息格式
+type botFormat interface {
+	// 渲染请求体
+	render(ms *MessageCenter) ([]byte, error)
+	// 请求地址, 需要加签的机器人在地址上附加签名
+	url(channelConfig config.ChannelConfig) string
+	// 检查响应体, 机器人在200响应中返回的错误码
+	check(body []byte) error
+}
+
+// 机器人返回的错误, 超过频率限制时重试
+type botError struct {
+	code      int
+	message   string
+	retryable bool
+}
+
+func (err *botError) Error() string {
+	return fmt.Sprintf("errcode %d %s", err.code, err.message)
+}
+
+func botRetryable(err error) bool {
+	if botErr, ok := err.(*botError); ok {
+		return botErr.retryable
+	}
+	return webhookRetryable(err)
+}
+
+// 钉钉、企业微信的响应
+type botResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// 解析errcode, rateLimitCode为超过频率限制的错误码
+func checkBotResponse(body []byte, rateLimitCode int) error {
+	resp := botResponse{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	if resp.ErrCode != 0 {
+		return &botError{code: resp.ErrCode, message: resp.ErrMsg, retryable: resp.ErrCode == rateLimitCode}
+	}
+	return nil
+}
+
+// 钉钉自定义机器人, markdown消息, 配置secret时按加签方式在地址上附加timestamp和sign
+type dingtalkFormat struct{}
+
+func (dingtalkFormat) render(ms *MessageCenter) ([]byte, error) {
+	colors := map[int]string{resultLevelSuccess: "#52C41A", resultLevelFailure: "#F5222D", resultLevelOther: "#8C8C8C"}
+	text := fmt.Sprintf("#### %s\n\n> 来源：%s\n\n> 结果：<font color=%s>%s</font>\n\n> 时间：%s",
+		ms.Subject, messageSource(ms), colors[resultLevel(ms.Result)], ms.Result, ms.CreateTime.Format("2006-01-02 15:04:05"))
+	if ms.Link != "" {
+		text += fmt.Sprintf("\n\n[查看详情](%s)", ms.Link)
+	}
+	return json.Marshal(map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": ms.Subject, "text": text},
+	})
+}
+
+func (dingtalkFormat) url(channelConfig config.ChannelConfig) string {
+	if channelConfig.Secret == "" {
+		return channelConfig.Url
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	return appendQuery(channelConfig.Url, "timestamp="+timestamp+"&sign="+url.QueryEscape(SignDingtalk(channelConfig.Secret, timestamp)))
+}
+
+// 超过每分钟20条的限制时返回130101
+func (dingtalkFormat) check(body []byte) error {
+	return checkBotResponse(body, 130101)
+}
+
+// 钉钉加签: base64(hmac-sha256(secret, 毫秒时间戳 + "\n" + secret))
+func SignDingtalk(secret string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 企业微信群机器人, markdown消息; 没有加签, 地址中的key即凭证
+type wecomFormat struct{}
+
+func (wecomFormat) render(ms *MessageCenter) ([]byte, error) {
+	colors := map[int]string{resultLevelSuccess: "info", resultLevelFailure: "warning", resultLevelOther: "comment"}
+	content := fmt.Sprintf("### %s\n> 来源：%s\n> 结果：<font color=\"%s\">%s</font>\n> 时间：%s",
+		ms.Subject, messageSource(ms), colors[resultLevel(ms.Result)], ms.Result, ms.CreateTime.Format("2006-01-02 15:04:05"))
+	if ms.Link != "" {
+		content += fmt.Sprintf("\n[查看详情](%s)", ms.Link)
+	}
+	return json.Marshal(map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"content": content},
+	})
+}
+
+func (wecomFormat) url(channelConfig config.ChannelConfig) string {
+	return channelConfig.Url
+}
+
+// 超过每分钟20条的限制时返回45009
+func (wecomFormat) check(body []byte) error {
+	return checkBotResponse(body, 45009)
+}
+
+// slack incoming webhook, 带颜色的attachment; 没有加签, 地址即凭证, 超过频率限制时返回429
+type slackFormat struct{}
+
+func (slackFormat) render(ms *MessageCenter) ([]byte, error) {
+	colors := map[int]string{resultLevelSuccess: "good", resultLevelFailure: "danger", resultLevelOther: "#8C8C8C"}
+	title := ms.Subject
+	if ms.Link != "" {
+		title = fmt.Sprintf("<%s|%s>", ms.Link, ms.Subject)
+	}
+	return json.Marshal(map[string]interface{}{
+		"text": title,
+		"attachments": []map[string]interface{}{{
+			"color":      colors[resultLevel(ms.Result)],
+			"title":      ms.Subject,
+			"title_link": ms.Link,
+			"fields": []map[string]interface{}{
+				{"title": "来源", "value": messageSource(ms), "short": true},
+				{"title": "结果", "value": ms.Result, "short": true},
+			},
+			"ts": ms.CreateTime.Unix(),
+		}},
+	})
+}
+
+func (slackFormat) url(channelConfig config.ChannelConfig) string {
+	return channelConfig.Url
+}
+
+// 成功时响应体为ok, 错误通过响应码返回
+func (slackFormat) check(body []byte) error {
+	return nil
+}
+
+// 在地址上附加查询参数
+func appendQuery(address string, query string) string {
+	if strings.Contains(address, "?") {
+		return address + "&" + query
+	}
+	return address + "?" + query
+}
+
+// 按一分钟的滑动窗口限制发送数, 超过时等待
+type rateLimiter struct {
+	mutex sync.Mutex
+	sent  []time.Time
+}
+
+func (limiter *rateLimiter) wait(limit int) {
+	if limit <= 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	for len(limiter.sent) > 0 && now.Sub(limiter.sent[0]) >= time.Minute {
+		limiter.sent = limiter.sent[1:]
+	}
+	if len(limiter.sent) >= limit {
+		// 等到窗口内第一条满一分钟, 持有锁等待使后续发送依次排队
+		time.Sleep(limiter.sent[len(limiter.sent)-limit].Add(time.Minute).Sub(now))
+		limiter.sent = limiter.sent[len(limiter.sent)-limit+1:]
+		now = time.Now()
+	}
+	limiter.sent = append(limiter.sent, now)
+}
+
+// 群机器人渠道, 每条消息发送到配置的机器人一次
+type botSender struct {
+	format  botFormat
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func newBotSender(botType string) *botSender {
+	formats := map[string]botFormat{
+		BOT_TYPE_DINGTALK: dingtalkFormat{},
+		BOT_TYPE_WECOM:    wecomFormat{},
+		BOT_TYPE_SLACK:    slackFormat{},
+	}
+	format, ok := formats[botType]
+	if !ok {
+		return nil
+	}
+	return &botSender{
+		format:  format,
+		client:  &http.Client{},
+		limiter: &rateLimiter{},
+	}
+}
+
+func (s *botSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	if job.Config.Url == "" {
+		for _, ms := range messages {
+			if job.Selected(ms, "") {
+				job.Report(ms, SendResult{Err: utils.ChannelUrlMissing})
+			}
+		}
+		return
+	}
+	for _, ms := range messages {
+		if !job.Selected(ms, "") {
+			continue
+		}
+		logrus.Info(fmt.Sprintf("推送群机器人消息：%s %s", job.Config.Name, ms.Subject))
+		ms := ms
+		job.Go(func() {
+			start := time.Now()
+			attempts, err := s.deliver(job, ms)
+			job.Report(ms, SendResult{Attempts: attempts, StartTime: start, Err: err})
+		})
+	}
+}
+
+// 按频率限制发送, 按渠道配置重试; 等待频率限制和退避期间不占用共用的发送任务数
+func (s *botSender) deliver(job *ChannelJob, ms *MessageCenter) (attempts int, err error) {
+	channelConfig := job.Config
+	body, err := s.format.render(ms)
+	if err != nil {
+		return 0, err
+	}
+	for attempts = 1; ; attempts++ {
+		job.Idle(func() {
+			s.limiter.wait(channelConfig.RateLimit)
+		})
+		if err = s.post(channelConfig, body); err == nil || attempts >= channelConfig.Retry || !botRetryable(err) {
+			return
+		}
+		logrus.Warn("推送群机器人消息失败：" + channelConfig.Name + " " + err.Error())
+		job.Idle(func() {
+			time.Sleep(webhookBackoff(channelConfig, attempts))
+		})
+	}
+}
+
+func (s *botSender) post(channelConfig config.ChannelConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(channelConfig.Timeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, s.format.url(channelConfig), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// 地址中带有凭证, 不记录到结果和日志
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return s.format.check(respBody)
+}
@@ -0,0 +1,142 @@
+package process_message
+
+import (
+	"message-center/cmd/logic/config"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignDingtalk(t *testing.T) {
+	cases := []struct {
+		secret    string
+		timestamp string
+		want      string // 独立计算的base64(HMAC-SHA256)
+	}{
+		{"SECabc", "1700000000000", "jcUpW0QmtKduN03n4JqQ0PBosVjqnM8gU7fIIvsDmCM="},
+		{"SECxyz", "1577836800000", "O4gE9lpINPQqQUpdfzo7hUJNxXdyWWRvHBIq2pbJCxI="},
+	}
+	for _, c := range cases {
+		if got := SignDingtalk(c.secret, c.timestamp); got != c.want {
+			t.Errorf("SignDingtalk(%s, %s) = %s, want %s", c.secret, c.timestamp, got, c.want)
+		}
+	}
+}
+
+func TestDingtalkUrl(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		secret  string
+		signed  bool
+	}{
+		{"未配置secret不加签", "https://oapi.dingtalk.com/robot/send?access_token=t", "", false},
+		{"加签附加到已有参数后", "https://oapi.dingtalk.com/robot/send?access_token=t", "SECabc", true},
+	}
+	for _, c := range cases {
+		got := dingtalkFormat{}.url(config.ChannelConfig{Url: c.address, Secret: c.secret})
+		if !c.signed {
+			if got != c.address {
+				t.Errorf("%s: url = %s", c.name, got)
+			}
+			continue
+		}
+		parsed, err := url.Parse(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := parsed.Query()
+		timestamp, _ := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+		if query.Get("access_token") != "t" || time.Since(time.Unix(0, timestamp*int64(time.Millisecond))) > time.Minute {
+			t.Errorf("%s: url = %s", c.name, got)
+		}
+		if query.Get("sign") != SignDingtalk(c.secret, query.Get("timestamp")) {
+			t.Errorf("%s: sign = %s", c.name, query.Get("sign"))
+		}
+	}
+}
+
+func TestCheckBotResponse(t *testing.T) {
+	cases := []struct {
+		name      string
+		body      string
+		wantErr   bool
+		retryable bool
+	}{
+		{"成功", `{"errcode":0,"errmsg":"ok"}`, false, false},
+		{"超过频率限制重试", `{"errcode":130101,"errmsg":"send too fast"}`, true, true},
+		{"其他错误不重试", `{"errcode":310000,"errmsg":"sign not match"}`, true, false},
+		{"无法解析的响应", `not json`, true, true},
+	}
+	for _, c := range cases {
+		err := dingtalkFormat{}.check([]byte(c.body))
+		if (err != nil) != c.wantErr || (err != nil && botRetryable(err) != c.retryable) {
+			t.Errorf("%s: check = %v", c.name, err)
+		}
+	}
+}
+
+func TestBotRender(t *testing.T) {
+	var (
+		createTime = time.Date(2026, 1, 1, 8, 0, 0, 0, time.Local)
+	)
+	cases := []struct {
+		name     string
+		format   botFormat
+		ms       *MessageCenter
+		contains []string
+		excludes []string
+	}{
+		{"钉钉成功为绿色", dingtalkFormat{}, &MessageCenter{Subject: "发布", Result: "success", SourceCH: "流水线", CreateTime: createTime},
+			[]string{`"msgtype":"markdown"`, "#52C41A", "流水线", "2026-01-01 08:00:00"}, []string{"查看详情"}},
+		{"钉钉失败为红色并附带链接", dingtalkFormat{}, &MessageCenter{Subject: "发布", Result: "reject", Link: "https://ci/1", CreateTime: createTime},
+			[]string{"#F5222D", "[查看详情](https://ci/1)"}, nil},
+		{"企业微信其他结果为comment, 没有中文来源时使用source", wecomFormat{}, &MessageCenter{Subject: "申请", Result: "pending", Source: "apply", CreateTime: createTime},
+			[]string{`"content"`, "comment", "apply"}, nil},
+		// json编码时<和>被转义
+		{"slack有链接时标题为链接", slackFormat{}, &MessageCenter{Subject: "告警", Result: "FAILED", Link: "https://alarm/1", CreateTime: createTime},
+			[]string{`"color":"danger"`, `"text":"\u003chttps://alarm/1|告警\u003e"`, `"ts":` + strconv.FormatInt(createTime.Unix(), 10)}, nil},
+	}
+	for _, c := range cases {
+		body, err := c.format.render(c.ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range c.contains {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("%s: 缺少%s: %s", c.name, want, body)
+			}
+		}
+		for _, unwanted := range c.excludes {
+			if strings.Contains(string(body), unwanted) {
+				t.Errorf("%s: 不应包含%s: %s", c.name, unwanted, body)
+			}
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		sends int
+	}{
+		{"不限制", 0, 50},
+		{"未超过限制时不等待", 20, 20},
+	}
+	for _, c := range cases {
+		limiter := &rateLimiter{}
+		start := time.Now()
+		for i := 0; i < c.sends; i++ {
+			limiter.wait(c.limit)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("%s: 等待了%v", c.name, elapsed)
+		}
+		if c.limit == 0 && len(limiter.sent) != 0 {
+			t.Errorf("%s: 不限制时不应记录发送时间", c.name)
+		}
+	}
+}
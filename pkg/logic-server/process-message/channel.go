@@ -0,0 +1,202 @@
+package process_message
+
+import (
+	"fmt"
+	"message-center/cmd/logic/config"
+	"message-center/utils"
+	"sync"
+	"time"
+)
+
+// 消息渠道插件, 以渠道名注册到ProcessMessageImpl, MessageCenter.Channel中的值对应渠道名
+type ChannelSender interface {
+	// 发送本轮需要该渠道处理的消息; 只发送job.Selected的收件人, 每个发送任务通过job.Go提交以遵守渠道的并发数, 每个收件人的结果通过job.Report记录
+	// 任务中的频率限制、退避等长时间等待通过job.Idle进行
+	// 返回时任务可以仍在执行, 由调用方等待
+	Send(job *ChannelJob, messages []*MessageCenter)
+}
+
+// 渠道对一个收件人的发送结果
+type SendResult struct {
+	Recipient  string    // 收件人, 如邮箱、房间、webhook地址; 群机器人等没有具体收件人的渠道为空
+	Attempts   int       // 尝试次数, 为0时按1记录
+	ProviderId string    // 渠道返回的消息ID
+	StartTime  time.Time // 首次发送时间, 为空时使用记录时间
+	Err        error
+}
+
+// 一个渠道本轮的发送任务和结果
+type ChannelJob struct {
+	Config    config.ChannelConfig
+	slots     chan byte // 并发数
+	workers   chan byte // 所有渠道共用的发送任务数
+	waitGroup sync.WaitGroup
+	mutex     sync.Mutex
+	records   map[*MessageCenter][]*DeliveryRecord
+	selected  map[*MessageCenter]map[string]bool // 重新发送的消息只发送选中的收件人
+}
+
+func newChannelJob(channelConfig config.ChannelConfig, workers chan byte) *ChannelJob {
+	return &ChannelJob{
+		Config:   channelConfig,
+		slots:    make(chan byte, channelConfig.Concurrency),
+		workers:  workers,
+		records:  map[*MessageCenter][]*DeliveryRecord{},
+		selected: map[*MessageCenter]map[string]bool{},
+	}
+}
+
+// 本轮是否需要发送给该收件人, 发送前检查; 重新发送时只发送上次失败的收件人
+func (job *ChannelJob) Selected(ms *MessageCenter, recipient string) bool {
+	recipients, ok := job.selected[ms]
+	return !ok || recipients[recipient]
+}
+
+// 执行发送任务, 达到渠道的并发数或所有渠道的发送任务数时阻塞等待
+func (job *ChannelJob) Go(task func()) {
+	job.slots <- 1
+	job.workers <- 1
+	job.waitGroup.Add(1)
+	go func() {
+		defer func() {
+			<-job.workers
+			<-job.slots
+			job.waitGroup.Done()
+		}()
+		task()
+	}()
+}
+
+// 发送任务中长时间等待(如频率限制、重试退避)时调用, 等待期间让出所有渠道共用的发送任务数, 不占用其他渠道的发送
+func (job *ChannelJob) Idle(wait func()) {
+	<-job.workers
+	defer func() {
+		job.workers <- 1
+	}()
+	wait()
+}
+
+// 记录消息在本渠道对一个收件人的结果
+func (job *ChannelJob) Report(ms *MessageCenter, result SendResult) {
+	record := &DeliveryRecord{
+		Channel:    job.Config.Name,
+		Recipient:  result.Recipient,
+		Status:     DELIVERY_STATUS_SUCCESS,
+		Attempts:   result.Attempts,
+		ProviderId: result.ProviderId,
+		CreateTime: result.StartTime,
+		UpdateTime: time.Now(),
+	}
+	if record.Attempts <= 0 {
+		record.Attempts = 1
+	}
+	if record.CreateTime.IsZero() {
+		record.CreateTime = record.UpdateTime
+	}
+	if result.Err != nil {
+		record.Status = DELIVERY_STATUS_FAILED
+		record.LastError = result.Err.Error()
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.records[ms] = append(job.records[ms], record)
+}
+
+func (job *ChannelJob) wait() {
+	job.waitGroup.Wait()
+}
+
+func (job *ChannelJob) deliveries(ms *MessageCenter) []*DeliveryRecord {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.records[ms]
+}
+
+// 注册渠道, 同名渠道覆盖, 需在Run之前调用
+func (p *ProcessMessageImpl) RegisterChannel(name string, sender ChannelSender) {
+	p.channels[name] = sender
+}
+
+// 一条消息本轮需要重新发送的渠道和收件人: 渠道 -> 收件人
+type deliverySelection map[string]map[string]bool
+
+// 渠道名, 按名称排序
+func (selection deliverySelection) channels() []string {
+	names := []string{}
+	for name := range selection {
+		names = append(names, name)
+	}
+	return utils.SortedUnique(names)
+}
+
+// 按渠道分组后各渠道并行发送, 返回每条消息本轮的发送记录, 按渠道名排序; 未注册或已停用的渠道直接记录
+// selections中的消息只发送选中的渠道和收件人, 其余消息发送所有渠道和收件人
+func (p *ProcessMessageImpl) sendChannels(mcs []*MessageCenter, selections map[*MessageCenter]deliverySelection) map[*MessageCenter][]*DeliveryRecord {
+	channelMessages := map[string][]*MessageCenter{}
+	jobs := map[string]*ChannelJob{}
+	records := map[*MessageCenter][]*DeliveryRecord{}
+	logicConfig := config.GlobalLogicConfig()
+	for _, ms := range mcs {
+		names := utils.SortedUnique(ms.Channel)
+		if selection, ok := selections[ms]; ok {
+			names = selection.channels()
+		}
+		for _, name := range names {
+			if _, ok := p.channels[name]; !ok {
+				continue
+			}
+			if logicConfig.Channel(name).Disabled {
+				continue
+			}
+			channelMessages[name] = append(channelMessages[name], ms)
+		}
+	}
+
+	waitGroup := sync.WaitGroup{}
+	for name, messages := range channelMessages {
+		job := newChannelJob(logicConfig.Channel(name), p.workers)
+		for _, ms := range messages {
+			if selection, ok := selections[ms]; ok {
+				job.selected[ms] = selection[name]
+			}
+		}
+		jobs[name] = job
+		waitGroup.Add(1)
+		go func(sender ChannelSender, messages []*MessageCenter) {
+			defer waitGroup.Done()
+			sender.Send(job, messages)
+			job.wait()
+		}(p.channels[name], messages)
+	}
+	waitGroup.Wait()
+
+	for _, ms := range mcs {
+		names := utils.SortedUnique(ms.Channel)
+		if selection, ok := selections[ms]; ok {
+			names = selection.channels()
+		}
+		for _, name := range names {
+			if _, ok := p.channels[name]; !ok {
+				records[ms] = append(records[ms], newChannelRecord(name, DELIVERY_STATUS_FAILED, fmt.Sprintf("unknown channel %s", name)))
+			} else if job, ok := jobs[name]; ok {
+				records[ms] = append(records[ms], job.deliveries(ms)...)
+			} else {
+				records[ms] = append(records[ms], newChannelRecord(name, DELIVERY_STATUS_SKIPPED, fmt.Sprintf("channel %s disabled", name)))
+			}
+		}
+	}
+	return records
+}
+
+// 整个渠道的记录, 用于未注册或已停用的渠道
+func newChannelRecord(channel string, status string, lastError string) *DeliveryRecord {
+	now := time.Now()
+	return &DeliveryRecord{
+		Channel:    channel,
+		Status:     status,
+		LastError:  lastError,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+}
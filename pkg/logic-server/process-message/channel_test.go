@@ -0,0 +1,112 @@
+package process_message
+
+import (
+	"errors"
+	"message-center/cmd/logic/config"
+	"sync"
+	"testing"
+)
+
+// 记录收到的消息, 逐个收件人发送, failed中的收件人发送失败
+type fakeSender struct {
+	mutex    sync.Mutex
+	messages []*MessageCenter
+	failed   map[string]bool
+}
+
+func (s *fakeSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	s.mutex.Lock()
+	s.messages = append(s.messages, messages...)
+	s.mutex.Unlock()
+	for _, ms := range messages {
+		for _, recipient := range ms.Emails {
+			if !job.Selected(ms, recipient) {
+				continue
+			}
+			ms, recipient := ms, recipient
+			job.Go(func() {
+				var err error
+				if s.failed[recipient] {
+					err = errors.New("send failed")
+				}
+				job.Report(ms, SendResult{Recipient: recipient, Err: err})
+			})
+		}
+	}
+}
+
+// 记录的渠道、收件人和状态, 格式: 渠道/收件人/状态
+func recordKeys(records []*DeliveryRecord) map[string]bool {
+	keys := map[string]bool{}
+	for _, record := range records {
+		keys[record.Channel+"/"+record.Recipient+"/"+record.Status] = true
+	}
+	return keys
+}
+
+func TestSendChannels(t *testing.T) {
+	initTestChannelConfig(t)
+	config.GlobalLogicConfig().ProcessChannels = append(config.GlobalLogicConfig().ProcessChannels, config.ChannelConfig{Name: "off", Disabled: true})
+
+	cases := []struct {
+		name        string
+		channels    []string
+		emails      []string
+		selection   deliverySelection // 为nil时发送所有渠道和收件人
+		replaced    bool              // 发送前以同名重新注册fake渠道
+		wantSent    []bool            // fake、other渠道是否收到消息
+		wantRecords []string
+	}{
+		{"发送到注册的渠道", []string{"fake"}, []string{"a", "b"}, nil, false, []bool{true, false},
+			[]string{"fake/a/" + DELIVERY_STATUS_SUCCESS, "fake/b/" + DELIVERY_STATUS_SUCCESS}},
+		{"每个收件人的结果单独记录", []string{"fake"}, []string{"a", "fail"}, nil, false, []bool{true, false},
+			[]string{"fake/a/" + DELIVERY_STATUS_SUCCESS, "fake/fail/" + DELIVERY_STATUS_FAILED}},
+		{"多个渠道分别发送", []string{"fake", "other", "fake"}, []string{"a"}, nil, false, []bool{true, true},
+			[]string{"fake/a/" + DELIVERY_STATUS_SUCCESS, "other/a/" + DELIVERY_STATUS_SUCCESS}},
+		{"未注册的渠道记录为失败", []string{"fake", "unknown"}, []string{"a"}, nil, false, []bool{true, false},
+			[]string{"fake/a/" + DELIVERY_STATUS_SUCCESS, "unknown//" + DELIVERY_STATUS_FAILED}},
+		{"停用的渠道记录为跳过", []string{"off"}, []string{"a"}, nil, false, []bool{false, false},
+			[]string{"off//" + DELIVERY_STATUS_SKIPPED}},
+		{"重新发送时只发送选中的渠道和收件人", []string{"fake", "other"}, []string{"a", "b"}, deliverySelection{"fake": {"b": true}}, false, []bool{true, false},
+			[]string{"fake/b/" + DELIVERY_STATUS_SUCCESS}},
+		{"同名渠道覆盖之前的注册", []string{"fake"}, []string{"a"}, nil, true, []bool{false, false},
+			[]string{"fake/a/" + DELIVERY_STATUS_SUCCESS}},
+	}
+	for _, c := range cases {
+		var (
+			p       = &ProcessMessageImpl{channels: map[string]ChannelSender{}, workers: make(chan byte, 4)}
+			senders = []*fakeSender{{failed: map[string]bool{"fail": true}}, {}}
+			ms      = &MessageCenter{Channel: c.channels, Emails: c.emails}
+		)
+		p.RegisterChannel("fake", senders[0])
+		p.RegisterChannel("other", senders[1])
+		p.RegisterChannel("off", &fakeSender{})
+		if c.replaced {
+			p.RegisterChannel("fake", &fakeSender{})
+		}
+		selections := map[*MessageCenter]deliverySelection{}
+		if c.selection != nil {
+			selections[ms] = c.selection
+		}
+
+		records := p.sendChannels([]*MessageCenter{ms}, selections)[ms]
+		for senderIdx, sender := range senders {
+			if sent := len(sender.messages) > 0; sent != c.wantSent[senderIdx] {
+				t.Errorf("%s: 渠道%d收到消息=%v, want %v", c.name, senderIdx, sent, c.wantSent[senderIdx])
+			}
+			if len(sender.messages) > 1 {
+				t.Errorf("%s: 渠道%d收到%d次消息, want 1", c.name, senderIdx, len(sender.messages))
+			}
+		}
+		keys := recordKeys(records)
+		if len(records) != len(c.wantRecords) {
+			t.Errorf("%s: 记录=%v, want %v", c.name, keys, c.wantRecords)
+			continue
+		}
+		for _, want := range c.wantRecords {
+			if !keys[want] {
+				t.Errorf("%s: 记录=%v, want %v", c.name, keys, c.wantRecords)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package process_message
+
+import (
+	"encoding/json"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/configuration"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const deadLetterCollection = "message_dead_letter"
+
+// 死信状态
+const (
+	DEAD_LETTER_STATUS_DEAD     = "dead"
+	DEAD_LETTER_STATUS_REDRIVEN = "redriven" // 已重新发送
+)
+
+// 重新排队次数用完仍然失败的发送, 一个渠道的一个收件人一条
+type DeadLetter struct {
+	Id          bson.ObjectId  `json:"id" bson:"_id"`
+	MessageId   *bson.ObjectId `json:"message_id" bson:"message_id"`
+	Subject     string         `json:"subject" bson:"subject"`
+	Channel     string         `json:"channel" bson:"channel"`
+	Recipient   string         `json:"recipient" bson:"recipient"`
+	Attempts    int            `json:"attempts" bson:"attempts"`
+	LastError   string         `json:"last_error" bson:"last_error"`
+	Status      string         `json:"status" bson:"status"`
+	CreateTime  time.Time      `json:"create_time" bson:"create_time"` // 进入死信的时间
+	RedriveTime time.Time      `json:"redrive_time,omitempty" bson:"redrive_time,omitempty"`
+}
+
+// 按渠道的重新排队策略处理本轮失败的记录: 还有次数时等待重新发送, 否则进入死信
+func applyRequeuePolicy(ms *MessageCenter, records []*DeliveryRecord, now time.Time) (deadLetters []*DeadLetter) {
+	logicConfig := config.GlobalLogicConfig()
+	for _, record := range records {
+		if record.Status != DELIVERY_STATUS_FAILED {
+			continue
+		}
+		channelConfig := logicConfig.Channel(record.Channel)
+		if record.Requeued < channelConfig.RequeueLimit {
+			record.Status = DELIVERY_STATUS_RETRYING
+			record.NextTime = now.Add(time.Duration(channelConfig.RequeueDelay(record.Requeued)) * time.Second)
+			record.Requeued++
+			continue
+		}
+		deadLetters = append(deadLetters, &DeadLetter{
+			Id:         bson.NewObjectId(),
+			MessageId:  ms.Id,
+			Subject:    ms.Subject,
+			Channel:    record.Channel,
+			Recipient:  record.Recipient,
+			Attempts:   record.Attempts,
+			LastError:  record.LastError,
+			Status:     DEAD_LETTER_STATUS_DEAD,
+			CreateTime: now,
+		})
+	}
+	return
+}
+
+// 本轮的发送记录替换同一渠道同一收件人的旧记录, 累计尝试次数
+func mergeDeliveries(deliveries []*DeliveryRecord, records []*DeliveryRecord) []*DeliveryRecord {
+	for _, record := range records {
+		replaced := false
+		for i, old := range deliveries {
+			if old.Channel == record.Channel && old.Recipient == record.Recipient {
+				record.Attempts += old.Attempts
+				record.Requeued = old.Requeued
+				record.CreateTime = old.CreateTime
+				deliveries[i] = record
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			deliveries = append(deliveries, record)
+		}
+	}
+	return deliveries
+}
+
+// 到期需要重新发送的渠道和收件人
+func dueSelection(ms *MessageCenter, now time.Time) deliverySelection {
+	selection := deliverySelection{}
+	for _, record := range ms.Deliveries {
+		if record.Status != DELIVERY_STATUS_RETRYING || record.NextTime.After(now) {
+			continue
+		}
+		if selection[record.Channel] == nil {
+			selection[record.Channel] = map[string]bool{}
+		}
+		selection[record.Channel][record.Recipient] = true
+	}
+	return selection
+}
+
+// 最早的重新发送时间
+func nextRetryTime(deliveries []*DeliveryRecord) (next time.Time) {
+	for _, record := range deliveries {
+		if record.Status == DELIVERY_STATUS_RETRYING && (next.IsZero() || record.NextTime.Before(next)) {
+			next = record.NextTime
+		}
+	}
+	return
+}
+
+func (p *ProcessMessageImpl) saveDeadLetters(session *mgo.Session, deadLetters []*DeadLetter) {
+	for _, deadLetter := range deadLetters {
+		logrus.Warn("发送失败进入死信：" + deadLetter.Subject + " " + deadLetter.Channel + " " + deadLetter.Recipient + " " + deadLetter.LastError)
+		if err := session.DB(configuration.DB).C(deadLetterCollection).Insert(deadLetter); err != nil {
+			logrus.Warn("保存死信失败：" + err.Error())
+		}
+	}
+}
+
+// 死信查询响应
+type deadLetterQueryResponse struct {
+	Code        string        `json:"code"`
+	Message     string        `json:"message,omitempty"`
+	DeadLetters []*DeadLetter `json:"dead_letters,omitempty"`
+}
+
+// 查询死信GET channel=xxx&recipient=xxx&status=dead&limit=100, 按进入死信的时间倒序
+func (p *ProcessMessageImpl) HandleDeadLetters(resp http.ResponseWriter, req *http.Request) {
+	var (
+		query = bson.M{}
+		limit = 100
+		buf   []byte
+		err   error
+	)
+	for _, field := range []string{"channel", "recipient", "status"} {
+		if value := req.FormValue(field); value != "" {
+			query[field] = value
+		}
+	}
+	if req.FormValue("limit") != "" {
+		if limit, err = strconv.Atoi(req.FormValue("limit")); err != nil || limit <= 0 || limit > maxDeliveryQueryLimit {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: "limit invalid"})
+			return
+		}
+	}
+
+	session := p.dbController.NewSession()
+	defer session.Close()
+	queryResp := &deadLetterQueryResponse{Code: types.PUSH_CODE_OK, DeadLetters: []*DeadLetter{}}
+	if err = session.DB(configuration.DB).C(deadLetterCollection).Find(query).Sort("-create_time").Limit(limit).All(&queryResp.DeadLetters); err != nil {
+		queryResp = &deadLetterQueryResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error()}
+	}
+
+	if buf, err = json.Marshal(queryResp); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(types.PushStatus(queryResp.Code))
+	_, _ = resp.Write(buf)
+}
+
+// 重新发送死信POST id=死信ID: 对应的发送记录重新按渠道的策略排队, 立即处理
+func (p *ProcessMessageImpl) HandleRedrive(resp http.ResponseWriter, req *http.Request) {
+	var (
+		id  = req.FormValue("id")
+		err error
+	)
+	if req.Method != http.MethodPost {
+		types.WritePushResponse(resp, http.StatusMethodNotAllowed, &types.PushResponse{Code: types.PUSH_CODE_BAD_METHOD})
+		return
+	}
+	if err = p.redrive(id); err != nil {
+		switch err {
+		case utils.DeadLetterNotFound:
+			types.WritePushResponse(resp, http.StatusNotFound, &types.PushResponse{Code: types.PUSH_CODE_NOT_FOUND, Message: err.Error()})
+		case utils.DeadLetterRedriven:
+			types.WritePushResponse(resp, http.StatusConflict, &types.PushResponse{Code: types.PUSH_CODE_NOT_PENDING, Message: err.Error()})
+		default:
+			types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error()})
+		}
+		return
+	}
+	p.trigger()
+	types.WritePushResponse(resp, http.StatusOK, &types.PushResponse{Code: types.PUSH_CODE_OK})
+}
+
+func (p *ProcessMessageImpl) redrive(id string) (err error) {
+	session := p.dbController.NewStrongSession()
+	defer session.Close()
+	db := session.DB(configuration.DB)
+	now := time.Now()
+
+	if !bson.IsObjectIdHex(id) {
+		return utils.DeadLetterNotFound
+	}
+	// 先标记死信, 避免重复重新发送
+	deadLetter := &DeadLetter{}
+	_, err = db.C(deadLetterCollection).Find(bson.M{"_id": bson.ObjectIdHex(id), "status": DEAD_LETTER_STATUS_DEAD}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": DEAD_LETTER_STATUS_REDRIVEN, "redrive_time": now}},
+		ReturnNew: true,
+	}, deadLetter)
+	if err == mgo.ErrNotFound {
+		if count, _ := db.C(deadLetterCollection).FindId(bson.ObjectIdHex(id)).Count(); count > 0 {
+			return utils.DeadLetterRedriven
+		}
+		return utils.DeadLetterNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// 正在处理的消息处理完成后会整体覆盖, 不能修改
+	query := bson.M{
+		"_id":        deadLetter.MessageId,
+		"deliveries": bson.M{"$elemMatch": bson.M{"channel": deadLetter.Channel, "recipient": deadLetter.Recipient}},
+	}
+	leaseQuery := bson.M{"$or": []bson.M{{"lease_expire": bson.M{"$exists": false}}, {"lease_expire": bson.M{"$lt": now}}}}
+	for key, value := range query {
+		leaseQuery[key] = value
+	}
+	err = db.C("message_center").Update(leaseQuery, bson.M{"$set": bson.M{
+		"deliveries.$.status":    DELIVERY_STATUS_RETRYING,
+		"deliveries.$.requeued":  0,
+		"deliveries.$.next_time": now,
+		"processed":              PROCESSED_STATUS_RETRYING,
+		"next_retry_time":        now,
+	}})
+	if err != nil {
+		// 消息已删除等情况, 恢复死信
+		_ = db.C(deadLetterCollection).UpdateId(deadLetter.Id, bson.M{"$set": bson.M{"status": DEAD_LETTER_STATUS_DEAD}, "$unset": bson.M{"redrive_time": ""}})
+		if err == mgo.ErrNotFound {
+			if count, _ := db.C("message_center").Find(query).Count(); count > 0 {
+				return utils.MessageLeased
+			}
+			return utils.DeadLetterNotFound
+		}
+	}
+	return
+}
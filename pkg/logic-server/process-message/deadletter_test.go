@@ -0,0 +1,165 @@
+package process_message
+
+import (
+	"message-center/cmd/logic/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func initTestChannelConfig(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().ProcessChannels = []config.ChannelConfig{
+		{Name: "email", RequeueLimit: 2, RequeueSchedule: []int{30, 300}},
+		{Name: "webhook", RequeueLimit: 3},
+	}
+}
+
+func TestApplyRequeuePolicy(t *testing.T) {
+	var (
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		ms  = &MessageCenter{Subject: "build failed"}
+	)
+	initTestChannelConfig(t)
+
+	cases := []struct {
+		name         string
+		record       *DeliveryRecord
+		wantStatus   string
+		wantRequeued int
+		wantDelay    time.Duration // 重新发送前的等待时间
+		wantDead     bool
+	}{
+		{"第一次失败按计划等待", &DeliveryRecord{Channel: "email", Status: DELIVERY_STATUS_FAILED}, DELIVERY_STATUS_RETRYING, 1, 30 * time.Second, false},
+		{"第二次失败使用下一个间隔", &DeliveryRecord{Channel: "email", Status: DELIVERY_STATUS_FAILED, Requeued: 1}, DELIVERY_STATUS_RETRYING, 2, 300 * time.Second, false},
+		{"次数用完进入死信", &DeliveryRecord{Channel: "email", Status: DELIVERY_STATUS_FAILED, Requeued: 2, Attempts: 3, LastError: "smtp timeout"}, DELIVERY_STATUS_FAILED, 2, 0, true},
+		{"未配置间隔时等待60秒", &DeliveryRecord{Channel: "webhook", Status: DELIVERY_STATUS_FAILED}, DELIVERY_STATUS_RETRYING, 1, 60 * time.Second, false},
+		{"未配置重新排队直接进入死信", &DeliveryRecord{Channel: "message", Status: DELIVERY_STATUS_FAILED}, DELIVERY_STATUS_FAILED, 0, 0, true},
+		{"成功的记录不处理", &DeliveryRecord{Channel: "email", Status: DELIVERY_STATUS_SUCCESS}, DELIVERY_STATUS_SUCCESS, 0, 0, false},
+	}
+	for _, c := range cases {
+		deadLetters := applyRequeuePolicy(ms, []*DeliveryRecord{c.record}, now)
+		if c.record.Status != c.wantStatus || c.record.Requeued != c.wantRequeued {
+			t.Errorf("%s: status=%s requeued=%d", c.name, c.record.Status, c.record.Requeued)
+		}
+		if c.wantStatus == DELIVERY_STATUS_RETRYING && !c.record.NextTime.Equal(now.Add(c.wantDelay)) {
+			t.Errorf("%s: nextTime=%v, want %v", c.name, c.record.NextTime, now.Add(c.wantDelay))
+		}
+		if (len(deadLetters) == 1) != c.wantDead {
+			t.Errorf("%s: 死信%d条", c.name, len(deadLetters))
+			continue
+		}
+		if c.wantDead {
+			deadLetter := deadLetters[0]
+			if deadLetter.Status != DEAD_LETTER_STATUS_DEAD || deadLetter.Channel != c.record.Channel || deadLetter.Attempts != c.record.Attempts ||
+				deadLetter.LastError != c.record.LastError || deadLetter.Subject != ms.Subject || !deadLetter.CreateTime.Equal(now) {
+				t.Errorf("%s: 死信%+v", c.name, deadLetter)
+			}
+		}
+	}
+}
+
+func TestMergeDeliveries(t *testing.T) {
+	var (
+		firstTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+	cases := []struct {
+		name         string
+		records      []*DeliveryRecord
+		wantCount    int
+		wantAttempts int // email/a的累计尝试次数
+		wantRequeued int
+	}{
+		{"替换同一渠道同一收件人的记录, 累计尝试次数", []*DeliveryRecord{
+			{Channel: "email", Recipient: "a", Status: DELIVERY_STATUS_SUCCESS, Attempts: 1},
+		}, 2, 3, 1},
+		{"其他收件人追加", []*DeliveryRecord{
+			{Channel: "email", Recipient: "c", Status: DELIVERY_STATUS_SUCCESS, Attempts: 1},
+		}, 3, 2, 1},
+		{"其他渠道的同一收件人追加", []*DeliveryRecord{
+			{Channel: "webhook", Recipient: "a", Status: DELIVERY_STATUS_SUCCESS, Attempts: 1},
+		}, 3, 2, 1},
+	}
+	for _, c := range cases {
+		deliveries := []*DeliveryRecord{
+			{Channel: "email", Recipient: "a", Status: DELIVERY_STATUS_RETRYING, Attempts: 2, Requeued: 1, CreateTime: firstTime},
+			{Channel: "email", Recipient: "b", Status: DELIVERY_STATUS_SUCCESS, Attempts: 1, CreateTime: firstTime},
+		}
+		merged := mergeDeliveries(deliveries, c.records)
+		if len(merged) != c.wantCount {
+			t.Errorf("%s: 合并后%d条, want %d", c.name, len(merged), c.wantCount)
+			continue
+		}
+		if merged[0].Attempts != c.wantAttempts || merged[0].Requeued != c.wantRequeued || !merged[0].CreateTime.Equal(firstTime) {
+			t.Errorf("%s: email/a %+v", c.name, merged[0])
+		}
+	}
+}
+
+func TestDueSelection(t *testing.T) {
+	var (
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		ms  = &MessageCenter{Deliveries: []*DeliveryRecord{
+			{Channel: "email", Recipient: "a", Status: DELIVERY_STATUS_RETRYING, NextTime: now.Add(-time.Minute)},
+			{Channel: "email", Recipient: "b", Status: DELIVERY_STATUS_RETRYING, NextTime: now},
+			{Channel: "email", Recipient: "c", Status: DELIVERY_STATUS_RETRYING, NextTime: now.Add(time.Minute)},
+			{Channel: "webhook", Recipient: "d", Status: DELIVERY_STATUS_FAILED, NextTime: now.Add(-time.Minute)},
+			{Channel: "mq", Recipient: "", Status: DELIVERY_STATUS_RETRYING, NextTime: now.Add(-time.Hour)},
+		}}
+		selection = dueSelection(ms, now)
+	)
+	cases := []struct {
+		name      string
+		channel   string
+		recipient string
+		want      bool
+	}{
+		{"已到期", "email", "a", true},
+		{"恰好到期", "email", "b", true},
+		{"未到期", "email", "c", false},
+		{"不在等待重新发送", "webhook", "d", false},
+		{"没有收件人的渠道", "mq", "", true},
+	}
+	for _, c := range cases {
+		if got := selection[c.channel][c.recipient]; got != c.want {
+			t.Errorf("%s: %s/%s选中=%v, want %v", c.name, c.channel, c.recipient, got, c.want)
+		}
+	}
+	if channels := selection.channels(); len(channels) != 2 || channels[0] != "email" || channels[1] != "mq" {
+		t.Errorf("channels = %v", channels)
+	}
+
+	if next := nextRetryTime(ms.Deliveries); !next.Equal(now.Add(-time.Hour)) {
+		t.Errorf("nextRetryTime = %v", next)
+	}
+}
+
+// 参数错误在访问数据库前返回
+func TestDeadLetterHandlersValidation(t *testing.T) {
+	var (
+		p = &ProcessMessageImpl{}
+	)
+	cases := []struct {
+		name       string
+		handler    func(resp http.ResponseWriter, req *http.Request)
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{"死信查询limit为负数", p.HandleDeadLetters, http.MethodGet, "/deadletters?limit=-1", http.StatusBadRequest},
+		{"死信查询limit超过上限", p.HandleDeadLetters, http.MethodGet, "/deadletters?limit=5000", http.StatusBadRequest},
+		{"重新发送只接受POST", p.HandleRedrive, http.MethodGet, "/deadletters/redrive?id=5f0000000000000000000000", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		resp := httptest.NewRecorder()
+		c.handler(resp, httptest.NewRequest(c.method, c.target, nil))
+		if resp.Code != c.wantStatus {
+			t.Errorf("%s: %d %s", c.name, resp.Code, resp.Body.String())
+		}
+	}
+}
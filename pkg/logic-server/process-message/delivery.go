@@ -0,0 +1,98 @@
+package process_message
+
+import (
+	"encoding/json"
+	"github.com/globalsign/mgo/bson"
+	"message-center/pkg/configuration"
+	"message-center/pkg/types"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 最多返回的消息数
+const maxDeliveryQueryLimit = 1000
+
+// 发送记录查询响应
+type deliveryQueryResponse struct {
+	Code     string             `json:"code"`
+	Message  string             `json:"message,omitempty"`
+	Messages []*deliveryMessage `json:"messages,omitempty"`
+}
+
+// 消息及其发送记录
+type deliveryMessage struct {
+	Id            *bson.ObjectId    `json:"id" bson:"_id"`
+	Subject       string            `json:"subject" bson:"subject"`
+	Processed     string            `json:"processed" bson:"processed"`
+	ProcessedTime time.Time         `json:"processed_time" bson:"processed_time"`
+	Deliveries    []*DeliveryRecord `json:"deliveries" bson:"deliveries"`
+}
+
+// 查询发送记录GET id=消息ID, 或recipient=xxx&channel=xxx&status=failed&limit=100
+// 按收件人、渠道或状态查询时只返回匹配的记录, 按处理时间倒序
+func (p *ProcessMessageImpl) HandleDeliveries(resp http.ResponseWriter, req *http.Request) {
+	var (
+		query    = bson.M{}
+		match    = bson.M{}
+		limit    = 100
+		queryErr error
+		buf      []byte
+		err      error
+	)
+	if id := req.FormValue("id"); id != "" {
+		if !bson.IsObjectIdHex(id) {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: "id invalid"})
+			return
+		}
+		query["_id"] = bson.ObjectIdHex(id)
+	}
+	for _, field := range []string{"recipient", "channel", "status"} {
+		if value := req.FormValue(field); value != "" {
+			match[field] = value
+		}
+	}
+	if len(match) > 0 {
+		query["deliveries"] = bson.M{"$elemMatch": match}
+	}
+	if req.FormValue("limit") != "" {
+		if limit, err = strconv.Atoi(req.FormValue("limit")); err != nil || limit <= 0 || limit > maxDeliveryQueryLimit {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: "limit invalid"})
+			return
+		}
+	}
+
+	session := p.dbController.NewSession()
+	defer session.Close()
+	queryResp := &deliveryQueryResponse{Code: types.PUSH_CODE_OK, Messages: []*deliveryMessage{}}
+	queryErr = session.DB(configuration.DB).C("message_center").Find(query).Sort("-processed_time").Limit(limit).All(&queryResp.Messages)
+	if queryErr != nil {
+		queryResp = &deliveryQueryResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: queryErr.Error()}
+	}
+	if len(match) > 0 {
+		for _, message := range queryResp.Messages {
+			message.Deliveries = filterDeliveries(message.Deliveries, match)
+		}
+	}
+
+	if buf, err = json.Marshal(queryResp); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(types.PushStatus(queryResp.Code))
+	_, _ = resp.Write(buf)
+}
+
+// 只保留匹配查询条件的记录
+func filterDeliveries(deliveries []*DeliveryRecord, match bson.M) []*DeliveryRecord {
+	filtered := []*DeliveryRecord{}
+	for _, record := range deliveries {
+		if (match["recipient"] == nil || match["recipient"] == record.Recipient) &&
+			(match["channel"] == nil || match["channel"] == record.Channel) &&
+			(match["status"] == nil || match["status"] == record.Status) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
@@ -1,16 +1,18 @@
 package process_message
 
 import (
-	"encoding/json"
 	"fmt"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/sirupsen/logrus"
+	"message-center/cmd/logic/config"
 	"message-center/pkg/configuration"
 	ec "message-center/pkg/email-client"
-	"message-center/pkg/logic-server/push"
 	"message-center/pkg/mongodb"
 	"message-center/pkg/mq"
-	"message-center/utils"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -24,6 +26,14 @@ type ProcessMessageImpl struct {
 	mqController *mq.MqController
 	emailClient  *ec.EmailClientImpl
 	stopChan     chan byte
+	triggerChan  chan byte // change stream监听到新消息
+	channels     map[string]ChannelSender
+	owner        string    // 本logic的标识, 抢占消息的租约
+	workers      chan byte // 所有渠道共用的发送任务数
+
+	// 已通知处理但未保存的change stream位置
+	tokenMutex   sync.Mutex
+	pendingToken *bson.Raw
 }
 
 func (p *ProcessMessageImpl) Initialize(dbController *mongodb.MongoDBController, mqController *mq.MqController, emailClient *ec.EmailClientImpl) {
@@ -31,129 +41,249 @@ func (p *ProcessMessageImpl) Initialize(dbController *mongodb.MongoDBController,
 	p.mqController = mqController
 	p.emailClient = emailClient
 	p.stopChan = make(chan byte)
+	p.triggerChan = make(chan byte, 1)
+	p.channels = map[string]ChannelSender{}
+	hostname, _ := os.Hostname()
+	p.owner = hostname + "-" + strconv.Itoa(os.Getpid())
+	workers := config.GlobalLogicConfig().ProcessWorkers
+	if workers <= 0 {
+		workers = 16
+	}
+	p.workers = make(chan byte, workers)
+
+	session := dbController.NewStrongSession()
+	defer session.Close()
+	if err := session.DB(configuration.DB).C("message_center").EnsureIndexKey("deliveries.recipient"); err != nil {
+		logrus.Warn("创建发送记录索引失败：" + err.Error())
+	}
+	if err := session.DB(configuration.DB).C("message_center").EnsureIndexKey("processed", "next_retry_time"); err != nil {
+		logrus.Warn("创建消息处理索引失败：" + err.Error())
+	}
+
+	p.RegisterChannel("email", &emailSender{emailClient: emailClient})
+	p.RegisterChannel("mq", &mqSender{mqController: mqController})
+	p.RegisterChannel("message", &socketSender{})
+	p.RegisterChannel("webhook", newWebhookSender(dbController))
+	// 群机器人渠道按配置注册
+	for _, channelConfig := range config.GlobalLogicConfig().ProcessChannels {
+		if channelConfig.Type == "" {
+			continue
+		}
+		if sender := newBotSender(channelConfig.Type); sender != nil {
+			p.RegisterChannel(channelConfig.Name, sender)
+		} else {
+			logrus.Warn(fmt.Sprintf("未知的渠道类型：%s %s", channelConfig.Name, channelConfig.Type))
+		}
+	}
 }
 
+// 监听到新消息时立即处理, 并按processPollInterval轮询兜底
 func (p *ProcessMessageImpl) Run() {
-	t := time.NewTicker(60 * time.Second)
-	go func(t *time.Ticker) {
-		defer t.Stop()
+	if config.GlobalLogicConfig().ProcessWatch {
+		go p.watchMain()
+	}
+	go func() {
 		for {
+			interval := config.GlobalLogicConfig().ProcessPollInterval
+			if interval <= 0 {
+				interval = 60
+			}
 			select {
-			case <-t.C:
+			case <-time.After(time.Duration(interval) * time.Second):
 				logrus.Info(fmt.Sprintf("run businsess %s", time.Now().Format("2006-01-02 15:04:05")))
-				err := p.processBusiness()
-				if err != nil {
-					logrus.Info(fmt.Sprintf("process businsess error %s", err.Error()))
-				}
+			case <-p.triggerChan:
 			case <-p.stopChan:
 				logrus.Info("停止业务处理任务")
 				return
 			}
+			if err := p.runOnce(p.processBusiness, p.saveResumeToken); err != nil {
+				logrus.Info(fmt.Sprintf("process businsess error %s", err.Error()))
+			}
 		}
-	}(t)
+	}()
+}
+
+// 处理一轮: 处理前取出位置, 处理成功后才保存, 保证保存的位置之前插入的消息都已处理
+// 处理失败时不保存, 重启后从上次保存的位置重新通知; 处理期间收到的新消息会再次通知, 位置留到下一轮保存
+func (p *ProcessMessageImpl) runOnce(process func() error, save func(token *bson.Raw)) error {
+	token := p.takePendingToken()
+	if err := process(); err != nil {
+		return err
+	}
+	if token != nil {
+		save(token)
+	}
+	return nil
 }
 
 func (p *ProcessMessageImpl) Close() {
 	close(p.stopChan)
 }
 
+// 分页抢占新消息和到期需要重新发送的消息并处理, 直到没有可抢占的消息
+// 多个logic副本共用message_center, 每条消息只由持有租约的副本处理
 func (p *ProcessMessageImpl) processBusiness() error {
-	session := p.dbController.NewSession()
+	session := p.dbController.NewStrongSession()
 	defer session.Close()
 	c := session.DB(configuration.DB).C("message_center")
-	query := bson.M{"known": "unread"}
-	query["processed"] = bson.M{"$ne": "processed"}
-	mcs := []*MessageCenter{}
-	err := c.Find(query).Sort("-create_time").All(&mcs)
-	if err != nil {
-		return err
+	for {
+		select {
+		case <-p.stopChan:
+			return nil
+		default:
+		}
+		mcs, err := p.claimPage(c)
+		if err != nil {
+			return err
+		}
+		if len(mcs) == 0 {
+			return nil
+		}
+		p.processPage(c, mcs)
 	}
+}
 
-	scg := map[string][]*socketMessage{}
+// 按页抢占没有有效租约的待处理消息, 每页最多processBatchSize条
+// 先查出候选消息, 再以抢占条件一次更新这些消息的租约, 最后读回租约属于本logic的消息; 同时被其他logic抢占的消息不会读回
+// 处理中的logic崩溃后租约过期, 消息由其他logic重新抢占
+func (p *ProcessMessageImpl) claimPage(c *mgo.Collection) ([]*MessageCenter, error) {
+	logicConfig := config.GlobalLogicConfig()
+	batchSize := logicConfig.ProcessBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	now := time.Now()
+	candidates := []*MessageCenter{}
+	err := c.Find(claimQuery(now)).Sort("-create_time").Limit(batchSize).
+		Select(bson.M{"_id": 1, "subject": 1, "lease_owner": 1}).All(&candidates)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+	ids := []bson.ObjectId{}
+	previousOwners := map[bson.ObjectId]string{}
+	for _, candidate := range candidates {
+		ids = append(ids, *candidate.Id)
+		previousOwners[*candidate.Id] = candidate.LeaseOwner
+	}
 
+	// mongodb的时间精度为毫秒, 截断后才能按租约到期时间读回
+	leaseExpire := time.Now().Add(p.leaseTime()).Truncate(time.Millisecond)
+	if _, err = c.UpdateAll(claimPageQuery(now, ids), bson.M{"$set": bson.M{"lease_owner": p.owner, "lease_expire": leaseExpire}}); err != nil {
+		return nil, err
+	}
+	mcs := []*MessageCenter{}
+	if err = c.Find(claimedQuery(ids, p.owner, leaseExpire)).Sort("-create_time").All(&mcs); err != nil {
+		return nil, err
+	}
 	for _, ms := range mcs {
-		ms.ProcessedTime = time.Now()
-		ms.Processed = "processed"
-		if utils.Contains(ms.Channel, "email") {
-			logrus.Info(fmt.Sprintf("发送邮件：%s", ms.Subject))
-			message := fmt.Sprintf("结果：%s \r\n 链接: %s", ms.Result, ms.Link)
-			for _, m := range ms.Emails {
-				receive := ec.Receive{
-					Ccer:       []string{},
-					Recipients: []string{m},
-				}
-				err := p.emailClient.SendEmail(m, ms.Subject, message, receive)
-				if err != nil {
-					ms.ProcessedResult += ";" + err.Error()
-				}
-			}
-		}
-		if utils.Contains(ms.Channel, "mq") {
-			logrus.Info(fmt.Sprintf("推送mq消息：%s", ms.Subject))
-			mqMessage, err := json.Marshal(ms)
-			if err != nil {
-				ms.ProcessedResult += ";" + err.Error()
-			}
-			err = p.mqController.SendMessage(configuration.TOPIC, mqMessage)
-			if err != nil {
-				ms.ProcessedResult += ";" + err.Error()
-			}
+		if previousOwner := previousOwners[*ms.Id]; previousOwner != "" && previousOwner != p.owner {
+			logrus.Warn(fmt.Sprintf("接管租约已过期的消息：%s %s", ms.Subject, previousOwner))
 		}
-		// 此处处理逻辑为,根据邮箱将消息发往不通渠道
-		// 处理数据，将消息按照邮箱分组，并根据消息来源聚合
-		if utils.Contains(ms.Channel, "message") {
-			logrus.Info(fmt.Sprintf("推送socket消息: %s", ms.Subject))
-			if len(ms.Emails) == 0 {
-				continue
-			}
-			for _, em := range ms.Emails {
-				if _, ok := scg[em]; ok {
-					for _, s := range scg[em] {
-						if ms.Source == s.Name {
-							s.Count += 1
-							if len(s.Data) >= 2 {
-								continue
-							} else {
-								s.Data = append(s.Data, ms)
-							}
-						}
-					}
-				} else {
-					scg[em] = append(scg[em], &socketMessage{
-						Name:  ms.Source,
-						Count: 1,
-						Data:  []*MessageCenter{ms},
-					})
-
-				}
-			}
+	}
+	return mcs, nil
+}
 
-		}
+// 候选消息中仍可抢占的消息, 查出候选后已被其他logic抢占或已处理的消息不满足
+func claimPageQuery(now time.Time, ids []bson.ObjectId) bson.M {
+	query := claimQuery(now)
+	query["_id"] = bson.M{"$in": ids}
+	return query
+}
+
+// 本次抢占到的消息: 租约属于本logic且到期时间为本次设置的时间
+func claimedQuery(ids []bson.ObjectId, owner string, leaseExpire time.Time) bson.M {
+	return bson.M{"_id": bson.M{"$in": ids}, "lease_owner": owner, "lease_expire": leaseExpire}
+}
+
+// 可抢占的消息: 未读且未处理的新消息, 或到期需要重新发送的消息, 并且没有租约或租约已过期
+func claimQuery(now time.Time) bson.M {
+	return bson.M{"$and": []bson.M{
+		{"$or": []bson.M{
+			{"known": "unread", "processed": bson.M{"$nin": []string{PROCESSED_STATUS_PROCESSED, PROCESSED_STATUS_PARTIAL, PROCESSED_STATUS_FAILED, PROCESSED_STATUS_RETRYING}}},
+			{"processed": PROCESSED_STATUS_RETRYING, "next_retry_time": bson.M{"$lte": now}},
+		}},
+		{"$or": []bson.M{{"lease_expire": bson.M{"$exists": false}}, {"lease_expire": bson.M{"$lt": now}}}},
+	}}
+}
+
+func (p *ProcessMessageImpl) leaseTime() time.Duration {
+	leaseTime := config.GlobalLogicConfig().ProcessLeaseTime
+	if leaseTime <= 0 {
+		leaseTime = 300
+	}
+	return time.Duration(leaseTime) * time.Second
+}
 
-		err = c.UpdateId(ms.Id, ms)
+// 处理期间每三分之一租约时间续约一次, 避免发送耗时超过租约时被其他logic重复处理
+func (p *ProcessMessageImpl) renewLeases(mcs []*MessageCenter, done chan byte) {
+	ids := []*bson.ObjectId{}
+	for _, ms := range mcs {
+		ids = append(ids, ms.Id)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(p.leaseTime() / 3):
+		}
+		session := p.dbController.NewStrongSession()
+		_, err := session.DB(configuration.DB).C("message_center").UpdateAll(
+			bson.M{"_id": bson.M{"$in": ids}, "lease_owner": p.owner},
+			bson.M{"$set": bson.M{"lease_expire": time.Now().Add(p.leaseTime())}},
+		)
+		session.Close()
 		if err != nil {
-			logrus.Info(fmt.Sprintf("更新数据库消息失败：%s-%s", ms.Subject, ms.ProcessedResult))
+			logrus.Warn("消息续约失败：" + err.Error())
 		}
 	}
+}
 
-	// 推送到不同的websocket渠道
-	for k, v := range scg {
-		// 不采用http请求，而是直接调用方法发送消息
-		// 因此要自己进行序列化数据
-		var msgArr []json.RawMessage
-		v1, err := json.Marshal(v)
-		if err != nil {
-			logrus.Info(fmt.Sprintf("序列化json数据失败：%s", err))
-			continue
+// 发送一页已抢占的消息, 保存结果并释放租约; 租约已被其他logic接管的消息不保存
+func (p *ProcessMessageImpl) processPage(c *mgo.Collection, mcs []*MessageCenter) {
+	done := make(chan byte)
+	go p.renewLeases(mcs, done)
+	defer close(done)
+
+	// 重新发送的消息只发送到期的渠道和收件人
+	now := time.Now()
+	selections := map[*MessageCenter]deliverySelection{}
+	for _, ms := range mcs {
+		if ms.Processed == PROCESSED_STATUS_RETRYING {
+			selections[ms] = dueSelection(ms, now)
+		} else {
+			ms.Deliveries = nil
 		}
-		if err = json.Unmarshal(v1, &msgArr); err != nil {
-			logrus.Info(fmt.Sprintf("序列化json数据失败：%s", err))
+		ms.ProcessedTime = time.Now()
+	}
+	records := p.sendChannels(mcs, selections)
+
+	deadLetters := []*DeadLetter{}
+	for _, ms := range mcs {
+		ms.Deliveries = mergeDeliveries(ms.Deliveries, records[ms])
+		msDeadLetters := applyRequeuePolicy(ms, records[ms], time.Now())
+		ms.Processed = processedStatus(ms.Deliveries)
+		ms.ProcessedResult = processedResult(ms.Deliveries)
+		ms.NextRetryTime = nextRetryTime(ms.Deliveries)
+		// 只更新处理产生的字段, 不覆盖处理期间对消息的其他修改(如已读)
+		err := c.Update(bson.M{"_id": ms.Id, "lease_owner": p.owner}, bson.M{
+			"$set": bson.M{
+				"deliveries":       ms.Deliveries,
+				"processed":        ms.Processed,
+				"processed_result": ms.ProcessedResult,
+				"processed_time":   ms.ProcessedTime,
+				"next_retry_time":  ms.NextRetryTime,
+			},
+			"$unset": bson.M{"lease_owner": "", "lease_expire": ""},
+		})
+		if err == mgo.ErrNotFound {
+			logrus.Warn(fmt.Sprintf("消息租约已失效, 不保存本次处理结果：%s", ms.Subject))
 			continue
 		}
-		err = push.GlobalConnectManager.PushRoom(k, msgArr)
 		if err != nil {
-			logrus.Info(fmt.Sprintf("推送socket消息失败：%s", err.Error()))
+			logrus.Info(fmt.Sprintf("更新数据库消息失败：%s-%s", ms.Subject, err.Error()))
+			continue
 		}
+		deadLetters = append(deadLetters, msDeadLetters...)
 	}
-	return nil
+	p.saveDeadLetters(c.Database.Session, deadLetters)
 }
@@ -0,0 +1,189 @@
+package process_message
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"message-center/cmd/logic/config"
+	"os"
+	"testing"
+	"time"
+)
+
+// 按mongodb的语义判断文档是否满足查询, 只支持抢占消息用到的$and、$or、$in、$nin、$lt、$lte、$exists和相等
+func matchQuery(doc bson.M, query bson.M) bool {
+	for key, cond := range query {
+		switch key {
+		case "$and":
+			for _, sub := range cond.([]bson.M) {
+				if !matchQuery(doc, sub) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, sub := range cond.([]bson.M) {
+				matched = matched || matchQuery(doc, sub)
+			}
+			if !matched {
+				return false
+			}
+		default:
+			if !matchField(doc, key, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchField(doc bson.M, key string, cond interface{}) bool {
+	value, exists := doc[key]
+	ops, isOps := cond.(bson.M)
+	if !isOps {
+		if condTime, ok := cond.(time.Time); ok {
+			valueTime, ok := value.(time.Time)
+			return ok && valueTime.Equal(condTime)
+		}
+		return exists && value == cond
+	}
+	for op, operand := range ops {
+		switch op {
+		case "$exists":
+			if exists != operand.(bool) {
+				return false
+			}
+		case "$in":
+			matched := false
+			for _, id := range operand.([]bson.ObjectId) {
+				matched = matched || value == id
+			}
+			if !matched {
+				return false
+			}
+		case "$nin":
+			for _, excluded := range operand.([]string) {
+				if value == excluded {
+					return false
+				}
+			}
+		case "$lt", "$lte":
+			valueTime, ok := value.(time.Time)
+			if !ok || valueTime.After(operand.(time.Time)) || (op == "$lt" && valueTime.Equal(operand.(time.Time))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 消息按保存到mongodb后的字段判断
+func messageDoc(t *testing.T, ms *MessageCenter) (doc bson.M) {
+	buf, err := bson.Marshal(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bson.Unmarshal(buf, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestClaimQuery(t *testing.T) {
+	var (
+		now = time.Now().Truncate(time.Millisecond)
+	)
+	cases := []struct {
+		name string
+		ms   *MessageCenter
+		want bool
+	}{
+		{"未读的新消息", &MessageCenter{Known: "unread"}, true},
+		{"已读的新消息", &MessageCenter{Known: "read"}, false},
+		{"已处理", &MessageCenter{Known: "unread", Processed: PROCESSED_STATUS_PROCESSED}, false},
+		{"部分失败", &MessageCenter{Known: "unread", Processed: PROCESSED_STATUS_PARTIAL}, false},
+		{"到期重新发送", &MessageCenter{Known: "read", Processed: PROCESSED_STATUS_RETRYING, NextRetryTime: now}, true},
+		{"未到重新发送时间", &MessageCenter{Known: "unread", Processed: PROCESSED_STATUS_RETRYING, NextRetryTime: now.Add(time.Minute)}, false},
+		{"租约有效", &MessageCenter{Known: "unread", LeaseOwner: "logic-a", LeaseExpire: now.Add(time.Minute)}, false},
+		{"租约恰好到期", &MessageCenter{Known: "unread", LeaseOwner: "logic-a", LeaseExpire: now}, false},
+		{"租约已过期, 由其他logic接管", &MessageCenter{Known: "unread", LeaseOwner: "logic-a", LeaseExpire: now.Add(-time.Second)}, true},
+		{"重新发送的消息租约有效", &MessageCenter{Processed: PROCESSED_STATUS_RETRYING, NextRetryTime: now.Add(-time.Minute), LeaseOwner: "logic-a", LeaseExpire: now.Add(time.Minute)}, false},
+	}
+	for _, c := range cases {
+		if got := matchQuery(messageDoc(t, c.ms), claimQuery(now)); got != c.want {
+			t.Errorf("%s: 可抢占=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 以候选消息的ID和抢占条件一次更新租约
+func TestClaimPageQuery(t *testing.T) {
+	var (
+		now       = time.Now().Truncate(time.Millisecond)
+		candidate = bson.NewObjectId()
+		other     = bson.NewObjectId()
+	)
+	cases := []struct {
+		name string
+		id   bson.ObjectId
+		ms   *MessageCenter
+		want bool
+	}{
+		{"候选消息", candidate, &MessageCenter{Known: "unread"}, true},
+		{"不是候选的消息", other, &MessageCenter{Known: "unread"}, false},
+		{"查出后已被其他logic抢占", candidate, &MessageCenter{Known: "unread", LeaseOwner: "logic-b", LeaseExpire: now.Add(time.Minute)}, false},
+		{"查出后已处理", candidate, &MessageCenter{Known: "unread", Processed: PROCESSED_STATUS_PROCESSED}, false},
+		{"候选消息的租约已过期", candidate, &MessageCenter{Known: "unread", LeaseOwner: "logic-b", LeaseExpire: now.Add(-time.Second)}, true},
+	}
+	for _, c := range cases {
+		c.ms.Id = &c.id
+		if got := matchQuery(messageDoc(t, c.ms), claimPageQuery(now, []bson.ObjectId{candidate})); got != c.want {
+			t.Errorf("%s: 抢占=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 只读回本次抢占到的消息
+func TestClaimedQuery(t *testing.T) {
+	var (
+		leaseExpire = time.Now().Add(time.Minute).Truncate(time.Millisecond)
+		candidate   = bson.NewObjectId()
+		other       = bson.NewObjectId()
+	)
+	cases := []struct {
+		name string
+		id   bson.ObjectId
+		ms   *MessageCenter
+		want bool
+	}{
+		{"本次抢占到的消息", candidate, &MessageCenter{LeaseOwner: "logic-a", LeaseExpire: leaseExpire}, true},
+		{"被其他logic抢占", candidate, &MessageCenter{LeaseOwner: "logic-b", LeaseExpire: leaseExpire}, false},
+		{"本logic之前的租约", candidate, &MessageCenter{LeaseOwner: "logic-a", LeaseExpire: leaseExpire.Add(-time.Second)}, false},
+		{"不是候选的消息", other, &MessageCenter{LeaseOwner: "logic-a", LeaseExpire: leaseExpire}, false},
+	}
+	for _, c := range cases {
+		c.ms.Id = &c.id
+		if got := matchQuery(messageDoc(t, c.ms), claimedQuery([]bson.ObjectId{candidate}, "logic-a", leaseExpire)); got != c.want {
+			t.Errorf("%s: 读回=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLeaseTime(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		leaseTime int
+		want      time.Duration
+	}{
+		{0, 300 * time.Second},
+		{-1, 300 * time.Second},
+		{60, 60 * time.Second},
+	}
+	for _, c := range cases {
+		config.GlobalLogicConfig().ProcessLeaseTime = c.leaseTime
+		if got := (&ProcessMessageImpl{}).leaseTime(); got != c.want {
+			t.Errorf("ProcessLeaseTime=%d: leaseTime = %v, want %v", c.leaseTime, got, c.want)
+		}
+	}
+}
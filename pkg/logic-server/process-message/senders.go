@@ -0,0 +1,177 @@
+package process_message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/configuration"
+	ec "message-center/pkg/email-client"
+	"message-center/pkg/logic-server/push"
+	"message-center/pkg/mq"
+	"message-center/utils"
+	"strings"
+	"time"
+)
+
+// 邮件渠道, 每个收件人单独发送
+type emailSender struct {
+	emailClient *ec.EmailClientImpl
+}
+
+func (s *emailSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	for _, ms := range messages {
+		logrus.Info(fmt.Sprintf("发送邮件：%s", ms.Subject))
+		message := fmt.Sprintf("结果：%s \r\n 链接: %s", ms.Result, ms.Link)
+		for _, m := range ms.Emails {
+			if !job.Selected(ms, m) {
+				continue
+			}
+			ms, m := ms, m
+			job.Go(func() {
+				receive := ec.Receive{
+					Ccer:       []string{},
+					Recipients: []string{m},
+				}
+				err := s.emailClient.SendEmail(m, ms.Subject, message, receive)
+				job.Report(ms, SendResult{Recipient: m, Err: err})
+			})
+		}
+	}
+}
+
+// mq渠道, 整条消息序列化后发到configuration.TOPIC
+type mqSender struct {
+	mqController *mq.MqController
+}
+
+func (s *mqSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	for _, ms := range messages {
+		if !job.Selected(ms, configuration.TOPIC) {
+			continue
+		}
+		logrus.Info(fmt.Sprintf("推送mq消息：%s", ms.Subject))
+		mqMessage, err := json.Marshal(ms)
+		if err != nil {
+			job.Report(ms, SendResult{Recipient: configuration.TOPIC, Err: err})
+			continue
+		}
+		ms := ms
+		job.Go(func() {
+			err := s.mqController.SendMessage(configuration.TOPIC, mqMessage)
+			job.Report(ms, SendResult{Recipient: configuration.TOPIC, Err: err})
+		})
+	}
+}
+
+// socket渠道, 以邮箱为房间, 按消息来源聚合后推送
+type socketSender struct{}
+
+func (s *socketSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	scg := map[string][]*socketMessage{}
+	// 每个房间(邮箱)涉及的消息, 用于记录socket推送结果
+	roomMessages := map[string][]*MessageCenter{}
+
+	// 此处处理逻辑为,根据邮箱将消息发往不通渠道
+	// 处理数据，将消息按照邮箱分组，并根据消息来源聚合
+	for _, ms := range messages {
+		logrus.Info(fmt.Sprintf("推送socket消息: %s", ms.Subject))
+		for _, em := range ms.Emails {
+			if !job.Selected(ms, em) {
+				continue
+			}
+			roomMessages[em] = append(roomMessages[em], ms)
+			if _, ok := scg[em]; ok {
+				for _, s := range scg[em] {
+					if ms.Source == s.Name {
+						s.Count += 1
+						if len(s.Data) >= 2 {
+							continue
+						} else {
+							s.Data = append(s.Data, ms)
+						}
+					}
+				}
+			} else {
+				scg[em] = append(scg[em], &socketMessage{
+					Name:  ms.Source,
+					Count: 1,
+					Data:  []*MessageCenter{ms},
+				})
+			}
+		}
+	}
+
+	for k, v := range scg {
+		// 不采用http请求，而是直接调用方法发送消息
+		// 因此要自己进行序列化数据
+		var msgArr []json.RawMessage
+		v1, err := json.Marshal(v)
+		if err != nil {
+			logrus.Info(fmt.Sprintf("序列化json数据失败：%s", err))
+			continue
+		}
+		if err = json.Unmarshal(v1, &msgArr); err != nil {
+			logrus.Info(fmt.Sprintf("序列化json数据失败：%s", err))
+			continue
+		}
+		room := k
+		job.Go(func() {
+			start := time.Now()
+			err := pushRoom(room, msgArr).failure()
+			for _, ms := range roomMessages[room] {
+				job.Report(ms, SendResult{Recipient: room, StartTime: start, Err: err})
+			}
+		})
+	}
+}
+
+// 推送到房间并等待各message server的推送结果
+func pushRoom(room string, msgArr []json.RawMessage) *roomOutcome {
+	outcomeChan := make(chan *roomOutcome, 1)
+	err := push.GlobalConnectManager.PushRoomWithOutcome(room, msgArr, nil, func(outcomes []push.PushOutcome) {
+		outcomeChan <- &roomOutcome{room: room, outcomes: outcomes}
+	})
+	if err != nil {
+		logrus.Info(fmt.Sprintf("推送socket消息失败：%s", err.Error()))
+		return &roomOutcome{room: room, err: err}
+	}
+
+	// 等待时间: 重试总时限加上最后一次请求的超时, 再留出排队时间
+	select {
+	case ro := <-outcomeChan:
+		return ro
+	case <-time.After(time.Duration(config.GlobalLogicConfig().MessageServerRetryDeadline+config.GlobalLogicConfig().MessageServerTimeout)*time.Millisecond + time.Second):
+		logrus.Info(fmt.Sprintf("等待socket推送结果超时：%s", room))
+		return &roomOutcome{room: room, err: utils.SocketOutcomeTimeout}
+	}
+}
+
+// 一个房间的socket推送结果
+type roomOutcome struct {
+	room     string
+	outcomes []push.PushOutcome
+	err      error // 未能进入分发队列或等待超时
+}
+
+// 房间推送失败的message server, 格式: message server 结果;message server 结果; 全部成功时返回nil
+// 没有订阅者和已写入溢出队列(稍后重放)不算失败
+func (ro *roomOutcome) failure() error {
+	if ro.err != nil {
+		return ro.err
+	}
+	failures := []string{}
+	for _, outcome := range ro.outcomes {
+		switch {
+		case outcome.Err != nil:
+			failures = append(failures, fmt.Sprintf("%s %s", outcome.Address, outcome.Err.Error()))
+		case outcome.Skipped != "" && outcome.Skipped != push.SKIPPED_NO_SUBSCRIBER && outcome.Skipped != push.SKIPPED_SPILLED:
+			failures = append(failures, fmt.Sprintf("%s skipped: %s", outcome.Address, outcome.Skipped))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, ";"))
+}
@@ -7,21 +7,88 @@ import (
 
 // 消息中心结构体
 type MessageCenter struct {
-	Id              *bson.ObjectId `bson:"_id" json:"id"`
-	TenantId        *bson.ObjectId `json:"tenant_id" bson:"tenant_id"`
-	Subject         string         `json:"subject" bson:"subject"`                   // 消息主题
-	Result          string         `json:"result" bson:"result"`                     // 结果 success/failed/pass/reject/complete
-	Link            string         `json:"link" bson:"link"`                         // 链接
-	Known           string         `json:"known" bson:"known"`                       // 是否已读 read/unread
-	Emails          []string       `json:"emails" bson:"emails"`                     // 接收消息列表
-	Channel         []string       `json:"channel" bson:"channel"`                   // 推送消息渠道，可填写多个 email/mq/message
-	Source          string         `json:"source" bson:"source"`                     // 消息来源pipeline/alarm/tenant/domain/service/openapi
-	SourceCH        string         `json:"source_ch" bson:"source_ch"`               // 消息来源中文名称
-	Type            string         `json:"type" bson:"type"`                         // 消息类型，流水线pipeline/告警alarm/订阅subscribe/申请apply/审核audit/通知inform
-	CreateTime      time.Time      `json:"create_time" bson:"create_time"`           // 消息创建时间
-	Processed       string         `json:"processed" bson:"processed"`               // 该消息是否已处理
-	ProcessedResult string         `json:"processed_result" bson:"processed_result"` // 处理结果
-	ProcessedTime   time.Time      `json:"processed_time" bson:"processed_time"`     // 处理时间
+	Id              *bson.ObjectId    `bson:"_id" json:"id"`
+	TenantId        *bson.ObjectId    `json:"tenant_id" bson:"tenant_id"`
+	Subject         string            `json:"subject" bson:"subject"`                   // 消息主题
+	Result          string            `json:"result" bson:"result"`                     // 结果 success/failed/pass/reject/complete
+	Link            string            `json:"link" bson:"link"`                         // 链接
+	Known           string            `json:"known" bson:"known"`                       // 是否已读 read/unread
+	Emails          []string          `json:"emails" bson:"emails"`                     // 接收消息列表
+	Channel         []string          `json:"channel" bson:"channel"`                   // 推送消息渠道，可填写多个 email/mq/message
+	Source          string            `json:"source" bson:"source"`                     // 消息来源pipeline/alarm/tenant/domain/service/openapi
+	SourceCH        string            `json:"source_ch" bson:"source_ch"`               // 消息来源中文名称
+	Type            string            `json:"type" bson:"type"`                         // 消息类型，流水线pipeline/告警alarm/订阅subscribe/申请apply/审核audit/通知inform
+	CreateTime      time.Time         `json:"create_time" bson:"create_time"`           // 消息创建时间
+	Processed       string            `json:"processed" bson:"processed"`               // 该消息是否已处理
+	ProcessedResult string            `json:"processed_result" bson:"processed_result"` // 处理结果, 由发送记录汇总的错误, 格式: ;错误;错误
+	ProcessedTime   time.Time         `json:"processed_time" bson:"processed_time"`     // 处理时间
+	Deliveries      []*DeliveryRecord `json:"deliveries" bson:"deliveries"`             // 每个渠道、每个收件人的发送记录
+	NextRetryTime   time.Time         `json:"next_retry_time" bson:"next_retry_time"`   // 最早需要重新发送的时间
+	LeaseOwner      string            `json:"-" bson:"lease_owner,omitempty"`           // 正在处理的logic, 处理完成后清除
+	LeaseExpire     time.Time         `json:"-" bson:"lease_expire,omitempty"`
+}
+
+// 消息处理状态
+const (
+	PROCESSED_STATUS_PROCESSED = "processed" // 全部发送成功(停用的渠道除外)
+	PROCESSED_STATUS_PARTIAL   = "partial"   // 部分发送失败
+	PROCESSED_STATUS_FAILED    = "failed"    // 全部发送失败
+	PROCESSED_STATUS_RETRYING  = "retrying"  // 有等待重新发送的收件人
+)
+
+// 发送状态
+const (
+	DELIVERY_STATUS_SUCCESS  = "success"
+	DELIVERY_STATUS_FAILED   = "failed"
+	DELIVERY_STATUS_SKIPPED  = "skipped"  // 渠道已停用
+	DELIVERY_STATUS_RETRYING = "retrying" // 等待重新发送
+)
+
+// 一个渠道对一个收件人的发送记录
+type DeliveryRecord struct {
+	Channel    string    `json:"channel" bson:"channel"`
+	Recipient  string    `json:"recipient" bson:"recipient"` // 邮箱、房间、webhook地址等, 群机器人为空
+	Status     string    `json:"status" bson:"status"`
+	Attempts   int       `json:"attempts" bson:"attempts"` // 所有轮次的尝试次数
+	Requeued   int       `json:"requeued" bson:"requeued"` // 已重新排队的次数
+	LastError  string    `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	ProviderId string    `json:"provider_id,omitempty" bson:"provider_id,omitempty"` // 渠道返回的消息ID
+	CreateTime time.Time `json:"create_time" bson:"create_time"`                     // 首次发送时间
+	UpdateTime time.Time `json:"update_time" bson:"update_time"`                     // 最后一次发送时间
+	NextTime   time.Time `json:"next_time,omitempty" bson:"next_time,omitempty"`     // 重新发送的时间
+}
+
+// 按发送记录汇总消息的处理状态
+func processedStatus(deliveries []*DeliveryRecord) string {
+	succeeded, failed := 0, 0
+	for _, record := range deliveries {
+		switch record.Status {
+		case DELIVERY_STATUS_SUCCESS:
+			succeeded++
+		case DELIVERY_STATUS_FAILED:
+			failed++
+		case DELIVERY_STATUS_RETRYING:
+			return PROCESSED_STATUS_RETRYING
+		}
+	}
+	if failed == 0 {
+		return PROCESSED_STATUS_PROCESSED
+	}
+	if succeeded == 0 {
+		return PROCESSED_STATUS_FAILED
+	}
+	return PROCESSED_STATUS_PARTIAL
+}
+
+// 按发送记录汇总处理结果, 保持原有的;错误格式供已有的使用方读取
+func processedResult(deliveries []*DeliveryRecord) string {
+	result := ""
+	for _, record := range deliveries {
+		if record.LastError != "" {
+			result += ";" + record.LastError
+		}
+	}
+	return result
 }
 
 type socketMessage struct {
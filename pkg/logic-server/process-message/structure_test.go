@@ -0,0 +1,95 @@
+package process_message
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"message-center/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func deliveryStatuses(statuses ...string) (deliveries []*DeliveryRecord) {
+	for _, status := range statuses {
+		deliveries = append(deliveries, &DeliveryRecord{Channel: "email", Status: status})
+	}
+	return
+}
+
+func TestProcessedStatus(t *testing.T) {
+	cases := []struct {
+		name       string
+		deliveries []*DeliveryRecord
+		want       string
+	}{
+		{"没有发送记录", nil, PROCESSED_STATUS_PROCESSED},
+		{"全部成功", deliveryStatuses(DELIVERY_STATUS_SUCCESS, DELIVERY_STATUS_SUCCESS), PROCESSED_STATUS_PROCESSED},
+		{"停用的渠道不计入失败", deliveryStatuses(DELIVERY_STATUS_SUCCESS, DELIVERY_STATUS_SKIPPED), PROCESSED_STATUS_PROCESSED},
+		{"部分失败", deliveryStatuses(DELIVERY_STATUS_SUCCESS, DELIVERY_STATUS_FAILED), PROCESSED_STATUS_PARTIAL},
+		{"全部失败", deliveryStatuses(DELIVERY_STATUS_FAILED, DELIVERY_STATUS_SKIPPED), PROCESSED_STATUS_FAILED},
+		{"有等待重新发送的收件人", deliveryStatuses(DELIVERY_STATUS_FAILED, DELIVERY_STATUS_RETRYING), PROCESSED_STATUS_RETRYING},
+	}
+	for _, c := range cases {
+		if got := processedStatus(c.deliveries); got != c.want {
+			t.Errorf("%s: processedStatus = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProcessedResult(t *testing.T) {
+	deliveries := []*DeliveryRecord{
+		{Channel: "email", Status: DELIVERY_STATUS_FAILED, LastError: "smtp timeout"},
+		{Channel: "message", Status: DELIVERY_STATUS_SUCCESS},
+		{Channel: "webhook", Status: DELIVERY_STATUS_FAILED, LastError: "status 500"},
+	}
+	if got := processedResult(deliveries); got != ";smtp timeout;status 500" {
+		t.Errorf("processedResult = %q", got)
+	}
+}
+
+func TestFilterDeliveries(t *testing.T) {
+	deliveries := []*DeliveryRecord{
+		{Channel: "email", Recipient: "a@example.com", Status: DELIVERY_STATUS_SUCCESS},
+		{Channel: "email", Recipient: "b@example.com", Status: DELIVERY_STATUS_FAILED},
+		{Channel: "webhook", Recipient: "https://example.com/hook", Status: DELIVERY_STATUS_FAILED},
+	}
+	cases := []struct {
+		name  string
+		match bson.M
+		want  int
+	}{
+		{"按收件人", bson.M{"recipient": "a@example.com"}, 1},
+		{"按渠道", bson.M{"channel": "email"}, 2},
+		{"按状态", bson.M{"status": DELIVERY_STATUS_FAILED}, 2},
+		{"多个条件同时满足", bson.M{"channel": "email", "status": DELIVERY_STATUS_FAILED}, 1},
+		{"没有匹配", bson.M{"channel": "mq"}, 0},
+	}
+	for _, c := range cases {
+		if got := filterDeliveries(deliveries, c.match); len(got) != c.want {
+			t.Errorf("%s: filterDeliveries返回%d条, want %d", c.name, len(got), c.want)
+		}
+	}
+}
+
+// 参数错误在查询数据库前返回400
+func TestHandleDeliveriesValidation(t *testing.T) {
+	var (
+		p = &ProcessMessageImpl{}
+	)
+	cases := []struct {
+		name  string
+		query string
+	}{
+		{"id不是ObjectId", "id=123"},
+		{"limit不是数字", "limit=abc"},
+		{"limit为0", "limit=0"},
+		{"limit超过上限", "limit=1001"},
+	}
+	for _, c := range cases {
+		resp := httptest.NewRecorder()
+		p.HandleDeliveries(resp, httptest.NewRequest(http.MethodGet, "/deliveries?"+c.query, nil))
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), `"code":"`+types.PUSH_CODE_INVALID_FORM+`"`) {
+			t.Errorf("%s: %d %s", c.name, resp.Code, resp.Body.String())
+		}
+	}
+}
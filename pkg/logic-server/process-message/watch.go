@@ -0,0 +1,146 @@
+package process_message
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/configuration"
+	"os"
+	"time"
+)
+
+const (
+	watchStateCollection = "message_center_watch"
+	watchStatePrefix     = "process-message-"
+)
+
+// 已处理到的change stream位置, 重启后从这里继续监听
+// 每个logic主机保存自己的位置(_id为前缀加主机名), 多个副本互不覆盖; 待处理的消息按查询抢占, 位置只决定何时触发处理
+type watchState struct {
+	Id          string    `bson:"_id"`
+	ResumeToken *bson.Raw `bson:"resume_token,omitempty"`
+	UpdateTime  time.Time `bson:"update_time"`
+}
+
+// change stream事件, 只关心类型, 消息本身由processBusiness查询
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+}
+
+// 监听message_center的插入, 有新消息时通知处理; 监听失败时由轮询兜底, 并定期重新尝试
+func (p *ProcessMessageImpl) watchMain() {
+	for {
+		err := p.watch()
+		if err == nil {
+			return
+		}
+		logrus.Warn("监听message_center失败, 回退到轮询：" + err.Error())
+		select {
+		case <-p.stopChan:
+			return
+		case <-time.After(time.Duration(config.GlobalLogicConfig().ProcessWatchRetry) * time.Second):
+		}
+	}
+}
+
+// 持续监听直到关闭(返回nil)或出错
+func (p *ProcessMessageImpl) watch() error {
+	session := p.dbController.NewStrongSession()
+	defer session.Close()
+	c := session.DB(configuration.DB).C("message_center")
+	pipeline := []bson.M{{"$match": bson.M{"operationType": "insert"}}}
+	options := mgo.ChangeStreamOptions{
+		ResumeAfter:    p.loadResumeToken(session),
+		MaxAwaitTimeMS: time.Second,
+	}
+	stream, err := c.Watch(pipeline, options)
+	if err != nil && options.ResumeAfter != nil {
+		// resume token已失效(oplog已被覆盖), 从当前位置监听, 之间插入的消息由本次触发的处理补上
+		logrus.Warn("resume token已失效, 从当前位置监听：" + err.Error())
+		options.ResumeAfter = nil
+		stream, err = c.Watch(pipeline, options)
+		if err == nil {
+			p.trigger()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	logrus.Info("开始监听message_center新消息")
+
+	event := changeEvent{}
+	for {
+		select {
+		case <-p.stopChan:
+			return nil
+		default:
+		}
+		// 超时未收到事件时Next返回false且没有错误, 继续等待
+		if stream.Next(&event) {
+			p.setPendingToken(stream.ResumeToken())
+			p.trigger()
+			continue
+		}
+		if err = stream.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// 通知处理新消息, 处理中收到的多次通知合并为一次
+func (p *ProcessMessageImpl) trigger() {
+	select {
+	case p.triggerChan <- 1:
+	default:
+	}
+}
+
+func (p *ProcessMessageImpl) setPendingToken(token *bson.Raw) {
+	p.tokenMutex.Lock()
+	defer p.tokenMutex.Unlock()
+	p.pendingToken = token
+}
+
+// 取出已通知但未保存的位置
+func (p *ProcessMessageImpl) takePendingToken() *bson.Raw {
+	p.tokenMutex.Lock()
+	defer p.tokenMutex.Unlock()
+	token := p.pendingToken
+	p.pendingToken = nil
+	return token
+}
+
+// 本主机的位置, 主机名不变时重启后可以继续
+func watchStateId() string {
+	hostname, _ := os.Hostname()
+	return watchStatePrefix + hostname
+}
+
+func (p *ProcessMessageImpl) loadResumeToken(session *mgo.Session) *bson.Raw {
+	state := watchState{}
+	err := session.DB(configuration.DB).C(watchStateCollection).FindId(watchStateId()).One(&state)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logrus.Warn("读取resume token失败, 从当前位置监听：" + err.Error())
+		}
+		return nil
+	}
+	return state.ResumeToken
+}
+
+// 处理完成后保存位置, 之前插入的消息都已处理
+func (p *ProcessMessageImpl) saveResumeToken(token *bson.Raw) {
+	session := p.dbController.NewStrongSession()
+	defer session.Close()
+	id := watchStateId()
+	_, err := session.DB(configuration.DB).C(watchStateCollection).UpsertId(id, &watchState{
+		Id:          id,
+		ResumeToken: token,
+		UpdateTime:  time.Now(),
+	})
+	if err != nil {
+		logrus.Warn("保存resume token失败：" + err.Error())
+	}
+}
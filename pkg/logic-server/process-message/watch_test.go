@@ -0,0 +1,114 @@
+package process_message
+
+import (
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	"sync"
+	"testing"
+)
+
+// 多次通知合并为一次, 取走后可以再次通知, 通知不会阻塞
+func TestTrigger(t *testing.T) {
+	p := &ProcessMessageImpl{triggerChan: make(chan byte, 1)}
+
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			p.trigger()
+		}()
+	}
+	waitGroup.Wait()
+	if len(p.triggerChan) != 1 {
+		t.Fatalf("通知%d次, want 合并为1次", len(p.triggerChan))
+	}
+	<-p.triggerChan
+	if len(p.triggerChan) != 0 {
+		t.Fatal("取走后不应还有通知")
+	}
+	p.trigger()
+	if len(p.triggerChan) != 1 {
+		t.Fatal("取走后应能再次通知")
+	}
+}
+
+func TestTakePendingToken(t *testing.T) {
+	var (
+		first  = &bson.Raw{Kind: 3, Data: []byte("first")}
+		second = &bson.Raw{Kind: 3, Data: []byte("second")}
+	)
+	cases := []struct {
+		name   string
+		tokens []*bson.Raw // 依次设置的位置
+		want   *bson.Raw
+	}{
+		{"没有位置", nil, nil},
+		{"取出设置的位置", []*bson.Raw{first}, first},
+		{"多次设置时取出最新的位置", []*bson.Raw{first, second}, second},
+	}
+	for _, c := range cases {
+		p := &ProcessMessageImpl{}
+		for _, token := range c.tokens {
+			p.setPendingToken(token)
+		}
+		if got := p.takePendingToken(); got != c.want {
+			t.Errorf("%s: 取出%v, want %v", c.name, got, c.want)
+		}
+		if got := p.takePendingToken(); got != nil {
+			t.Errorf("%s: 取出后应清空, 再次取出%v", c.name, got)
+		}
+	}
+}
+
+// 处理成功后才保存处理前取出的位置
+func TestRunOnceSavesTokenAfterProcess(t *testing.T) {
+	var (
+		token      = &bson.Raw{Kind: 3, Data: []byte("token")}
+		later      = &bson.Raw{Kind: 3, Data: []byte("later")}
+		processErr = errors.New("process failed")
+	)
+	cases := []struct {
+		name        string
+		token       *bson.Raw // 处理前的位置
+		during      *bson.Raw // 处理期间收到的位置
+		err         error
+		wantSaved   *bson.Raw
+		wantPending *bson.Raw // 处理后仍待保存的位置
+	}{
+		{"处理成功后保存", token, nil, nil, token, nil},
+		{"没有位置时不保存", nil, nil, nil, nil, nil},
+		{"处理失败时不保存", token, nil, processErr, nil, nil},
+		{"处理期间收到的位置留到下一轮", token, later, nil, token, later},
+	}
+	for _, c := range cases {
+		var (
+			p      = &ProcessMessageImpl{}
+			events []string
+			saved  *bson.Raw
+		)
+		p.setPendingToken(c.token)
+		err := p.runOnce(func() error {
+			events = append(events, "process")
+			if c.during != nil {
+				p.setPendingToken(c.during)
+			}
+			return c.err
+		}, func(token *bson.Raw) {
+			events = append(events, "save")
+			saved = token
+		})
+		if err != c.err {
+			t.Errorf("%s: err=%v, want %v", c.name, err, c.err)
+		}
+		if saved != c.wantSaved {
+			t.Errorf("%s: 保存%v, want %v", c.name, saved, c.wantSaved)
+		}
+		if saved != nil && (len(events) != 2 || events[0] != "process") {
+			t.Errorf("%s: 顺序%v, want 处理完成后保存", c.name, events)
+		}
+		if pending := p.takePendingToken(); pending != c.wantPending {
+			t.Errorf("%s: 待保存%v, want %v", c.name, pending, c.wantPending)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package process_message
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/configuration"
+	"message-center/pkg/mongodb"
+	"message-center/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookSubscriptionCollection = "webhook_subscription"
+	webhookDeliveryCollection     = "webhook_delivery"
+
+	HEADER_WEBHOOK_DELIVERY  = "X-Webhook-Delivery"
+	HEADER_WEBHOOK_TIMESTAMP = "X-Webhook-Timestamp"
+	HEADER_WEBHOOK_SIGNATURE = "X-Webhook-Signature"
+)
+
+// webhook订阅, subscriber对应MessageCenter.Emails中的收件人
+type webhookSubscription struct {
+	Id         bson.ObjectId `bson:"_id"`
+	Subscriber string        `bson:"subscriber"`
+	Url        string        `bson:"url"`
+	Secret     string        `bson:"secret"` // 不为空时对请求签名
+	Disabled   bool          `bson:"disabled"`
+	CreateTime time.Time     `bson:"create_time"`
+}
+
+// 一次投递(含重试)的记录
+type webhookDelivery struct {
+	Id             bson.ObjectId  `bson:"_id"`
+	SubscriptionId bson.ObjectId  `bson:"subscription_id"`
+	Url            string         `bson:"url"`
+	MessageId      *bson.ObjectId `bson:"message_id"`
+	Success        bool           `bson:"success"`
+	Attempts       int            `bson:"attempts"`
+	StatusCode     int            `bson:"status_code,omitempty"` // 最后一次请求的响应码
+	Error          string         `bson:"error,omitempty"`       // 最后一次请求的错误
+	Duration       int64          `bson:"duration"`              // 总耗时, 单位毫秒
+	CreateTime     time.Time      `bson:"create_time"`
+}
+
+// webhook响应码错误, 5xx和429重试
+type webhookStatusError struct {
+	status int
+}
+
+func (err *webhookStatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(err.status)
+}
+
+// webhook渠道, 把消息以json POST到收件人登记的地址
+type webhookSender struct {
+	dbController *mongodb.MongoDBController
+	client       *http.Client
+}
+
+func newWebhookSender(dbController *mongodb.MongoDBController) *webhookSender {
+	session := dbController.NewStrongSession()
+	defer session.Close()
+	db := session.DB(configuration.DB)
+	if err := db.C(webhookSubscriptionCollection).EnsureIndexKey("subscriber"); err != nil {
+		logrus.Warn("创建webhook订阅索引失败：" + err.Error())
+	}
+	if err := db.C(webhookDeliveryCollection).EnsureIndexKey("subscription_id", "-create_time"); err != nil {
+		logrus.Warn("创建webhook投递记录索引失败：" + err.Error())
+	}
+	return &webhookSender{
+		dbController: dbController,
+		client:       &http.Client{},
+	}
+}
+
+func (s *webhookSender) Send(job *ChannelJob, messages []*MessageCenter) {
+	subscriptions, err := s.subscriptions(messages)
+	if err != nil {
+		for _, ms := range messages {
+			job.Report(ms, SendResult{Err: err})
+		}
+		return
+	}
+
+	for _, ms := range messages {
+		logrus.Info(fmt.Sprintf("推送webhook消息：%s", ms.Subject))
+		body, err := json.Marshal(ms)
+		if err != nil {
+			job.Report(ms, SendResult{Err: err})
+			continue
+		}
+		subscribed := false
+		for _, em := range utils.SortedUnique(ms.Emails) {
+			for _, subscription := range subscriptions[em] {
+				subscribed = true
+				if !job.Selected(ms, subscription.Url) {
+					continue
+				}
+				ms, subscription := ms, subscription
+				job.Go(func() {
+					delivery, err := s.deliver(job.Config, subscription, ms, body)
+					job.Report(ms, SendResult{
+						Recipient:  subscription.Url,
+						Attempts:   delivery.Attempts,
+						ProviderId: delivery.Id.Hex(),
+						StartTime:  delivery.CreateTime,
+						Err:        err,
+					})
+				})
+			}
+		}
+		if !subscribed && job.Selected(ms, "") {
+			job.Report(ms, SendResult{Err: utils.WebhookNoSubscription})
+		}
+	}
+}
+
+// 本轮消息收件人的有效订阅, 按收件人分组
+func (s *webhookSender) subscriptions(messages []*MessageCenter) (map[string][]*webhookSubscription, error) {
+	session := s.dbController.NewSession()
+	defer session.Close()
+	emails := []string{}
+	for _, ms := range messages {
+		emails = append(emails, ms.Emails...)
+	}
+	found := []*webhookSubscription{}
+	query := bson.M{"subscriber": bson.M{"$in": emails}, "disabled": bson.M{"$ne": true}}
+	if err := session.DB(configuration.DB).C(webhookSubscriptionCollection).Find(query).All(&found); err != nil {
+		return nil, err
+	}
+	subscriptions := map[string][]*webhookSubscription{}
+	for _, subscription := range found {
+		subscriptions[subscription.Subscriber] = append(subscriptions[subscription.Subscriber], subscription)
+	}
+	return subscriptions, nil
+}
+
+// 按渠道配置重试投递, 并记录投递历史, 投递ID即请求头中的X-Webhook-Delivery
+func (s *webhookSender) deliver(channelConfig config.ChannelConfig, subscription *webhookSubscription, ms *MessageCenter, body []byte) (delivery *webhookDelivery, err error) {
+	delivery = &webhookDelivery{
+		Id:             bson.NewObjectId(),
+		SubscriptionId: subscription.Id,
+		Url:            subscription.Url,
+		MessageId:      ms.Id,
+		CreateTime:     time.Now(),
+	}
+	defer func() {
+		delivery.Success = err == nil
+		delivery.Duration = time.Since(delivery.CreateTime).Nanoseconds() / int64(time.Millisecond)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		s.saveDelivery(delivery)
+	}()
+
+	for delivery.Attempts = 1; ; delivery.Attempts++ {
+		delivery.StatusCode, err = s.post(channelConfig, subscription, delivery.Id, body)
+		if err == nil || delivery.Attempts >= channelConfig.Retry || !webhookRetryable(err) {
+			return
+		}
+		logrus.Warn("推送webhook失败：" + subscription.Url + " " + err.Error())
+		time.Sleep(webhookBackoff(channelConfig, delivery.Attempts))
+	}
+}
+
+func (s *webhookSender) post(channelConfig config.ChannelConfig, subscription *webhookSubscription, deliveryId bson.ObjectId, body []byte) (status int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(channelConfig.Timeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_WEBHOOK_DELIVERY, deliveryId.Hex())
+	req.Header.Set(HEADER_WEBHOOK_TIMESTAMP, timestamp)
+	if subscription.Secret != "" {
+		req.Header.Set(HEADER_WEBHOOK_SIGNATURE, hex.EncodeToString(SignWebhook(subscription.Secret, timestamp, body)))
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, &webhookStatusError{status: resp.StatusCode}
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *webhookSender) saveDelivery(delivery *webhookDelivery) {
+	session := s.dbController.NewStrongSession()
+	defer session.Close()
+	if err := session.DB(configuration.DB).C(webhookDeliveryCollection).Insert(delivery); err != nil {
+		logrus.Warn("保存webhook投递记录失败：" + err.Error())
+	}
+}
+
+// webhook签名: hmac-sha256(secret, 时间戳 + "\n" + 请求体), 接收方按同样的方式校验
+func SignWebhook(secret string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// 网络错误、5xx和429重试, 其余4xx不重试
+func webhookRetryable(err error) bool {
+	statusErr, ok := err.(*webhookStatusError)
+	if !ok {
+		return true
+	}
+	return statusErr.status >= http.StatusInternalServerError || statusErr.status == http.StatusTooManyRequests
+}
+
+// 第attempt次失败后的等待时间: 指数退避, 在[delay/2, delay)之间随机
+func webhookBackoff(channelConfig config.ChannelConfig, attempt int) time.Duration {
+	delay := time.Duration(channelConfig.RetryBackoff) * time.Millisecond
+	maxDelay := time.Duration(channelConfig.RetryMaxBackoff) * time.Millisecond
+	for ; attempt > 1 && (maxDelay <= 0 || delay < maxDelay); attempt-- {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
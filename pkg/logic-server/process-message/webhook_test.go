@@ -0,0 +1,118 @@
+package process_message
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string // 独立计算的HMAC-SHA256
+	}{
+		{"json请求体", `{"subject":"a"}`, "414c7c17257f5bf93ae2cd14e340862d98500d5c1fd62d2c80190b676a414daa"},
+		{"空请求体", "", "2503b564f83fc730f840978c9c3454d48fe424971b25bd126f8c3e600e025caf"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(SignWebhook("whsec", "1700000000", []byte(c.body))); got != c.want {
+			t.Errorf("%s: SignWebhook = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWebhookRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"网络错误", errors.New("connection refused"), true},
+		{"5xx", &webhookStatusError{status: http.StatusBadGateway}, true},
+		{"429", &webhookStatusError{status: http.StatusTooManyRequests}, true},
+		{"其余4xx", &webhookStatusError{status: http.StatusNotFound}, false},
+	}
+	for _, c := range cases {
+		if got := webhookRetryable(c.err); got != c.want {
+			t.Errorf("%s: webhookRetryable = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	cases := []struct {
+		name       string
+		backoff    int
+		maxBackoff int
+		attempt    int
+		want       time.Duration // 退避在[want/2, want]之间
+	}{
+		{"第一次重试", 100, 0, 1, 100 * time.Millisecond},
+		{"每次翻倍", 100, 0, 3, 400 * time.Millisecond},
+		{"不超过上限", 100, 300, 5, 300 * time.Millisecond},
+		{"未配置退避", 0, 0, 3, 0},
+	}
+	for _, c := range cases {
+		channelConfig := config.ChannelConfig{RetryBackoff: c.backoff, RetryMaxBackoff: c.maxBackoff}
+		for i := 0; i < 20; i++ {
+			if got := webhookBackoff(channelConfig, c.attempt); got < c.want/2 || got > c.want {
+				t.Errorf("%s: webhookBackoff = %v, want [%v, %v]", c.name, got, c.want/2, c.want)
+			}
+		}
+	}
+}
+
+func TestWebhookPost(t *testing.T) {
+	var (
+		deliveryId = bson.NewObjectId()
+		body       = []byte(`{"subject":"build failed"}`)
+	)
+	cases := []struct {
+		name       string
+		secret     string
+		status     int
+		wantErr    bool
+		wantSigned bool
+	}{
+		{"签名的请求", "whsec", http.StatusOK, false, true},
+		{"未配置secret不签名", "", http.StatusNoContent, false, false},
+		{"非2xx返回响应码错误", "whsec", http.StatusServiceUnavailable, true, true},
+	}
+	for _, c := range cases {
+		var received *http.Request
+		var receivedBody []byte
+		server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			received = req
+			receivedBody, _ = ioutil.ReadAll(req.Body)
+			resp.WriteHeader(c.status)
+		}))
+		sender := &webhookSender{client: server.Client()}
+		status, err := sender.post(config.ChannelConfig{Timeout: 1000}, &webhookSubscription{Url: server.URL, Secret: c.secret}, deliveryId, body)
+		server.Close()
+
+		if status != c.status || (err != nil) != c.wantErr {
+			t.Errorf("%s: status=%d err=%v", c.name, status, err)
+		}
+		if statusErr, ok := err.(*webhookStatusError); c.wantErr && (!ok || statusErr.status != c.status) {
+			t.Errorf("%s: 应返回响应码错误: %v", c.name, err)
+		}
+		if received.Header.Get(HEADER_WEBHOOK_DELIVERY) != deliveryId.Hex() || string(receivedBody) != string(body) {
+			t.Errorf("%s: delivery=%s body=%s", c.name, received.Header.Get(HEADER_WEBHOOK_DELIVERY), receivedBody)
+		}
+		// 接收方按时间戳和请求体校验签名
+		signature := received.Header.Get(HEADER_WEBHOOK_SIGNATURE)
+		if c.wantSigned && signature != hex.EncodeToString(SignWebhook(c.secret, received.Header.Get(HEADER_WEBHOOK_TIMESTAMP), receivedBody)) {
+			t.Errorf("%s: 签名%s无法校验", c.name, signature)
+		}
+		if !c.wantSigned && signature != "" {
+			t.Errorf("%s: 不应签名: %s", c.name, signature)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 调用方认证请求头
+const (
+	HEADER_API_KEY   = "X-Api-Key"
+	HEADER_TIMESTAMP = "X-Timestamp" // unix时间戳, 单位秒
+	HEADER_NONCE     = "X-Nonce"     // 随机串, 签名窗口内不能重复
+	HEADER_SIGNATURE = "X-Signature" // hex(HMAC-SHA256(secret, method\npath\nquery\ntimestamp\nnonce\nbody))
+)
+
+type apiKeyContextKey struct{}
+
+// 签名窗口内已使用的nonce, 防止重放
+type nonceCache struct {
+	mutex     sync.Mutex
+	seen      map[string]time.Time // key+nonce -> 过期时间
+	lastSweep time.Time
+}
+
+var (
+	usedNonces = &nonceCache{seen: make(map[string]time.Time)}
+)
+
+// 记录nonce, 窗口内已使用过时返回false
+func (cache *nonceCache) use(nonce string, window time.Duration) bool {
+	var (
+		now    = time.Now()
+		expire time.Time
+		key    string
+		exists bool
+	)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// 每个窗口清理一次过期的nonce
+	if now.Sub(cache.lastSweep) >= window {
+		for key, expire = range cache.seen {
+			if now.After(expire) {
+				delete(cache.seen, key)
+			}
+		}
+		cache.lastSweep = now
+	}
+
+	if expire, exists = cache.seen[nonce]; exists && now.Before(expire) {
+		return false
+	}
+	// 时间戳允许前后各一个窗口的误差, nonce需要保留两个窗口
+	cache.seen[nonce] = now.Add(2 * window)
+	return true
+}
+
+// 校验调用方, 未配置apiKeys时不校验; 通过后将api key放入请求上下文, 由接口按权限检查推送目标
+// 所有接口都经过这里, 同时限制请求体大小
+func authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var (
+			apiKey *config.ApiKeyConfig
+			err    error
+		)
+		if maxBodySize := config.GlobalLogicConfig().ServiceMaxBodySize; maxBodySize > 0 {
+			req.Body = http.MaxBytesReader(resp, req.Body, int64(maxBodySize))
+		}
+		if len(config.GlobalLogicConfig().ApiKeys) == 0 {
+			handler(resp, req)
+			return
+		}
+		if apiKey, err = verifyRequest(req); err != nil {
+			types.WritePushResponse(resp, http.StatusUnauthorized, &types.PushResponse{Code: types.PUSH_CODE_UNAUTHORIZED, Message: err.Error()})
+			return
+		}
+		handler(resp, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey)))
+	}
+}
+
+// 查找api key, 配置了secret时校验签名、时间戳和nonce
+func verifyRequest(req *http.Request) (apiKey *config.ApiKeyConfig, err error) {
+	var (
+		keyIdx    int
+		apiKeys   = config.GlobalLogicConfig().ApiKeys
+		key       = req.Header.Get(HEADER_API_KEY)
+		timestamp int64
+		window    = time.Duration(config.GlobalLogicConfig().ApiSignWindow) * time.Second
+		nonce     string
+		body      []byte
+		mac       []byte
+		signature []byte
+	)
+	for keyIdx, _ = range apiKeys {
+		if key != "" && subtle.ConstantTimeCompare([]byte(apiKeys[keyIdx].Key), []byte(key)) == 1 {
+			apiKey = &apiKeys[keyIdx]
+			break
+		}
+	}
+	if apiKey == nil {
+		return nil, utils.ApiKeyInvalid
+	}
+	if apiKey.Secret == "" {
+		return
+	}
+
+	if timestamp, err = strconv.ParseInt(req.Header.Get(HEADER_TIMESTAMP), 10, 64); err != nil {
+		return nil, utils.TimestampExpired
+	}
+	if offset := time.Since(time.Unix(timestamp, 0)); offset > window || offset < -window {
+		return nil, utils.TimestampExpired
+	}
+	if nonce = req.Header.Get(HEADER_NONCE); nonce == "" {
+		return nil, utils.SignatureInvalid
+	}
+
+	// 读出请求体参与签名, 再放回供后续解析表单
+	if body, err = ioutil.ReadAll(req.Body); err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if signature, err = hex.DecodeString(req.Header.Get(HEADER_SIGNATURE)); err != nil {
+		return nil, utils.SignatureInvalid
+	}
+	mac = Sign(apiKey.Secret, req.Method, req.URL.Path, CanonicalQuery(req.URL.Query()), req.Header.Get(HEADER_TIMESTAMP), nonce, body)
+	if !hmac.Equal(mac, signature) {
+		return nil, utils.SignatureInvalid
+	}
+
+	// 签名通过后才记录nonce, 避免伪造请求占用nonce
+	if !usedNonces.use(apiKey.Key+"\n"+nonce, window) {
+		return nil, utils.NonceReplayed
+	}
+	return
+}
+
+// 计算请求签名, 调用方按同样的方式签名; query为CanonicalQuery的结果, 没有查询参数时为空
+func Sign(secret string, method string, path string, query string, timestamp string, nonce string, body []byte) []byte {
+	var (
+		mac = hmac.New(sha256.New, []byte(secret))
+	)
+	mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// 参与签名的查询参数: 按参数名排序, 同名参数保持原有顺序, 名称和值按url编码后以&连接
+func CanonicalQuery(query url.Values) string {
+	return query.Encode()
+}
+
+// 请求对应的api key, 未开启认证时为nil
+func requestApiKey(req *http.Request) *config.ApiKeyConfig {
+	apiKey, _ := req.Context().Value(apiKeyContextKey{}).(*config.ApiKeyConfig)
+	return apiKey
+}
+
+// 检查api key是否允许本次推送, 不允许时直接响应403
+func authorize(resp http.ResponseWriter, req *http.Request, allow func(apiKey *config.ApiKeyConfig) bool) bool {
+	var (
+		apiKey = requestApiKey(req)
+	)
+	if apiKey == nil || allow(apiKey) {
+		return true
+	}
+	types.WritePushResponse(resp, http.StatusForbidden, &types.PushResponse{Code: types.PUSH_CODE_FORBIDDEN, Message: utils.ScopeForbidden.Error()})
+	return false
+}
+
+func allowBroadcast(apiKey *config.ApiKeyConfig) bool {
+	return apiKey.Broadcast
+}
+
+func allowUsers(apiKey *config.ApiKeyConfig) bool {
+	return apiKey.Users
+}
+
+func allowAdmin(apiKey *config.ApiKeyConfig) bool {
+	return apiKey.Admin
+}
+
+func allowRooms(rooms ...string) func(apiKey *config.ApiKeyConfig) bool {
+	return func(apiKey *config.ApiKeyConfig) bool {
+		for _, room := range rooms {
+			if !apiKey.AllowRoom(room) {
+				return false
+			}
+		}
+		return true
+	}
+}
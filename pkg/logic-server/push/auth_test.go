@@ -0,0 +1,171 @@
+package push
+
+import (
+	"context"
+	"encoding/hex"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		query  string
+		nonce  string
+		body   string
+		want   string // 独立计算的HMAC-SHA256
+	}{
+		{"表单请求", "POST", "/push/room", "", "nonce-1", "room=a&msg=hi", "1880c32f1d4513d4161ec8550f8a5ac115fd105623fa64fc124bbcd95cae48f3"},
+		{"带查询参数", "GET", "/servers", "a=1&b=2&b=1", "nonce-2", "", "e728fca2ace3cc2b42dabb0e288fba37c8edb6e4a4223ab72a20d845c50a8821"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(Sign("secret", c.method, c.path, c.query, "1700000000", c.nonce, []byte(c.body))); got != c.want {
+			t.Errorf("%s: Sign = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"没有查询参数", "", ""},
+		{"按参数名排序", "b=2&a=1", "a=1&b=2"},
+		{"同名参数保持原有顺序", "b=2&a=1&b=1", "a=1&b=2&b=1"},
+		{"名称和值url编码", "room=a b&x=%2F", "room=a+b&x=%2F"},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		if got := CanonicalQuery(query); got != c.want {
+			t.Errorf("%s: CanonicalQuery(%q) = %q, want %q", c.name, c.query, got, c.want)
+		}
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	var (
+		now = strconv.FormatInt(time.Now().Unix(), 10)
+		old = strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	)
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().ApiKeys = []config.ApiKeyConfig{
+		{Key: "signed", Secret: "secret"},
+		{Key: "plain"},
+	}
+
+	cases := []struct {
+		name      string
+		key       string
+		timestamp string
+		nonce     string
+		signWith  string // 签名使用的secret
+		want      error
+	}{
+		{"签名正确", "signed", now, "verify-1", "secret", nil},
+		{"nonce重复", "signed", now, "verify-1", "secret", utils.NonceReplayed},
+		{"签名错误", "signed", now, "verify-2", "other", utils.SignatureInvalid},
+		{"时间戳过期", "signed", old, "verify-3", "secret", utils.TimestampExpired},
+		{"缺少nonce", "signed", now, "", "secret", utils.SignatureInvalid},
+		{"未知api key", "unknown", now, "verify-4", "secret", utils.ApiKeyInvalid},
+		{"未配置secret不校验签名", "plain", "", "", "", nil},
+	}
+	for _, c := range cases {
+		var (
+			body = "room=a&msg=hi"
+			req  = httptest.NewRequest(http.MethodPost, "/push/room?b=2&a=1", strings.NewReader(body))
+		)
+		req.Header.Set(HEADER_API_KEY, c.key)
+		req.Header.Set(HEADER_TIMESTAMP, c.timestamp)
+		req.Header.Set(HEADER_NONCE, c.nonce)
+		req.Header.Set(HEADER_SIGNATURE, hex.EncodeToString(Sign(c.signWith, req.Method, req.URL.Path, "a=1&b=2", c.timestamp, c.nonce, []byte(body))))
+
+		if _, err := verifyRequest(req); err != c.want {
+			t.Errorf("%s: verifyRequest = %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	// 查询参数参与签名, 被篡改时签名失败; 参数顺序不影响签名
+	for target, want := range map[string]error{"/push/room?b=2&a=1": nil, "/push/room?b=3&a=1": utils.SignatureInvalid} {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		nonce := "query-" + target
+		req.Header.Set(HEADER_API_KEY, "signed")
+		req.Header.Set(HEADER_TIMESTAMP, now)
+		req.Header.Set(HEADER_NONCE, nonce)
+		req.Header.Set(HEADER_SIGNATURE, hex.EncodeToString(Sign("secret", req.Method, req.URL.Path, "a=1&b=2", now, nonce, nil)))
+		if _, err := verifyRequest(req); err != want {
+			t.Errorf("%s: verifyRequest = %v, want %v", target, err, want)
+		}
+	}
+}
+
+func TestAuthorizeRooms(t *testing.T) {
+	var (
+		apiKey = &config.ApiKeyConfig{Key: "k", Rooms: []string{"build-*", "alarm"}}
+	)
+	cases := []struct {
+		name  string
+		rooms []string
+		want  bool
+	}{
+		{"前缀匹配", []string{"build-42"}, true},
+		{"精确匹配", []string{"alarm"}, true},
+		{"精确匹配不按前缀", []string{"alarm-1"}, false},
+		{"多房间全部允许", []string{"build-1", "alarm"}, true},
+		{"多房间有一个不允许", []string{"build-1", "deploy"}, false},
+	}
+	for _, c := range cases {
+		var (
+			resp = httptest.NewRecorder()
+			req  = httptest.NewRequest(http.MethodPost, "/push/rooms", nil)
+		)
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey))
+		if got := authorize(resp, req, allowRooms(c.rooms...)); got != c.want {
+			t.Errorf("%s: authorize = %v, want %v", c.name, got, c.want)
+		}
+		if !c.want && (resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), types.PUSH_CODE_FORBIDDEN)) {
+			t.Errorf("%s: 应返回403: %d %s", c.name, resp.Code, resp.Body.String())
+		}
+	}
+
+	// 未开启认证时不检查
+	if !authorize(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push/all", nil), allowBroadcast) {
+		t.Error("未开启认证时应允许")
+	}
+}
+
+func TestNonceCacheUse(t *testing.T) {
+	var (
+		cache  = &nonceCache{seen: make(map[string]time.Time)}
+		window = 20 * time.Millisecond
+	)
+	if !cache.use("a", window) || cache.use("a", window) {
+		t.Error("窗口内重复的nonce应被拒绝")
+	}
+	if !cache.use("b", window) {
+		t.Error("不同的nonce应允许")
+	}
+	// nonce保留两个窗口, 过期后清理
+	time.Sleep(3 * window)
+	if !cache.use("a", window) {
+		t.Error("过期的nonce应允许再次使用")
+	}
+	if _, exists := cache.seen["b"]; exists {
+		t.Error("过期的nonce应被清理")
+	}
+}
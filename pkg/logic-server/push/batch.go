@@ -0,0 +1,187 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/common/log"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// message server不支持/push/batch, 改为逐个推送
+var errBatchUnsupported = errors.New("push batch unsupported")
+
+// 一个等待批量发送的推送
+type batchPush struct {
+	envelope   *types.PushEnvelope
+	resultChan chan batchResult // 收到该推送的结果后写入, 缓冲为1
+}
+
+type batchResult struct {
+	reached int // 等待送达时消息写入发送队列的连接数
+	err     error
+}
+
+// 每个message server一个批量发送器: 在短时间窗口内累积推送, 合并为一个/push/batch请求
+// 窗口内的推送数受pendingChan限制, 不超过messageServerMaxPendingCount
+type batchSender struct {
+	address     string
+	apiUrl      string
+	client      *http.Client
+	queueChan   chan *batchPush
+	unsupported int32 // 原子操作, 为1时message server不支持批量推送
+	stopChan    chan byte
+}
+
+func initBatchSender(address string, schema string, client *http.Client) (sender *batchSender) {
+	sender = &batchSender{
+		address:   address,
+		apiUrl:    schema + "/push/batch",
+		client:    client,
+		queueChan: make(chan *batchPush, config.GlobalLogicConfig().MessageServerMaxPendingCount),
+		stopChan:  make(chan byte),
+	}
+	go sender.collectMain()
+	return
+}
+
+// 批量推送, 网络错误、5xx和429按退避策略重试; message server不支持时返回errBatchUnsupported
+func (sender *batchSender) Push(pushJob *PushJob) (reached int, err error) {
+	var (
+		envelope *types.PushEnvelope
+	)
+	if atomic.LoadInt32(&sender.unsupported) == 1 {
+		return 0, errBatchUnsupported
+	}
+	if envelope, err = pushJob.envelope(); err != nil {
+		return
+	}
+
+	err = retryWithBackoff(sender.address, func() error {
+		var (
+			push   = &batchPush{envelope: envelope, resultChan: make(chan batchResult, 1)}
+			result batchResult
+		)
+		select {
+		case sender.queueChan <- push:
+		case <-sender.stopChan:
+			return errBatchUnsupported
+		}
+		select {
+		case result = <-push.resultChan:
+			reached = result.reached
+			return result.err
+		case <-sender.stopChan:
+			return errBatchUnsupported
+		}
+	})
+	return
+}
+
+// 收集协程: 取到第一个推送后等待一个窗口, 期间到达的推送合并为一批
+func (sender *batchSender) collectMain() {
+	var (
+		push    *batchPush
+		pushes  []*batchPush
+		timer   *time.Timer
+		maxSize int
+	)
+	for {
+		select {
+		case <-sender.stopChan:
+			return
+		case push = <-sender.queueChan:
+		}
+
+		pushes = []*batchPush{push}
+		maxSize = config.GlobalLogicConfig().MessageServerBatchSize
+		timer = time.NewTimer(time.Duration(config.GlobalLogicConfig().MessageServerBatchWindow) * time.Millisecond)
+	COLLECT:
+		for maxSize <= 0 || len(pushes) < maxSize {
+			select {
+			case push = <-sender.queueChan:
+				pushes = append(pushes, push)
+			case <-timer.C:
+				break COLLECT
+			}
+		}
+		timer.Stop()
+
+		// 发送不阻塞下一批的收集
+		go sender.send(pushes)
+	}
+}
+
+// 发送一批推送, 按顺序把结果交给每个调用方
+func (sender *batchSender) send(pushes []*batchPush) {
+	var (
+		batch     = types.PushBatch{Pushes: make([]*types.PushEnvelope, 0, len(pushes))}
+		batchResp *types.PushBatchResponse
+		push      *batchPush
+		pushIdx   int
+		reply     *types.PushResponse
+		err       error
+	)
+	for _, push = range pushes {
+		batch.Pushes = append(batch.Pushes, push.envelope)
+	}
+
+	if batchResp, err = sender.post(&batch); err != nil {
+		for _, push = range pushes {
+			push.resultChan <- batchResult{err: err}
+		}
+		return
+	}
+
+	for pushIdx, push = range pushes {
+		if pushIdx >= len(batchResp.Replies) || batchResp.Replies[pushIdx] == nil {
+			push.resultChan <- batchResult{err: &StatusError{Address: sender.apiUrl, Status: http.StatusBadGateway, Message: "missing batch reply"}}
+			continue
+		}
+		if reply = batchResp.Replies[pushIdx]; types.PushStatus(reply.Code) != http.StatusOK {
+			push.resultChan <- batchResult{err: &StatusError{Address: sender.apiUrl, Status: types.PushStatus(reply.Code), Code: reply.Code, Message: reply.Message}}
+			continue
+		}
+		push.resultChan <- batchResult{reached: reply.Reached}
+	}
+}
+
+func (sender *batchSender) post(batch *types.PushBatch) (batchResp *types.PushBatchResponse, err error) {
+	var (
+		reqBody []byte
+		resp    *http.Response
+		body    []byte
+	)
+	if reqBody, err = json.Marshal(batch); err != nil {
+		return
+	}
+	if resp, err = sender.client.Post(sender.apiUrl, "application/json", bytes.NewReader(reqBody)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ = ioutil.ReadAll(resp.Body)
+	// 旧版本message server没有批量接口
+	if resp.StatusCode == http.StatusNotFound {
+		if atomic.CompareAndSwapInt32(&sender.unsupported, 0, 1) {
+			log.Warn("message server不支持批量推送, 改为逐个推送：" + sender.address)
+		}
+		return nil, errBatchUnsupported
+	}
+
+	batchResp = &types.PushBatchResponse{}
+	_ = json.Unmarshal(body, batchResp)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{Address: sender.apiUrl, Status: resp.StatusCode, Code: batchResp.Code, Message: batchResp.Message}
+	}
+	return
+}
+
+func (sender *batchSender) Close() {
+	close(sender.stopChan)
+}
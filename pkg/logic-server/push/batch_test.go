@@ -0,0 +1,188 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func initTestBatchConfig(t *testing.T, window int, size int) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().MessageServerBatchWindow = window
+	config.GlobalLogicConfig().MessageServerBatchSize = size
+	config.GlobalLogicConfig().MessageServerPushRetry = 1
+}
+
+// 记录收到的批次, 按房间名返回每个推送的结果
+type fakeBatchServer struct {
+	mutex      sync.Mutex
+	requests   int // 收到的请求数
+	batchSizes []int
+	status     int                            // 整个请求的状态码, 0表示200
+	replies    map[string]*types.PushResponse // 房间 -> 结果, 不存在时该推送的结果为null
+}
+
+func (fake *fakeBatchServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var (
+		batch     types.PushBatch
+		batchResp = types.PushBatchResponse{Code: types.PUSH_CODE_OK}
+	)
+	fake.mutex.Lock()
+	fake.requests++
+	fake.mutex.Unlock()
+	if fake.status != 0 {
+		resp.WriteHeader(fake.status)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	_ = json.Unmarshal(body, &batch)
+	fake.mutex.Lock()
+	fake.batchSizes = append(fake.batchSizes, len(batch.Pushes))
+	fake.mutex.Unlock()
+	for _, envelope := range batch.Pushes {
+		batchResp.Replies = append(batchResp.Replies, fake.replies[envelope.Room])
+	}
+	buf, _ := json.Marshal(&batchResp)
+	_, _ = resp.Write(buf)
+}
+
+// 并发推送到这些房间, 返回每个推送的结果
+func pushBatchRooms(sender *batchSender, roomIds []string) (results []batchResult) {
+	var (
+		waitGroup sync.WaitGroup
+	)
+	results = make([]batchResult, len(roomIds))
+	for roomIdx, roomId := range roomIds {
+		waitGroup.Add(1)
+		go func(roomIdx int, roomId string) {
+			defer waitGroup.Done()
+			results[roomIdx].reached, results[roomIdx].err = sender.Push(newTestRoomJob(roomId))
+		}(roomIdx, roomId)
+	}
+	waitGroup.Wait()
+	return
+}
+
+// 同一批次中每个推送的结果互不影响, 缺少结果的推送视为失败
+func TestBatchSenderPartialFailure(t *testing.T) {
+	initTestBatchConfig(t, 100, 64)
+	fake := &fakeBatchServer{replies: map[string]*types.PushResponse{
+		"ok":      {Code: types.PUSH_CODE_OK, Reached: 2},
+		"partial": {Code: types.PUSH_CODE_PARTIAL, Reached: 1},
+		"full":    {Code: types.PUSH_CODE_CHANNEL_FULL},
+		"invalid": {Code: types.PUSH_CODE_INVALID_ROOM},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sender := initBatchSender("test", server.URL, server.Client())
+	defer sender.Close()
+
+	cases := []struct {
+		roomId      string
+		wantReached int
+		wantStatus  int // 0表示成功
+	}{
+		{"ok", 2, 0},
+		{"partial", 1, 0},
+		{"full", 0, http.StatusTooManyRequests},
+		{"invalid", 0, http.StatusBadRequest},
+		{"missing", 0, http.StatusBadGateway},
+	}
+	roomIds := make([]string, 0, len(cases))
+	for _, c := range cases {
+		roomIds = append(roomIds, c.roomId)
+	}
+	results := pushBatchRooms(sender, roomIds)
+	for caseIdx, c := range cases {
+		var (
+			result    = results[caseIdx]
+			statusErr *StatusError
+		)
+		if result.reached != c.wantReached {
+			t.Errorf("%s: reached=%d, want %d", c.roomId, result.reached, c.wantReached)
+		}
+		if c.wantStatus == 0 {
+			if result.err != nil {
+				t.Errorf("%s: %v", c.roomId, result.err)
+			}
+			continue
+		}
+		if !errors.As(result.err, &statusErr) || statusErr.Status != c.wantStatus {
+			t.Errorf("%s: err=%v, want status %d", c.roomId, result.err, c.wantStatus)
+		}
+	}
+	if len(fake.batchSizes) != 1 || fake.batchSizes[0] != len(cases) {
+		t.Errorf("批次=%v, want 一个批次%d个推送", fake.batchSizes, len(cases))
+	}
+}
+
+// 每批最多messageServerBatchSize个推送, 超出的推送进入下一批
+func TestBatchSenderSizeLimit(t *testing.T) {
+	cases := []struct {
+		name        string
+		size        int
+		pushes      int
+		wantBatches int
+	}{
+		{"未达上限合并为一批", 8, 5, 1},
+		{"刚好达到上限", 5, 5, 1},
+		{"超出上限分多批", 3, 7, 3},
+	}
+	for _, c := range cases {
+		initTestBatchConfig(t, 100, c.size)
+		fake := &fakeBatchServer{replies: map[string]*types.PushResponse{"a": {Code: types.PUSH_CODE_OK}}}
+		server := httptest.NewServer(fake)
+		sender := initBatchSender("test", server.URL, server.Client())
+
+		roomIds := make([]string, c.pushes)
+		for roomIdx := range roomIds {
+			roomIds[roomIdx] = "a"
+		}
+		for _, result := range pushBatchRooms(sender, roomIds) {
+			if result.err != nil {
+				t.Errorf("%s: %v", c.name, result.err)
+			}
+		}
+		total := 0
+		for _, batchSize := range fake.batchSizes {
+			if batchSize > c.size {
+				t.Errorf("%s: 批次大小%d超过上限%d", c.name, batchSize, c.size)
+			}
+			total += batchSize
+		}
+		if total != c.pushes || len(fake.batchSizes) != c.wantBatches {
+			t.Errorf("%s: 批次=%v, want %d批共%d个推送", c.name, fake.batchSizes, c.wantBatches, c.pushes)
+		}
+		sender.Close()
+		server.Close()
+	}
+}
+
+// message server没有批量接口时返回errBatchUnsupported, 之后不再发送批量请求
+func TestBatchSenderUnsupported(t *testing.T) {
+	initTestBatchConfig(t, 10, 64)
+	fake := &fakeBatchServer{status: http.StatusNotFound}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sender := initBatchSender("test", server.URL, server.Client())
+	defer sender.Close()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := sender.Push(newTestRoomJob("a")); err != errBatchUnsupported {
+			t.Errorf("第%d次: err=%v, want %v", attempt, err, errBatchUnsupported)
+		}
+	}
+	if fake.requests != 1 {
+		t.Errorf("请求%d次, want 1", fake.requests)
+	}
+}
@@ -1,41 +1,57 @@
 package push
 
 import (
-	"crypto/tls"
+	"encoding/json"
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/http2"
+	"io/ioutil"
 	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
 	"net/http"
 	"net/url"
-	"strconv"
+	"sync"
 	"time"
 )
 
-type pushInterface interface {
-	PushAll(itemsJson []byte) error
-	PushRoom(room string, itemsJson []byte) error
-}
-
-// 与消息服之间的通讯
+// 与消息服之间的通讯, 每个message server一个
 type ServerConn struct {
-	schema string
-	client *http.Client // 内置长连接+并发连接数
+	address     string // hostname:port, 唯一标识一个message server
+	schema      string
+	protocol    string
+	client      *http.Client      // 内置长连接+并发连接数
+	grpc        *grpcConn         // protocol为grpc时的推送连接, 否则使用HTTP推送
+	batch       *batchSender      // HTTP推送的批量发送器, 未开启批量推送时为nil
+	pendingChan chan byte         // 并发请求控制
+	rooms       *roomSubscription // message server上有订阅者的房间, 未开启按订阅路由时为nil
+	breaker     *circuitBreaker   // 熔断器, 连续失败后跳过该message server
+	spill       *spillQueue       // 溢出队列, 未开启时为nil
+	stopChan    chan byte         // 停止健康探测
+
+	retireMutex sync.RWMutex
+	retired     bool           // 已从列表中移除或被重建, 不再接受新的推送
+	inflight    sync.WaitGroup // 进行中的推送和重放
 }
 
-func InitMessageServerConn(gatewayConfig *config.MessageServerConfig) (serverConn *ServerConn, err error) {
+// 建立到message server的连接; spill不为nil时沿用同一地址旧连接的溢出队列, 由调用方在替换旧连接后切换重放目标
+func InitMessageServerConn(gatewayConfig *config.MessageServerConfig, spill *spillQueue) (serverConn *ServerConn, err error) {
 	var (
 		transport *http.Transport
 	)
 
 	serverConn = &ServerConn{
-		schema: "http://" + gatewayConfig.Hostname + ":" + strconv.Itoa(gatewayConfig.Port),
+		address:     gatewayConfig.Address(),
+		schema:      gatewayConfig.BaseUrl(),
+		protocol:    gatewayConfig.Protocol,
+		breaker:     initCircuitBreaker(),
+		stopChan:    make(chan byte),
+		pendingChan: make(chan byte, config.GlobalLogicConfig().MessageServerMaxPendingCount),
 	}
 
 	transport = &http.Transport{
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true}, // 不校验服务端证书
-		MaxIdleConns:        config.GlobalLogicConfig.MessageServerMaxConnection,
-		MaxIdleConnsPerHost: config.GlobalLogicConfig.MessageServerMaxConnection,
-		IdleConnTimeout:     time.Duration(config.GlobalLogicConfig.MessageServerIdleTimeout) * time.Second, // 连接空闲超时
+		TLSClientConfig:     clientCerts.ClientConfig(gatewayConfig.Hostname), // 用配置的CA或系统根证书校验服务端证书, 配置了客户端证书时出示
+		MaxIdleConns:        config.GlobalLogicConfig().MessageServerMaxConnection,
+		MaxIdleConnsPerHost: config.GlobalLogicConfig().MessageServerMaxConnection,
+		IdleConnTimeout:     time.Duration(config.GlobalLogicConfig().MessageServerIdleTimeout) * time.Second, // 连接空闲超时
 	}
 	// 启动HTTP/2协议
 	http2.ConfigureTransport(transport)
@@ -43,58 +59,317 @@ func InitMessageServerConn(gatewayConfig *config.MessageServerConfig) (serverCon
 	// HTTP/2 客户端
 	serverConn.client = &http.Client{
 		Transport: transport,
-		Timeout:   time.Duration(config.GlobalLogicConfig.MessageServerTimeout) * time.Millisecond, // 请求超时
+		Timeout:   time.Duration(config.GlobalLogicConfig().MessageServerTimeout) * time.Millisecond, // 请求超时
+	}
+
+	// gRPC推送连接
+	if gatewayConfig.UseGrpc() {
+		if serverConn.grpc, err = initGrpcConn(gatewayConfig.GrpcAddress(), gatewayConfig.UseTLS()); err != nil {
+			return nil, err
+		}
+	}
+
+	// HTTP推送合并为批量请求
+	if serverConn.grpc == nil && config.GlobalLogicConfig().MessageServerBatchWindow > 0 {
+		serverConn.batch = initBatchSender(serverConn.address, serverConn.schema, serverConn.client)
+	}
+
+	if serverConn.protocol == "" {
+		serverConn.protocol = config.PROTOCOL_HTTP
+	}
+
+	// 积压的推送写入溢出队列, 恢复后按顺序重放
+	if spill != nil {
+		serverConn.spill = spill
+	} else if config.GlobalLogicConfig().MessageServerSpillDir != "" {
+		if serverConn.spill, err = openSpillQueue(spillDir(serverConn.address)); err != nil {
+			if serverConn.grpc != nil {
+				serverConn.grpc.Close()
+			}
+			return nil, err
+		}
+		serverConn.spill.replayTo(serverConn.replay)
+	}
+
+	// 健康探测
+	go serverConn.breaker.probeMain(serverConn.client, serverConn.schema, serverConn.stopChan)
+
+	// 同步房间订阅, 房间推送只发给有订阅者的message server
+	if config.GlobalLogicConfig().MessageServerRoomRouting {
+		serverConn.rooms = initRoomSubscription(transport)
+		go serverConn.rooms.syncMain(serverConn.schema)
+	}
+	return
+}
+
+// 关闭空闲连接, 进行中的请求不受影响
+func (serverConn *ServerConn) Close() {
+	serverConn.close(true)
+}
+
+// closeSpill为false时溢出队列已交给新的连接或其他message server, 不再关闭
+func (serverConn *ServerConn) close(closeSpill bool) {
+	close(serverConn.stopChan)
+	if closeSpill && serverConn.spill != nil {
+		serverConn.spill.close()
+	}
+	if serverConn.rooms != nil {
+		serverConn.rooms.stop()
+	}
+	if serverConn.grpc != nil {
+		serverConn.grpc.Close()
+	}
+	if serverConn.batch != nil {
+		serverConn.batch.Close()
+	}
+	serverConn.client.CloseIdleConnections()
+}
+
+// 登记一个进行中的推送, 连接已移除时返回false; 返回true时需调用release
+func (serverConn *ServerConn) acquire() bool {
+	serverConn.retireMutex.RLock()
+	defer serverConn.retireMutex.RUnlock()
+
+	if serverConn.retired {
+		return false
+	}
+	serverConn.inflight.Add(1)
+	return true
+}
+
+func (serverConn *ServerConn) release() {
+	serverConn.inflight.Done()
+}
+
+// 不再接受新的推送, 等待进行中的推送和重放完成
+func (serverConn *ServerConn) drain() {
+	serverConn.retireMutex.Lock()
+	serverConn.retired = true
+	serverConn.retireMutex.Unlock()
+
+	serverConn.inflight.Wait()
+}
+
+// 推送协议与配置是否一致
+func (serverConn *ServerConn) sameConfig(gatewayConfig *config.MessageServerConfig) bool {
+	if serverConn.schema != gatewayConfig.BaseUrl() {
+		return false
+	}
+	if gatewayConfig.UseGrpc() {
+		return serverConn.grpc != nil && serverConn.grpc.address == gatewayConfig.GrpcAddress()
+	}
+	return serverConn.grpc == nil
+}
+
+// message server上是否可能有该推送的接收者, 广播总是返回true
+func (serverConn *ServerConn) hasSubscriber(pushJob *PushJob) bool {
+	if serverConn.rooms == nil {
+		return true
+	}
+	if pushJob.pushType == types.PUSH_TYPE_ROOM {
+		return serverConn.rooms.hasSubscriber(pushJob.roomId)
+	} else if pushJob.pushType == types.PUSH_TYPE_ROOMS {
+		return serverConn.rooms.hasSubscriber(pushJob.roomIds...)
+	}
+	return true
+}
+
+// 健康状态
+func (serverConn *ServerConn) Status() (status ServerStatus) {
+	status = serverConn.breaker.status()
+	status.Address = serverConn.address
+	status.Protocol = serverConn.protocol
+	if serverConn.spill != nil {
+		status.Spilled, status.Replayed = serverConn.spill.counts()
 	}
 	return
 }
 
-// 出于性能考虑, 消息数组在此前已经编码成json
-func (serverConn *ServerConn) PushAll(itemsJson []byte) (err error) {
+// 写入溢出队列, 未开启或写入失败时返回false
+func (serverConn *ServerConn) spillPush(pushJob *PushJob) bool {
 	var (
-		apiUrl string
-		form   url.Values
-		resp   *http.Response
-		retry  int
+		err error
+	)
+	if serverConn.spill == nil {
+		return false
+	}
+	if err = serverConn.spill.append(pushJob); err != nil {
+		log.Warn("写入溢出队列失败：" + serverConn.address + " " + err.Error())
+		return false
+	}
+	return true
+}
+
+// 溢出队列中还有积压时, 新的推送也写入队列排在后面, 保证顺序
+func (serverConn *ServerConn) spillBehindBacklog(pushJob *PushJob) bool {
+	var (
+		appended bool
+		err      error
 	)
+	if serverConn.spill == nil {
+		return false
+	}
+	if appended, err = serverConn.spill.appendIfPending(pushJob); err != nil {
+		log.Warn("写入溢出队列失败：" + serverConn.address + " " + err.Error())
+	}
+	return appended
+}
 
-	apiUrl = serverConn.schema + "/push/all"
+// 重放溢出队列中的推送, 熔断、并发已满或可重试的失败时返回false, 稍后重放同一个推送
+func (serverConn *ServerConn) replay(pushJob *PushJob) bool {
+	var (
+		err error
+	)
+	// 已过期的推送不再重放
+	if pushJob.expired() {
+		return true
+	}
+	// 连接已移除, 由接管溢出队列的连接重放
+	if !serverConn.acquire() {
+		return false
+	}
+	defer serverConn.release()
 
-	form = url.Values{}
-	form.Set("items", string(itemsJson))
+	if !serverConn.breaker.permit() {
+		return false
+	}
+	select {
+	case serverConn.pendingChan <- 1:
+	default:
+		serverConn.breaker.release()
+		return false
+	}
+	_, err = serverConn.Push(pushJob)
+	<-serverConn.pendingChan
 
-	for retry = 0; retry < config.GlobalLogicConfig.MessageServerPushRetry; retry++ {
-		if resp, err = serverConn.client.PostForm(apiUrl, form); err != nil {
-			log.Warn("向message server发送消息失败：" + err.Error())
-			continue
-		}
-		resp.Body.Close()
-		break
+	if retryable(err) {
+		return false
+	}
+	if err != nil {
+		log.Warn("丢弃无法重放的推送：" + serverConn.address + " " + err.Error())
 	}
+	return true
+}
+
+// 推送并将结果计入熔断器, 4xx说明message server正常响应, 不计为失败
+// 等待送达时返回消息写入发送队列的连接数
+func (serverConn *ServerConn) Push(pushJob *PushJob) (reached int, err error) {
+	if reached, err = serverConn.push(pushJob); err != nil && !retryable(err) {
+		serverConn.breaker.record(nil)
+		return
+	}
+	serverConn.breaker.record(err)
 	return
 }
 
-// 出于性能考虑, 消息数组在此前已经编码成json
-func (serverConn *ServerConn) PushRoom(room string, itemsJson []byte) (err error) {
+// 按推送类型推送, 配置为grpc时使用gRPC, 否则使用HTTP, 开启批量推送时合并为批量请求
+func (serverConn *ServerConn) push(pushJob *PushJob) (reached int, err error) {
 	var (
-		apiUrl string
-		form   url.Values
-		resp   *http.Response
-		retry  int
+		itemsJson []byte
 	)
+	if serverConn.grpc != nil {
+		return serverConn.grpc.Push(pushJob)
+	}
+	if serverConn.batch != nil {
+		if reached, err = serverConn.batch.Push(pushJob); err != errBatchUnsupported {
+			return
+		}
+	}
 
-	apiUrl = serverConn.schema + "/push/room"
+	if itemsJson, err = pushJob.encodeItems(); err != nil {
+		return
+	}
+	return serverConn.pushForm(pushJob, itemsJson)
+}
+
+// 表单推送, 出于性能考虑, 消息数组在此前已经编码成json
+func (serverConn *ServerConn) pushForm(pushJob *PushJob, itemsJson []byte) (reached int, err error) {
+	var (
+		form      url.Values
+		path      string
+		roomsJson []byte
+		pushResp  *types.PushResponse
+	)
 
 	form = url.Values{}
-	form.Set("room", room)
+	if pushJob.pushType == types.PUSH_TYPE_ALL {
+		path = "/push/all"
+	} else if pushJob.pushType == types.PUSH_TYPE_ROOM {
+		path = "/push/room"
+		form.Set("room", pushJob.roomId)
+	} else if pushJob.pushType == types.PUSH_TYPE_ROOMS {
+		if roomsJson, err = json.Marshal(pushJob.roomIds); err != nil {
+			return
+		}
+		path = "/push/rooms"
+		form.Set("rooms", string(roomsJson))
+	} else if pushJob.pushType == types.PUSH_TYPE_USER {
+		path = "/push/user"
+		form.Set("uid", pushJob.identity)
+	} else {
+		return
+	}
 	form.Set("items", string(itemsJson))
+	if err = setExclude(form, pushJob.exclude); err != nil {
+		return
+	}
+	if pushJob.wait {
+		form.Set("wait", "true")
+	}
 
-	for retry = 0; retry < config.GlobalLogicConfig.MessageServerPushRetry; retry++ {
-		if resp, err = serverConn.client.PostForm(apiUrl, form); err != nil {
-			log.Warn("向message server发送消息失败：" + err.Error())
-			continue
-		}
-		resp.Body.Close()
-		break
+	if pushResp, err = serverConn.post(path, form); err != nil {
+		return
+	}
+	return pushResp.Reached, nil
+}
+
+// 发送推送请求, 网络错误、5xx和429按退避策略重试, 其余非2xx响应直接失败
+func (serverConn *ServerConn) post(path string, form url.Values) (pushResp *types.PushResponse, err error) {
+	var (
+		apiUrl string
+	)
+
+	apiUrl = serverConn.schema + path
+
+	err = retryWithBackoff(serverConn.address, func() (err error) {
+		pushResp, err = serverConn.postOnce(apiUrl, form)
+		return
+	})
+	return
+}
+
+func (serverConn *ServerConn) postOnce(apiUrl string, form url.Values) (pushResp *types.PushResponse, err error) {
+	var (
+		resp *http.Response
+		body []byte
+	)
+
+	if resp, err = serverConn.client.PostForm(apiUrl, form); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// 尽量解析出message server返回的错误码和送达的连接数
+	body, _ = ioutil.ReadAll(resp.Body)
+	pushResp = &types.PushResponse{}
+	_ = json.Unmarshal(body, pushResp)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return
+	}
+	return nil, &StatusError{Address: apiUrl, Status: resp.StatusCode, Code: pushResp.Code, Message: pushResp.Message}
+}
+
+// 排除条件不为空时才携带exclude参数
+func setExclude(form url.Values, exclude *types.PushExclude) (err error) {
+	var (
+		excludeJson []byte
+	)
+	if exclude.IsEmpty() {
+		return
+	}
+	if excludeJson, err = json.Marshal(exclude); err != nil {
+		return
 	}
+	form.Set("exclude", string(excludeJson))
 	return
 }
@@ -4,54 +4,127 @@ import (
 	"encoding/json"
 	"github.com/prometheus/common/log"
 	"message-center/cmd/logic/config"
+	"message-center/pkg/certs"
 	"message-center/pkg/types"
 	"message-center/utils"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type managerInterface interface {
-	PushAll(items []json.RawMessage) error
-	PushRoom(roomId string, items []json.RawMessage) error
+	PushAll(items []json.RawMessage, exclude *types.PushExclude) error
+	PushRoom(roomId string, items []json.RawMessage, exclude *types.PushExclude) error
+	PushRooms(roomIds []string, items []json.RawMessage, exclude *types.PushExclude) error
+	PushUser(identity string, items []json.RawMessage, exclude *types.PushExclude) error
 	MessageConnectClose()
 }
 
 type PushJob struct {
-	pushType int               // 推送类型
-	roomId   string            // 房间ID
-	items    []json.RawMessage // 要推送的消息数组
+	pushType int                // 推送类型
+	roomId   string             // 房间ID
+	roomIds  []string           // 多房间推送的房间ID列表
+	identity string             // 用户推送的用户标识
+	items    []json.RawMessage  // 要推送的消息数组
+	exclude  *types.PushExclude // 推送排除条件
+	outcome  *outcomeCollector  // 推送结果汇总, 不关心结果时为nil
+	priority bool               // 高优先级, 分发时优先于普通推送
+	expireAt time.Time          // 过期时间, 分发或重放前已过期的推送被丢弃, 零值表示不过期
+	wait     bool               // 等待message server把消息推送到连接后再返回结果
+
+	itemsOnce sync.Once // 消息数组只序列化一次, 供所有需要json的通道共用
+	itemsJson []byte
+	itemsErr  error
+}
+
+// 登记未发送的message server
+func (pushJob *PushJob) skip(address string, reason string) {
+	if pushJob.outcome != nil {
+		pushJob.outcome.skip(address, reason)
+	}
+}
+
+func (pushJob *PushJob) expired() bool {
+	return !pushJob.expireAt.IsZero() && time.Now().After(pushJob.expireAt)
+}
+
+// 序列化后的消息数组, gRPC通道直接使用items, 不需要序列化
+func (pushJob *PushJob) encodeItems() ([]byte, error) {
+	pushJob.itemsOnce.Do(func() {
+		pushJob.itemsJson, pushJob.itemsErr = json.Marshal(pushJob.items)
+	})
+	return pushJob.itemsJson, pushJob.itemsErr
+}
+
+func (pushJob *PushJob) envelope() (envelope *types.PushEnvelope, err error) {
+	envelope = &types.PushEnvelope{
+		PushType: pushJob.pushType,
+		Room:     pushJob.roomId,
+		Rooms:    pushJob.roomIds,
+		User:     pushJob.identity,
+		Exclude:  pushJob.exclude,
+		Wait:     pushJob.wait,
+		Priority: pushJob.priority,
+	}
+	if !pushJob.expireAt.IsZero() {
+		envelope.ExpireAt = pushJob.expireAt.UnixNano() / int64(time.Millisecond)
+	}
+	if envelope.Items, err = pushJob.encodeItems(); err != nil {
+		return nil, err
+	}
+	return
 }
 
 type MessageConnectManager struct {
-	ServerConns  []*ServerConn // 到所有Message Server的连接数组
-	pendingChan  []chan byte   // message server的并发请求控制
+	rwMutex      sync.RWMutex
+	updateMutex  sync.Mutex    // 串行更新message server列表
+	serverConns  []*ServerConn // 到所有Message Server的连接数组, 列表变化时整体替换
+	discovery    Discovery     // message server发现, 仅http通道使用
+	transport    Transport     // 推送通道, http时逐个message server推送, 其余通道每个推送只发送一次
+	spill        *spillQueue   // 分发队列已满时的溢出队列, 未开启时为nil
 	dispatchChan chan *PushJob // 待分发的推送
+	priorityChan chan *PushJob // 待分发的高优先级推送, 分发协程优先处理
 	stopChan     chan byte     // 关闭连接
 }
 
 func InitConnManager() error {
 	var (
-		serverIdx         int
 		dispatchWorkerIdx int
-		serverConfig      config.MessageServerConfig
 		serverConnMgr     *MessageConnectManager
 		err               error
 	)
 
 	serverConnMgr = &MessageConnectManager{
-
-		ServerConns:  make([]*ServerConn, len(config.GlobalLogicConfig.MessageServerList)),
-		pendingChan:  make([]chan byte, len(config.GlobalLogicConfig.MessageServerList)),
-		dispatchChan: make(chan *PushJob, config.GlobalLogicConfig.MessageServerDispatchChannelSize),
+		dispatchChan: make(chan *PushJob, config.GlobalLogicConfig().MessageServerDispatchChannelSize),
+		priorityChan: make(chan *PushJob, config.GlobalLogicConfig().MessageServerDispatchChannelSize),
 		stopChan:     make(chan byte, 1),
 	}
 
-	for serverIdx, serverConfig = range config.GlobalLogicConfig.MessageServerList {
-		if serverConnMgr.ServerConns[serverIdx], err = InitMessageServerConn(&serverConfig); err != nil {
+	if clientCerts, err = certs.NewReloader(config.GlobalLogicConfig().MessageServerClientCert,
+		config.GlobalLogicConfig().MessageServerClientKey, config.GlobalLogicConfig().MessageServerCa); err != nil {
+		return err
+	}
+
+	if serverConnMgr.transport, err = InitBroadcastTransport(serverConnMgr); err != nil {
+		return err
+	}
+
+	// 分发队列已满的推送写入溢出队列, 有空位时按顺序放回分发队列
+	if config.GlobalLogicConfig().MessageServerSpillDir != "" {
+		if serverConnMgr.spill, err = openSpillQueue(spillDir("dispatch")); err != nil {
 			return err
 		}
-		serverConnMgr.pendingChan[serverIdx] = make(chan byte, config.GlobalLogicConfig.MessageServerMaxPendingCount)
+		serverConnMgr.spill.replayTo(serverConnMgr.redispatch)
 	}
 
-	for dispatchWorkerIdx = 0; dispatchWorkerIdx < config.GlobalLogicConfig.MessageServerDispatchWorkerCount; dispatchWorkerIdx++ {
+	// 发现message server, 列表变化时增删连接; 广播通道由message server主动订阅, 无需发现
+	if _, ok := serverConnMgr.transport.(*serverConnTransport); ok {
+		if err = serverConnMgr.startDiscovery(); err != nil {
+			return err
+		}
+	}
+
+	for dispatchWorkerIdx = 0; dispatchWorkerIdx < config.GlobalLogicConfig().MessageServerDispatchWorkerCount; dispatchWorkerIdx++ {
 		go serverConnMgr.dispatchWorkerMain(dispatchWorkerIdx)
 	}
 
@@ -60,7 +133,147 @@ func InitConnManager() error {
 	return nil
 }
 
-func (serverConnMgr *MessageConnectManager) PushAll(items []json.RawMessage) (err error) {
+func (serverConnMgr *MessageConnectManager) startDiscovery() (err error) {
+	if serverConnMgr.discovery, err = InitDiscovery(&config.GlobalLogicConfig().MessageServerDiscovery); err != nil {
+		return
+	}
+	return serverConnMgr.discovery.Start(func(serverList []config.MessageServerConfig) {
+		if err := serverConnMgr.UpdateServers(serverList); err != nil {
+			log.Warn("更新message server列表失败：" + err.Error())
+		}
+	})
+}
+
+// 所有message server的健康状态
+func (serverConnMgr *MessageConnectManager) ServerStatuses() (statuses []ServerStatus) {
+	var (
+		serverConn *ServerConn
+	)
+	statuses = []ServerStatus{}
+	for _, serverConn = range serverConnMgr.ServerConns() {
+		statuses = append(statuses, serverConn.Status())
+	}
+	return
+}
+
+// 当前的message server连接
+func (serverConnMgr *MessageConnectManager) ServerConns() []*ServerConn {
+	serverConnMgr.rwMutex.RLock()
+	defer serverConnMgr.rwMutex.RUnlock()
+
+	return serverConnMgr.serverConns
+}
+
+// 按新的列表增删message server连接, 已存在的连接保持不变
+// 先建立所有新连接再整体替换列表, 任一连接建立失败时保持原列表不变
+// 被移除或重建的连接不再接受新的推送, 等待进行中的推送完成后关闭; 重建的连接沿用原溢出队列, 被移除的连接的积压转交给其他message server
+func (serverConnMgr *MessageConnectManager) UpdateServers(serverList []config.MessageServerConfig) (err error) {
+	var (
+		serverIdx    int
+		serverConn   *ServerConn
+		oldConn      *ServerConn
+		existed      bool
+		address2Conn = make(map[string]*ServerConn)
+		serverConns  []*ServerConn
+		created      []*ServerConn
+		replaced     = make(map[string]*ServerConn) // 被重建的旧连接, 按地址
+		kept         = make(map[string]bool)
+		spill        *spillQueue
+	)
+
+	serverConnMgr.updateMutex.Lock()
+	defer serverConnMgr.updateMutex.Unlock()
+
+	for _, serverConn = range serverConnMgr.ServerConns() {
+		address2Conn[serverConn.address] = serverConn
+	}
+
+	for serverIdx, _ = range serverList {
+		if kept[serverList[serverIdx].Address()] {
+			continue
+		}
+		spill = nil
+		// 协议或gRPC端口变化, 重建连接
+		if oldConn, existed = address2Conn[serverList[serverIdx].Address()]; existed && !oldConn.sameConfig(&serverList[serverIdx]) {
+			spill = oldConn.spill
+			existed = false
+		}
+		if existed {
+			serverConn = oldConn
+		} else {
+			if serverConn, err = InitMessageServerConn(&serverList[serverIdx], spill); err != nil {
+				// 关闭本次已建立的连接, 沿用旧连接溢出队列的不关闭队列
+				for _, serverConn = range created {
+					serverConn.close(replaced[serverConn.address] == nil)
+				}
+				return
+			}
+			created = append(created, serverConn)
+			if spill != nil {
+				replaced[serverConn.address] = oldConn
+			}
+		}
+		kept[serverConn.address] = true
+		serverConns = append(serverConns, serverConn)
+	}
+
+	serverConnMgr.rwMutex.Lock()
+	serverConnMgr.serverConns = serverConns
+	serverConnMgr.rwMutex.Unlock()
+
+	for _, serverConn = range created {
+		if oldConn = replaced[serverConn.address]; oldConn != nil {
+			log.Info("message server配置变化, 重建连接：" + serverConn.address)
+			serverConn.spill.replayTo(serverConn.replay)
+			go serverConnMgr.retire(oldConn, false)
+		} else {
+			log.Info("添加message server：" + serverConn.address)
+		}
+	}
+	for _, serverConn = range address2Conn {
+		if !kept[serverConn.address] {
+			log.Info("移除message server：" + serverConn.address)
+			go serverConnMgr.retire(serverConn, true)
+		}
+	}
+	return
+}
+
+// 等待被移除或重建的连接上进行中的推送完成后关闭
+// removed为true时message server已移除, 溢出队列中的积压转交给一个仍在列表中的message server
+func (serverConnMgr *MessageConnectManager) retire(serverConn *ServerConn, removed bool) {
+	var (
+		target *ServerConn
+		moved  int
+		err    error
+	)
+	serverConn.drain()
+	if !removed || serverConn.spill == nil {
+		serverConn.close(false)
+		return
+	}
+
+	for _, target = range serverConnMgr.ServerConns() {
+		if target.spill != nil {
+			break
+		}
+		target = nil
+	}
+	if target == nil {
+		log.Warn("没有可以接管溢出队列的message server, 积压保留在磁盘上：" + serverConn.address)
+		serverConn.close(true)
+		return
+	}
+	moved, err = serverConn.spill.handOff(target.spill)
+	if err != nil {
+		log.Warn("转交溢出队列失败, 剩余的积压保留在磁盘上：" + serverConn.address + " " + err.Error())
+	} else if moved > 0 {
+		log.Info("溢出队列已转交：" + serverConn.address + " -> " + target.address + " " + strconv.Itoa(moved))
+	}
+	serverConn.close(false)
+}
+
+func (serverConnMgr *MessageConnectManager) PushAll(items []json.RawMessage, exclude *types.PushExclude) (err error) {
 	var (
 		pushJob *PushJob
 	)
@@ -68,17 +281,18 @@ func (serverConnMgr *MessageConnectManager) PushAll(items []json.RawMessage) (er
 	pushJob = &PushJob{
 		pushType: types.PUSH_TYPE_ALL,
 		items:    items,
+		exclude:  exclude,
 	}
 
-	select {
-	case serverConnMgr.dispatchChan <- pushJob:
-	default:
-		err = utils.LogicDisPatchChannelFull
-	}
-	return
+	return serverConnMgr.dispatch(pushJob)
 }
 
-func (serverConnMgr *MessageConnectManager) PushRoom(roomId string, items []json.RawMessage) (err error) {
+func (serverConnMgr *MessageConnectManager) PushRoom(roomId string, items []json.RawMessage, exclude *types.PushExclude) (err error) {
+	return serverConnMgr.PushRoomWithOutcome(roomId, items, exclude, nil)
+}
+
+// 房间推送, 所有message server都有结果后回调onOutcome; 返回错误时不会回调
+func (serverConnMgr *MessageConnectManager) PushRoomWithOutcome(roomId string, items []json.RawMessage, exclude *types.PushExclude, onOutcome OutcomeCallback) (err error) {
 	var (
 		pushJob *PushJob
 	)
@@ -87,59 +301,222 @@ func (serverConnMgr *MessageConnectManager) PushRoom(roomId string, items []json
 		pushType: types.PUSH_TYPE_ROOM,
 		roomId:   roomId,
 		items:    items,
+		exclude:  exclude,
+	}
+	if onOutcome != nil {
+		pushJob.outcome = &outcomeCollector{callback: onOutcome}
+	}
+
+	return serverConnMgr.dispatch(pushJob)
+}
+
+func (serverConnMgr *MessageConnectManager) PushRooms(roomIds []string, items []json.RawMessage, exclude *types.PushExclude) (err error) {
+	var (
+		pushJob *PushJob
+	)
+
+	pushJob = &PushJob{
+		pushType: types.PUSH_TYPE_ROOMS,
+		roomIds:  roomIds,
+		items:    items,
+		exclude:  exclude,
+	}
+
+	return serverConnMgr.dispatch(pushJob)
+}
+
+func (serverConnMgr *MessageConnectManager) PushUser(identity string, items []json.RawMessage, exclude *types.PushExclude) (err error) {
+	var (
+		pushJob *PushJob
+	)
+
+	pushJob = &PushJob{
+		pushType: types.PUSH_TYPE_USER,
+		identity: identity,
+		items:    items,
+		exclude:  exclude,
+	}
+
+	return serverConnMgr.dispatch(pushJob)
+}
+
+// 放入待分发队列, 队列已满时不等待
+// 开启溢出队列时, 队列已满或溢出队列中还有积压的推送写入溢出队列, 推送结果立即以spilled回调
+func (serverConnMgr *MessageConnectManager) dispatch(pushJob *PushJob) (err error) {
+	var (
+		spilled bool
+	)
+	select {
+	case <-serverConnMgr.stopChan:
+		return utils.LogicConnectClosed
+	default:
+	}
+
+	// 高优先级推送不排在溢出队列的积压之后, 优先级队列已满时按普通推送处理
+	if pushJob.priority {
+		select {
+		case serverConnMgr.priorityChan <- pushJob:
+			return
+		default:
+		}
+	}
+
+	if serverConnMgr.spill != nil {
+		if spilled, err = serverConnMgr.spill.appendIfPending(pushJob); err != nil {
+			log.Warn("写入溢出队列失败：" + err.Error())
+			return utils.LogicDisPatchChannelFull
+		}
+		if spilled {
+			serverConnMgr.spilled(pushJob)
+			return
+		}
 	}
 
 	select {
 	case serverConnMgr.dispatchChan <- pushJob:
 	default:
-		err = utils.LogicDisPatchChannelFull
+		if serverConnMgr.spill == nil {
+			return utils.LogicDisPatchChannelFull
+		}
+		if err = serverConnMgr.spill.append(pushJob); err != nil {
+			log.Warn("写入溢出队列失败：" + err.Error())
+			return utils.LogicDisPatchChannelFull
+		}
+		serverConnMgr.spilled(pushJob)
 	}
 	return
 }
 
+// 推送已写入分发溢出队列, 重放时不再回调
+func (serverConnMgr *MessageConnectManager) spilled(pushJob *PushJob) {
+	if pushJob.outcome != nil {
+		pushJob.skip("", SKIPPED_SPILLED)
+		pushJob.outcome.start(0)
+	}
+}
+
+// 溢出队列中的推送放回分发队列, 队列已满时返回false, 稍后重放
+func (serverConnMgr *MessageConnectManager) redispatch(pushJob *PushJob) bool {
+	select {
+	case serverConnMgr.dispatchChan <- pushJob:
+		return true
+	default:
+		return false
+	}
+}
+
 // 推送给一个message server
-func (serverConnMgr *MessageConnectManager) doPush(gatewayIdx int, pushJob *PushJob, itemsJson []byte) {
-	if pushJob.pushType == types.PUSH_TYPE_ALL {
-		serverConnMgr.ServerConns[gatewayIdx].PushAll(itemsJson)
-	} else if pushJob.pushType == types.PUSH_TYPE_ROOM {
-		serverConnMgr.ServerConns[gatewayIdx].PushRoom(pushJob.roomId, itemsJson)
+func (serverConnMgr *MessageConnectManager) doPush(serverConn *ServerConn, pushJob *PushJob) {
+	var (
+		reached int
+		err     error
+	)
+	reached, err = serverConn.Push(pushJob)
+	// 重试后仍失败, 写入溢出队列等待恢复后重放
+	if retryable(err) && serverConn.spillPush(pushJob) {
+		if pushJob.outcome != nil {
+			pushJob.outcome.doneSkipped(serverConn.address, SKIPPED_SPILLED)
+		}
+	} else if pushJob.outcome != nil {
+		pushJob.outcome.done(serverConn.address, reached, err)
 	}
 
 	// 释放名额
-	<-serverConnMgr.pendingChan[gatewayIdx]
+	<-serverConn.pendingChan
+	serverConn.release()
 }
 
 // 消息分发协程
 func (serverConnMgr *MessageConnectManager) dispatchWorkerMain(dispatchWorkerIdx int) {
 	var (
-		pushJob   *PushJob
-		serverIdx int
-		itemsJson []byte
-		err       error
+		pushJob         *PushJob
+		serverTransport *serverConnTransport
+		ok              bool
+		reached         int
+		err             error
 	)
 	for {
+		// 优先取高优先级推送
 		select {
-		case <-serverConnMgr.stopChan:
-			log.Info("worker 终止")
-			return
-		case pushJob = <-serverConnMgr.dispatchChan:
-			// 序列化
-			if itemsJson, err = json.Marshal(pushJob.items); err != nil {
-				continue
+		case pushJob = <-serverConnMgr.priorityChan:
+		default:
+			select {
+			case <-serverConnMgr.stopChan:
+				log.Info("worker 终止")
+				return
+			case pushJob = <-serverConnMgr.priorityChan:
+			case pushJob = <-serverConnMgr.dispatchChan:
 			}
-			// 分发到所有message server
-			for serverIdx = 0; serverIdx < len(serverConnMgr.ServerConns); serverIdx++ {
-				select {
-				case serverConnMgr.pendingChan[serverIdx] <- 1: // 并发控制
-					go serverConnMgr.doPush(serverIdx, pushJob, itemsJson)
-				default: // 并发已满, 直接丢弃
-				}
+		}
+		// 排队期间已过期
+		if pushJob.expired() {
+			if pushJob.outcome != nil {
+				pushJob.skip("", SKIPPED_EXPIRED)
+				pushJob.outcome.start(0)
 			}
+			continue
+		}
+		// 分发到所有message server, 房间推送跳过没有订阅者的message server, 熔断的message server计入skipped后跳过
+		// 开启溢出队列时, 熔断、并发已满或已有积压的message server写入溢出队列
+		if serverTransport, ok = serverConnMgr.transport.(*serverConnTransport); ok {
+			serverTransport.dispatch(pushJob)
+			continue
+		}
+		// 广播通道只发送一次
+		if reached, err = serverConnMgr.transport.Push(pushJob); err != nil {
+			log.Warn("推送通道发送失败：" + err.Error())
+		}
+		if pushJob.outcome != nil {
+			pushJob.outcome.start(1)
+			pushJob.outcome.done(config.GlobalLogicConfig().Backbone, reached, err)
+		}
+	}
+}
+
+// 是否立即推送给message server, 占用并发名额后返回true; 否则登记skipped, 可能已写入溢出队列
+func (serverConnMgr *MessageConnectManager) admit(serverConn *ServerConn, pushJob *PushJob) bool {
+	if !serverConn.hasSubscriber(pushJob) {
+		pushJob.skip(serverConn.address, SKIPPED_NO_SUBSCRIBER)
+		return false
+	}
+	if serverConn.spillBehindBacklog(pushJob) {
+		pushJob.skip(serverConn.address, SKIPPED_SPILLED)
+		return false
+	}
+	if !serverConn.breaker.allow() {
+		if serverConn.spillPush(pushJob) {
+			pushJob.skip(serverConn.address, SKIPPED_SPILLED)
+		} else {
+			pushJob.skip(serverConn.address, SKIPPED_CIRCUIT_OPEN)
 		}
+		return false
+	}
+	select {
+	case serverConn.pendingChan <- 1: // 并发控制
+		return true
+	default: // 并发已满, 写入溢出队列或直接丢弃
+		if serverConn.spillPush(pushJob) {
+			serverConn.breaker.release()
+			pushJob.skip(serverConn.address, SKIPPED_SPILLED)
+		} else {
+			serverConn.breaker.drop()
+			pushJob.skip(serverConn.address, SKIPPED_PENDING_FULL)
+		}
+		return false
 	}
 }
 
 func (serverConnMgr *MessageConnectManager) MessageConnectClose() {
-	serverConnMgr.ServerConns = nil
+	if serverConnMgr.discovery != nil {
+		serverConnMgr.discovery.Close()
+	}
+	serverConnMgr.transport.Close()
+	if serverConnMgr.spill != nil {
+		serverConnMgr.spill.close()
+	}
+	clientCerts.Close()
+	serverConnMgr.rwMutex.Lock()
+	serverConnMgr.serverConns = nil
+	serverConnMgr.rwMutex.Unlock()
 	close(serverConnMgr.stopChan)
 }
@@ -0,0 +1,230 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/common/log"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// message server发现方式
+const (
+	DISCOVERY_STATIC = "static" // 使用配置文件中的messageServerList, 支持热更新
+	DISCOVERY_FILE   = "file"   // 监听一个json文件, 内容为[{"hostname": "", "port": 7788}]
+	DISCOVERY_DNS    = "dns"    // 定时解析DNS, 支持SRV记录和k8s headless service
+)
+
+// message server发现, 列表变化时回调update, 由连接管理器增删连接
+type Discovery interface {
+	Start(update func(serverList []config.MessageServerConfig)) error
+	Close()
+}
+
+func InitDiscovery(discoveryConfig *config.DiscoveryConfig) (discovery Discovery, err error) {
+	switch discoveryConfig.Type {
+	case "", DISCOVERY_STATIC:
+		discovery = &staticDiscovery{}
+	case DISCOVERY_FILE:
+		if discoveryConfig.File == "" {
+			return nil, errors.New("discovery file is empty")
+		}
+		discovery = &fileDiscovery{file: discoveryConfig.File, stopChan: make(chan byte)}
+	case DISCOVERY_DNS:
+		if discoveryConfig.DnsName == "" {
+			return nil, errors.New("discovery dns name is empty")
+		}
+		dnsConfig := *discoveryConfig
+		if dnsConfig.RefreshInterval <= 0 {
+			dnsConfig.RefreshInterval = 10
+		}
+		discovery = &dnsDiscovery{config: dnsConfig, stopChan: make(chan byte)}
+	default:
+		return nil, errors.New("unknown discovery type: " + discoveryConfig.Type)
+	}
+	return
+}
+
+// 静态列表
+type staticDiscovery struct {
+}
+
+func (discovery *staticDiscovery) Start(update func(serverList []config.MessageServerConfig)) error {
+	update(config.GlobalLogicConfig().MessageServerList)
+
+	// message server列表热更新
+	config.OnReload(func(oldConfig, newConfig *config.Config) {
+		if !reflect.DeepEqual(oldConfig.MessageServerList, newConfig.MessageServerList) {
+			update(newConfig.MessageServerList)
+		}
+	})
+	return nil
+}
+
+func (discovery *staticDiscovery) Close() {
+}
+
+// 监听文件
+type fileDiscovery struct {
+	file     string
+	watcher  *fsnotify.Watcher
+	stopChan chan byte
+}
+
+func (discovery *fileDiscovery) Start(update func(serverList []config.MessageServerConfig)) (err error) {
+	var (
+		serverList []config.MessageServerConfig
+	)
+	if serverList, err = discovery.load(); err != nil {
+		return
+	}
+	update(serverList)
+
+	// 监听所在目录, 兼容编辑器替换文件和k8s configmap的软链接切换
+	if discovery.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return
+	}
+	if err = discovery.watcher.Add(filepath.Dir(discovery.file)); err != nil {
+		discovery.watcher.Close()
+		return
+	}
+	go discovery.watchMain(serverList, update)
+	return
+}
+
+func (discovery *fileDiscovery) watchMain(serverList []config.MessageServerConfig, update func(serverList []config.MessageServerConfig)) {
+	var (
+		newList []config.MessageServerConfig
+		err     error
+	)
+	for {
+		select {
+		case <-discovery.stopChan:
+			return
+		case err = <-discovery.watcher.Errors:
+			log.Warn("监听message server列表文件失败：" + err.Error())
+		case <-discovery.watcher.Events:
+			// 文件内容不合法时保持原列表
+			if newList, err = discovery.load(); err != nil {
+				log.Warn("读取message server列表文件失败：" + err.Error())
+				continue
+			}
+			if reflect.DeepEqual(serverList, newList) {
+				continue
+			}
+			serverList = newList
+			update(serverList)
+		}
+	}
+}
+
+func (discovery *fileDiscovery) load() (serverList []config.MessageServerConfig, err error) {
+	var (
+		buf []byte
+	)
+	if buf, err = ioutil.ReadFile(discovery.file); err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &serverList)
+	return
+}
+
+func (discovery *fileDiscovery) Close() {
+	close(discovery.stopChan)
+	if discovery.watcher != nil {
+		discovery.watcher.Close()
+	}
+}
+
+// 定时解析DNS
+type dnsDiscovery struct {
+	config   config.DiscoveryConfig
+	stopChan chan byte
+}
+
+func (discovery *dnsDiscovery) Start(update func(serverList []config.MessageServerConfig)) (err error) {
+	var (
+		serverList []config.MessageServerConfig
+	)
+	if serverList, err = discovery.lookup(); err != nil {
+		return
+	}
+	update(serverList)
+	go discovery.refreshMain(serverList, update)
+	return
+}
+
+func (discovery *dnsDiscovery) refreshMain(serverList []config.MessageServerConfig, update func(serverList []config.MessageServerConfig)) {
+	var (
+		ticker  = time.NewTicker(time.Duration(discovery.config.RefreshInterval) * time.Second)
+		newList []config.MessageServerConfig
+		err     error
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-discovery.stopChan:
+			return
+		case <-ticker.C:
+			// 解析失败时保持原列表, 避免DNS抖动导致摘除所有message server
+			if newList, err = discovery.lookup(); err != nil {
+				log.Warn("解析message server域名失败：" + err.Error())
+				continue
+			}
+			if reflect.DeepEqual(serverList, newList) {
+				continue
+			}
+			serverList = newList
+			update(serverList)
+		}
+	}
+}
+
+// SRV记录使用记录中的端口, 否则解析所有A记录并使用配置的端口
+func (discovery *dnsDiscovery) lookup() (serverList []config.MessageServerConfig, err error) {
+	var (
+		srvs  []*net.SRV
+		srv   *net.SRV
+		hosts []string
+		host  string
+	)
+	if discovery.config.DnsSrv {
+		if _, srvs, err = net.LookupSRV("", "", discovery.config.DnsName); err != nil {
+			return
+		}
+		for _, srv = range srvs {
+			serverList = append(serverList, config.MessageServerConfig{
+				Hostname: strings.TrimSuffix(srv.Target, "."),
+				Port:     int(srv.Port),
+				Scheme:   discovery.config.Scheme,
+			})
+		}
+	} else {
+		if hosts, err = net.LookupHost(discovery.config.DnsName); err != nil {
+			return
+		}
+		for _, host = range hosts {
+			serverList = append(serverList, config.MessageServerConfig{
+				Hostname: host,
+				Port:     discovery.config.DnsPort,
+				Scheme:   discovery.config.Scheme,
+			})
+		}
+	}
+	// 排序后比较, 避免DNS返回顺序变化引起无意义的更新
+	sort.Slice(serverList, func(i, j int) bool {
+		return serverList[i].Address() < serverList[j].Address()
+	})
+	return
+}
+
+func (discovery *dnsDiscovery) Close() {
+	close(discovery.stopChan)
+}
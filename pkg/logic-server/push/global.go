@@ -1,6 +1,12 @@
 package push
 
+import "message-center/pkg/certs"
+
 var (
 	GlobalHttpServer     *Service
 	GlobalConnectManager *MessageConnectManager
+	GlobalScheduler      *Scheduler // 定时推送调度, 未初始化mongodb时为nil
+
+	// 连接message server使用的客户端证书和CA, 所有连接共用, 文件变化后自动重新加载
+	clientCerts *certs.Reloader
 )
@@ -0,0 +1,333 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/rpc"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	grpcStreamBatchSize     = 64              // 流式推送每批最多携带的推送数
+	grpcStreamRetryInterval = 3 * time.Second // 流断开后的重建间隔
+)
+
+// 一次等待回复的流式推送
+type streamPush struct {
+	req       *rpc.PushRequest
+	replyChan chan *rpc.PushReply // 未收到回复即被关闭表示流已断开, 调用方改用一元调用
+}
+
+// 与message server之间的gRPC通讯
+// 推送优先通过双向流批量发送, 流不可用时退化为一元调用
+type grpcConn struct {
+	address  string
+	conn     *grpc.ClientConn
+	client   rpc.MessageServerClient
+	sendChan chan *streamPush // 待发送的流式推送
+
+	mutex    sync.Mutex
+	seq      uint64                           // 批次序号
+	waiting  map[uint64][]chan *rpc.PushReply // 已发送未回复的批次
+	stream   rpc.MessageServer_StreamClient   // 当前的流, nil表示不可用
+	cancel   context.CancelFunc               // 关闭当前的流
+	stopChan chan byte
+}
+
+func initGrpcConn(address string, useTLS bool) (grpcConnection *grpcConn, err error) {
+	var (
+		conn *grpc.ClientConn
+	)
+	// 与HTTP使用同一套客户端证书和CA; 未启用TLS的message server使用明文
+	if conn, err = grpc.Dial(address, grpcDialOption(address, useTLS)); err != nil {
+		return
+	}
+
+	grpcConnection = &grpcConn{
+		address:  address,
+		conn:     conn,
+		client:   rpc.NewMessageServerClient(conn),
+		sendChan: make(chan *streamPush, config.GlobalLogicConfig().MessageServerMaxPendingCount),
+		waiting:  make(map[uint64][]chan *rpc.PushReply),
+		stopChan: make(chan byte),
+	}
+	go grpcConnection.streamMain()
+	return
+}
+
+func grpcDialOption(address string, useTLS bool) grpc.DialOption {
+	var (
+		hostname string
+	)
+	if useTLS || config.GlobalLogicConfig().MessageServerGrpcTLS {
+		hostname, _, _ = net.SplitHostPort(address)
+		return grpc.WithTransportCredentials(credentials.NewTLS(clientCerts.ClientConfig(hostname)))
+	}
+	return grpc.WithInsecure()
+}
+
+// 每次推送生成新的推送ID, 重试和流断开后改用一元调用时保持不变, 由message server去重
+func (grpcConnection *grpcConn) newRequest(pushJob *PushJob) *rpc.PushRequest {
+	return &rpc.PushRequest{
+		PushType: int32(pushJob.pushType),
+		Room:     pushJob.roomId,
+		Rooms:    pushJob.roomIds,
+		User:     pushJob.identity,
+		Exclude:  rpc.NewExclude(pushJob.exclude),
+		Items:    rpc.NewItems(pushJob.items),
+		Wait:     pushJob.wait,
+		PushId:   bson.NewObjectId().Hex(),
+	}
+}
+
+// 推送失败时按退避策略重试, 错误码按HTTP状态码换算判断是否重试
+// 请求已发出但等待回复超时也会重试, 同一推送ID在message server上只处理一次, 不会重复推送
+func (grpcConnection *grpcConn) Push(pushJob *PushJob) (reached int, err error) {
+	var (
+		req *rpc.PushRequest
+	)
+	req = grpcConnection.newRequest(pushJob)
+
+	err = retryWithBackoff(grpcConnection.address, func() error {
+		var (
+			reply *rpc.PushReply
+			err   error
+		)
+		if reply, err = grpcConnection.pushOnce(req); err != nil {
+			return err
+		}
+		if status := types.PushStatus(reply.Code); status != http.StatusOK {
+			return &StatusError{Address: grpcConnection.address, Status: status, Code: reply.Code, Message: reply.Message}
+		}
+		reached = int(reply.Reached)
+		return nil
+	})
+	return
+}
+
+func (grpcConnection *grpcConn) pushOnce(req *rpc.PushRequest) (reply *rpc.PushReply, err error) {
+	var (
+		push    *streamPush
+		timeout = time.Duration(config.GlobalLogicConfig().MessageServerTimeout) * time.Millisecond
+		ctx     context.Context
+		cancel  context.CancelFunc
+		ok      bool
+	)
+
+	// 优先走流, 队列已满时直接一元调用
+	push = &streamPush{req: req, replyChan: make(chan *rpc.PushReply, 1)}
+	select {
+	case grpcConnection.sendChan <- push:
+		select {
+		case reply, ok = <-push.replyChan:
+			if ok && reply != nil {
+				return
+			}
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("%w: %s stream timeout", utils.MessageServerStatusError, grpcConnection.address)
+		}
+	default:
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	switch req.PushType {
+	case types.PUSH_TYPE_ALL:
+		return grpcConnection.client.PushAll(ctx, req)
+	case types.PUSH_TYPE_ROOM:
+		return grpcConnection.client.PushRoom(ctx, req)
+	case types.PUSH_TYPE_ROOMS:
+		return grpcConnection.client.PushRooms(ctx, req)
+	case types.PUSH_TYPE_USER:
+		return grpcConnection.client.PushUser(ctx, req)
+	}
+	return nil, fmt.Errorf("unknown push type %d", req.PushType)
+}
+
+// 打开流
+func (grpcConnection *grpcConn) openStream() (stream rpc.MessageServer_StreamClient, err error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	if stream, err = grpcConnection.client.Stream(ctx); err != nil {
+		cancel()
+		return
+	}
+
+	grpcConnection.mutex.Lock()
+	grpcConnection.stream = stream
+	grpcConnection.cancel = cancel
+	grpcConnection.mutex.Unlock()
+
+	go grpcConnection.recvMain(stream)
+	return
+}
+
+// 流断开: 未回复的推送改用一元调用
+func (grpcConnection *grpcConn) closeStream(stream rpc.MessageServer_StreamClient) {
+	var (
+		replyChans []chan *rpc.PushReply
+		replyChan  chan *rpc.PushReply
+	)
+	grpcConnection.mutex.Lock()
+	defer grpcConnection.mutex.Unlock()
+
+	if grpcConnection.stream != stream {
+		return
+	}
+	grpcConnection.cancel()
+	grpcConnection.stream = nil
+	for _, replyChans = range grpcConnection.waiting {
+		for _, replyChan = range replyChans {
+			close(replyChan)
+		}
+	}
+	grpcConnection.waiting = make(map[uint64][]chan *rpc.PushReply)
+}
+
+// 批量发送协程: 取出队列中的推送合并成一批发送
+func (grpcConnection *grpcConn) streamMain() {
+	var (
+		stream     rpc.MessageServer_StreamClient
+		push       *streamPush
+		req        *rpc.StreamRequest
+		replyChans []chan *rpc.PushReply
+		replyChan  chan *rpc.PushReply
+		err        error
+	)
+	for {
+		select {
+		case <-grpcConnection.stopChan:
+			return
+		case push = <-grpcConnection.sendChan:
+		}
+
+		// 流不可用, 退化为一元调用, 间隔一段时间后重建
+		grpcConnection.mutex.Lock()
+		stream = grpcConnection.stream
+		grpcConnection.mutex.Unlock()
+		if stream == nil {
+			if stream, err = grpcConnection.openStream(); err != nil {
+				log.Warn("建立gRPC推送流失败：" + grpcConnection.address + " " + err.Error())
+				close(push.replyChan)
+				grpcConnection.drainUntil(time.Now().Add(grpcStreamRetryInterval))
+				continue
+			}
+		}
+
+		// 合并队列中已有的推送
+		req = &rpc.StreamRequest{Pushes: []*rpc.PushRequest{push.req}}
+		replyChans = []chan *rpc.PushReply{push.replyChan}
+	BATCH:
+		for len(req.Pushes) < grpcStreamBatchSize {
+			select {
+			case push = <-grpcConnection.sendChan:
+				req.Pushes = append(req.Pushes, push.req)
+				replyChans = append(replyChans, push.replyChan)
+			default:
+				break BATCH
+			}
+		}
+
+		grpcConnection.mutex.Lock()
+		grpcConnection.seq++
+		req.Seq = grpcConnection.seq
+		grpcConnection.waiting[req.Seq] = replyChans
+		grpcConnection.mutex.Unlock()
+
+		if err = stream.Send(req); err != nil {
+			log.Warn("gRPC推送流发送失败：" + grpcConnection.address + " " + err.Error())
+			grpcConnection.closeStream(stream)
+			// 流已被接收协程关闭时, 本批次是关闭后才登记的, 仍需通知调用方
+			grpcConnection.mutex.Lock()
+			if replyChans = grpcConnection.waiting[req.Seq]; replyChans != nil {
+				delete(grpcConnection.waiting, req.Seq)
+				for _, replyChan = range replyChans {
+					close(replyChan)
+				}
+			}
+			grpcConnection.mutex.Unlock()
+		}
+	}
+}
+
+// 流重建间隔内, 队列中的推送全部退化为一元调用
+func (grpcConnection *grpcConn) drainUntil(deadline time.Time) {
+	var (
+		push *streamPush
+	)
+	for time.Now().Before(deadline) {
+		select {
+		case <-grpcConnection.stopChan:
+			return
+		case push = <-grpcConnection.sendChan:
+			close(push.replyChan)
+		case <-time.After(time.Until(deadline)):
+			return
+		}
+	}
+}
+
+// 接收协程: 按批次序号回复调用方, 收到CLOSING后关闭流
+func (grpcConnection *grpcConn) recvMain(stream rpc.MessageServer_StreamClient) {
+	var (
+		event      *rpc.StreamEvent
+		replyChans []chan *rpc.PushReply
+		replyIdx   int
+		err        error
+	)
+	for {
+		if event, err = stream.Recv(); err != nil {
+			grpcConnection.closeStream(stream)
+			return
+		}
+
+		if event.Type == rpc.STREAM_EVENT_CLOSING {
+			log.Info("message server即将关闭, 关闭gRPC推送流：" + grpcConnection.address)
+			grpcConnection.closeStream(stream)
+			return
+		}
+		if event.Type != rpc.STREAM_EVENT_ACK {
+			continue
+		}
+
+		grpcConnection.mutex.Lock()
+		replyChans = grpcConnection.waiting[event.Seq]
+		delete(grpcConnection.waiting, event.Seq)
+		grpcConnection.mutex.Unlock()
+
+		for replyIdx, _ = range replyChans {
+			if replyIdx < len(event.Replies) {
+				replyChans[replyIdx] <- event.Replies[replyIdx]
+			}
+			close(replyChans[replyIdx])
+		}
+	}
+}
+
+func (grpcConnection *grpcConn) Close() {
+	var (
+		stream rpc.MessageServer_StreamClient
+	)
+	close(grpcConnection.stopChan)
+
+	grpcConnection.mutex.Lock()
+	stream = grpcConnection.stream
+	grpcConnection.mutex.Unlock()
+	if stream != nil {
+		grpcConnection.closeStream(stream)
+	}
+	_ = grpcConnection.conn.Close()
+}
@@ -0,0 +1,208 @@
+package push
+
+import (
+	"fmt"
+	"github.com/prometheus/common/log"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/utils"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 熔断状态
+const (
+	CIRCUIT_CLOSED    = "CLOSED"    // 正常推送
+	CIRCUIT_OPEN      = "OPEN"      // 连续失败, 跳过推送
+	CIRCUIT_HALF_OPEN = "HALF_OPEN" // 熔断时间已过或探测成功, 放行一个试探推送, 成功则恢复
+)
+
+// message server健康状态, 由logic的/servers接口输出
+type ServerStatus struct {
+	Address             string    `json:"address"`
+	Protocol            string    `json:"protocol"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastChange          time.Time `json:"lastChange"` // 最近一次状态变化时间
+	LastProbe           time.Time `json:"lastProbe"`  // 最近一次主动探测时间
+	LastProbeError      string    `json:"lastProbeError,omitempty"`
+	Skipped             uint64    `json:"skipped"`  // 熔断期间跳过的推送数
+	Dropped             uint64    `json:"dropped"`  // 并发已满丢弃的推送数
+	Spilled             uint64    `json:"spilled"`  // 写入溢出队列的推送数
+	Replayed            uint64    `json:"replayed"` // 从溢出队列重放的推送数
+}
+
+// 每个message server一个熔断器
+// 只有推送结果计入连续失败次数, 达到阈值后熔断; 主动探测成功只会让熔断提前进入半开, 仍由试探推送决定是否恢复
+type circuitBreaker struct {
+	mutex               sync.Mutex
+	state               string
+	consecutiveFailures int
+	lastError           string
+	lastChange          time.Time
+	lastProbe           time.Time
+	lastProbeError      string
+	trialInFlight       bool // 半开状态下已放行一个试探推送
+
+	skipped uint64 // 原子操作
+	dropped uint64 // 原子操作
+}
+
+func initCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		state:      CIRCUIT_CLOSED,
+		lastChange: time.Now(),
+	}
+}
+
+// 切换状态, 需持有锁
+func (breaker *circuitBreaker) setState(state string) {
+	if breaker.state == state {
+		return
+	}
+	breaker.state = state
+	breaker.lastChange = time.Now()
+	breaker.trialInFlight = false
+}
+
+// 是否放行本次推送, 不放行时计入skipped
+func (breaker *circuitBreaker) allow() bool {
+	if breaker.permit() {
+		return true
+	}
+	atomic.AddUint64(&breaker.skipped, 1)
+	return false
+}
+
+// 是否放行本次推送, 不计入skipped, 供溢出队列重放时判断是否已恢复
+func (breaker *circuitBreaker) permit() bool {
+	var (
+		openTime = time.Duration(config.GlobalLogicConfig().MessageServerBreakerOpenTime) * time.Millisecond
+	)
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	// 熔断时间已过, 进入半开
+	if breaker.state == CIRCUIT_OPEN && time.Since(breaker.lastChange) >= openTime {
+		breaker.setState(CIRCUIT_HALF_OPEN)
+	}
+
+	switch breaker.state {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_HALF_OPEN:
+		if !breaker.trialInFlight {
+			breaker.trialInFlight = true
+			return true
+		}
+	}
+	return false
+}
+
+// 并发已满丢弃, 若是半开状态的试探推送则让出试探名额
+func (breaker *circuitBreaker) drop() {
+	atomic.AddUint64(&breaker.dropped, 1)
+	breaker.release()
+}
+
+// 放行后未发送, 若是半开状态的试探推送则让出试探名额
+func (breaker *circuitBreaker) release() {
+	breaker.mutex.Lock()
+	breaker.trialInFlight = false
+	breaker.mutex.Unlock()
+}
+
+// 记录推送结果
+func (breaker *circuitBreaker) record(err error) {
+	var (
+		threshold = config.GlobalLogicConfig().MessageServerBreakerThreshold
+	)
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if err == nil {
+		breaker.consecutiveFailures = 0
+		breaker.setState(CIRCUIT_CLOSED)
+		return
+	}
+
+	breaker.consecutiveFailures++
+	breaker.lastError = err.Error()
+	// 半开状态下试探失败, 或连续失败达到阈值, 熔断
+	if breaker.state == CIRCUIT_HALF_OPEN || (threshold > 0 && breaker.consecutiveFailures >= threshold) {
+		if breaker.state != CIRCUIT_OPEN {
+			log.Warn(fmt.Sprintf("message server连续失败%d次, 熔断：%s", breaker.consecutiveFailures, breaker.lastError))
+		}
+		breaker.setState(CIRCUIT_OPEN)
+		// 重新计时
+		breaker.lastChange = time.Now()
+	}
+}
+
+func (breaker *circuitBreaker) status() (status ServerStatus) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return ServerStatus{
+		State:               breaker.state,
+		ConsecutiveFailures: breaker.consecutiveFailures,
+		LastError:           breaker.lastError,
+		LastChange:          breaker.lastChange,
+		LastProbe:           breaker.lastProbe,
+		LastProbeError:      breaker.lastProbeError,
+		Skipped:             atomic.LoadUint64(&breaker.skipped),
+		Dropped:             atomic.LoadUint64(&breaker.dropped),
+	}
+}
+
+// 定时探测message server的/health接口, 直到stopChan关闭
+// 熔断期间探测成功则提前进入半开, 由下一个推送试探
+func (breaker *circuitBreaker) probeMain(client *http.Client, schema string, stopChan chan byte) {
+	var (
+		interval time.Duration
+	)
+	for {
+		if interval = time.Duration(config.GlobalLogicConfig().MessageServerProbeInterval) * time.Millisecond; interval <= 0 {
+			// 未开启主动探测, 等待配置热更新
+			interval = time.Second
+		} else {
+			breaker.probeOnce(client, schema)
+		}
+
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (breaker *circuitBreaker) probeOnce(client *http.Client, schema string) {
+	var (
+		resp *http.Response
+		err  error
+	)
+	if resp, err = client.Get(schema + "/health"); err == nil {
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%w: %s/health %d", utils.MessageServerStatusError, schema, resp.StatusCode)
+		}
+	}
+
+	// 探测结果不计入连续失败次数: /health正常不代表推送正常
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.lastProbe = time.Now()
+	breaker.lastProbeError = ""
+	if err != nil {
+		breaker.lastProbeError = err.Error()
+		return
+	}
+	if breaker.state == CIRCUIT_OPEN {
+		breaker.setState(CIRCUIT_HALF_OPEN)
+	}
+}
@@ -0,0 +1,159 @@
+package push
+
+import (
+	"errors"
+	"message-center/cmd/logic/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// 熔断器的一步操作: allow/success/failure/drop/release/wait/probe, 执行后检查状态
+type breakerStep struct {
+	op        string
+	wantAllow bool // 仅op为allow时检查
+	wantState string
+}
+
+func initTestBreakerConfig(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().MessageServerBreakerThreshold = 2
+	config.GlobalLogicConfig().MessageServerBreakerOpenTime = 20
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var (
+		pushErr = errors.New("push failed")
+	)
+	initTestBreakerConfig(t)
+
+	cases := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"未达阈值不熔断, 成功后重新计数", []breakerStep{
+			{op: "failure", wantState: CIRCUIT_CLOSED},
+			{op: "success", wantState: CIRCUIT_CLOSED},
+			{op: "failure", wantState: CIRCUIT_CLOSED},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_CLOSED},
+		}},
+		{"连续失败达到阈值熔断, 熔断期间跳过", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "allow", wantAllow: false, wantState: CIRCUIT_OPEN},
+		}},
+		{"熔断时间已过进入半开, 只放行一个试探推送", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "wait"},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+			{op: "allow", wantAllow: false, wantState: CIRCUIT_HALF_OPEN},
+			{op: "success", wantState: CIRCUIT_CLOSED},
+		}},
+		{"试探失败重新熔断并重新计时", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "wait"},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+			{op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "allow", wantAllow: false, wantState: CIRCUIT_OPEN},
+		}},
+		{"试探推送因并发已满丢弃时让出名额", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "wait"},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+			{op: "drop", wantState: CIRCUIT_HALF_OPEN},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+		}},
+		{"熔断期间探测成功提前进入半开", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "probe", wantState: CIRCUIT_HALF_OPEN},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+		}},
+		{"试探推送放行后未发送时让出名额", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "wait"},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+			{op: "release", wantState: CIRCUIT_HALF_OPEN},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+		}},
+		{"探测成功不直接恢复, 试探推送失败后重新熔断", []breakerStep{
+			{op: "failure"}, {op: "failure", wantState: CIRCUIT_OPEN},
+			{op: "probe", wantState: CIRCUIT_HALF_OPEN},
+			{op: "probe", wantState: CIRCUIT_HALF_OPEN},
+			{op: "allow", wantAllow: true, wantState: CIRCUIT_HALF_OPEN},
+			{op: "failure", wantState: CIRCUIT_OPEN},
+		}},
+		{"探测失败不计入连续失败", []breakerStep{
+			{op: "failure", wantState: CIRCUIT_CLOSED},
+			{op: "probeFailure", wantState: CIRCUIT_CLOSED},
+			{op: "probeFailure", wantState: CIRCUIT_CLOSED},
+		}},
+	}
+
+	probeServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer probeServer.Close()
+
+	for _, c := range cases {
+		breaker := initCircuitBreaker()
+		for stepIdx, step := range c.steps {
+			switch step.op {
+			case "allow":
+				if allowed := breaker.allow(); allowed != step.wantAllow {
+					t.Errorf("%s: 第%d步allow=%v, want %v", c.name, stepIdx, allowed, step.wantAllow)
+				}
+			case "success":
+				breaker.record(nil)
+			case "failure":
+				breaker.record(pushErr)
+			case "drop":
+				breaker.drop()
+			case "release":
+				breaker.release()
+			case "wait":
+				time.Sleep(30 * time.Millisecond)
+			case "probe":
+				breaker.probeOnce(probeServer.Client(), probeServer.URL)
+			case "probeFailure":
+				breaker.probeOnce(probeServer.Client(), "http://127.0.0.1:1")
+			}
+			if step.wantState != "" && breaker.status().State != step.wantState {
+				t.Errorf("%s: 第%d步(%s)后状态%s, want %s", c.name, stepIdx, step.op, breaker.status().State, step.wantState)
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerCounters(t *testing.T) {
+	var (
+		breaker = initCircuitBreaker()
+		status  ServerStatus
+	)
+	initTestBreakerConfig(t)
+
+	breaker.record(errors.New("first"))
+	breaker.record(errors.New("second"))
+	breaker.allow()
+	breaker.allow()
+	breaker.drop()
+	if status = breaker.status(); status.ConsecutiveFailures != 2 || status.LastError != "second" || status.Skipped != 2 || status.Dropped != 1 {
+		t.Errorf("status: %+v", status)
+	}
+	if !status.LastProbe.IsZero() {
+		t.Errorf("未探测时lastProbe应为零值: %v", status.LastProbe)
+	}
+
+	// permit供溢出队列重放判断是否已恢复, 不计入skipped
+	breaker.permit()
+	if status = breaker.status(); status.Skipped != 2 {
+		t.Errorf("permit不应计入skipped: %d", status.Skipped)
+	}
+
+	// 探测失败只记录探测错误, 不改变连续失败次数和最近的推送错误
+	breaker.probeOnce(http.DefaultClient, "http://127.0.0.1:1")
+	if status = breaker.status(); status.LastProbeError == "" || status.LastProbe.IsZero() || status.ConsecutiveFailures != 2 || status.LastError != "second" {
+		t.Errorf("probe failure: %+v", status)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"message-center/utils"
 	"net"
 	"net/http"
 	"strconv"
@@ -12,6 +14,7 @@ import (
 
 type Service struct {
 	server *http.Server
+	mux    *http.ServeMux
 }
 
 func InitHttpService() (err error) {
@@ -21,25 +24,31 @@ func InitHttpService() (err error) {
 		listener net.Listener
 	)
 
-	// 路由
+	// 路由, 配置了apiKeys时校验调用方
 	mux = http.NewServeMux()
-	mux.HandleFunc("/push/all", handlePushAll)
-	mux.HandleFunc("/push/room", handlePushRoom)
+	mux.HandleFunc("/push/all", authenticate(handlePushAll))
+	mux.HandleFunc("/push/room", authenticate(handlePushRoom))
+	mux.HandleFunc("/push/rooms", authenticate(handlePushRooms))
+	mux.HandleFunc("/push/user", authenticate(handlePushUser))
+	mux.HandleFunc("/push/scheduled", authenticate(handleScheduledList))
+	mux.HandleFunc("/push/scheduled/cancel", authenticate(handleScheduledCancel))
+	mux.HandleFunc("/servers", authenticate(handleServers))
 	// mux.HandleFunc("/stats", handleStats)
 
 	// HTTP/1服务
 	server = &http.Server{
-		ReadTimeout:  time.Duration(config.GlobalLogicConfig.ServiceReadTimeout) * time.Millisecond,
-		WriteTimeout: time.Duration(config.GlobalLogicConfig.ServiceWriteTimeout) * time.Millisecond,
+		ReadTimeout:  time.Duration(config.GlobalLogicConfig().ServiceReadTimeout) * time.Millisecond,
+		WriteTimeout: time.Duration(config.GlobalLogicConfig().ServiceWriteTimeout) * time.Millisecond,
 		Handler:      mux,
 	}
 
 	// 监听端口
-	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalLogicConfig.ServicePort)); err != nil {
+	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalLogicConfig().ServicePort)); err != nil {
 		return
 	}
 	GlobalHttpServer = &Service{
 		server: server,
+		mux:    mux,
 	}
 
 	// 拉起服务
@@ -48,45 +57,187 @@ func InitHttpService() (err error) {
 	return
 }
 
-// 全量推送POST msg={}
+// 响应分发结果: 队列已满429, 服务关闭中503
+func writeDispatchResult(resp http.ResponseWriter, msgArr []json.RawMessage, err error) {
+	if err == utils.LogicDisPatchChannelFull {
+		types.WritePushResponse(resp, http.StatusTooManyRequests, &types.PushResponse{Code: types.PUSH_CODE_CHANNEL_FULL, Message: err.Error(), Dropped: len(msgArr)})
+		return
+	}
+	if err != nil {
+		types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error(), Dropped: len(msgArr)})
+		return
+	}
+	types.WritePushResponse(resp, http.StatusOK, &types.PushResponse{Code: types.PUSH_CODE_OK, Accepted: len(msgArr)})
+}
+
+// 全量推送POST items=[]&exclude={}, 或json请求体, 公共参数见pushRequest
 func handlePushAll(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err    error
-		items  string
-		msgArr []json.RawMessage
+		pushReq *pushRequest
+		ok      bool
 	)
-	if err = req.ParseForm(); err != nil {
+	if pushReq, ok = parsePushRequest(resp, req); !ok {
 		return
 	}
-
-	items = req.PostForm.Get("items")
-	if err = json.Unmarshal([]byte(items), &msgArr); err != nil {
+	if !authorize(resp, req, allowBroadcast) {
 		return
 	}
 
-	_ = GlobalConnectManager.PushAll(msgArr)
+	dispatchPush(resp, req, pushReq, pushReq.newPushJob(types.PUSH_TYPE_ALL))
 }
 
-// 房间推送POST room=xxx&msg
+// 房间推送POST room=xxx&items=[]&exclude={}
 func handlePushRoom(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err    error
-		room   string
-		items  string
-		msgArr []json.RawMessage
+		pushReq *pushRequest
+		ok      bool
+	)
+	if pushReq, ok = parsePushRequest(resp, req); !ok {
+		return
+	}
+
+	if pushReq.Room == "" {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()})
+		return
+	}
+	if !authorize(resp, req, allowRooms(pushReq.Room)) {
+		return
+	}
+
+	dispatchPush(resp, req, pushReq, pushReq.newPushJob(types.PUSH_TYPE_ROOM))
+}
+
+// 多房间推送POST rooms=["a","b"]&items=[]&exclude={}, 同时加入多个房间的连接只收到一次
+func handlePushRooms(resp http.ResponseWriter, req *http.Request) {
+	var (
+		pushReq *pushRequest
+		ok      bool
 	)
-	if err = req.ParseForm(); err != nil {
+	if pushReq, ok = parsePushRequest(resp, req); !ok {
+		return
+	}
+
+	if pushReq.Rooms = utils.SortedUnique(pushReq.Rooms); len(pushReq.Rooms) == 0 {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()})
+		return
+	}
+	if !authorize(resp, req, allowRooms(pushReq.Rooms...)) {
 		return
 	}
 
-	room = req.PostForm.Get("room")
-	items = req.PostForm.Get("items")
+	dispatchPush(resp, req, pushReq, pushReq.newPushJob(types.PUSH_TYPE_ROOMS))
+}
+
+// 用户推送POST uid=xxx&items=[]&exclude={}, 推送给该用户在所有message server上的连接
+func handlePushUser(resp http.ResponseWriter, req *http.Request) {
+	var (
+		pushReq *pushRequest
+		ok      bool
+	)
+	if pushReq, ok = parsePushRequest(resp, req); !ok {
+		return
+	}
 
-	if err = json.Unmarshal([]byte(items), &msgArr); err != nil {
+	if pushReq.Uid == "" {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_USER, Message: utils.UserIdInvalid.Error()})
+		return
+	}
+	if !authorize(resp, req, allowUsers) {
 		return
 	}
 
-	_ = GlobalConnectManager.PushRoom(room, msgArr)
+	dispatchPush(resp, req, pushReq, pushReq.newPushJob(types.PUSH_TYPE_USER))
+}
+
+// 定时推送列表响应
+type scheduledListResponse struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message,omitempty"`
+	Pushes  []*scheduledPush `json:"pushes,omitempty"`
+}
+
+// 定时推送列表GET status=pending&limit=100, 开启认证时只返回本api key创建的推送
+func handleScheduledList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		listResp = &scheduledListResponse{Code: types.PUSH_CODE_OK}
+		limit    = 100
+		buf      []byte
+		err      error
+	)
+	if GlobalScheduler == nil {
+		types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: utils.SchedulerUnavailable.Error()})
+		return
+	}
+	if req.FormValue("limit") != "" {
+		if limit, err = strconv.Atoi(req.FormValue("limit")); err != nil || limit <= 0 {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: "limit invalid"})
+			return
+		}
+	}
+	if listResp.Pushes, err = GlobalScheduler.list(requestApiKey(req), req.FormValue("status"), limit); err != nil {
+		listResp = &scheduledListResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error()}
+	}
+	if buf, err = json.Marshal(listResp); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(types.PushStatus(listResp.Code))
+	_, _ = resp.Write(buf)
+}
+
+// 取消定时推送POST id=pushId, 已分发或正在分发的推送返回409
+func handleScheduledCancel(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+	)
+	if req.Method != http.MethodPost {
+		types.WritePushResponse(resp, http.StatusMethodNotAllowed, &types.PushResponse{Code: types.PUSH_CODE_BAD_METHOD})
+		return
+	}
+	if GlobalScheduler == nil {
+		types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: utils.SchedulerUnavailable.Error()})
+		return
+	}
+	switch err = GlobalScheduler.cancel(requestApiKey(req), req.FormValue("id")); err {
+	case nil:
+		types.WritePushResponse(resp, http.StatusOK, &types.PushResponse{Code: types.PUSH_CODE_OK})
+	case utils.ScheduledPushNotFound:
+		types.WritePushResponse(resp, http.StatusNotFound, &types.PushResponse{Code: types.PUSH_CODE_NOT_FOUND, Message: err.Error()})
+	case utils.ScheduledPushNotPending:
+		types.WritePushResponse(resp, http.StatusConflict, &types.PushResponse{Code: types.PUSH_CODE_NOT_PENDING, Message: err.Error()})
+	default:
+		types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error()})
+	}
+}
+
+// message server健康状态GET, 包括熔断状态和跳过/丢弃的推送数
+func handleServers(resp http.ResponseWriter, req *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	if buf, err = json.Marshal(GlobalConnectManager.ServerStatuses()); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write(buf)
+}
+
+// 注册其他模块的接口, 与推送接口一样校验调用方
+func (service *Service) HandleFunc(pattern string, handler http.HandlerFunc) {
+	service.mux.HandleFunc(pattern, authenticate(handler))
+}
+
+// 注册管理接口, 开启认证时只允许admin的api key调用
+func (service *Service) HandleAdminFunc(pattern string, handler http.HandlerFunc) {
+	service.mux.HandleFunc(pattern, authenticate(func(resp http.ResponseWriter, req *http.Request) {
+		if !authorize(resp, req, allowAdmin) {
+			return
+		}
+		handler(resp, req)
+	}))
 }
 
 func HttpServerClose() {
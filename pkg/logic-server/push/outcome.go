@@ -0,0 +1,83 @@
+package push
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 推送到一个message server的结果
+type PushOutcome struct {
+	Address string // message server地址, 广播通道时为通道类型
+	Skipped string // 未发送的原因, 为空表示已发送
+	Err     error  // 发送失败的错误, 重试后的最终结果
+	Reached int    // 等待送达时消息写入发送队列的连接数
+}
+
+// 是否送达message server
+func (outcome *PushOutcome) Delivered() bool {
+	return outcome.Skipped == "" && outcome.Err == nil
+}
+
+// 是否推送失败: 出错或因熔断、并发已满、没有可用的message server、已过期未发送
+// 没有订阅者和已写入溢出队列(稍后重放)不算失败
+func (outcome *PushOutcome) Failed() bool {
+	return outcome.Err != nil || (outcome.Skipped != "" && outcome.Skipped != SKIPPED_NO_SUBSCRIBER && outcome.Skipped != SKIPPED_SPILLED)
+}
+
+// 未发送的原因
+const (
+	SKIPPED_NO_SUBSCRIBER = "no subscriber" // 按订阅路由时message server上没有订阅者
+	SKIPPED_CIRCUIT_OPEN  = "circuit open"  // 熔断中
+	SKIPPED_PENDING_FULL  = "pending full"  // 并发已满
+	SKIPPED_NO_SERVER     = "no server"     // 没有可用的message server
+	SKIPPED_SPILLED       = "spilled"       // 已写入溢出队列, 稍后重放
+	SKIPPED_EXPIRED       = "expired"       // 分发前已超过ttl
+)
+
+// 推送完成回调, 所有目标message server都有结果后调用一次, 在分发协程或推送协程中执行, 不要阻塞
+type OutcomeCallback func(outcomes []PushOutcome)
+
+// 汇总一个推送在各个message server上的结果
+type outcomeCollector struct {
+	mutex    sync.Mutex
+	outcomes []PushOutcome
+	pending  int32 // 尚未返回结果的推送数
+	callback OutcomeCallback
+}
+
+// 登记未发送的结果, 需在start之前调用
+func (collector *outcomeCollector) skip(address string, reason string) {
+	collector.outcomes = append(collector.outcomes, PushOutcome{Address: address, Skipped: reason})
+}
+
+// 已发起pending个推送, 没有推送时立即回调
+func (collector *outcomeCollector) start(pending int) {
+	if pending == 0 {
+		if len(collector.outcomes) == 0 {
+			collector.skip("", SKIPPED_NO_SERVER)
+		}
+		collector.callback(collector.outcomes)
+		return
+	}
+	atomic.StoreInt32(&collector.pending, int32(pending))
+}
+
+// 登记一个推送结果, 最后一个结果到达时回调
+func (collector *outcomeCollector) done(address string, reached int, err error) {
+	collector.finish(PushOutcome{Address: address, Reached: reached, Err: err})
+}
+
+// 已发起的推送最终未发送, 如失败后写入溢出队列
+func (collector *outcomeCollector) doneSkipped(address string, reason string) {
+	collector.finish(PushOutcome{Address: address, Skipped: reason})
+}
+
+func (collector *outcomeCollector) finish(outcome PushOutcome) {
+	collector.mutex.Lock()
+	collector.outcomes = append(collector.outcomes, outcome)
+	collector.mutex.Unlock()
+
+	if atomic.AddInt32(&collector.pending, -1) == 0 {
+		collector.callback(collector.outcomes)
+	}
+}
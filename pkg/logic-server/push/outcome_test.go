@@ -0,0 +1,78 @@
+package push
+
+import (
+	"errors"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPushOutcomeFailed(t *testing.T) {
+	cases := []struct {
+		name    string
+		outcome PushOutcome
+		want    bool
+	}{
+		{"已送达", PushOutcome{Reached: 2}, false},
+		{"推送出错", PushOutcome{Err: errors.New("status 500")}, true},
+		{"没有订阅者", PushOutcome{Skipped: SKIPPED_NO_SUBSCRIBER}, false},
+		{"已写入溢出队列", PushOutcome{Skipped: SKIPPED_SPILLED}, false},
+		{"熔断中", PushOutcome{Skipped: SKIPPED_CIRCUIT_OPEN}, true},
+		{"并发已满", PushOutcome{Skipped: SKIPPED_PENDING_FULL}, true},
+		{"没有可用的message server", PushOutcome{Skipped: SKIPPED_NO_SERVER}, true},
+		{"已过期", PushOutcome{Skipped: SKIPPED_EXPIRED}, true},
+	}
+	for _, c := range cases {
+		if got := c.outcome.Failed(); got != c.want {
+			t.Errorf("%s: Failed = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAwaitOutcomes(t *testing.T) {
+	var (
+		pushErr = errors.New("status 500")
+	)
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().PushWaitTimeout = 50
+
+	cases := []struct {
+		name        string
+		outcomes    []PushOutcome // nil表示等待超时
+		wantCode    string
+		wantReached int
+	}{
+		{"全部送达", []PushOutcome{{Address: "a", Reached: 2}, {Address: "b", Reached: 1}}, types.PUSH_CODE_OK, 3},
+		{"没有订阅者不算失败", []PushOutcome{{Address: "a", Reached: 2}, {Address: "b", Skipped: SKIPPED_NO_SUBSCRIBER}}, types.PUSH_CODE_OK, 2},
+		{"部分失败", []PushOutcome{{Address: "a", Reached: 2}, {Address: "b", Err: pushErr}}, types.PUSH_CODE_PARTIAL_FAILED, 2},
+		{"全部失败", []PushOutcome{{Address: "a", Err: pushErr}, {Address: "b", Skipped: SKIPPED_CIRCUIT_OPEN}}, types.PUSH_CODE_FAILED, 0},
+		{"等待超时", nil, types.PUSH_CODE_WAIT_TIMEOUT, 0},
+	}
+	for _, c := range cases {
+		var (
+			result      = &pushResult{PushResponse: types.PushResponse{Code: types.PUSH_CODE_OK}}
+			outcomeChan = make(chan []PushOutcome, 1)
+		)
+		if c.outcomes != nil {
+			outcomeChan <- c.outcomes
+		}
+		awaitOutcomes(httptest.NewRequest("POST", "/push/room", nil), result, outcomeChan)
+		if result.Code != c.wantCode || result.Reached != c.wantReached {
+			t.Errorf("%s: code=%s reached=%d, want %s/%d", c.name, result.Code, result.Reached, c.wantCode, c.wantReached)
+		}
+		if c.outcomes != nil && len(result.Servers) != len(c.outcomes) {
+			t.Errorf("%s: servers=%d", c.name, len(result.Servers))
+			continue
+		}
+		for i, server := range result.Servers {
+			if outcome := c.outcomes[i]; server.Address != outcome.Address || server.Skipped != outcome.Skipped || (outcome.Err != nil) != (server.Error != "") {
+				t.Errorf("%s: server %+v", c.name, server)
+			}
+		}
+	}
+}
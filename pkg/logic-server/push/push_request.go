@@ -0,0 +1,426 @@
+package push
+
+import (
+	"encoding/json"
+	"github.com/globalsign/mgo/bson"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 推送优先级
+const (
+	PUSH_PRIORITY_NORMAL = "normal"
+	PUSH_PRIORITY_HIGH   = "high"
+)
+
+// 调用方可以用请求头代替请求体中的idempotencyKey
+const HEADER_IDEMPOTENCY_KEY = "Idempotency-Key"
+
+// 推送请求, 来自json请求体或表单
+// json请求体: {"room": "xxx", "items": [...], "exclude": {...}, "priority": "high", "ttl": 30, "idempotencyKey": "xxx", "wait": true}
+// 指定deliverAt或delay时为定时推送, 保存后到期再分发
+// 表单中rooms和exclude仍为json字符串
+type pushRequest struct {
+	Room           string             `json:"room"`
+	Rooms          []string           `json:"rooms"`
+	Uid            string             `json:"uid"`
+	Items          []json.RawMessage  `json:"items"`
+	Exclude        *types.PushExclude `json:"exclude"`
+	Priority       string             `json:"priority"`       // normal(默认)或high
+	Ttl            int                `json:"ttl"`            // 单位秒, 分发前超过ttl的推送被丢弃, 0表示不过期
+	IdempotencyKey string             `json:"idempotencyKey"` // 窗口内相同key的推送只分发一次
+	Wait           bool               `json:"wait"`           // 等待所有message server回复, 返回每个message server送达的连接数
+	DeliverAt      *time.Time         `json:"deliverAt"`      // 定时推送的时间, RFC3339格式
+	Delay          int                `json:"delay"`          // 延迟推送, 单位秒
+}
+
+// 推送接口响应, 在types.PushResponse的基础上增加推送ID和等待送达的结果
+type pushResult struct {
+	types.PushResponse
+	PushId    string         `json:"pushId,omitempty"`
+	Duplicate bool           `json:"duplicate,omitempty"` // 幂等key重复, 返回首次推送的结果
+	Servers   []serverResult `json:"servers,omitempty"`   // wait时每个message server的结果
+	DeliverAt *time.Time     `json:"deliverAt,omitempty"` // 定时推送的分发时间
+}
+
+// 推送在一个message server上的结果
+type serverResult struct {
+	Address string `json:"address"`
+	Reached int    `json:"reached"`           // 消息写入发送队列的连接数
+	Skipped string `json:"skipped,omitempty"` // 未发送的原因
+	Error   string `json:"error,omitempty"`
+}
+
+// 已分发的幂等推送
+type idempotentPush struct {
+	result *pushResult
+	expire time.Time
+}
+
+// 幂等key -> 首次推送的结果, 按api key隔离
+type idempotencyCache struct {
+	mutex     sync.Mutex
+	pushes    map[string]*idempotentPush
+	lastSweep time.Time
+}
+
+var (
+	idempotentPushes = &idempotencyCache{pushes: make(map[string]*idempotentPush)}
+)
+
+// 登记幂等key, 窗口内已登记过时返回首次推送的结果
+func (cache *idempotencyCache) reserve(key string, result *pushResult, window time.Duration) (existing *pushResult, exists bool) {
+	var (
+		now  = time.Now()
+		push *idempotentPush
+	)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// 每个窗口清理一次过期的key
+	if now.Sub(cache.lastSweep) >= window {
+		for pushKey, push := range cache.pushes {
+			if now.After(push.expire) {
+				delete(cache.pushes, pushKey)
+			}
+		}
+		cache.lastSweep = now
+	}
+
+	if push, exists = cache.pushes[key]; exists && now.Before(push.expire) {
+		return push.result, true
+	}
+	cache.pushes[key] = &idempotentPush{result: result, expire: now.Add(window)}
+	return nil, false
+}
+
+// 推送完成后记录最终结果
+func (cache *idempotencyCache) complete(key string, result *pushResult) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if push, exists := cache.pushes[key]; exists {
+		push.result = result
+	}
+}
+
+// 分发失败, 允许调用方用同一个key重试
+func (cache *idempotencyCache) release(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.pushes, key)
+}
+
+// 解析推送请求, Content-Type为application/json时解析请求体, 否则解析表单; 参数不合法时直接响应
+func parsePushRequest(resp http.ResponseWriter, req *http.Request) (pushReq *pushRequest, ok bool) {
+	var (
+		mediaType string
+		body      []byte
+		ttl       string
+		err       error
+	)
+	pushReq = &pushRequest{}
+	if mediaType, _, _ = mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		return parsePushRequestForm(resp, req)
+	}
+
+	if req.Method != http.MethodPost {
+		types.WritePushResponse(resp, http.StatusMethodNotAllowed, &types.PushResponse{Code: types.PUSH_CODE_BAD_METHOD})
+		return
+	}
+	if body, err = ioutil.ReadAll(req.Body); err == nil {
+		err = json.Unmarshal(body, pushReq)
+	}
+	if err != nil {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: err.Error()})
+		return
+	}
+	if pushReq.Items == nil {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ITEMS, Message: utils.ItemsInvalid.Error()})
+		return
+	}
+	if pushReq.Exclude.IsEmpty() {
+		pushReq.Exclude = nil
+	}
+
+	// 查询参数中的ttl和wait同样有效
+	if ttl = req.URL.Query().Get("ttl"); ttl != "" && pushReq.Ttl == 0 {
+		if pushReq.Ttl, err = strconv.Atoi(ttl); err != nil {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.TtlInvalid.Error()})
+			return
+		}
+	}
+	pushReq.Wait = pushReq.Wait || req.URL.Query().Get("wait") == "true"
+	return pushReq, pushReq.validate(resp, req)
+}
+
+// 表单推送: items=[]&exclude={}&room=xxx&rooms=[]&uid=xxx&priority=high&ttl=30&idempotencyKey=xxx&wait=true&deliverAt=RFC3339&delay=60
+func parsePushRequestForm(resp http.ResponseWriter, req *http.Request) (pushReq *pushRequest, ok bool) {
+	var (
+		rooms     string
+		ttl       string
+		deliverAt string
+		delay     string
+		err       error
+	)
+	pushReq = &pushRequest{}
+	if pushReq.Items, pushReq.Exclude, ok = types.ParsePushForm(resp, req); !ok {
+		return
+	}
+
+	pushReq.Room = req.PostForm.Get("room")
+	pushReq.Uid = req.PostForm.Get("uid")
+	if rooms = req.PostForm.Get("rooms"); rooms != "" {
+		if err = json.Unmarshal([]byte(rooms), &pushReq.Rooms); err != nil {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: err.Error()})
+			return nil, false
+		}
+	}
+	pushReq.Priority = req.Form.Get("priority")
+	if ttl = req.Form.Get("ttl"); ttl != "" {
+		if pushReq.Ttl, err = strconv.Atoi(ttl); err != nil {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.TtlInvalid.Error()})
+			return nil, false
+		}
+	}
+	pushReq.IdempotencyKey = req.Form.Get("idempotencyKey")
+	pushReq.Wait = req.Form.Get("wait") == "true"
+	if deliverAt = req.Form.Get("deliverAt"); deliverAt != "" {
+		pushReq.DeliverAt = &time.Time{}
+		if *pushReq.DeliverAt, err = time.Parse(time.RFC3339, deliverAt); err != nil {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.DeliverAtInvalid.Error()})
+			return nil, false
+		}
+	}
+	if delay = req.Form.Get("delay"); delay != "" {
+		if pushReq.Delay, err = strconv.Atoi(delay); err != nil {
+			types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.DeliverAtInvalid.Error()})
+			return nil, false
+		}
+	}
+	return pushReq, pushReq.validate(resp, req)
+}
+
+// 校验公共参数, 请求头中的幂等key在参数未指定时生效
+func (pushReq *pushRequest) validate(resp http.ResponseWriter, req *http.Request) bool {
+	if pushReq.IdempotencyKey == "" {
+		pushReq.IdempotencyKey = req.Header.Get(HEADER_IDEMPOTENCY_KEY)
+	}
+	if pushReq.Priority != "" && pushReq.Priority != PUSH_PRIORITY_NORMAL && pushReq.Priority != PUSH_PRIORITY_HIGH {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.PriorityInvalid.Error()})
+		return false
+	}
+	if pushReq.Ttl < 0 {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.TtlInvalid.Error()})
+		return false
+	}
+	// deliverAt和delay只能指定一个, 定时推送无法等待送达
+	if pushReq.Delay < 0 || (pushReq.Delay > 0 && pushReq.DeliverAt != nil) {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.DeliverAtInvalid.Error()})
+		return false
+	}
+	if pushReq.Wait && !pushReq.deliverTime().IsZero() {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: utils.ScheduledPushWait.Error()})
+		return false
+	}
+	return true
+}
+
+// 定时推送的分发时间, 不是未来的时间时返回零值, 立即分发
+func (pushReq *pushRequest) deliverTime() (deliverAt time.Time) {
+	if pushReq.DeliverAt != nil {
+		deliverAt = *pushReq.DeliverAt
+	} else if pushReq.Delay > 0 {
+		deliverAt = time.Now().Add(time.Duration(pushReq.Delay) * time.Second)
+	}
+	if !deliverAt.After(time.Now()) {
+		return time.Time{}
+	}
+	return
+}
+
+func (pushReq *pushRequest) newPushJob(pushType int) (pushJob *PushJob) {
+	pushJob = &PushJob{
+		pushType: pushType,
+		roomId:   pushReq.Room,
+		roomIds:  pushReq.Rooms,
+		identity: pushReq.Uid,
+		items:    pushReq.Items,
+		exclude:  pushReq.Exclude,
+		priority: pushReq.Priority == PUSH_PRIORITY_HIGH,
+		wait:     pushReq.Wait,
+	}
+	if pushReq.Ttl > 0 {
+		pushJob.expireAt = time.Now().Add(time.Duration(pushReq.Ttl) * time.Second)
+	}
+	return
+}
+
+// 分发推送并响应: 生成推送ID, 幂等key重复时返回首次推送的结果, wait时等待所有message server回复
+func dispatchPush(resp http.ResponseWriter, req *http.Request, pushReq *pushRequest, pushJob *PushJob) {
+	var (
+		result         *pushResult
+		existing       *pushResult
+		exists         bool
+		idempotencyKey string
+		outcomeChan    chan []PushOutcome
+		err            error
+	)
+	result = &pushResult{PushId: bson.NewObjectId().Hex()}
+
+	if pushReq.IdempotencyKey != "" {
+		if apiKey := requestApiKey(req); apiKey != nil {
+			idempotencyKey = apiKey.Key
+		}
+		idempotencyKey += "\n" + pushReq.IdempotencyKey
+		// 推送完成前重复的请求得到已接收的结果
+		pending := &pushResult{PushResponse: types.PushResponse{Code: types.PUSH_CODE_OK, Accepted: len(pushReq.Items)}, PushId: result.PushId}
+		if existing, exists = idempotentPushes.reserve(idempotencyKey, pending,
+			time.Duration(config.GlobalLogicConfig().PushIdempotencyWindow)*time.Second); exists {
+			duplicate := *existing
+			duplicate.Duplicate = true
+			writePushResult(resp, &duplicate)
+			return
+		}
+	}
+
+	if deliverAt := pushReq.deliverTime(); !deliverAt.IsZero() {
+		schedulePush(resp, req, pushReq, pushJob, result, idempotencyKey, deliverAt)
+		return
+	}
+
+	if pushJob.wait {
+		outcomeChan = make(chan []PushOutcome, 1)
+		pushJob.outcome = &outcomeCollector{callback: func(outcomes []PushOutcome) {
+			outcomeChan <- outcomes
+		}}
+	}
+
+	if err = GlobalConnectManager.dispatch(pushJob); err != nil {
+		if idempotencyKey != "" {
+			idempotentPushes.release(idempotencyKey)
+		}
+		writeDispatchResult(resp, pushReq.Items, err)
+		return
+	}
+
+	result.Code = types.PUSH_CODE_OK
+	result.Accepted = len(pushReq.Items)
+	if pushJob.wait {
+		awaitOutcomes(req, result, outcomeChan)
+	}
+	if idempotencyKey != "" {
+		idempotentPushes.complete(idempotencyKey, result)
+	}
+	writePushResult(resp, result)
+}
+
+// 保存定时推送, 返回的pushId用于查询和取消
+func schedulePush(resp http.ResponseWriter, req *http.Request, pushReq *pushRequest, pushJob *PushJob, result *pushResult, idempotencyKey string, deliverAt time.Time) {
+	var (
+		scheduled *scheduledPush
+		itemsJson []byte
+		err       error
+	)
+	if GlobalScheduler == nil {
+		err = utils.SchedulerUnavailable
+	} else if itemsJson, err = pushJob.encodeItems(); err == nil {
+		scheduled = &scheduledPush{
+			Id:        bson.ObjectIdHex(result.PushId),
+			PushType:  pushJob.pushType,
+			Room:      pushJob.roomId,
+			Rooms:     pushJob.roomIds,
+			Uid:       pushJob.identity,
+			ItemsJson: string(itemsJson),
+			Exclude:   pushJob.exclude,
+			Priority:  pushReq.Priority,
+			Ttl:       pushReq.Ttl,
+			DeliverAt: deliverAt,
+		}
+		if apiKey := requestApiKey(req); apiKey != nil {
+			scheduled.ApiKey = apiKey.Key
+		}
+		err = GlobalScheduler.schedule(scheduled)
+	}
+	if err != nil {
+		if idempotencyKey != "" {
+			idempotentPushes.release(idempotencyKey)
+		}
+		types.WritePushResponse(resp, http.StatusServiceUnavailable, &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Message: err.Error(), Dropped: len(pushReq.Items)})
+		return
+	}
+
+	result.Code = types.PUSH_CODE_OK
+	result.Accepted = len(pushReq.Items)
+	result.DeliverAt = &deliverAt
+	if idempotencyKey != "" {
+		idempotentPushes.complete(idempotencyKey, result)
+	}
+	writePushResult(resp, result)
+}
+
+// 等待所有message server的推送结果, 超时或调用方断开时返回WAIT_TIMEOUT, 推送仍会继续
+// 部分message server失败时返回PARTIAL_FAILED, 全部失败时返回FAILED
+func awaitOutcomes(req *http.Request, result *pushResult, outcomeChan chan []PushOutcome) {
+	var (
+		timeout  = time.Duration(config.GlobalLogicConfig().PushWaitTimeout) * time.Millisecond
+		maxWait  = time.Duration(config.GlobalLogicConfig().ServiceWriteTimeout) * time.Millisecond
+		outcomes []PushOutcome
+		outcome  PushOutcome
+		server   serverResult
+		failed   int
+	)
+	if timeout > maxWait {
+		timeout = maxWait
+	}
+	select {
+	case outcomes = <-outcomeChan:
+	case <-time.After(timeout):
+		result.Code, result.Message = types.PUSH_CODE_WAIT_TIMEOUT, utils.WaitTimeout.Error()
+		return
+	case <-req.Context().Done():
+		result.Code, result.Message = types.PUSH_CODE_WAIT_TIMEOUT, utils.WaitTimeout.Error()
+		return
+	}
+
+	for _, outcome = range outcomes {
+		server = serverResult{Address: outcome.Address, Reached: outcome.Reached, Skipped: outcome.Skipped}
+		if outcome.Err != nil {
+			server.Error = outcome.Err.Error()
+		}
+		if outcome.Failed() {
+			failed++
+		}
+		result.Reached += outcome.Reached
+		result.Servers = append(result.Servers, server)
+	}
+	switch {
+	case failed == 0:
+	case failed == len(outcomes):
+		result.Code, result.Message = types.PUSH_CODE_FAILED, utils.PushServerFailed.Error()
+	default:
+		result.Code, result.Message = types.PUSH_CODE_PARTIAL_FAILED, utils.PushServerFailed.Error()
+	}
+}
+
+func writePushResult(resp http.ResponseWriter, result *pushResult) {
+	var (
+		buf []byte
+		err error
+	)
+	if buf, err = json.Marshal(result); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(types.PushStatus(result.Code))
+	_, _ = resp.Write(buf)
+}
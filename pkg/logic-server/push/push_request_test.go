@@ -0,0 +1,186 @@
+package push
+
+import (
+	"message-center/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	var (
+		first  = &pushResult{PushId: "first"}
+		second = &pushResult{PushId: "second"}
+	)
+	cases := []struct {
+		name       string
+		window     time.Duration
+		secondKey  string
+		release    bool          // 首次分发失败后释放key
+		sleep      time.Duration // 两次登记之间的间隔
+		wantExists bool
+	}{
+		{"窗口内重复的key返回首次的结果", time.Second, "key-1", false, 0, true},
+		{"不同的key", time.Second, "key-2", false, 0, false},
+		{"分发失败释放后可以重试", time.Second, "key-1", true, 0, false},
+		{"窗口过期后重新分发", 20 * time.Millisecond, "key-1", false, 30 * time.Millisecond, false},
+	}
+	for _, c := range cases {
+		cache := &idempotencyCache{pushes: make(map[string]*idempotentPush)}
+		if _, exists := cache.reserve("key-1", first, c.window); exists {
+			t.Errorf("%s: 首次登记不应重复", c.name)
+		}
+		if c.release {
+			cache.release("key-1")
+		}
+		time.Sleep(c.sleep)
+		existing, exists := cache.reserve(c.secondKey, second, c.window)
+		if exists != c.wantExists || (exists && existing != first) {
+			t.Errorf("%s: exists=%v existing=%+v", c.name, exists, existing)
+		}
+	}
+
+	// 推送完成后重复的请求得到最终结果
+	cache := &idempotencyCache{pushes: make(map[string]*idempotentPush)}
+	cache.reserve("key-1", first, time.Second)
+	cache.complete("key-1", second)
+	if existing, _ := cache.reserve("key-1", first, time.Second); existing != second {
+		t.Errorf("complete后应返回最终结果: %+v", existing)
+	}
+}
+
+func TestParsePushRequest(t *testing.T) {
+	cases := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		header      string // Idempotency-Key请求头
+		wantCode    string // 为空表示解析成功
+		want        pushRequest
+	}{
+		{"json请求体", "/push/room", "application/json", `{"room":"a","items":[1],"priority":"high","ttl":30,"idempotencyKey":"k","wait":true}`, "",
+			"", pushRequest{Room: "a", Priority: PUSH_PRIORITY_HIGH, Ttl: 30, IdempotencyKey: "k", Wait: true}},
+		{"json请求体的ttl和wait可以来自查询参数", "/push/room?ttl=10&wait=true", "application/json; charset=utf-8", `{"room":"a","items":[1]}`, "",
+			"", pushRequest{Room: "a", Ttl: 10, Wait: true}},
+		{"参数未指定时使用请求头中的幂等key", "/push/room", "application/json", `{"room":"a","items":[1]}`, "header-key",
+			"", pushRequest{Room: "a", IdempotencyKey: "header-key"}},
+		{"参数中的幂等key优先", "/push/room", "application/json", `{"room":"a","items":[1],"idempotencyKey":"k"}`, "header-key",
+			"", pushRequest{Room: "a", IdempotencyKey: "k"}},
+		{"表单", "/push/rooms", "application/x-www-form-urlencoded", `rooms=["a","b"]&items=[1]&priority=normal&ttl=5&wait=true`, "",
+			"", pushRequest{Rooms: []string{"a", "b"}, Priority: PUSH_PRIORITY_NORMAL, Ttl: 5, Wait: true}},
+		{"json请求体缺少items", "/push/room", "application/json", `{"room":"a"}`, "", types.PUSH_CODE_INVALID_ITEMS, pushRequest{}},
+		{"json格式错误", "/push/room", "application/json", `{"room":`, "", types.PUSH_CODE_INVALID_FORM, pushRequest{}},
+		{"不支持的优先级", "/push/room", "application/json", `{"room":"a","items":[1],"priority":"urgent"}`, "", types.PUSH_CODE_INVALID_FORM, pushRequest{}},
+		{"ttl为负数", "/push/room", "application/json", `{"room":"a","items":[1],"ttl":-1}`, "", types.PUSH_CODE_INVALID_FORM, pushRequest{}},
+		{"表单ttl不是数字", "/push/room", "application/x-www-form-urlencoded", `room=a&items=[1]&ttl=abc`, "", types.PUSH_CODE_INVALID_FORM, pushRequest{}},
+		{"表单rooms格式错误", "/push/rooms", "application/x-www-form-urlencoded", `rooms=a,b&items=[1]`, "", types.PUSH_CODE_INVALID_ROOM, pushRequest{}},
+	}
+	for _, c := range cases {
+		var (
+			req  = httptest.NewRequest(http.MethodPost, c.target, strings.NewReader(c.body))
+			resp = httptest.NewRecorder()
+		)
+		req.Header.Set("Content-Type", c.contentType)
+		if c.header != "" {
+			req.Header.Set(HEADER_IDEMPOTENCY_KEY, c.header)
+		}
+		pushReq, ok := parsePushRequest(resp, req)
+		if c.wantCode != "" {
+			if ok || resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), `"code":"`+c.wantCode+`"`) {
+				t.Errorf("%s: ok=%v %d %s", c.name, ok, resp.Code, resp.Body.String())
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: 解析失败 %s", c.name, resp.Body.String())
+			continue
+		}
+		if pushReq.Room != c.want.Room || !equalStrings(pushReq.Rooms, c.want.Rooms) || pushReq.Priority != c.want.Priority ||
+			pushReq.Ttl != c.want.Ttl || pushReq.IdempotencyKey != c.want.IdempotencyKey || pushReq.Wait != c.want.Wait || len(pushReq.Items) != 1 {
+			t.Errorf("%s: %+v", c.name, pushReq)
+		}
+	}
+}
+
+func TestNewPushJobExpire(t *testing.T) {
+	cases := []struct {
+		name     string
+		pushReq  *pushRequest
+		wantTtl  time.Duration // 0表示不过期
+		priority bool
+	}{
+		{"未指定ttl不过期", &pushRequest{Room: "a"}, 0, false},
+		{"按ttl计算过期时间", &pushRequest{Room: "a", Ttl: 30, Priority: PUSH_PRIORITY_HIGH}, 30 * time.Second, true},
+	}
+	for _, c := range cases {
+		pushJob := c.pushReq.newPushJob(types.PUSH_TYPE_ROOM)
+		if pushJob.priority != c.priority || pushJob.roomId != c.pushReq.Room {
+			t.Errorf("%s: %+v", c.name, pushJob)
+		}
+		if c.wantTtl == 0 && !pushJob.expireAt.IsZero() {
+			t.Errorf("%s: 不应过期 %v", c.name, pushJob.expireAt)
+		}
+		if remain := time.Until(pushJob.expireAt); c.wantTtl > 0 && (remain > c.wantTtl || remain < c.wantTtl-time.Second) {
+			t.Errorf("%s: 剩余%v", c.name, remain)
+		}
+	}
+}
+
+func TestParseDeliverTime(t *testing.T) {
+	var (
+		future = time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		past   = time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	)
+	cases := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		wantCode    string        // 为空表示解析成功
+		wantDelay   time.Duration // 期望的分发时间距现在的间隔, 0表示立即分发
+	}{
+		{"json指定deliverAt", "/push/room", "application/json", `{"room":"a","items":[1],"deliverAt":"` + future.Format(time.RFC3339) + `"}`, "", time.Hour},
+		{"json指定delay", "/push/room", "application/json", `{"room":"a","items":[1],"delay":60}`, "", time.Minute},
+		{"表单指定deliverAt", "/push/room", "application/x-www-form-urlencoded", `room=a&items=[1]&deliverAt=` + future.Format(time.RFC3339), "", time.Hour},
+		{"表单指定delay", "/push/room", "application/x-www-form-urlencoded", `room=a&items=[1]&delay=60`, "", time.Minute},
+		{"delay为0时立即分发", "/push/room", "application/json", `{"room":"a","items":[1],"delay":0}`, "", 0},
+		{"deliverAt已过去时立即分发", "/push/room", "application/json", `{"room":"a","items":[1],"deliverAt":"` + past.Format(time.RFC3339) + `"}`, "", 0},
+		{"json的deliverAt不是RFC3339格式", "/push/room", "application/json", `{"room":"a","items":[1],"deliverAt":"2030-01-01 00:00:00"}`, types.PUSH_CODE_INVALID_FORM, 0},
+		{"表单的deliverAt不是RFC3339格式", "/push/room", "application/x-www-form-urlencoded", `room=a&items=[1]&deliverAt=tomorrow`, types.PUSH_CODE_INVALID_FORM, 0},
+		{"表单的delay不是数字", "/push/room", "application/x-www-form-urlencoded", `room=a&items=[1]&delay=1m`, types.PUSH_CODE_INVALID_FORM, 0},
+		{"delay为负数", "/push/room", "application/json", `{"room":"a","items":[1],"delay":-1}`, types.PUSH_CODE_INVALID_FORM, 0},
+		{"同时指定deliverAt和delay", "/push/room", "application/json", `{"room":"a","items":[1],"delay":60,"deliverAt":"` + future.Format(time.RFC3339) + `"}`, types.PUSH_CODE_INVALID_FORM, 0},
+		{"定时推送不能等待送达", "/push/room", "application/json", `{"room":"a","items":[1],"delay":60,"wait":true}`, types.PUSH_CODE_INVALID_FORM, 0},
+	}
+	for _, c := range cases {
+		var (
+			req  = httptest.NewRequest(http.MethodPost, c.target, strings.NewReader(c.body))
+			resp = httptest.NewRecorder()
+		)
+		req.Header.Set("Content-Type", c.contentType)
+		pushReq, ok := parsePushRequest(resp, req)
+		if c.wantCode != "" {
+			if ok || resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), `"code":"`+c.wantCode+`"`) {
+				t.Errorf("%s: ok=%v %d %s", c.name, ok, resp.Code, resp.Body.String())
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: 解析失败 %s", c.name, resp.Body.String())
+			continue
+		}
+		deliverAt := pushReq.deliverTime()
+		if c.wantDelay == 0 {
+			if !deliverAt.IsZero() {
+				t.Errorf("%s: 应立即分发, deliverAt=%v", c.name, deliverAt)
+			}
+			continue
+		}
+		if remain := time.Until(deliverAt); remain > c.wantDelay || remain < c.wantDelay-2*time.Second {
+			t.Errorf("%s: 距分发还有%v, want %v", c.name, remain, c.wantDelay)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/log"
+	"math/rand"
+	"message-center/cmd/logic/config"
+	"message-center/utils"
+	"net/http"
+	"time"
+)
+
+// message server返回的非成功响应
+type StatusError struct {
+	Address string
+	Status  int    // HTTP状态码, gRPC响应按错误码换算
+	Code    string // 推送接口错误码
+	Message string
+}
+
+func (statusErr *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s %d %s %s", utils.MessageServerStatusError.Error(), statusErr.Address, statusErr.Status, statusErr.Code, statusErr.Message)
+}
+
+func (statusErr *StatusError) Unwrap() error {
+	return utils.MessageServerStatusError
+}
+
+// 是否值得重试: 网络错误、5xx和429重试, 其余4xx是请求本身的问题, 重试也不会成功
+func retryable(err error) bool {
+	var (
+		statusErr *StatusError
+	)
+	if err == nil || errors.Is(err, errBatchUnsupported) {
+		return false
+	}
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.Status >= http.StatusInternalServerError || statusErr.Status == http.StatusTooManyRequests
+}
+
+// 第retry次重试前的等待时间: 指数退避, 加上随机抖动避免多个logic同时重试
+func backoff(retry int) time.Duration {
+	var (
+		base     = time.Duration(config.GlobalLogicConfig().MessageServerRetryBackoff) * time.Millisecond
+		maxDelay = time.Duration(config.GlobalLogicConfig().MessageServerRetryMaxBackoff) * time.Millisecond
+		delay    = base
+	)
+	for ; retry > 1 && delay < maxDelay; retry-- {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// 在[delay/2, delay)之间随机
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// 按退避策略重试, 最多MessageServerPushRetry次, 总耗时不超过MessageServerRetryDeadline
+func retryWithBackoff(address string, attempt func() error) (err error) {
+	var (
+		retry    int
+		delay    time.Duration
+		deadline = time.Now().Add(time.Duration(config.GlobalLogicConfig().MessageServerRetryDeadline) * time.Millisecond)
+	)
+	for retry = 0; retry < config.GlobalLogicConfig().MessageServerPushRetry; retry++ {
+		if retry > 0 {
+			// 等待后会超过总时限, 不再重试
+			if delay = backoff(retry); time.Now().Add(delay).After(deadline) {
+				return
+			}
+			time.Sleep(delay)
+		}
+		if err = attempt(); err == nil {
+			return
+		}
+		log.Warn("向message server发送消息失败：" + address + " " + err.Error())
+		if !retryable(err) {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"message-center/cmd/logic/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func initTestRetryConfig(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().MessageServerRetryBackoff = 100
+	config.GlobalLogicConfig().MessageServerRetryMaxBackoff = 1000
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"成功", nil, false},
+		{"不支持批量推送", errBatchUnsupported, false},
+		{"网络错误", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"其他错误", errors.New("unexpected EOF"), true},
+		{"500", &StatusError{Status: http.StatusInternalServerError}, true},
+		{"502", &StatusError{Status: http.StatusBadGateway}, true},
+		{"503", &StatusError{Status: http.StatusServiceUnavailable}, true},
+		{"429", &StatusError{Status: http.StatusTooManyRequests}, true},
+		{"包装后的503", fmt.Errorf("push: %w", &StatusError{Status: http.StatusServiceUnavailable}), true},
+		{"400", &StatusError{Status: http.StatusBadRequest}, false},
+		{"404", &StatusError{Status: http.StatusNotFound}, false},
+		{"409", &StatusError{Status: http.StatusConflict}, false},
+	}
+	for _, c := range cases {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("%s: retryable=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	initTestRetryConfig(t)
+
+	cases := []struct {
+		name     string
+		base     int
+		retry    int
+		wantDown time.Duration // 抖动下限(含)
+		wantUp   time.Duration // 抖动上限(含)
+	}{
+		{"第一次重试", 100, 1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"指数增长", 100, 3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"不超过最大退避", 100, 5, 500 * time.Millisecond, 1000 * time.Millisecond},
+		{"重试次数很大时不溢出", 100, 100, 500 * time.Millisecond, 1000 * time.Millisecond},
+		{"退避为0时不等待", 0, 3, 0, 0},
+	}
+	for _, c := range cases {
+		config.GlobalLogicConfig().MessageServerRetryBackoff = c.base
+		for i := 0; i < 200; i++ {
+			if delay := backoff(c.retry); delay < c.wantDown || delay > c.wantUp {
+				t.Errorf("%s: backoff=%v, want [%v, %v]", c.name, delay, c.wantDown, c.wantUp)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryWithBackoffDeadline(t *testing.T) {
+	initTestRetryConfig(t)
+
+	cases := []struct {
+		name         string
+		retry        int
+		deadline     int     // 毫秒
+		errs         []error // 每次尝试的结果, 超出时沿用最后一个
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"首次成功", 3, 1000, []error{nil}, 1, false},
+		{"重试后成功", 3, 1000, []error{&StatusError{Status: 503}, nil}, 2, false},
+		{"重试次数用完", 3, 1000, []error{&StatusError{Status: 503}}, 3, true},
+		{"不可重试的错误不重试", 3, 1000, []error{&StatusError{Status: 400}}, 1, true},
+		// 第一次退避最多100ms, 前两次退避至少150ms: 总时限120ms只够重试一次
+		{"等待后超过总时限时不再重试", 5, 120, []error{&StatusError{Status: 503}}, 2, true},
+		{"总时限小于第一次退避时不重试", 5, 40, []error{&StatusError{Status: 429}}, 1, true},
+	}
+	for _, c := range cases {
+		var (
+			attempts int
+			start    = time.Now()
+		)
+		config.GlobalLogicConfig().MessageServerPushRetry = c.retry
+		config.GlobalLogicConfig().MessageServerRetryDeadline = c.deadline
+		err := retryWithBackoff("test", func() error {
+			attempts++
+			if attempts > len(c.errs) {
+				return c.errs[len(c.errs)-1]
+			}
+			return c.errs[attempts-1]
+		})
+		if attempts != c.wantAttempts || (err != nil) != c.wantErr {
+			t.Errorf("%s: attempts=%d err=%v, want attempts=%d", c.name, attempts, err, c.wantAttempts)
+		}
+		if elapsed := time.Since(start); elapsed > time.Duration(c.deadline)*time.Millisecond+50*time.Millisecond {
+			t.Errorf("%s: 耗时%v超过总时限%dms", c.name, elapsed, c.deadline)
+		}
+	}
+}
+
+// 每个message server只回调一次结果, 跳过的message server也有结果
+func TestDispatchOutcomePerServer(t *testing.T) {
+	initTestRetryConfig(t)
+	config.GlobalLogicConfig().MessageServerRetryBackoff = 1
+	config.GlobalLogicConfig().MessageServerRetryMaxBackoff = 1
+	config.GlobalLogicConfig().MessageServerPushRetry = 3
+
+	var (
+		statuses    = []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusBadRequest, http.StatusOK}
+		pushCounts  = make([]int32, len(statuses))
+		serverConns []*ServerConn
+		callbacks   int32
+		outcomeChan = make(chan []PushOutcome, 2)
+	)
+	for serverIdx, status := range statuses {
+		serverIdx, status := serverIdx, status
+		server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			// 探测失败, 熔断中的message server不会因探测成功进入半开
+			if req.URL.Path != "/push/room" {
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			atomic.AddInt32(&pushCounts[serverIdx], 1)
+			resp.WriteHeader(status)
+			_, _ = resp.Write([]byte(`{"code":"OK","reached":1}`))
+		}))
+		defer server.Close()
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		portNum, _ := strconv.Atoi(port)
+		serverConn, err := InitMessageServerConn(&config.MessageServerConfig{Hostname: host, Port: portNum}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverConn.Close()
+		serverConns = append(serverConns, serverConn)
+	}
+	// 最后一个message server熔断中
+	serverConns[3].breaker.mutex.Lock()
+	serverConns[3].breaker.setState(CIRCUIT_OPEN)
+	serverConns[3].breaker.mutex.Unlock()
+
+	transport := &serverConnTransport{serverConnMgr: &MessageConnectManager{serverConns: serverConns}}
+	pushJob := newTestRoomJob("a")
+	pushJob.outcome = &outcomeCollector{callback: func(outcomes []PushOutcome) {
+		atomic.AddInt32(&callbacks, 1)
+		outcomeChan <- outcomes
+	}}
+	transport.dispatch(pushJob)
+
+	var outcomes []PushOutcome
+	select {
+	case outcomes = <-outcomeChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有推送结果")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&callbacks); got != 1 {
+		t.Errorf("回调%d次, want 1", got)
+	}
+
+	address2Outcome := make(map[string]PushOutcome)
+	for _, outcome := range outcomes {
+		if _, existed := address2Outcome[outcome.Address]; existed {
+			t.Errorf("message server %s 有多个结果", outcome.Address)
+		}
+		address2Outcome[outcome.Address] = outcome
+	}
+	cases := []struct {
+		name         string
+		wantAttempts int32
+		check        func(outcome PushOutcome) bool
+	}{
+		{"送达", 1, func(outcome PushOutcome) bool { return outcome.Delivered() && outcome.Reached == 1 }},
+		{"503重试后失败", 3, func(outcome PushOutcome) bool { return outcome.Err != nil }},
+		{"400不重试", 1, func(outcome PushOutcome) bool { return outcome.Err != nil }},
+		{"熔断中跳过", 0, func(outcome PushOutcome) bool { return outcome.Skipped == SKIPPED_CIRCUIT_OPEN }},
+	}
+	for serverIdx, c := range cases {
+		outcome, existed := address2Outcome[serverConns[serverIdx].address]
+		if !existed || !c.check(outcome) {
+			t.Errorf("%s: 结果=%+v", c.name, outcome)
+		}
+		if attempts := atomic.LoadInt32(&pushCounts[serverIdx]); attempts != c.wantAttempts {
+			t.Errorf("%s: 请求%d次, want %d", c.name, attempts, c.wantAttempts)
+		}
+	}
+	if len(outcomes) != len(serverConns) {
+		t.Errorf("结果数=%d, want %d", len(outcomes), len(serverConns))
+	}
+}
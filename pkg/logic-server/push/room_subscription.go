@@ -0,0 +1,150 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/log"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// message server上有订阅者的房间
+// 通过长轮询/rooms接口同步: 版本没有变化时message server挂起请求, 有房间增删时立即返回增量
+// 未同步成功或同步过期时视为所有房间都有订阅者
+// 同步成功后立即发起下一次长轮询, message server有房间增加时立即唤醒挂起的请求
+// 注意: 连接加入房间到增量返回之间(一次响应往返)该房间的推送仍会跳过这个message server
+type roomSubscription struct {
+	rwMutex  sync.RWMutex
+	epoch    int64           // message server本次运行的标识
+	version  uint64          // 已同步的房间列表版本
+	rooms    map[string]bool // 有订阅者的房间
+	syncTime time.Time       // 最近一次同步成功的时间
+	client   *http.Client    // 长轮询使用单独的超时时间
+	stopChan chan byte
+}
+
+func initRoomSubscription(transport http.RoundTripper) (subscription *roomSubscription) {
+	subscription = &roomSubscription{
+		rooms: make(map[string]bool),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(config.GlobalLogicConfig().MessageServerRoomSyncWait+config.GlobalLogicConfig().MessageServerTimeout) * time.Millisecond,
+		},
+		stopChan: make(chan byte),
+	}
+	return
+}
+
+// 同步是否有效, 过期则不能据此过滤
+func (subscription *roomSubscription) isFresh() bool {
+	var (
+		maxAge = 3 * time.Duration(config.GlobalLogicConfig().MessageServerRoomSyncWait+config.GlobalLogicConfig().MessageServerTimeout) * time.Millisecond
+	)
+	return !subscription.syncTime.IsZero() && time.Since(subscription.syncTime) < maxAge
+}
+
+// 这些房间中是否有房间在message server上有订阅者
+func (subscription *roomSubscription) hasSubscriber(roomIds ...string) bool {
+	var (
+		roomId string
+	)
+	subscription.rwMutex.RLock()
+	defer subscription.rwMutex.RUnlock()
+
+	if !subscription.isFresh() {
+		return true
+	}
+	for _, roomId = range roomIds {
+		if subscription.rooms[roomId] {
+			return true
+		}
+	}
+	return false
+}
+
+// 持续同步, 直到stop
+// 同步成功后立即重新挂起请求, 不等待间隔, 否则间隔内加入的房间收不到推送; 失败后等待一个长轮询时间再重试
+func (subscription *roomSubscription) syncMain(schema string) {
+	var (
+		err error
+	)
+	for {
+		if err = subscription.syncOnce(schema); err != nil {
+			log.Warn("同步message server房间订阅失败：" + err.Error())
+			select {
+			case <-subscription.stopChan:
+				return
+			case <-time.After(time.Duration(config.GlobalLogicConfig().MessageServerRoomSyncWait) * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case <-subscription.stopChan:
+			return
+		default:
+		}
+	}
+}
+
+func (subscription *roomSubscription) syncOnce(schema string) (err error) {
+	var (
+		apiUrl string
+		resp   *http.Response
+		body   []byte
+		digest types.RoomDigest
+		change types.RoomChange
+		roomId string
+	)
+
+	subscription.rwMutex.RLock()
+	apiUrl = schema + "/rooms?epoch=" + strconv.FormatInt(subscription.epoch, 10) +
+		"&version=" + strconv.FormatUint(subscription.version, 10) +
+		"&wait=" + strconv.Itoa(config.GlobalLogicConfig().MessageServerRoomSyncWait)
+	subscription.rwMutex.RUnlock()
+
+	if resp, err = subscription.client.Get(apiUrl); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s %d", utils.MessageServerStatusError, apiUrl, resp.StatusCode)
+	}
+	if err = json.Unmarshal(body, &digest); err != nil {
+		return
+	}
+
+	subscription.rwMutex.Lock()
+	defer subscription.rwMutex.Unlock()
+
+	if digest.Full {
+		subscription.rooms = make(map[string]bool, len(digest.Rooms))
+		for _, roomId = range digest.Rooms {
+			subscription.rooms[roomId] = true
+		}
+	} else {
+		for _, change = range digest.Changes {
+			if change.Join {
+				subscription.rooms[change.Room] = true
+			} else {
+				delete(subscription.rooms, change.Room)
+			}
+		}
+	}
+	subscription.epoch = digest.Epoch
+	subscription.version = digest.Version
+	subscription.syncTime = time.Now()
+	return
+}
+
+func (subscription *roomSubscription) stop() {
+	close(subscription.stopChan)
+}
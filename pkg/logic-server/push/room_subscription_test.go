@@ -0,0 +1,268 @@
+package push
+
+import (
+	"encoding/json"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func initTestRoomConfig(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().MessageServerRoomSyncWait = 1000
+}
+
+// 模拟message server的房间订阅: 房间增加时唤醒挂起的/rooms请求, 总是返回全量房间列表
+type fakeRooms struct {
+	mutex      sync.Mutex
+	version    uint64
+	rooms      []string
+	notifyChan chan byte
+	pushCount  int32 // 收到的推送请求数
+}
+
+func newFakeRooms(rooms ...string) *fakeRooms {
+	return &fakeRooms{version: 1, rooms: rooms, notifyChan: make(chan byte)}
+}
+
+func (fake *fakeRooms) join(roomId string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.rooms = append(fake.rooms, roomId)
+	fake.version++
+	close(fake.notifyChan)
+	fake.notifyChan = make(chan byte)
+}
+
+func (fake *fakeRooms) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/rooms":
+		fake.mutex.Lock()
+		notifyChan := fake.notifyChan
+		unchanged := req.URL.Query().Get("version") == strconv.FormatUint(fake.version, 10)
+		fake.mutex.Unlock()
+		if unchanged {
+			select {
+			case <-notifyChan:
+			case <-time.After(time.Second):
+			}
+		}
+		fake.mutex.Lock()
+		buf, _ := json.Marshal(&types.RoomDigest{Epoch: 1, Version: fake.version, Full: true, Rooms: fake.rooms})
+		fake.mutex.Unlock()
+		_, _ = resp.Write(buf)
+	case "/push/room":
+		atomic.AddInt32(&fake.pushCount, 1)
+		_, _ = resp.Write([]byte(`{"code":"OK","reached":1}`))
+	}
+}
+
+// 等待同步到房间, 超时返回false
+func waitSubscriber(subscription *roomSubscription, roomId string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		subscription.rwMutex.RLock()
+		synced := subscription.rooms[roomId]
+		subscription.rwMutex.RUnlock()
+		if synced {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestRoomSubscriptionSyncOnce(t *testing.T) {
+	var (
+		digests   []*types.RoomDigest
+		gotQuery  string
+		statusErr bool
+	)
+	initTestRoomConfig(t)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		gotQuery = req.URL.Query().Get("epoch") + "/" + req.URL.Query().Get("version")
+		if statusErr {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		buf, _ := json.Marshal(digests[0])
+		_, _ = resp.Write(buf)
+	}))
+	defer server.Close()
+	subscription := initRoomSubscription(http.DefaultTransport)
+
+	cases := []struct {
+		name      string
+		digest    *types.RoomDigest
+		statusErr bool
+		wantQuery string // 请求携带的epoch/version
+		wantRooms []string
+		wantErr   bool
+	}{
+		{"首次全量同步", &types.RoomDigest{Epoch: 1, Version: 2, Full: true, Rooms: []string{"a", "b"}}, false, "0/0", []string{"a", "b"}, false},
+		{"增量加入和离开", &types.RoomDigest{Epoch: 1, Version: 4, Changes: []types.RoomChange{{Room: "c", Join: true}, {Room: "a"}}}, false, "1/2", []string{"b", "c"}, false},
+		{"没有变化", &types.RoomDigest{Epoch: 1, Version: 4}, false, "1/4", []string{"b", "c"}, false},
+		{"message server重启后全量替换", &types.RoomDigest{Epoch: 2, Version: 1, Full: true, Rooms: []string{"d"}}, false, "1/4", []string{"d"}, false},
+		{"状态码错误时保持原状态", nil, true, "2/1", []string{"d"}, true},
+	}
+	for _, c := range cases {
+		digests, statusErr = []*types.RoomDigest{c.digest}, c.statusErr
+		err := subscription.syncOnce(server.URL)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err=%v", c.name, err)
+		}
+		if gotQuery != c.wantQuery {
+			t.Errorf("%s: 请求epoch/version=%s, want %s", c.name, gotQuery, c.wantQuery)
+		}
+		if len(subscription.rooms) != len(c.wantRooms) {
+			t.Errorf("%s: rooms=%v, want %v", c.name, subscription.rooms, c.wantRooms)
+		}
+		for _, roomId := range c.wantRooms {
+			if !subscription.rooms[roomId] {
+				t.Errorf("%s: rooms=%v, want %v", c.name, subscription.rooms, c.wantRooms)
+			}
+		}
+	}
+}
+
+func TestRoomSubscriptionFresh(t *testing.T) {
+	initTestRoomConfig(t)
+	maxAge := 3 * time.Duration(config.GlobalLogicConfig().MessageServerRoomSyncWait+config.GlobalLogicConfig().MessageServerTimeout) * time.Millisecond
+
+	cases := []struct {
+		name     string
+		syncTime time.Time
+		roomIds  []string
+		want     bool
+	}{
+		{"从未同步成功时视为有订阅者", time.Time{}, []string{"x"}, true},
+		{"同步有效时有订阅者", time.Now(), []string{"a"}, true},
+		{"同步有效时没有订阅者", time.Now(), []string{"x"}, false},
+		{"多房间中有一个有订阅者", time.Now(), []string{"x", "a"}, true},
+		{"同步过期时视为有订阅者", time.Now().Add(-maxAge), []string{"x"}, true},
+	}
+	for _, c := range cases {
+		subscription := initRoomSubscription(http.DefaultTransport)
+		subscription.rooms["a"] = true
+		subscription.syncTime = c.syncTime
+		if got := subscription.hasSubscriber(c.roomIds...); got != c.want {
+			t.Errorf("%s: hasSubscriber=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 同步成功后立即重新挂起请求, 连续加入的房间都能立即同步到
+func TestRoomSubscriptionSyncMainWakeOnJoin(t *testing.T) {
+	initTestRoomConfig(t)
+	fake := newFakeRooms()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	subscription := initRoomSubscription(http.DefaultTransport)
+	go subscription.syncMain(server.URL)
+	defer subscription.stop()
+
+	for _, roomId := range []string{"a", "b", "c"} {
+		fake.join(roomId)
+		if !waitSubscriber(subscription, roomId, 50*time.Millisecond) {
+			t.Fatalf("加入房间%s后没有立即同步", roomId)
+		}
+	}
+}
+
+// 分发时跳过没有订阅者的message server, 同步过期时推送给所有message server
+func TestDispatchSkipsNoSubscriber(t *testing.T) {
+	initTestRoomConfig(t)
+	config.GlobalLogicConfig().MessageServerRoomRouting = true
+
+	var (
+		fakes       = []*fakeRooms{newFakeRooms("a"), newFakeRooms("b")}
+		serverConns []*ServerConn
+	)
+	for _, fake := range fakes {
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		portNum, _ := strconv.Atoi(port)
+		serverConn, err := InitMessageServerConn(&config.MessageServerConfig{Hostname: host, Port: portNum}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverConn.Close()
+		serverConns = append(serverConns, serverConn)
+	}
+	if !waitSubscriber(serverConns[0].rooms, "a", time.Second) || !waitSubscriber(serverConns[1].rooms, "b", time.Second) {
+		t.Fatal("房间订阅没有同步")
+	}
+	serverConnMgr := &MessageConnectManager{
+		serverConns:  serverConns,
+		dispatchChan: make(chan *PushJob, 1),
+		priorityChan: make(chan *PushJob, 1),
+		stopChan:     make(chan byte),
+	}
+	serverConnMgr.transport = &serverConnTransport{serverConnMgr: serverConnMgr}
+	go serverConnMgr.dispatchWorkerMain(0)
+	defer close(serverConnMgr.stopChan)
+
+	cases := []struct {
+		name       string
+		roomId     string
+		stale      bool   // 第二个message server的同步过期
+		wantPushed []bool // 各message server是否收到推送
+	}{
+		{"只推送给有订阅者的message server", "a", false, []bool{true, false}},
+		{"都没有订阅者", "x", false, []bool{false, false}},
+		{"同步过期时推送给所有message server", "a", true, []bool{true, true}},
+	}
+	for _, c := range cases {
+		// 换成不再同步的订阅, 房间仍然没有订阅者但同步已过期
+		if c.stale {
+			serverConns[1].rooms.stop()
+			serverConns[1].rooms = initRoomSubscription(http.DefaultTransport)
+			serverConns[1].rooms.rooms["b"] = true
+		}
+		for _, fake := range fakes {
+			atomic.StoreInt32(&fake.pushCount, 0)
+		}
+		outcomeChan := make(chan []PushOutcome, 1)
+		err := serverConnMgr.PushRoomWithOutcome(c.roomId, []json.RawMessage{json.RawMessage(`{}`)}, nil, func(outcomes []PushOutcome) {
+			outcomeChan <- outcomes
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outcomes []PushOutcome
+		select {
+		case outcomes = <-outcomeChan:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: 没有推送结果", c.name)
+		}
+		address2Outcome := make(map[string]PushOutcome)
+		for _, outcome := range outcomes {
+			address2Outcome[outcome.Address] = outcome
+		}
+		for serverIdx, serverConn := range serverConns {
+			outcome := address2Outcome[serverConn.address]
+			pushed := atomic.LoadInt32(&fakes[serverIdx].pushCount) == 1
+			if pushed != c.wantPushed[serverIdx] {
+				t.Errorf("%s: message server %d 收到推送=%v", c.name, serverIdx, pushed)
+			}
+			if c.wantPushed[serverIdx] && !outcome.Delivered() {
+				t.Errorf("%s: message server %d 结果=%+v, want 送达", c.name, serverIdx, outcome)
+			}
+			if !c.wantPushed[serverIdx] && outcome.Skipped != SKIPPED_NO_SUBSCRIBER {
+				t.Errorf("%s: message server %d 结果=%+v, want %s", c.name, serverIdx, outcome, SKIPPED_NO_SUBSCRIBER)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/prometheus/common/log"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/configuration"
+	"message-center/pkg/mongodb"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 定时推送状态
+const (
+	SCHEDULE_STATUS_PENDING    = "pending"    // 等待到期
+	SCHEDULE_STATUS_DISPATCHED = "dispatched" // 已进入分发队列
+	SCHEDULE_STATUS_CANCELLED  = "cancelled"  // 已取消
+)
+
+const scheduledPushCollection = "scheduled_push"
+
+// 持久化在mongodb中的定时推送, _id即返回给调用方的pushId
+// 到期后由某个logic通过findAndModify抢占租约(owner, lease_expire)后分发, 租约过期前其他logic不会重复分发
+type scheduledPush struct {
+	Id           bson.ObjectId      `bson:"_id" json:"pushId"`
+	PushType     int                `bson:"push_type" json:"pushType"`
+	Room         string             `bson:"room,omitempty" json:"room,omitempty"`
+	Rooms        []string           `bson:"rooms,omitempty" json:"rooms,omitempty"`
+	Uid          string             `bson:"uid,omitempty" json:"uid,omitempty"`
+	ItemsJson    string             `bson:"items" json:"-"` // json编码的消息数组
+	Items        json.RawMessage    `bson:"-" json:"items"`
+	Exclude      *types.PushExclude `bson:"exclude,omitempty" json:"exclude,omitempty"`
+	Priority     string             `bson:"priority,omitempty" json:"priority,omitempty"`
+	Ttl          int                `bson:"ttl,omitempty" json:"ttl,omitempty"` // 从分发时开始计算
+	ApiKey       string             `bson:"api_key,omitempty" json:"-"`         // 创建者, 只能查询和取消自己的定时推送
+	DeliverAt    time.Time          `bson:"deliver_at" json:"deliverAt"`
+	Status       string             `bson:"status" json:"status"`
+	CreateTime   time.Time          `bson:"create_time" json:"createTime"`
+	DispatchTime time.Time          `bson:"dispatch_time,omitempty" json:"dispatchTime,omitempty"`
+	Result       string             `bson:"result,omitempty" json:"result,omitempty"` // 各message server的推送结果
+	Owner        string             `bson:"owner,omitempty" json:"-"`                 // 持有租约的logic
+	LeaseExpire  time.Time          `bson:"lease_expire,omitempty" json:"-"`
+}
+
+func (scheduled *scheduledPush) newPushJob() (pushJob *PushJob, err error) {
+	pushJob = &PushJob{
+		pushType: scheduled.PushType,
+		roomId:   scheduled.Room,
+		roomIds:  scheduled.Rooms,
+		identity: scheduled.Uid,
+		exclude:  scheduled.Exclude,
+		priority: scheduled.Priority == PUSH_PRIORITY_HIGH,
+	}
+	if err = json.Unmarshal([]byte(scheduled.ItemsJson), &pushJob.items); err != nil {
+		return nil, err
+	}
+	if scheduled.Ttl > 0 {
+		pushJob.expireAt = time.Now().Add(time.Duration(scheduled.Ttl) * time.Second)
+	}
+	return
+}
+
+// 定时推送调度: 定时查找到期的推送, 抢占租约后放入分发队列
+// 多个logic副本共用同一个集合, 每个推送只由抢到租约的副本分发; 分发后未能更新状态时, 租约过期后会被再次分发
+type Scheduler struct {
+	dbController *mongodb.MongoDBController
+	owner        string // 本logic的标识
+	stopChan     chan byte
+}
+
+func InitScheduler(dbController *mongodb.MongoDBController) (err error) {
+	var (
+		scheduler *Scheduler
+		hostname  string
+		session   *mgo.Session
+	)
+	hostname, _ = os.Hostname()
+	scheduler = &Scheduler{
+		dbController: dbController,
+		owner:        hostname + "-" + strconv.Itoa(os.Getpid()),
+		stopChan:     make(chan byte),
+	}
+
+	session = dbController.NewStrongSession()
+	defer session.Close()
+	if err = scheduler.collection(session).EnsureIndexKey("status", "deliver_at"); err != nil {
+		return
+	}
+
+	GlobalScheduler = scheduler
+	go scheduler.fireMain()
+	return
+}
+
+func (scheduler *Scheduler) collection(session *mgo.Session) *mgo.Collection {
+	return session.DB(configuration.DB).C(scheduledPushCollection)
+}
+
+// 保存定时推送
+func (scheduler *Scheduler) schedule(scheduled *scheduledPush) (err error) {
+	var (
+		session = scheduler.dbController.NewStrongSession()
+	)
+	defer session.Close()
+
+	scheduled.Status = SCHEDULE_STATUS_PENDING
+	scheduled.CreateTime = time.Now()
+	return scheduler.collection(session).Insert(scheduled)
+}
+
+// 按创建者和状态查询, 按到期时间排序
+func (scheduler *Scheduler) list(apiKey *config.ApiKeyConfig, status string, limit int) (scheduledPushes []*scheduledPush, err error) {
+	var (
+		session   = scheduler.dbController.NewSession()
+		query     = bson.M{}
+		scheduled *scheduledPush
+	)
+	defer session.Close()
+
+	if apiKey != nil {
+		query["api_key"] = apiKey.Key
+	}
+	if status != "" {
+		query["status"] = status
+	}
+	scheduledPushes = []*scheduledPush{}
+	if err = scheduler.collection(session).Find(query).Sort("deliver_at").Limit(limit).All(&scheduledPushes); err != nil {
+		return
+	}
+	for _, scheduled = range scheduledPushes {
+		scheduled.Items = json.RawMessage(scheduled.ItemsJson)
+	}
+	return
+}
+
+// 取消等待中的定时推送, 正在分发(租约未过期)或已分发的推送不能取消
+func (scheduler *Scheduler) cancel(apiKey *config.ApiKeyConfig, pushId string) (err error) {
+	var (
+		session = scheduler.dbController.NewStrongSession()
+		query   bson.M
+	)
+	defer session.Close()
+
+	if !bson.IsObjectIdHex(pushId) {
+		return utils.ScheduledPushNotFound
+	}
+	query = ownedQuery(apiKey, bson.ObjectIdHex(pushId))
+	err = scheduler.collection(session).Update(cancelQuery(query, time.Now()), bson.M{"$set": bson.M{"status": SCHEDULE_STATUS_CANCELLED}})
+	if err == mgo.ErrNotFound {
+		// 区分不存在和不能取消
+		if count, _ := scheduler.collection(session).Find(query).Count(); count == 0 {
+			return utils.ScheduledPushNotFound
+		}
+		return utils.ScheduledPushNotPending
+	}
+	return
+}
+
+// 创建者的定时推送, apiKey为nil时不限制创建者
+func ownedQuery(apiKey *config.ApiKeyConfig, pushId bson.ObjectId) bson.M {
+	query := bson.M{"_id": pushId}
+	if apiKey != nil {
+		query["api_key"] = apiKey.Key
+	}
+	return query
+}
+
+// 可取消的定时推送: 满足query, 等待中并且没有租约或租约已过期
+func cancelQuery(query bson.M, now time.Time) bson.M {
+	cancellable := bson.M{
+		"status": SCHEDULE_STATUS_PENDING,
+		"$or":    leaseFreeQuery(now),
+	}
+	for key, value := range query {
+		cancellable[key] = value
+	}
+	return cancellable
+}
+
+// 可抢占的定时推送: 已到期的等待中推送, 并且没有租约或租约已过期
+func claimQuery(now time.Time) bson.M {
+	return bson.M{
+		"status":     SCHEDULE_STATUS_PENDING,
+		"deliver_at": bson.M{"$lte": now},
+		"$or":        leaseFreeQuery(now),
+	}
+}
+
+// 没有租约或租约已过期
+func leaseFreeQuery(now time.Time) []bson.M {
+	return []bson.M{{"lease_expire": bson.M{"$exists": false}}, {"lease_expire": bson.M{"$lt": now}}}
+}
+
+// 定时查找到期的推送
+func (scheduler *Scheduler) fireMain() {
+	for {
+		select {
+		case <-scheduler.stopChan:
+			return
+		case <-time.After(time.Duration(config.GlobalLogicConfig().ScheduleInterval) * time.Millisecond):
+		}
+		scheduler.fireDue()
+	}
+}
+
+// 逐个抢占到期的推送并分发, 每轮最多ScheduleBatchSize个
+func (scheduler *Scheduler) fireDue() {
+	var (
+		session   = scheduler.dbController.NewStrongSession()
+		scheduled *scheduledPush
+		fired     int
+		err       error
+	)
+	defer session.Close()
+
+	for fired = 0; fired < config.GlobalLogicConfig().ScheduleBatchSize; fired++ {
+		if scheduled, err = scheduler.claim(session); err != nil {
+			if err != mgo.ErrNotFound {
+				log.Warn("抢占定时推送失败：" + err.Error())
+			}
+			return
+		}
+		if err = scheduler.fire(session, scheduled); err != nil {
+			log.Warn("分发定时推送失败：" + scheduled.Id.Hex() + " " + err.Error())
+			// 分发队列已满等情况, 停止本轮, 租约过期后重新分发
+			return
+		}
+	}
+}
+
+// 抢占一个到期且没有有效租约的推送, 没有时返回mgo.ErrNotFound
+func (scheduler *Scheduler) claim(session *mgo.Session) (scheduled *scheduledPush, err error) {
+	var (
+		now   = time.Now()
+		lease = time.Duration(config.GlobalLogicConfig().ScheduleLeaseTime) * time.Second
+	)
+	scheduled = &scheduledPush{}
+	_, err = scheduler.collection(session).Find(claimQuery(now)).Sort("deliver_at").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"owner": scheduler.owner, "lease_expire": now.Add(lease)}},
+		ReturnNew: true,
+	}, scheduled)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 放入分发队列后标记为已分发, 推送结果异步写回
+func (scheduler *Scheduler) fire(session *mgo.Session, scheduled *scheduledPush) (err error) {
+	var (
+		pushJob *PushJob
+		pushId  = scheduled.Id
+	)
+	if pushJob, err = scheduled.newPushJob(); err != nil {
+		// 消息无法解析, 不再重试
+		log.Warn("丢弃无法解析的定时推送：" + pushId.Hex() + " " + err.Error())
+		return scheduler.collection(session).UpdateId(pushId, bson.M{"$set": bson.M{
+			"status": SCHEDULE_STATUS_DISPATCHED, "dispatch_time": time.Now(), "result": err.Error(),
+		}})
+	}
+	pushJob.outcome = &outcomeCollector{callback: func(outcomes []PushOutcome) {
+		go scheduler.saveResult(pushId, outcomes)
+	}}
+
+	if err = GlobalConnectManager.dispatch(pushJob); err != nil {
+		return
+	}
+	return scheduler.collection(session).Update(bson.M{"_id": pushId, "owner": scheduler.owner}, bson.M{"$set": bson.M{
+		"status": SCHEDULE_STATUS_DISPATCHED, "dispatch_time": time.Now(),
+	}})
+}
+
+// 记录各message server的推送结果, 格式: address 结果;address 结果
+func (scheduler *Scheduler) saveResult(pushId bson.ObjectId, outcomes []PushOutcome) {
+	var (
+		session = scheduler.dbController.NewStrongSession()
+		results []string
+		outcome PushOutcome
+		status  string
+	)
+	defer session.Close()
+
+	for _, outcome = range outcomes {
+		status = "ok"
+		if outcome.Skipped != "" {
+			status = "skipped: " + outcome.Skipped
+		} else if outcome.Err != nil {
+			status = outcome.Err.Error()
+		}
+		results = append(results, fmt.Sprintf("%s %s", outcome.Address, status))
+	}
+	if err := scheduler.collection(session).UpdateId(pushId, bson.M{"$set": bson.M{"result": strings.Join(results, ";")}}); err != nil {
+		log.Warn("更新定时推送结果失败：" + pushId.Hex() + " " + err.Error())
+	}
+}
+
+func (scheduler *Scheduler) Close() {
+	close(scheduler.stopChan)
+}
@@ -0,0 +1,123 @@
+package push
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"message-center/cmd/logic/config"
+	"testing"
+	"time"
+)
+
+// 按mongodb的语义判断文档是否满足查询, 只支持定时推送查询用到的$or、$lt、$lte、$exists和相等
+func matchQuery(doc bson.M, query bson.M) bool {
+	for key, cond := range query {
+		if key == "$or" {
+			matched := false
+			for _, sub := range cond.([]bson.M) {
+				matched = matched || matchQuery(doc, sub)
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		value, exists := doc[key]
+		ops, isOps := cond.(bson.M)
+		if !isOps {
+			if !exists || value != cond {
+				return false
+			}
+			continue
+		}
+		for op, operand := range ops {
+			switch op {
+			case "$exists":
+				if exists != operand.(bool) {
+					return false
+				}
+			case "$lt", "$lte":
+				valueTime, ok := value.(time.Time)
+				if !ok || valueTime.After(operand.(time.Time)) || (op == "$lt" && valueTime.Equal(operand.(time.Time))) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// 定时推送按保存到mongodb后的字段判断
+func scheduledDoc(t *testing.T, scheduled *scheduledPush) (doc bson.M) {
+	buf, err := bson.Marshal(scheduled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bson.Unmarshal(buf, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestScheduleClaimQuery(t *testing.T) {
+	var (
+		now = time.Now().Truncate(time.Millisecond)
+	)
+	cases := []struct {
+		name      string
+		scheduled *scheduledPush
+		want      bool
+	}{
+		{"已到期", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now.Add(-time.Second)}, true},
+		{"恰好到期", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now}, true},
+		{"未到期", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now.Add(time.Second)}, false},
+		{"已分发", &scheduledPush{Status: SCHEDULE_STATUS_DISPATCHED, DeliverAt: now.Add(-time.Second)}, false},
+		{"已取消", &scheduledPush{Status: SCHEDULE_STATUS_CANCELLED, DeliverAt: now.Add(-time.Second)}, false},
+		{"租约有效", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now.Add(-time.Second), Owner: "logic-a", LeaseExpire: now.Add(time.Minute)}, false},
+		{"租约恰好到期", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now.Add(-time.Second), Owner: "logic-a", LeaseExpire: now}, false},
+		{"租约已过期, 由其他logic重新分发", &scheduledPush{Status: SCHEDULE_STATUS_PENDING, DeliverAt: now.Add(-time.Minute), Owner: "logic-a", LeaseExpire: now.Add(-time.Second)}, true},
+	}
+	for _, c := range cases {
+		c.scheduled.Id = bson.NewObjectId()
+		if got := matchQuery(scheduledDoc(t, c.scheduled), claimQuery(now)); got != c.want {
+			t.Errorf("%s: 可抢占=%v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 只能取消自己的等待中且没有有效租约的推送, 不能取消时区分不存在和不能取消
+func TestScheduleCancelQuery(t *testing.T) {
+	var (
+		now    = time.Now().Truncate(time.Millisecond)
+		apiKey = &config.ApiKeyConfig{Key: "key-a"}
+	)
+	cases := []struct {
+		name       string
+		scheduled  *scheduledPush
+		apiKey     *config.ApiKeyConfig
+		wantCancel bool
+		wantExists bool // 不能取消时是否存在, 存在时返回ScheduledPushNotPending
+	}{
+		{"等待中", &scheduledPush{ApiKey: "key-a", Status: SCHEDULE_STATUS_PENDING}, apiKey, true, true},
+		{"未限制创建者", &scheduledPush{ApiKey: "key-b", Status: SCHEDULE_STATUS_PENDING}, nil, true, true},
+		{"其他创建者的推送", &scheduledPush{ApiKey: "key-b", Status: SCHEDULE_STATUS_PENDING}, apiKey, false, false},
+		{"正在分发时不能取消", &scheduledPush{ApiKey: "key-a", Status: SCHEDULE_STATUS_PENDING, Owner: "logic-a", LeaseExpire: now.Add(time.Minute)}, apiKey, false, true},
+		{"租约过期后可以取消", &scheduledPush{ApiKey: "key-a", Status: SCHEDULE_STATUS_PENDING, Owner: "logic-a", LeaseExpire: now.Add(-time.Second)}, apiKey, true, true},
+		{"已分发", &scheduledPush{ApiKey: "key-a", Status: SCHEDULE_STATUS_DISPATCHED}, apiKey, false, true},
+		{"已取消", &scheduledPush{ApiKey: "key-a", Status: SCHEDULE_STATUS_CANCELLED}, apiKey, false, true},
+	}
+	for _, c := range cases {
+		c.scheduled.Id = bson.NewObjectId()
+		var (
+			doc   = scheduledDoc(t, c.scheduled)
+			query = ownedQuery(c.apiKey, c.scheduled.Id)
+		)
+		if got := matchQuery(doc, cancelQuery(query, now)); got != c.wantCancel {
+			t.Errorf("%s: 可取消=%v, want %v", c.name, got, c.wantCancel)
+		}
+		if got := matchQuery(doc, query); got != c.wantExists {
+			t.Errorf("%s: 存在=%v, want %v", c.name, got, c.wantExists)
+		}
+		if matchQuery(doc, cancelQuery(ownedQuery(c.apiKey, bson.NewObjectId()), now)) {
+			t.Errorf("%s: 不应取消其他推送", c.name)
+		}
+	}
+}
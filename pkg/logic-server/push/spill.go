@@ -0,0 +1,482 @@
+package push
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/log"
+	"io"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spillSegmentSuffix         = ".log"
+	spillCursorFile            = "cursor"
+	spillDefaultSegmentSize    = 64                      // 单位MB
+	spillDefaultReplayInterval = 1000 * time.Millisecond // 未配置重放间隔时使用
+)
+
+// 溢出队列: 推送积压时写入本地文件, 容量恢复后按写入顺序重放
+// 文件按段追加写入, 每行一个json编码的types.PushEnvelope, 已重放的位置记录在cursor文件中
+// 每次启动都写入新的段, 避免在上次异常退出时写了一半的行后面继续追加
+type spillQueue struct {
+	mutex       sync.Mutex
+	dir         string
+	segmentSize int64
+
+	writeSeg  int64    // 正在写入的段
+	writeFile *os.File // 正在写入的文件
+	writeSize int64    // 正在写入的段的大小
+	dirty     bool     // 有未fsync的写入
+
+	readSeg    int64         // 正在重放的段
+	readOffset int64         // 下一条待重放记录在段内的偏移
+	readFile   *os.File      // 正在重放的文件
+	reader     *bufio.Reader // readFile在readOffset处的读取器
+	peeked     []byte        // 已读出但尚未确认的记录, 包含换行符
+
+	appended uint64 // 写入的推送数, 原子操作
+	replayed uint64 // 重放的推送数, 原子操作
+
+	deliver    func(pushJob *PushJob) bool // 重放目标, message server连接重建后切换到新的连接
+	closed     bool
+	notifyChan chan byte // 有新记录写入
+	stopChan   chan byte
+}
+
+// 队列已关闭
+var errSpillClosed = errors.New("spill queue closed")
+
+func segmentPath(dir string, seg int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seg, spillSegmentSuffix))
+}
+
+// 打开目录下的溢出队列, 目录不存在则创建
+func openSpillQueue(dir string) (queue *spillQueue, err error) {
+	var (
+		fileInfos []os.FileInfo
+		fileInfo  os.FileInfo
+		segs      []int64
+		seg       int64
+		cursor    []byte
+		fields    []string
+	)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if fileInfos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, fileInfo = range fileInfos {
+		if !strings.HasSuffix(fileInfo.Name(), spillSegmentSuffix) {
+			continue
+		}
+		if seg, err = strconv.ParseInt(strings.TrimSuffix(fileInfo.Name(), spillSegmentSuffix), 10, 64); err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	err = nil
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+
+	queue = &spillQueue{
+		dir:         dir,
+		segmentSize: int64(config.GlobalLogicConfig().MessageServerSpillSegmentSize) << 20,
+		notifyChan:  make(chan byte, 1),
+		stopChan:    make(chan byte),
+	}
+	if queue.segmentSize <= 0 {
+		queue.segmentSize = spillDefaultSegmentSize << 20
+	}
+
+	// 重放位置: cursor文件不存在或指向的段已删除时, 从最早的段开始
+	if len(segs) > 0 {
+		queue.readSeg = segs[0]
+		queue.writeSeg = segs[len(segs)-1] + 1
+	}
+	if cursor, err = ioutil.ReadFile(filepath.Join(dir, spillCursorFile)); err == nil {
+		if fields = strings.Fields(string(cursor)); len(fields) == 2 {
+			seg, _ = strconv.ParseInt(fields[0], 10, 64)
+			if seg >= queue.readSeg {
+				queue.readSeg = seg
+				queue.readOffset, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		}
+	}
+	err = nil
+	if queue.readSeg > queue.writeSeg {
+		queue.readSeg, queue.readOffset = queue.writeSeg, 0
+	}
+
+	queue.skipConsumed()
+
+	if queue.writeFile, err = os.OpenFile(segmentPath(dir, queue.writeSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	go queue.syncMain()
+	return
+}
+
+// 删除启动前已重放完的段, 避免重启后误判为有积压, 使新的推送都写入溢出队列
+func (queue *spillQueue) skipConsumed() {
+	for queue.readSeg < queue.writeSeg {
+		fileInfo, err := os.Stat(segmentPath(queue.dir, queue.readSeg))
+		if err == nil && queue.readOffset < fileInfo.Size() {
+			return
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		queue.nextSegment()
+	}
+}
+
+// 是否还有未重放的记录, 需持有锁
+func (queue *spillQueue) pending() bool {
+	return queue.peeked != nil || queue.readSeg < queue.writeSeg || queue.readOffset < queue.writeSize
+}
+
+// 追加一个推送
+func (queue *spillQueue) append(pushJob *PushJob) (err error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.appendLocked(pushJob)
+}
+
+// 队列中还有未重放的记录时追加, 保证后来的推送不会越过积压的推送; 队列为空时返回false
+func (queue *spillQueue) appendIfPending(pushJob *PushJob) (appended bool, err error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if !queue.pending() {
+		return false, nil
+	}
+	return true, queue.appendLocked(pushJob)
+}
+
+func (queue *spillQueue) appendLocked(pushJob *PushJob) (err error) {
+	var (
+		envelope *types.PushEnvelope
+		buf      []byte
+	)
+	if queue.closed {
+		return errSpillClosed
+	}
+	if envelope, err = pushJob.envelope(); err != nil {
+		return
+	}
+	if buf, err = json.Marshal(envelope); err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+
+	// 当前段已满, 切换到新的段
+	if queue.writeSize > 0 && queue.writeSize+int64(len(buf)) > queue.segmentSize {
+		_ = queue.writeFile.Sync()
+		_ = queue.writeFile.Close()
+		queue.writeSeg++
+		queue.writeSize = 0
+		if queue.writeFile, err = os.OpenFile(segmentPath(queue.dir, queue.writeSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return
+		}
+	}
+	if _, err = queue.writeFile.Write(buf); err != nil {
+		return
+	}
+	queue.writeSize += int64(len(buf))
+	queue.dirty = true
+	atomic.AddUint64(&queue.appended, 1)
+
+	select {
+	case queue.notifyChan <- 1:
+	default:
+	}
+	return
+}
+
+// 读出下一条待重放的记录, 没有记录时返回nil
+func (queue *spillQueue) peek() (pushJob *PushJob, err error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return nil, errSpillClosed
+	}
+	return queue.peekLocked()
+}
+
+func (queue *spillQueue) peekLocked() (pushJob *PushJob, err error) {
+	var (
+		line     []byte
+		envelope types.PushEnvelope
+	)
+	for queue.peeked == nil {
+		if queue.reader == nil {
+			if queue.readFile, err = os.Open(segmentPath(queue.dir, queue.readSeg)); err != nil {
+				// 段文件已不存在
+				if os.IsNotExist(err) && queue.readSeg < queue.writeSeg {
+					queue.nextSegment()
+					continue
+				}
+				return
+			}
+			if _, err = queue.readFile.Seek(queue.readOffset, io.SeekStart); err != nil {
+				return
+			}
+			queue.reader = bufio.NewReader(queue.readFile)
+		}
+
+		if line, err = queue.reader.ReadBytes('\n'); err == nil {
+			queue.peeked = line
+			break
+		}
+		if err != io.EOF {
+			return
+		}
+		err = nil
+		// 当前段读完, 删除后继续读下一个段; 段末尾不完整的行是异常退出时写了一半的记录, 丢弃
+		if queue.readSeg < queue.writeSeg {
+			if len(line) > 0 {
+				log.Warn("丢弃溢出队列中不完整的记录：" + segmentPath(queue.dir, queue.readSeg))
+			}
+			queue.nextSegment()
+			continue
+		}
+		// 没有新的记录
+		return nil, nil
+	}
+
+	if err = json.Unmarshal(queue.peeked, &envelope); err == nil {
+		pushJob, err = newPushJobFromEnvelope(&envelope)
+	}
+	if err != nil {
+		// 无法解析的记录直接跳过, 避免阻塞后续重放
+		log.Warn("丢弃溢出队列中无法解析的记录：" + err.Error())
+		queue.commitLocked()
+		return nil, err
+	}
+	return
+}
+
+// 切换到下一个段并删除已读完的段, 需持有锁
+func (queue *spillQueue) nextSegment() {
+	if queue.readFile != nil {
+		_ = queue.readFile.Close()
+		queue.readFile = nil
+	}
+	queue.reader = nil
+	_ = os.Remove(segmentPath(queue.dir, queue.readSeg))
+	queue.readSeg++
+	queue.readOffset = 0
+	queue.saveCursor()
+}
+
+// 确认peek读出的记录已重放
+func (queue *spillQueue) commit() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.commitLocked()
+}
+
+func (queue *spillQueue) commitLocked() {
+	if queue.peeked == nil {
+		return
+	}
+	queue.readOffset += int64(len(queue.peeked))
+	queue.peeked = nil
+	atomic.AddUint64(&queue.replayed, 1)
+	queue.saveCursor()
+}
+
+// 先写临时文件再改名, 保证cursor文件完整
+func (queue *spillQueue) saveCursor() {
+	var (
+		tmpPath = filepath.Join(queue.dir, spillCursorFile+".tmp")
+		err     error
+	)
+	if err = ioutil.WriteFile(tmpPath, []byte(fmt.Sprintf("%d %d", queue.readSeg, queue.readOffset)), 0644); err == nil {
+		err = os.Rename(tmpPath, filepath.Join(queue.dir, spillCursorFile))
+	}
+	if err != nil {
+		log.Warn("保存溢出队列重放位置失败：" + err.Error())
+	}
+}
+
+// 设置重放目标, 首次设置时启动重放协程; message server连接重建后由新的连接接管重放
+func (queue *spillQueue) replayTo(deliver func(pushJob *PushJob) bool) {
+	queue.mutex.Lock()
+	started := queue.deliver != nil
+	queue.deliver = deliver
+	queue.mutex.Unlock()
+
+	if !started {
+		go queue.replayMain()
+	}
+}
+
+// 按写入顺序重放, deliver返回false时稍后重试同一条记录, 直到stop
+func (queue *spillQueue) replayMain() {
+	var (
+		pushJob *PushJob
+		deliver func(pushJob *PushJob) bool
+		err     error
+	)
+	for {
+		if pushJob, err = queue.peek(); err == errSpillClosed {
+			return
+		} else if err != nil {
+			log.Warn("读取溢出队列失败：" + queue.dir + " " + err.Error())
+		}
+		queue.mutex.Lock()
+		deliver = queue.deliver
+		queue.mutex.Unlock()
+		if pushJob != nil && deliver(pushJob) {
+			queue.commit()
+			continue
+		}
+
+		// 没有记录时等待写入, 投递失败时等待重试间隔
+		select {
+		case <-queue.stopChan:
+			return
+		case <-queue.notifyChan:
+			if pushJob != nil {
+				time.Sleep(spillReplayInterval())
+			}
+		case <-time.After(spillReplayInterval()):
+		}
+	}
+}
+
+func spillReplayInterval() time.Duration {
+	if interval := config.GlobalLogicConfig().MessageServerSpillReplayInterval; interval > 0 {
+		return time.Duration(interval) * time.Millisecond
+	}
+	return spillDefaultReplayInterval
+}
+
+// 写入和重放的推送数
+func (queue *spillQueue) counts() (appended uint64, replayed uint64) {
+	return atomic.LoadUint64(&queue.appended), atomic.LoadUint64(&queue.replayed)
+}
+
+// 定时fsync, 避免每次写入都等待磁盘
+func (queue *spillQueue) syncMain() {
+	for {
+		select {
+		case <-queue.stopChan:
+			return
+		case <-time.After(time.Second):
+		}
+		queue.mutex.Lock()
+		if queue.dirty && !queue.closed {
+			_ = queue.writeFile.Sync()
+			queue.dirty = false
+		}
+		queue.mutex.Unlock()
+	}
+}
+
+func (queue *spillQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+	close(queue.stopChan)
+	_ = queue.writeFile.Sync()
+	_ = queue.writeFile.Close()
+	if queue.readFile != nil {
+		_ = queue.readFile.Close()
+		queue.readFile = nil
+		queue.reader = nil
+	}
+}
+
+// 关闭队列, 把未重放的推送按顺序追加到target, 全部转交后删除队列目录; 用于移除message server时转交给其他message server
+// 转交失败时剩余的记录保留在磁盘上, 该message server重新加入时继续重放
+func (queue *spillQueue) handOff(target *spillQueue) (moved int, err error) {
+	var (
+		pushJob   *PushJob
+		seg       int64
+		offset    int64
+		remaining bool
+	)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return 0, errSpillClosed
+	}
+	queue.closed = true
+	close(queue.stopChan)
+	_ = queue.writeFile.Sync()
+	_ = queue.writeFile.Close()
+
+	for queue.pending() {
+		seg, offset = queue.readSeg, queue.readOffset
+		if pushJob, err = queue.peekLocked(); err != nil || pushJob == nil {
+			// 跳过了无法解析的记录, 继续转交后面的记录
+			if queue.readSeg != seg || queue.readOffset != offset {
+				err = nil
+				continue
+			}
+			break
+		}
+		if err = target.append(pushJob); err != nil {
+			break
+		}
+		queue.commitLocked()
+		moved++
+	}
+	remaining = queue.pending()
+	if queue.readFile != nil {
+		_ = queue.readFile.Close()
+		queue.readFile = nil
+		queue.reader = nil
+	}
+	if err == nil && !remaining {
+		err = os.RemoveAll(queue.dir)
+	}
+	return
+}
+
+// 由溢出记录还原推送
+func newPushJobFromEnvelope(envelope *types.PushEnvelope) (pushJob *PushJob, err error) {
+	pushJob = &PushJob{
+		pushType: envelope.PushType,
+		roomId:   envelope.Room,
+		roomIds:  envelope.Rooms,
+		identity: envelope.User,
+		exclude:  envelope.Exclude,
+		wait:     envelope.Wait,
+		priority: envelope.Priority,
+	}
+	if envelope.ExpireAt > 0 {
+		pushJob.expireAt = time.Unix(0, envelope.ExpireAt*int64(time.Millisecond))
+	}
+	if err = json.Unmarshal(envelope.Items, &pushJob.items); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 每个message server一个溢出目录
+func spillDir(name string) string {
+	return filepath.Join(config.GlobalLogicConfig().MessageServerSpillDir, strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(name))
+}
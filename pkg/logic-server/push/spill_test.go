@@ -0,0 +1,394 @@
+package push
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/types"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func initTestSpillConfig(t *testing.T) (dir string) {
+	var (
+		err error
+	)
+	os.Unsetenv("CONFIG")
+	if err = config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalLogicConfig().MessageServerSpillReplayInterval = 10
+	if dir, err = ioutil.TempDir("", "spill"); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func newTestRoomJob(roomId string) *PushJob {
+	return &PushJob{
+		pushType: types.PUSH_TYPE_ROOM,
+		roomId:   roomId,
+		items:    []json.RawMessage{json.RawMessage(`{"room":"` + roomId + `"}`)},
+	}
+}
+
+// 读出并确认队列中所有待重放的推送, 返回房间ID
+func drainSpill(t *testing.T, queue *spillQueue) (roomIds []string) {
+	for {
+		pushJob, err := queue.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pushJob == nil {
+			return
+		}
+		roomIds = append(roomIds, pushJob.roomId)
+		queue.commit()
+	}
+}
+
+func roomSequence(from int, to int) (roomIds []string) {
+	for i := from; i < to; i++ {
+		roomIds = append(roomIds, "room-"+strconv.Itoa(i))
+	}
+	return
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSpillQueueReplayOrder(t *testing.T) {
+	cases := []struct {
+		name        string
+		segmentSize int64 // 0表示使用配置
+		count       int
+		failEvery   int // 每failEvery次投递失败一次, 0表示不失败
+	}{
+		{"单个段", 0, 20, 0},
+		{"跨多个段", 200, 20, 0},
+		{"投递失败后重试同一条记录", 200, 10, 3},
+	}
+	for _, c := range cases {
+		var (
+			dir      = initTestSpillConfig(t)
+			queue    *spillQueue
+			attempts int
+			gotChan  = make(chan string, c.count)
+			got      []string
+			err      error
+		)
+		if queue, err = openSpillQueue(dir); err != nil {
+			t.Fatal(err)
+		}
+		if c.segmentSize > 0 {
+			queue.segmentSize = c.segmentSize
+		}
+		for _, roomId := range roomSequence(0, c.count) {
+			if err = queue.append(newTestRoomJob(roomId)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		queue.replayTo(func(pushJob *PushJob) bool {
+			attempts++
+			if c.failEvery > 0 && attempts%c.failEvery == 0 {
+				return false
+			}
+			gotChan <- pushJob.roomId
+			return true
+		})
+		for len(got) < c.count {
+			select {
+			case roomId := <-gotChan:
+				got = append(got, roomId)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: 重放超时, 已重放%v", c.name, got)
+			}
+		}
+		queue.close()
+
+		if !equalStrings(got, roomSequence(0, c.count)) {
+			t.Errorf("%s: 重放顺序%v", c.name, got)
+		}
+		if appended, replayed := queue.counts(); appended != uint64(c.count) || replayed != uint64(c.count) {
+			t.Errorf("%s: appended=%d replayed=%d", c.name, appended, replayed)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// 溢出记录还原出的推送与写入前一致
+func TestSpillEnvelopeRoundTrip(t *testing.T) {
+	var (
+		expireAt = time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	)
+	cases := []struct {
+		name    string
+		pushJob *PushJob
+	}{
+		{"房间推送带排除条件", &PushJob{pushType: types.PUSH_TYPE_ROOM, roomId: "room-a", exclude: &types.PushExclude{ConnIds: []uint64{7}, Tags: []string{"bot"}}}},
+		{"多房间推送", &PushJob{pushType: types.PUSH_TYPE_ROOMS, roomIds: []string{"room-a", "room-b"}}},
+		{"用户推送", &PushJob{pushType: types.PUSH_TYPE_USER, identity: "user-a"}},
+		{"保留等待送达、优先级和过期时间", &PushJob{pushType: types.PUSH_TYPE_ALL, wait: true, priority: true, expireAt: expireAt}},
+	}
+	for _, c := range cases {
+		var (
+			dir   = initTestSpillConfig(t)
+			queue *spillQueue
+			got   *PushJob
+			err   error
+		)
+		c.pushJob.items = []json.RawMessage{json.RawMessage(`{"a":1}`), json.RawMessage(`"text"`)}
+		if queue, err = openSpillQueue(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err = queue.append(c.pushJob); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = queue.peek(); err != nil || got == nil {
+			t.Fatalf("%s: peek: %v", c.name, err)
+		}
+		queue.close()
+		os.RemoveAll(dir)
+
+		if got.pushType != c.pushJob.pushType || got.roomId != c.pushJob.roomId || !equalStrings(got.roomIds, c.pushJob.roomIds) || got.identity != c.pushJob.identity {
+			t.Errorf("%s: 目标不一致 %+v", c.name, got)
+		}
+		if (got.exclude == nil) != (c.pushJob.exclude == nil) || (got.exclude != nil && (got.exclude.ConnIds[0] != 7 || got.exclude.Tags[0] != "bot")) {
+			t.Errorf("%s: 排除条件不一致 %+v", c.name, got.exclude)
+		}
+		if len(got.items) != 2 || string(got.items[0]) != `{"a":1}` || string(got.items[1]) != `"text"` {
+			t.Errorf("%s: 消息不一致 %s", c.name, got.items)
+		}
+		if got.wait != c.pushJob.wait || got.priority != c.pushJob.priority || !got.expireAt.Equal(c.pushJob.expireAt) {
+			t.Errorf("%s: wait=%v priority=%v expireAt=%v", c.name, got.wait, got.priority, got.expireAt)
+		}
+	}
+}
+
+// 连接重建后切换重放目标, 未确认的记录由新的目标重放
+func TestSpillQueueReplayRetarget(t *testing.T) {
+	var (
+		dir      = initTestSpillConfig(t)
+		queue    *spillQueue
+		attempts = make(chan string, 16)
+		gotChan  = make(chan string, 2)
+		err      error
+	)
+	defer os.RemoveAll(dir)
+	if queue, err = openSpillQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.close()
+	_ = queue.append(newTestRoomJob("room-0"))
+	_ = queue.append(newTestRoomJob("room-1"))
+
+	// 旧连接一直投递失败
+	queue.replayTo(func(pushJob *PushJob) bool {
+		select {
+		case attempts <- pushJob.roomId:
+		default:
+		}
+		return false
+	})
+	select {
+	case <-attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("旧目标未开始重放")
+	}
+	queue.replayTo(func(pushJob *PushJob) bool {
+		gotChan <- pushJob.roomId
+		return true
+	})
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case roomId := <-gotChan:
+			got = append(got, roomId)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("新目标重放超时, 已重放%v", got)
+		}
+	}
+	if !equalStrings(got, []string{"room-0", "room-1"}) {
+		t.Errorf("新目标重放%v", got)
+	}
+}
+
+func TestSpillQueueRestart(t *testing.T) {
+	cases := []struct {
+		name      string
+		appended  int
+		committed int
+		corrupt   string // 重启前追加到最后一个段末尾的内容
+	}{
+		{"从cursor位置继续重放", 5, 2, ""},
+		{"全部重放后重启没有积压", 5, 5, ""},
+		{"丢弃写了一半的记录", 5, 1, `{"pushType":1,"ro`},
+		{"跳过无法解析的记录", 5, 0, "not json\n"},
+	}
+	for _, c := range cases {
+		var (
+			dir   = initTestSpillConfig(t)
+			queue *spillQueue
+			file  *os.File
+			err   error
+		)
+		if queue, err = openSpillQueue(dir); err != nil {
+			t.Fatal(err)
+		}
+		for _, roomId := range roomSequence(0, c.appended) {
+			if err = queue.append(newTestRoomJob(roomId)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < c.committed; i++ {
+			if _, err = queue.peek(); err != nil {
+				t.Fatal(err)
+			}
+			queue.commit()
+		}
+		queue.close()
+
+		if c.corrupt != "" {
+			if file, err = os.OpenFile(segmentPath(dir, queue.writeSeg), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = file.WriteString(c.corrupt)
+			file.Close()
+		}
+
+		// 重启后写入新的段, 新的推送排在积压的推送后面
+		if queue, err = openSpillQueue(dir); err != nil {
+			t.Fatal(err)
+		}
+		if appended, _ := queue.appendIfPending(newTestRoomJob("room-new")); appended != (c.committed < c.appended || c.corrupt != "") {
+			t.Errorf("%s: appendIfPending=%v", c.name, appended)
+		}
+
+		want := roomSequence(c.committed, c.appended)
+		if c.committed < c.appended || c.corrupt != "" {
+			want = append(want, "room-new")
+		}
+		var got []string
+		for {
+			pushJob, err := queue.peek()
+			if err != nil {
+				// 无法解析的记录已被跳过
+				continue
+			}
+			if pushJob == nil {
+				break
+			}
+			got = append(got, pushJob.roomId)
+			queue.commit()
+		}
+		if !equalStrings(got, want) {
+			t.Errorf("%s: 重放%v, want %v", c.name, got, want)
+		}
+		queue.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSpillQueueSkipConsumed(t *testing.T) {
+	var (
+		dir   = initTestSpillConfig(t)
+		queue *spillQueue
+		err   error
+	)
+	defer os.RemoveAll(dir)
+
+	if queue, err = openSpillQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	_ = queue.append(newTestRoomJob("room-0"))
+	drainSpill(t, queue)
+	queue.close()
+
+	// 已重放完的段在启动时删除, 队列为空, 新的推送不写入溢出队列
+	if queue, err = openSpillQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.close()
+	if _, err = os.Stat(segmentPath(dir, 0)); !os.IsNotExist(err) {
+		t.Errorf("已重放完的段应被删除: %v", err)
+	}
+	if appended, _ := queue.appendIfPending(newTestRoomJob("room-1")); appended {
+		t.Error("队列为空时不应写入")
+	}
+}
+
+func TestSpillQueueHandOff(t *testing.T) {
+	cases := []struct {
+		name      string
+		source    int // 源队列中的推送数
+		committed int // 转交前已重放的推送数
+		target    int // 目标队列中已有的推送数
+	}{
+		{"空队列", 0, 0, 0},
+		{"转交未重放的推送", 5, 2, 0},
+		{"排在目标已有推送后面", 3, 0, 2},
+	}
+	for _, c := range cases {
+		var (
+			sourceDir = initTestSpillConfig(t)
+			targetDir = initTestSpillConfig(t)
+			source    *spillQueue
+			target    *spillQueue
+			moved     int
+			err       error
+		)
+		if source, err = openSpillQueue(sourceDir); err != nil {
+			t.Fatal(err)
+		}
+		if target, err = openSpillQueue(targetDir); err != nil {
+			t.Fatal(err)
+		}
+		for _, roomId := range roomSequence(0, c.source) {
+			_ = source.append(newTestRoomJob("source-" + roomId))
+		}
+		for i := 0; i < c.committed; i++ {
+			_, _ = source.peek()
+			source.commit()
+		}
+		for _, roomId := range roomSequence(0, c.target) {
+			_ = target.append(newTestRoomJob("target-" + roomId))
+		}
+
+		if moved, err = source.handOff(target); err != nil || moved != c.source-c.committed {
+			t.Errorf("%s: moved=%d err=%v", c.name, moved, err)
+		}
+		// 全部转交后删除源队列目录
+		if _, err = os.Stat(sourceDir); !os.IsNotExist(err) {
+			t.Errorf("%s: 源队列目录应被删除: %v", c.name, err)
+		}
+		if _, err = source.handOff(target); err != errSpillClosed {
+			t.Errorf("%s: 重复转交应返回errSpillClosed: %v", c.name, err)
+		}
+
+		var want []string
+		for _, roomId := range roomSequence(0, c.target) {
+			want = append(want, "target-"+roomId)
+		}
+		for _, roomId := range roomSequence(c.committed, c.source) {
+			want = append(want, "source-"+roomId)
+		}
+		if got := drainSpill(t, target); !equalStrings(got, want) {
+			t.Errorf("%s: 目标队列%v, want %v", c.name, got, want)
+		}
+		target.close()
+		os.RemoveAll(targetDir)
+	}
+}
@@ -0,0 +1,159 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"message-center/cmd/logic/config"
+	"message-center/pkg/backbone"
+	"message-center/pkg/mq"
+	"message-center/pkg/types"
+	"message-center/utils"
+)
+
+// 推送通道
+// http/grpc: 每个message server一个ServerConn, 逐个推送
+// inprocess/stomp: 全局一个, 推送一次即可到达所有message server
+type Transport interface {
+	Push(pushJob *PushJob) (reached int, err error) // 等待送达时返回消息写入发送队列的连接数, 无法等待的通道返回0
+	Close()
+}
+
+// 单个message server的HTTP/gRPC推送
+var _ Transport = (*ServerConn)(nil)
+
+// 按配置创建推送通道, http通道逐个推送serverConnMgr中的message server
+func InitBroadcastTransport(serverConnMgr *MessageConnectManager) (transport Transport, err error) {
+	switch config.GlobalLogicConfig().Backbone {
+	case "", backbone.BACKBONE_HTTP:
+		return &serverConnTransport{serverConnMgr: serverConnMgr}, nil
+	case backbone.BACKBONE_INPROCESS:
+		return &inProcessTransport{}, nil
+	case backbone.BACKBONE_STOMP:
+		return initStompTransport(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", utils.BackboneInvalid, config.GlobalLogicConfig().Backbone)
+}
+
+// 逐个message server推送(http/grpc), 跳过没有订阅者的message server, 熔断或并发已满时写入溢出队列或跳过
+type serverConnTransport struct {
+	serverConnMgr *MessageConnectManager
+}
+
+// 分发到所有message server后立即返回, 各message server的结果登记到pushJob.outcome
+// 分发协程使用, 不等待推送完成, 并发由各ServerConn的pendingChan控制
+func (transport *serverConnTransport) dispatch(pushJob *PushJob) {
+	var (
+		serverConn  *ServerConn
+		serverConns []*ServerConn
+	)
+	for _, serverConn = range transport.serverConnMgr.ServerConns() {
+		// 分发期间已被移除或重建的连接不再推送
+		if !serverConn.acquire() {
+			continue
+		}
+		if transport.serverConnMgr.admit(serverConn, pushJob) {
+			serverConns = append(serverConns, serverConn)
+		} else {
+			serverConn.release()
+		}
+	}
+	// 先登记推送数, 再发起推送
+	if pushJob.outcome != nil {
+		pushJob.outcome.start(len(serverConns))
+	}
+	for _, serverConn = range serverConns {
+		go transport.serverConnMgr.doPush(serverConn, pushJob)
+	}
+}
+
+// 推送到所有message server并等待结果, 返回送达的连接数之和; 有message server推送失败时返回错误
+func (transport *serverConnTransport) Push(pushJob *PushJob) (reached int, err error) {
+	var (
+		outcomeChan = make(chan []PushOutcome, 1)
+		callback    OutcomeCallback
+		outcome     PushOutcome
+	)
+	callback = func(outcomes []PushOutcome) {
+		outcomeChan <- outcomes
+	}
+	// 调用方已关心结果时, 先回调调用方
+	if pushJob.outcome != nil {
+		onOutcome := pushJob.outcome.callback
+		callback = func(outcomes []PushOutcome) {
+			onOutcome(outcomes)
+			outcomeChan <- outcomes
+		}
+	}
+	pushJob.outcome = &outcomeCollector{callback: callback}
+	transport.dispatch(pushJob)
+
+	for _, outcome = range <-outcomeChan {
+		reached += outcome.Reached
+		if outcome.Failed() && err == nil {
+			err = utils.PushServerFailed
+		}
+	}
+	return
+}
+
+// message server连接由MessageConnectManager管理, 无需关闭
+func (transport *serverConnTransport) Close() {}
+
+// 同进程内直接调用message server, message server需先注册
+type inProcessTransport struct{}
+
+func (transport *inProcessTransport) Push(pushJob *PushJob) (reached int, err error) {
+	var (
+		receiver backbone.Receiver
+		envelope *types.PushEnvelope
+		pushResp *types.PushResponse
+	)
+	if receiver = backbone.InProcess(); receiver == nil {
+		return 0, utils.BackboneReceiverMissing
+	}
+	if envelope, err = pushJob.envelope(); err != nil {
+		return
+	}
+	if pushResp = receiver.Receive(envelope); pushResp.Code != types.PUSH_CODE_OK {
+		return 0, fmt.Errorf("%w: %s %s", utils.MessageServerStatusError, pushResp.Code, pushResp.Message)
+	}
+	return pushResp.Reached, nil
+}
+
+func (transport *inProcessTransport) Close() {}
+
+// 向activemq topic发布一次, 所有message server订阅同一topic
+type stompTransport struct {
+	controller *mq.MqController
+	topic      string
+}
+
+func initStompTransport() (transport *stompTransport) {
+	transport = &stompTransport{
+		controller: &mq.MqController{},
+		topic:      config.GlobalLogicConfig().BackboneStompTopic,
+	}
+	transport.controller.Configure(config.GlobalLogicConfig().BackboneStompAddress,
+		config.GlobalLogicConfig().BackboneStompUsername, config.GlobalLogicConfig().BackboneStompPassword)
+	return
+}
+
+// 发布后不等待message server处理, 无法获得送达的连接数
+func (transport *stompTransport) Push(pushJob *PushJob) (reached int, err error) {
+	var (
+		envelope *types.PushEnvelope
+		buf      []byte
+	)
+	if envelope, err = pushJob.envelope(); err != nil {
+		return
+	}
+	envelope.Wait = false
+	if buf, err = json.Marshal(envelope); err != nil {
+		return
+	}
+	return 0, transport.controller.Publish(transport.topic, buf)
+}
+
+func (transport *stompTransport) Close() {
+	transport.controller.Close()
+}
@@ -0,0 +1,224 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-stomp/stomp/server"
+	"github.com/gorilla/websocket"
+	"message-center/cmd/logic/config"
+	messageConfig "message-center/cmd/message/config"
+	message_server "message-center/pkg/message-server"
+	web_socket "message-center/pkg/message-server/web-socket"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 同一进程内启动stomp broker和message server, 分别经http、inprocess、stomp通道推送到同一个websocket连接
+func TestTransportDeliversToRoom(t *testing.T) {
+	var (
+		broker      net.Listener
+		wsPort      int
+		servicePort int
+		wsConn      *websocket.Conn
+		serverConn  *ServerConn
+		received    = make(chan string, 64)
+		err         error
+	)
+	os.Unsetenv("CONFIG")
+
+	if broker, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	go server.Serve(broker)
+
+	if wsPort, err = freePort(); err != nil {
+		t.Fatal(err)
+	}
+	if servicePort, err = freePort(); err != nil {
+		t.Fatal(err)
+	}
+
+	// message server: 提供HTTP接口, 注册同进程接收方, 订阅topic, websocket连接加入房间
+	_ = messageConfig.LoadConfig()
+	messageConfig.GlobalServerConfig().WsPort = wsPort
+	messageConfig.GlobalServerConfig().ServicePort = servicePort
+	messageConfig.GlobalServerConfig().MaxMergerDelay = 10
+	messageConfig.GlobalServerConfig().Backbone = "stomp"
+	messageConfig.GlobalServerConfig().BackboneStompAddress = broker.Addr().String()
+	if err = web_socket.InitConnectManager(); err != nil {
+		t.Fatal(err)
+	}
+	if err = web_socket.InitSocketEndpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err = web_socket.InitMessageMerger(); err != nil {
+		t.Fatal(err)
+	}
+	if err = message_server.InitHttpService(); err != nil {
+		t.Fatal(err)
+	}
+	defer message_server.HttpServerClose()
+	if err = message_server.InitBackbone(); err != nil {
+		t.Fatal(err)
+	}
+	defer message_server.BackboneClose()
+
+	if wsConn, _, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:"+strconv.Itoa(wsPort)+"/connect", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+	if err = wsConn.WriteMessage(websocket.TextMessage, []byte(`{"type": "JOIN", "data": {"room": "transport-room"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			_, data, err := wsConn.ReadMessage()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(data)
+		}
+	}()
+
+	// logic: http通道推送到这个message server
+	_ = config.LoadConfig()
+	if serverConn, err = InitMessageServerConn(&config.MessageServerConfig{Hostname: "127.0.0.1", Port: servicePort}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	serverConnMgr := &MessageConnectManager{serverConns: []*ServerConn{serverConn}}
+
+	cases := []struct {
+		backbone    string
+		wantReached int // 等待送达时写入发送队列的连接数, stomp无法等待
+	}{
+		{"http", 1},
+		{"inprocess", 1},
+		{"stomp", 0},
+	}
+	for _, c := range cases {
+		var (
+			transport Transport
+			marker    = `"via":"` + c.backbone + `"`
+			delivered bool
+			deadline  = time.Now().Add(5 * time.Second)
+		)
+		config.GlobalLogicConfig().Backbone = c.backbone
+		config.GlobalLogicConfig().BackboneStompAddress = broker.Addr().String()
+		if transport, err = InitBroadcastTransport(serverConnMgr); err != nil {
+			t.Fatal(err)
+		}
+
+		// 加入房间和订阅topic都是异步完成的, 未收到时重新推送
+		for !delivered && time.Now().Before(deadline) {
+			reached, err := transport.Push(&PushJob{
+				pushType: types.PUSH_TYPE_ROOM,
+				roomId:   "transport-room",
+				items:    []json.RawMessage{json.RawMessage(`{` + marker + `}`)},
+				wait:     true,
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", c.backbone, err)
+			}
+			timeout := time.After(200 * time.Millisecond)
+		receive:
+			for {
+				select {
+				case data, ok := <-received:
+					if !ok {
+						t.Fatal("websocket连接已断开")
+					}
+					if strings.Contains(data, marker) {
+						delivered = true
+						if reached != c.wantReached {
+							t.Errorf("%s: reached=%d, want %d", c.backbone, reached, c.wantReached)
+						}
+						break receive
+					}
+				case <-timeout:
+					break receive
+				}
+			}
+		}
+		transport.Close()
+		if !delivered {
+			t.Errorf("推送未经%s通道送达websocket连接", c.backbone)
+		}
+	}
+}
+
+func TestInitBroadcastTransport(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	_ = config.LoadConfig()
+
+	cases := []struct {
+		backbone string
+		wantType string // 为空表示应返回错误
+	}{
+		{"", "*push.serverConnTransport"},
+		{"http", "*push.serverConnTransport"},
+		{"inprocess", "*push.inProcessTransport"},
+		{"stomp", "*push.stompTransport"},
+		{"kafka", ""},
+	}
+	for _, c := range cases {
+		config.GlobalLogicConfig().Backbone = c.backbone
+		transport, err := InitBroadcastTransport(&MessageConnectManager{})
+		if c.wantType == "" {
+			if !errors.Is(err, utils.BackboneInvalid) {
+				t.Errorf("backbone %s: err=%v, want %v", c.backbone, err, utils.BackboneInvalid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("backbone %s: %v", c.backbone, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", transport); got != c.wantType {
+			t.Errorf("backbone %s: %s, want %s", c.backbone, got, c.wantType)
+		}
+	}
+}
+
+// 没有可用的message server时逐个推送的通道返回失败
+func TestServerConnTransportNoServer(t *testing.T) {
+	var (
+		outcomes []PushOutcome
+	)
+	os.Unsetenv("CONFIG")
+	_ = config.LoadConfig()
+
+	transport := &serverConnTransport{serverConnMgr: &MessageConnectManager{}}
+	pushJob := newTestRoomJob("a")
+	pushJob.outcome = &outcomeCollector{callback: func(result []PushOutcome) {
+		outcomes = result
+	}}
+	reached, err := transport.Push(pushJob)
+	if reached != 0 || !errors.Is(err, utils.PushServerFailed) {
+		t.Errorf("reached=%d err=%v", reached, err)
+	}
+	if len(outcomes) != 1 || outcomes[0].Skipped != SKIPPED_NO_SERVER {
+		t.Errorf("调用方的回调应收到结果: %+v", outcomes)
+	}
+}
+
+func freePort() (port int, err error) {
+	var (
+		listener net.Listener
+	)
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	port = listener.Addr().(*net.TCPAddr).Port
+	err = listener.Close()
+	return
+}
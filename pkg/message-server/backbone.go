@@ -0,0 +1,128 @@
+package message_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"message-center/cmd/message/config"
+	"message-center/pkg/backbone"
+	web_socket "message-center/pkg/message-server/web-socket"
+	"message-center/pkg/mq"
+	"message-center/pkg/types"
+	"message-center/utils"
+)
+
+// 从推送通道接收logic推送, 与HTTP接口共用合并队列
+type envelopeReceiver struct{}
+
+var (
+	backboneStopChan chan byte
+)
+
+// 注册同进程接收方; 配置为stomp时订阅topic
+func InitBackbone() error {
+	var (
+		receiver   = &envelopeReceiver{}
+		controller *mq.MqController
+	)
+	backbone.RegisterInProcess(receiver)
+
+	switch config.GlobalServerConfig().Backbone {
+	case "", backbone.BACKBONE_HTTP, backbone.BACKBONE_INPROCESS:
+		return nil
+	case backbone.BACKBONE_STOMP:
+	default:
+		return fmt.Errorf("%w: %s", utils.BackboneInvalid, config.GlobalServerConfig().Backbone)
+	}
+
+	controller = &mq.MqController{}
+	controller.Configure(config.GlobalServerConfig().BackboneStompAddress,
+		config.GlobalServerConfig().BackboneStompUsername, config.GlobalServerConfig().BackboneStompPassword)
+	backboneStopChan = make(chan byte)
+	go controller.Subscribe(config.GlobalServerConfig().BackboneStompTopic, receiver.receiveMessage, backboneStopChan)
+	return nil
+}
+
+// topic消息是序列化的PushEnvelope, 无法回复, 处理失败只记录日志
+func (receiver *envelopeReceiver) receiveMessage(message []byte) {
+	var (
+		envelope types.PushEnvelope
+		pushResp *types.PushResponse
+	)
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		logrus.Warn("解析推送通道消息失败：" + err.Error())
+		return
+	}
+	// 无法回复, 不等待送达
+	envelope.Wait = false
+	if pushResp = receiver.Receive(&envelope); pushResp.Code != types.PUSH_CODE_OK {
+		logrus.Warnf("推送通道消息处理失败：%s, 丢弃%d条", pushResp.Code, pushResp.Dropped)
+	}
+}
+
+// 同进程推送, 调用方阻塞等待结果, 可等待送达
+func (receiver *envelopeReceiver) Receive(envelope *types.PushEnvelope) *types.PushResponse {
+	return receiveEnvelope(envelope)
+}
+
+// 解析消息数组后提交到合并队列, 推送通道与批量推送接口共用
+func receiveEnvelope(envelope *types.PushEnvelope) (pushResp *types.PushResponse) {
+	var (
+		delivery *web_socket.Delivery
+	)
+	pushResp, delivery = submitEnvelope(envelope)
+	awaitDelivery(pushResp, delivery, deliveryDeadline())
+	return
+}
+
+// 解析消息数组后提交到合并队列, envelope.Wait时返回跟踪送达的delivery
+func submitEnvelope(envelope *types.PushEnvelope) (*types.PushResponse, *web_socket.Delivery) {
+	var (
+		msgArr []json.RawMessage
+	)
+	if err := json.Unmarshal(envelope.Items, &msgArr); err != nil {
+		return &types.PushResponse{Code: types.PUSH_CODE_INVALID_ITEMS, Message: err.Error()}, nil
+	}
+	return submitEnvelopeItems(envelope, msgArr)
+}
+
+// 按推送类型提交到合并队列, 消息数组已由调用方解析, envelope.Items不再使用
+func submitEnvelopeItems(envelope *types.PushEnvelope, msgArr []json.RawMessage) (*types.PushResponse, *web_socket.Delivery) {
+	var (
+		rooms []string
+	)
+	switch envelope.PushType {
+	case types.PUSH_TYPE_ALL:
+		return submitItems(msgArr, envelope.Wait, func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+			return web_socket.GlobalMessageMergeServer.PushAll(msg, envelope.Exclude, delivery)
+		})
+	case types.PUSH_TYPE_ROOM:
+		if envelope.Room == "" {
+			return &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()}, nil
+		}
+		return submitItems(msgArr, envelope.Wait, func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+			return web_socket.GlobalMessageMergeServer.PushRoom(envelope.Room, msg, envelope.Exclude, delivery)
+		})
+	case types.PUSH_TYPE_ROOMS:
+		if rooms = utils.SortedUnique(envelope.Rooms); len(rooms) == 0 {
+			return &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()}, nil
+		}
+		return submitItems(msgArr, envelope.Wait, func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+			return web_socket.GlobalMessageMergeServer.PushRooms(rooms, msg, envelope.Exclude, delivery)
+		})
+	case types.PUSH_TYPE_USER:
+		if envelope.User == "" {
+			return &types.PushResponse{Code: types.PUSH_CODE_INVALID_USER, Message: utils.UserIdInvalid.Error()}, nil
+		}
+		return submitItems(msgArr, envelope.Wait, func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+			return web_socket.GlobalMessageMergeServer.PushUser(envelope.User, msg, envelope.Exclude, delivery)
+		})
+	}
+	return &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: "unknown push type"}, nil
+}
+
+func BackboneClose() {
+	if backboneStopChan != nil {
+		close(backboneStopChan)
+	}
+}
@@ -0,0 +1,26 @@
+package message_server
+
+import (
+	"message-center/cmd/message/config"
+	"message-center/pkg/certs"
+	"sync"
+)
+
+var (
+	internalCerts     *certs.Reloader
+	internalCertsOnce sync.Once
+	internalCertsErr  error
+)
+
+// 内部通讯证书, HTTP与gRPC服务共用, 文件变化后自动重新加载; 未配置证书时返回nil
+// 配置了clientCa时要求logic出示由该CA签发的客户端证书
+func internalTLS() (*certs.Reloader, error) {
+	internalCertsOnce.Do(func() {
+		if config.GlobalServerConfig().ServerPem == "" || config.GlobalServerConfig().ServerKey == "" {
+			return
+		}
+		internalCerts, internalCertsErr = certs.NewReloader(config.GlobalServerConfig().ServerPem,
+			config.GlobalServerConfig().ServerKey, config.GlobalServerConfig().ClientCa)
+	})
+	return internalCerts, internalCertsErr
+}
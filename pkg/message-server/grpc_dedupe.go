@@ -0,0 +1,77 @@
+package message_server
+
+import (
+	"message-center/cmd/message/config"
+	"message-center/pkg/rpc"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"sync"
+	"time"
+)
+
+// 一个推送ID的处理结果
+type grpcPushRecord struct {
+	doneChan chan byte      // 处理完成后关闭
+	reply    *rpc.PushReply // 处理结果, doneChan关闭后有效
+	expire   time.Time
+}
+
+// 按推送ID去重: logic等待回复超时后会用同一推送ID重试, 已处理过的推送直接返回首次的结果
+type grpcDeduper struct {
+	mutex     sync.Mutex
+	records   map[string]*grpcPushRecord
+	lastSweep time.Time
+}
+
+var (
+	grpcPushes = &grpcDeduper{records: make(map[string]*grpcPushRecord)}
+)
+
+// 登记推送ID, 窗口内已登记过时返回首次的记录; 没有推送ID时不去重, 返回nil
+func (deduper *grpcDeduper) reserve(pushId string) (record *grpcPushRecord, exists bool) {
+	var (
+		now    = time.Now()
+		window = time.Duration(config.GlobalServerConfig().GrpcDedupeWindow) * time.Millisecond
+	)
+	if pushId == "" || window <= 0 {
+		return nil, false
+	}
+	deduper.mutex.Lock()
+	defer deduper.mutex.Unlock()
+
+	// 每个窗口清理一次过期的记录
+	if now.Sub(deduper.lastSweep) >= window {
+		for key, record := range deduper.records {
+			if now.After(record.expire) {
+				delete(deduper.records, key)
+			}
+		}
+		deduper.lastSweep = now
+	}
+
+	if record, exists = deduper.records[pushId]; exists && now.Before(record.expire) {
+		return record, true
+	}
+	record = &grpcPushRecord{doneChan: make(chan byte), expire: now.Add(window)}
+	deduper.records[pushId] = record
+	return record, false
+}
+
+// 记录处理结果, 通知等待的重复推送
+func (record *grpcPushRecord) finish(reply *rpc.PushReply) *rpc.PushReply {
+	if record != nil {
+		record.reply = reply
+		close(record.doneChan)
+	}
+	return reply
+}
+
+// 重复的推送等待首次处理的结果, 超时时按等待送达超时回复
+func (record *grpcPushRecord) wait(deadline time.Time) *rpc.PushReply {
+	select {
+	case <-record.doneChan:
+		return record.reply
+	case <-time.After(time.Until(deadline)):
+		return &rpc.PushReply{Code: types.PUSH_CODE_OK, Message: utils.WaitTimeout.Error()}
+	}
+}
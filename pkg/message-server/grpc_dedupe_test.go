@@ -0,0 +1,79 @@
+package message_server
+
+import (
+	"message-center/cmd/message/config"
+	"message-center/pkg/rpc"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGrpcDeduper(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		window     int
+		firstId    string
+		secondId   string
+		sleep      time.Duration // 两次登记之间的间隔
+		wantExists bool
+	}{
+		{"窗口内重复的推送ID", 1000, "push-1", "push-1", 0, true},
+		{"不同的推送ID", 1000, "push-1", "push-2", 0, false},
+		{"没有推送ID不去重", 1000, "", "", 0, false},
+		{"未开启去重", 0, "push-1", "push-1", 0, false},
+		{"窗口过期后重新处理", 20, "push-1", "push-1", 30 * time.Millisecond, false},
+	}
+	for _, c := range cases {
+		config.GlobalServerConfig().GrpcDedupeWindow = c.window
+		deduper := &grpcDeduper{records: make(map[string]*grpcPushRecord)}
+
+		first, exists := deduper.reserve(c.firstId)
+		if exists {
+			t.Errorf("%s: 首次登记不应重复", c.name)
+		}
+		time.Sleep(c.sleep)
+		second, exists := deduper.reserve(c.secondId)
+		if exists != c.wantExists {
+			t.Errorf("%s: 重复=%v, want %v", c.name, exists, c.wantExists)
+		}
+		if exists && second != first {
+			t.Errorf("%s: 重复的推送应返回首次的记录", c.name)
+		}
+	}
+}
+
+func TestGrpcPushRecordWait(t *testing.T) {
+	var (
+		reply = &rpc.PushReply{Code: types.PUSH_CODE_OK, Message: "reached"}
+	)
+	cases := []struct {
+		name        string
+		finishAfter time.Duration // 首次推送完成的时间, 0表示未完成
+		wantMessage string
+	}{
+		{"返回首次推送的结果", 10 * time.Millisecond, "reached"},
+		{"首次推送未完成时按等待超时回复", 0, utils.WaitTimeout.Error()},
+	}
+	for _, c := range cases {
+		record := &grpcPushRecord{doneChan: make(chan byte)}
+		if c.finishAfter > 0 {
+			time.AfterFunc(c.finishAfter, func() { record.finish(reply) })
+		}
+		if got := record.wait(time.Now().Add(50 * time.Millisecond)); got.Code != types.PUSH_CODE_OK || got.Message != c.wantMessage {
+			t.Errorf("%s: wait = %+v", c.name, got)
+		}
+	}
+
+	// 没有推送ID时记录为nil, finish直接返回结果
+	var record *grpcPushRecord
+	if got := record.finish(reply); got != reply {
+		t.Errorf("nil记录的finish应返回原结果: %+v", got)
+	}
+}
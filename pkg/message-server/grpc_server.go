@@ -0,0 +1,198 @@
+package message_server
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io"
+	"message-center/cmd/message/config"
+	"message-center/pkg/certs"
+	web_socket "message-center/pkg/message-server/web-socket"
+	"message-center/pkg/rpc"
+	"message-center/pkg/types"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 内部通讯gRPC服务, 与HTTP接口共用合并队列
+type GrpcService struct {
+	server   *grpc.Server
+	stopChan chan byte // 关闭时通知所有流
+}
+
+var GlobalGrpcServer *GrpcService
+
+func InitGrpcService() (err error) {
+	var (
+		options  []grpc.ServerOption
+		creds    credentials.TransportCredentials
+		reloader *certs.Reloader
+		listener net.Listener
+		service  *GrpcService
+	)
+
+	// 未配置端口则不启动
+	if config.GlobalServerConfig().GrpcPort == 0 {
+		return
+	}
+
+	// 与HTTP服务使用同一套证书
+	if reloader, err = internalTLS(); err != nil {
+		return
+	}
+	if reloader != nil {
+		creds = credentials.NewTLS(reloader.ServerConfig())
+		options = append(options, grpc.Creds(creds))
+	}
+
+	// 监听端口
+	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalServerConfig().GrpcPort)); err != nil {
+		return
+	}
+
+	service = &GrpcService{
+		server:   grpc.NewServer(options...),
+		stopChan: make(chan byte),
+	}
+	rpc.RegisterMessageServerServer(service.server, service)
+	GlobalGrpcServer = service
+
+	go service.server.Serve(listener)
+	return
+}
+
+// 一元推送, 推送类型以方法为准; 重复的推送ID返回首次推送的结果
+func (service *GrpcService) push(pushType int, req *rpc.PushRequest) *rpc.PushReply {
+	var (
+		pushResp *types.PushResponse
+		delivery *web_socket.Delivery
+		record   *grpcPushRecord
+		exists   bool
+	)
+	if record, exists = grpcPushes.reserve(req.PushId); exists {
+		return record.wait(deliveryDeadline())
+	}
+	pushResp, delivery = service.submit(pushType, req)
+	awaitDelivery(pushResp, delivery, deliveryDeadline())
+	return record.finish(rpc.NewPushReply(pushResp))
+}
+
+// 提交到合并队列, req.Wait时返回跟踪送达的delivery
+func (service *GrpcService) submit(pushType int, req *rpc.PushRequest) (*types.PushResponse, *web_socket.Delivery) {
+	var (
+		envelope *types.PushEnvelope
+	)
+	envelope = &types.PushEnvelope{
+		PushType: pushType,
+		Room:     req.Room,
+		Rooms:    req.Rooms,
+		User:     req.User,
+		Exclude:  req.Exclude.PushExclude(),
+		Wait:     req.Wait,
+	}
+	return submitEnvelopeItems(envelope, req.MsgArr())
+}
+
+func (service *GrpcService) PushAll(ctx context.Context, req *rpc.PushRequest) (*rpc.PushReply, error) {
+	return service.push(types.PUSH_TYPE_ALL, req), nil
+}
+
+func (service *GrpcService) PushRoom(ctx context.Context, req *rpc.PushRequest) (*rpc.PushReply, error) {
+	return service.push(types.PUSH_TYPE_ROOM, req), nil
+}
+
+func (service *GrpcService) PushRooms(ctx context.Context, req *rpc.PushRequest) (*rpc.PushReply, error) {
+	return service.push(types.PUSH_TYPE_ROOMS, req), nil
+}
+
+func (service *GrpcService) PushUser(ctx context.Context, req *rpc.PushRequest) (*rpc.PushReply, error) {
+	return service.push(types.PUSH_TYPE_USER, req), nil
+}
+
+// 双向流: logic发送批量推送, message server逐批回复ACK, 关闭前发送CLOSING
+func (service *GrpcService) Stream(stream rpc.MessageServer_StreamServer) (err error) {
+	var (
+		sendMutex  sync.Mutex
+		doneChan   = make(chan byte)
+		req        *rpc.StreamRequest
+		event      *rpc.StreamEvent
+		pushResps  []*types.PushResponse
+		deliveries []*web_socket.Delivery
+		records    []*grpcPushRecord
+		duplicated []bool
+		deadline   time.Time
+	)
+	defer close(doneChan)
+
+	// 服务关闭时通知logic, logic收到后关闭发送方向, 本流随之结束
+	go func() {
+		select {
+		case <-doneChan:
+		case <-service.stopChan:
+			sendMutex.Lock()
+			_ = stream.Send(&rpc.StreamEvent{Type: rpc.STREAM_EVENT_CLOSING})
+			sendMutex.Unlock()
+		}
+	}()
+
+	for {
+		if req, err = stream.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		// 整批提交后再等待送达, 等待时间不随推送个数累加; 重复的推送ID不再提交, 等待首次推送的结果
+		event = &rpc.StreamEvent{Type: rpc.STREAM_EVENT_ACK, Seq: req.Seq}
+		pushResps = make([]*types.PushResponse, len(req.Pushes))
+		deliveries = make([]*web_socket.Delivery, len(req.Pushes))
+		records = make([]*grpcPushRecord, len(req.Pushes))
+		duplicated = make([]bool, len(req.Pushes))
+		for pushIdx, push := range req.Pushes {
+			if records[pushIdx], duplicated[pushIdx] = grpcPushes.reserve(push.PushId); !duplicated[pushIdx] {
+				pushResps[pushIdx], deliveries[pushIdx] = service.submit(int(push.PushType), push)
+			}
+		}
+		deadline = deliveryDeadline()
+		for pushIdx, pushResp := range pushResps {
+			if duplicated[pushIdx] {
+				event.Replies = append(event.Replies, records[pushIdx].wait(deadline))
+				continue
+			}
+			awaitDelivery(pushResp, deliveries[pushIdx], deadline)
+			event.Replies = append(event.Replies, records[pushIdx].finish(rpc.NewPushReply(pushResp)))
+		}
+
+		sendMutex.Lock()
+		err = stream.Send(event)
+		sendMutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 先通知所有流, 等待进行中的请求完成, 超时后强制关闭
+func GrpcServerClose() {
+	var (
+		stoppedChan = make(chan byte)
+	)
+	if GlobalGrpcServer == nil {
+		return
+	}
+	close(GlobalGrpcServer.stopChan)
+
+	go func() {
+		GlobalGrpcServer.server.GracefulStop()
+		close(stoppedChan)
+	}()
+	select {
+	case <-stoppedChan:
+	case <-time.After(time.Duration(config.GlobalServerConfig().ServiceWriteTimeout) * time.Millisecond):
+		logrus.Warn("gRPC服务关闭超时, 强制关闭")
+		GlobalGrpcServer.server.Stop()
+	}
+}
@@ -2,13 +2,16 @@ package message_server
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"io/ioutil"
 	"message-center/cmd/message/config"
+	"message-center/pkg/certs"
 	"message-center/pkg/message-server/web-socket"
+	"message-center/pkg/types"
 	"message-center/utils"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -24,6 +27,7 @@ func InitHttpService() error {
 		mux      *http.ServeMux
 		server   *http.Server
 		listener net.Listener
+		reloader *certs.Reloader
 		err      error
 	)
 
@@ -31,16 +35,21 @@ func InitHttpService() error {
 	mux = http.NewServeMux()
 	mux.HandleFunc("/push/all", handlePushAll)
 	mux.HandleFunc("/push/room", handlePushRoom)
+	mux.HandleFunc("/push/rooms", handlePushRooms)
+	mux.HandleFunc("/push/user", handlePushUser)
+	mux.HandleFunc("/push/batch", handlePushBatch)
+	mux.HandleFunc("/rooms", handleRooms)
+	mux.HandleFunc("/health", handleHealth)
 
 	// HTTP/2 TLS服务
 	server = &http.Server{
-		ReadTimeout:  time.Duration(config.GlobalServerConfig.ServiceReadTimeout) * time.Millisecond,
-		WriteTimeout: time.Duration(config.GlobalServerConfig.ServiceWriteTimeout) * time.Millisecond,
+		ReadTimeout:  time.Duration(config.GlobalServerConfig().ServiceReadTimeout) * time.Millisecond,
+		WriteTimeout: time.Duration(config.GlobalServerConfig().ServiceWriteTimeout) * time.Millisecond,
 		Handler:      mux,
 	}
 
 	// 监听端口
-	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalServerConfig.ServicePort)); err != nil {
+	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalServerConfig().ServicePort)); err != nil {
 		return err
 	}
 
@@ -48,12 +57,13 @@ func InitHttpService() error {
 	GlobalHttpServer = &HttpService{
 		server: server,
 	}
-	if config.GlobalServerConfig.ServerPem != "" && config.GlobalServerConfig.ServerKey != "" {
-		// 验证tls证书是否合法
-		if _, err := tls.LoadX509KeyPair(config.GlobalServerConfig.ServerPem, config.GlobalServerConfig.ServerKey); err != nil {
-			return utils.CertInvalid
-		}
-		go server.ServeTLS(listener, config.GlobalServerConfig.ServerPem, config.GlobalServerConfig.ServerKey)
+	// 证书由reloader提供, 文件变化后新的连接使用新证书
+	if reloader, err = internalTLS(); err != nil {
+		return err
+	}
+	if reloader != nil {
+		server.TLSConfig = reloader.ServerConfig()
+		go server.ServeTLS(listener, "", "")
 		return nil
 	}
 
@@ -62,51 +72,257 @@ func InitHttpService() error {
 	return nil
 }
 
-// 全量推送POST msg={}
-func handlePushAll(resp http.ResponseWriter, req *http.Request) {
+// 逐条提交到合并队列并等待送达, 见submitItems和awaitDelivery
+func pushItems(msgArr []json.RawMessage, wait bool, push func(msg *json.RawMessage, delivery *web_socket.Delivery) error) (pushResp *types.PushResponse) {
+	var (
+		delivery *web_socket.Delivery
+	)
+	pushResp, delivery = submitItems(msgArr, wait, push)
+	awaitDelivery(pushResp, delivery, deliveryDeadline())
+	return
+}
+
+// 等待送达的截止时间, 不超过写超时的一半
+func deliveryDeadline() time.Time {
+	return time.Now().Add(time.Duration(config.GlobalServerConfig().ServiceWriteTimeout/2) * time.Millisecond)
+}
+
+// 逐条提交到合并队列, 全部丢弃时为CHANNEL_FULL, 部分丢弃时为PARTIAL_DROPPED
+// wait时返回跟踪送达的delivery, 由调用方等待
+func submitItems(msgArr []json.RawMessage, wait bool, push func(msg *json.RawMessage, delivery *web_socket.Delivery) error) (pushResp *types.PushResponse, delivery *web_socket.Delivery) {
 	var (
-		err    error
-		items  string
-		msgArr []json.RawMessage
 		msgIdx int
 	)
-	if err = req.ParseForm(); err != nil {
-		return
+	if web_socket.GlobalMessageMergeServer.IsClosed() {
+		return &types.PushResponse{Code: types.PUSH_CODE_UNAVAILABLE, Dropped: len(msgArr)}, nil
 	}
 
-	items = req.PostForm.Get("items")
-	if err = json.Unmarshal([]byte(items), &msgArr); err != nil {
+	if wait {
+		delivery = web_socket.NewDelivery(len(msgArr))
+	}
+	pushResp = &types.PushResponse{Code: types.PUSH_CODE_OK}
+	for msgIdx, _ = range msgArr {
+		if err := push(&msgArr[msgIdx], delivery); err != nil {
+			delivery.Drop()
+			pushResp.Dropped++
+			pushResp.Message = err.Error()
+		} else {
+			pushResp.Accepted++
+		}
+	}
+
+	if pushResp.Dropped > 0 && pushResp.Accepted == 0 {
+		pushResp.Code = types.PUSH_CODE_CHANNEL_FULL
+	} else if pushResp.Dropped > 0 {
+		pushResp.Code = types.PUSH_CODE_PARTIAL
+	}
+	return
+}
+
+// 等待消息推送到连接, 记录写入发送队列的连接数; 超时时推送已被接收, 只在Message中说明
+func awaitDelivery(pushResp *types.PushResponse, delivery *web_socket.Delivery, deadline time.Time) {
+	var (
+		done bool
+	)
+	if delivery == nil || pushResp.Accepted == 0 {
 		return
 	}
+	if pushResp.Reached, done = delivery.Wait(time.Until(deadline)); !done {
+		pushResp.Message = utils.WaitTimeout.Error()
+	}
+}
 
-	for msgIdx, _ = range msgArr {
-		_ = web_socket.GlobalMessageMergeServer.PushAll(&msgArr[msgIdx])
+// 表单或查询参数wait=true时等待送达
+func waitParam(req *http.Request) bool {
+	return req.Form.Get("wait") == "true"
+}
+
+func writePushResponse(resp http.ResponseWriter, pushResp *types.PushResponse) {
+	types.WritePushResponse(resp, types.PushStatus(pushResp.Code), pushResp)
+}
+
+// 全量推送POST items=[]&exclude={}&wait=true
+func handlePushAll(resp http.ResponseWriter, req *http.Request) {
+	var (
+		msgArr  []json.RawMessage
+		exclude *types.PushExclude
+		ok      bool
+	)
+	if msgArr, exclude, ok = types.ParsePushForm(resp, req); !ok {
+		return
 	}
+
+	writePushResponse(resp, pushItems(msgArr, waitParam(req), func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+		return web_socket.GlobalMessageMergeServer.PushAll(msg, exclude, delivery)
+	}))
 }
 
-// 房间推送POST room=xxx&msg
+// 房间推送POST room=xxx&items=[]&exclude={}
 func handlePushRoom(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err    error
-		room   string
-		items  string
-		msgArr []json.RawMessage
-		msgIdx int
+		room    string
+		msgArr  []json.RawMessage
+		exclude *types.PushExclude
+		ok      bool
 	)
-	if err = req.ParseForm(); err != nil {
+	if msgArr, exclude, ok = types.ParsePushForm(resp, req); !ok {
 		return
 	}
 
-	room = req.PostForm.Get("room")
-	items = req.PostForm.Get("items")
+	if room = req.PostForm.Get("room"); room == "" {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()})
+		return
+	}
+
+	writePushResponse(resp, pushItems(msgArr, waitParam(req), func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+		return web_socket.GlobalMessageMergeServer.PushRoom(room, msg, exclude, delivery)
+	}))
+}
 
-	if err = json.Unmarshal([]byte(items), &msgArr); err != nil {
+// 多房间推送POST rooms=["a","b"]&items=[]&exclude={}
+func handlePushRooms(resp http.ResponseWriter, req *http.Request) {
+	var (
+		rooms   []string
+		msgArr  []json.RawMessage
+		exclude *types.PushExclude
+		ok      bool
+	)
+	if msgArr, exclude, ok = types.ParsePushForm(resp, req); !ok {
 		return
 	}
 
-	for msgIdx, _ = range msgArr {
-		_ = web_socket.GlobalMessageMergeServer.PushRoom(room, &msgArr[msgIdx])
+	if err := json.Unmarshal([]byte(req.PostForm.Get("rooms")), &rooms); err != nil {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: err.Error()})
+		return
+	}
+	if rooms = utils.SortedUnique(rooms); len(rooms) == 0 {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_ROOM, Message: utils.RoomIdInvalid.Error()})
+		return
+	}
+
+	writePushResponse(resp, pushItems(msgArr, waitParam(req), func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+		return web_socket.GlobalMessageMergeServer.PushRooms(rooms, msg, exclude, delivery)
+	}))
+}
+
+// 用户推送POST uid=xxx&items=[]&exclude={}, 推送给握手时uid相同的所有连接
+func handlePushUser(resp http.ResponseWriter, req *http.Request) {
+	var (
+		uid     string
+		msgArr  []json.RawMessage
+		exclude *types.PushExclude
+		ok      bool
+	)
+	if msgArr, exclude, ok = types.ParsePushForm(resp, req); !ok {
+		return
+	}
+
+	if uid = req.PostForm.Get("uid"); uid == "" {
+		types.WritePushResponse(resp, http.StatusBadRequest, &types.PushResponse{Code: types.PUSH_CODE_INVALID_USER, Message: utils.UserIdInvalid.Error()})
+		return
+	}
+
+	writePushResponse(resp, pushItems(msgArr, waitParam(req), func(msg *json.RawMessage, delivery *web_socket.Delivery) error {
+		return web_socket.GlobalMessageMergeServer.PushUser(uid, msg, exclude, delivery)
+	}))
+}
+
+// 批量推送POST json请求体{"pushes":[PushEnvelope]}, 逐个提交到合并队列, 按顺序返回每个推送的结果
+// 全部提交后再等待需要送达结果的推送, 等待时间不随推送个数累加
+func handlePushBatch(resp http.ResponseWriter, req *http.Request) {
+	var (
+		batch      types.PushBatch
+		batchResp  *types.PushBatchResponse
+		envelope   *types.PushEnvelope
+		reply      *types.PushResponse
+		delivery   *web_socket.Delivery
+		deliveries []*web_socket.Delivery
+		deadline   time.Time
+		replyIdx   int
+		buf        []byte
+		err        error
+	)
+	if req.Method != http.MethodPost {
+		writePushBatchResponse(resp, http.StatusMethodNotAllowed, &types.PushBatchResponse{Code: types.PUSH_CODE_BAD_METHOD})
+		return
+	}
+	if buf, err = ioutil.ReadAll(req.Body); err == nil {
+		err = json.Unmarshal(buf, &batch)
+	}
+	if err != nil {
+		writePushBatchResponse(resp, http.StatusBadRequest, &types.PushBatchResponse{Code: types.PUSH_CODE_INVALID_FORM, Message: err.Error()})
+		return
+	}
+	if web_socket.GlobalMessageMergeServer.IsClosed() {
+		writePushBatchResponse(resp, http.StatusServiceUnavailable, &types.PushBatchResponse{Code: types.PUSH_CODE_UNAVAILABLE})
+		return
+	}
+
+	batchResp = &types.PushBatchResponse{Code: types.PUSH_CODE_OK, Replies: make([]*types.PushResponse, 0, len(batch.Pushes))}
+	deliveries = make([]*web_socket.Delivery, len(batch.Pushes))
+	for replyIdx, envelope = range batch.Pushes {
+		if envelope == nil {
+			batchResp.Replies = append(batchResp.Replies, &types.PushResponse{Code: types.PUSH_CODE_INVALID_FORM})
+			continue
+		}
+		reply, deliveries[replyIdx] = submitEnvelope(envelope)
+		batchResp.Replies = append(batchResp.Replies, reply)
+	}
+	deadline = deliveryDeadline()
+	for replyIdx, delivery = range deliveries {
+		awaitDelivery(batchResp.Replies[replyIdx], delivery, deadline)
+	}
+	writePushBatchResponse(resp, http.StatusOK, batchResp)
+}
+
+func writePushBatchResponse(resp http.ResponseWriter, status int, batchResp *types.PushBatchResponse) {
+	var (
+		buf []byte
+	)
+	buf, _ = json.Marshal(batchResp)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	_, _ = resp.Write(buf)
+}
+
+// 房间订阅摘要GET epoch=xxx&version=xxx&wait=毫秒
+// 版本没有变化时最多等待wait毫秒(不超过写超时的一半), 有变化立即返回增量, 无法增量时返回全量
+func handleRooms(resp http.ResponseWriter, req *http.Request) {
+	var (
+		query   url.Values
+		epoch   int64
+		version uint64
+		wait    int
+		maxWait int
+		digest  *types.RoomDigest
+		buf     []byte
+		err     error
+	)
+	query = req.URL.Query()
+	epoch, _ = strconv.ParseInt(query.Get("epoch"), 10, 64)
+	version, _ = strconv.ParseUint(query.Get("version"), 10, 64)
+	wait, _ = strconv.Atoi(query.Get("wait"))
+	if maxWait = config.GlobalServerConfig().ServiceWriteTimeout / 2; wait > maxWait {
+		wait = maxWait
+	}
+
+	digest = web_socket.GlobalSocketConnectionManager.RoomDigest(epoch, version, time.Duration(wait)*time.Millisecond)
+	if buf, err = json.Marshal(digest); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write(buf)
+}
+
+// 健康检查GET, 合并服务关闭中返回503
+func handleHealth(resp http.ResponseWriter, req *http.Request) {
+	if web_socket.GlobalMessageMergeServer.IsClosed() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write([]byte(`{"status":"ok"}`))
 }
 
 func HttpServerClose() {
@@ -0,0 +1,151 @@
+package message_server
+
+import (
+	"encoding/json"
+	"message-center/cmd/message/config"
+	"message-center/pkg/message-server/web-socket"
+	"message-center/pkg/types"
+	"message-center/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 逐条提交的结果汇总为错误码, 并映射为HTTP状态码
+func TestSubmitItemsResponse(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := web_socket.InitMessageMerger(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		dropAt       map[int]bool // 提交时丢弃的消息下标
+		closed       bool
+		wantStatus   int
+		wantCode     string
+		wantAccepted int
+		wantDropped  int
+	}{
+		{"全部接收", nil, false, http.StatusOK, types.PUSH_CODE_OK, 3, 0},
+		{"部分丢弃", map[int]bool{1: true}, false, http.StatusOK, types.PUSH_CODE_PARTIAL, 2, 1},
+		{"全部丢弃", map[int]bool{0: true, 1: true, 2: true}, false, http.StatusTooManyRequests, types.PUSH_CODE_CHANNEL_FULL, 0, 3},
+		{"关闭中", nil, true, http.StatusServiceUnavailable, types.PUSH_CODE_UNAVAILABLE, 0, 3},
+	}
+	for _, c := range cases {
+		var (
+			msgArr   = []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`2`), json.RawMessage(`3`)}
+			resp     = httptest.NewRecorder()
+			pushResp types.PushResponse
+			msgIdx   int
+		)
+		if c.closed {
+			web_socket.GlobalMessageMergeServer.MergeClose()
+		}
+		submitted, _ := submitItems(msgArr, false, func(msg *json.RawMessage, delivery *web_socket.Delivery) (err error) {
+			if c.dropAt[msgIdx] {
+				err = utils.MergeChannelFull
+			}
+			msgIdx++
+			return
+		})
+		writePushResponse(resp, submitted)
+		if resp.Code != c.wantStatus {
+			t.Errorf("%s: status=%d, want %d", c.name, resp.Code, c.wantStatus)
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &pushResp); err != nil {
+			t.Fatal(err)
+		}
+		if pushResp.Code != c.wantCode || pushResp.Accepted != c.wantAccepted || pushResp.Dropped != c.wantDropped {
+			t.Errorf("%s: %+v", c.name, pushResp)
+		}
+		if c.wantDropped > 0 && !c.closed && pushResp.Message != utils.MergeChannelFull.Error() {
+			t.Errorf("%s: 丢弃时应说明原因: %q", c.name, pushResp.Message)
+		}
+	}
+}
+
+// 批量推送逐个校验, 单个推送不合法不影响其他推送, 按顺序返回每个推送的结果
+func TestHandlePushBatch(t *testing.T) {
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := web_socket.InitConnectManager(); err != nil {
+		t.Fatal(err)
+	}
+	if err := web_socket.InitMessageMerger(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		method      string
+		body        string
+		wantStatus  int
+		wantCode    string
+		wantReplies []string // 每个推送的错误码
+	}{
+		{"不是POST", http.MethodGet, ``, http.StatusMethodNotAllowed, types.PUSH_CODE_BAD_METHOD, nil},
+		{"请求体不是json", http.MethodPost, `pushes`, http.StatusBadRequest, types.PUSH_CODE_INVALID_FORM, nil},
+		{"空批次", http.MethodPost, `{"pushes":[]}`, http.StatusOK, types.PUSH_CODE_OK, []string{}},
+		{"部分推送不合法", http.MethodPost, `{"pushes":[
+			{"pushType":1,"room":"a","items":[1,2]},
+			{"pushType":1,"items":[1]},
+			{"pushType":3,"rooms":["",""],"items":[1]},
+			{"pushType":4,"items":[1]},
+			{"pushType":1,"room":"a","items":"x"},
+			null,
+			{"pushType":9,"items":[1]},
+			{"pushType":2,"items":[1],"wait":true}
+		]}`, http.StatusOK, types.PUSH_CODE_OK, []string{
+			types.PUSH_CODE_OK,
+			types.PUSH_CODE_INVALID_ROOM,
+			types.PUSH_CODE_INVALID_ROOM,
+			types.PUSH_CODE_INVALID_USER,
+			types.PUSH_CODE_INVALID_ITEMS,
+			types.PUSH_CODE_INVALID_FORM,
+			types.PUSH_CODE_INVALID_FORM,
+			types.PUSH_CODE_OK,
+		}},
+	}
+	for _, c := range cases {
+		var (
+			resp      = httptest.NewRecorder()
+			req       = httptest.NewRequest(c.method, "/push/batch", strings.NewReader(c.body))
+			batchResp types.PushBatchResponse
+		)
+		handlePushBatch(resp, req)
+		if resp.Code != c.wantStatus {
+			t.Errorf("%s: status=%d, want %d", c.name, resp.Code, c.wantStatus)
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &batchResp); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if batchResp.Code != c.wantCode || len(batchResp.Replies) != len(c.wantReplies) {
+			t.Errorf("%s: code=%s replies=%d, want %s %d", c.name, batchResp.Code, len(batchResp.Replies), c.wantCode, len(c.wantReplies))
+			continue
+		}
+		for replyIdx, reply := range batchResp.Replies {
+			if reply.Code != c.wantReplies[replyIdx] {
+				t.Errorf("%s: 第%d个推送 code=%s, want %s", c.name, replyIdx, reply.Code, c.wantReplies[replyIdx])
+			}
+		}
+		if len(batchResp.Replies) > 0 && batchResp.Replies[0].Accepted != 2 {
+			t.Errorf("%s: 合法推送应接收2条: %+v", c.name, batchResp.Replies[0])
+		}
+	}
+
+	// 关闭中整批不可用
+	web_socket.GlobalMessageMergeServer.MergeClose()
+	resp := httptest.NewRecorder()
+	handlePushBatch(resp, httptest.NewRequest(http.MethodPost, "/push/batch", strings.NewReader(`{"pushes":[{"pushType":2,"items":[1]}]}`)))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("关闭中: status=%d, want %d", resp.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -15,43 +15,77 @@ type BucketInterface interface {
 	JoinRoom(roomId string, connection *WSConnection) error
 	// 离开房间
 	LeaveRoom(roomId string, connection *WSConnection) error
-	// 推送给Bucket内所有用户
-	PushAll(message *types.WSMessage)
+	// 推送给Bucket内所有用户, 返回写入发送队列的连接数, 下同
+	PushAll(message *types.WSMessage, filter *pushFilter) int
 	// 推送给Bucket内某个用户
-	PushRoom(roomId string, message *types.WSMessage)
+	PushRoom(roomId string, message *types.WSMessage, filter *pushFilter) int
+	// 推送给Bucket内多个房间的用户, 每个连接只推送一次
+	PushRooms(roomIds []string, message *types.WSMessage, filter *pushFilter) int
+	// 推送给Bucket内某个用户的所有连接
+	PushUser(identity string, message *types.WSMessage, filter *pushFilter) int
 }
 
 // 将socket连接打散，分别放入不同的桶中
 // 为的是在进行推送时，只锁桶内连接就可以了，不用每次推送消息锁所有的连接
 // 持有room的引用，管理room对象
 type Bucket struct {
-	rwMutex sync.RWMutex
-	index   int                      // 我是第几个桶
-	id2Conn map[uint64]*WSConnection // 连接列表(key=连接唯一ID)
-	rooms   map[string]*Room         // 房间列表
+	rwMutex   sync.RWMutex
+	index     int                                 // 我是第几个桶
+	id2Conn   map[uint64]*WSConnection            // 连接列表(key=连接唯一ID)
+	rooms     map[string]*Room                    // 房间列表
+	users     map[string]map[uint64]*WSConnection // 用户 -> 连接列表, 只包含握手时指定了uid的连接
+	roomIndex *RoomIndex                          // 房间 -> Bucket索引, 房间建立/删除时同步更新
 }
 
-func InitBucket(bucketIdx int) (bucket *Bucket) {
+func InitBucket(bucketIdx int, roomIndex *RoomIndex) (bucket *Bucket) {
 	bucket = &Bucket{
-		index:   bucketIdx,
-		id2Conn: make(map[uint64]*WSConnection),
-		rooms:   make(map[string]*Room),
+		index:     bucketIdx,
+		id2Conn:   make(map[uint64]*WSConnection),
+		rooms:     make(map[string]*Room),
+		users:     make(map[string]map[uint64]*WSConnection),
+		roomIndex: roomIndex,
 	}
 	return
 }
 
 func (bucket *Bucket) AddConn(wsConn *WSConnection) {
+	var (
+		userConns map[uint64]*WSConnection
+		existed   bool
+	)
 	bucket.rwMutex.Lock()
 	defer bucket.rwMutex.Unlock()
 
 	bucket.id2Conn[wsConn.connId] = wsConn
+
+	// 未指定uid的连接不能按用户推送
+	if wsConn.identity == "" {
+		return
+	}
+	if userConns, existed = bucket.users[wsConn.identity]; !existed {
+		userConns = make(map[uint64]*WSConnection)
+		bucket.users[wsConn.identity] = userConns
+	}
+	userConns[wsConn.connId] = wsConn
 }
 
 func (bucket *Bucket) DelConn(wsConn *WSConnection) {
+	var (
+		userConns map[uint64]*WSConnection
+		existed   bool
+	)
 	bucket.rwMutex.Lock()
 	defer bucket.rwMutex.Unlock()
 
 	delete(bucket.id2Conn, wsConn.connId)
+
+	// 用户的最后一个连接断开, 则删除
+	if userConns, existed = bucket.users[wsConn.identity]; existed {
+		delete(userConns, wsConn.connId)
+		if len(userConns) == 0 {
+			delete(bucket.users, wsConn.identity)
+		}
+	}
 }
 
 func (bucket *Bucket) JoinRoom(roomId string, wsConn *WSConnection) (err error) {
@@ -66,6 +100,8 @@ func (bucket *Bucket) JoinRoom(roomId string, wsConn *WSConnection) (err error)
 	if room, existed = bucket.rooms[roomId]; !existed {
 		room = InitRoom(roomId)
 		bucket.rooms[roomId] = room
+		// 持有Bucket锁时更新索引, 保证索引与房间列表一致
+		bucket.roomIndex.add(roomId, bucket.index)
 	}
 	// 加入房间
 	err = room.Join(wsConn)
@@ -92,12 +128,13 @@ func (bucket *Bucket) LeaveRoom(roomId string, wsConn *WSConnection) (err error)
 	// 房间为空, 则删除
 	if room.Count() == 0 {
 		delete(bucket.rooms, roomId)
+		bucket.roomIndex.remove(roomId, bucket.index)
 	}
 	return
 }
 
-// 推送给Bucket内所有用户
-func (bucket *Bucket) PushAll(wsMsg *types.WSMessage) {
+// 推送给Bucket内所有用户, 跳过被过滤器排除的连接
+func (bucket *Bucket) PushAll(wsMsg *types.WSMessage, filter *pushFilter) (reached int) {
 	var (
 		wsConn *WSConnection
 	)
@@ -108,12 +145,18 @@ func (bucket *Bucket) PushAll(wsMsg *types.WSMessage) {
 
 	// 全量非阻塞推送
 	for _, wsConn = range bucket.id2Conn {
-		wsConn.SendMessage(wsMsg)
+		if filter.excluded(wsConn) {
+			continue
+		}
+		if wsConn.SendMessage(wsMsg) == nil {
+			reached++
+		}
 	}
+	return
 }
 
-// 推送给某个房间的所有用户
-func (bucket *Bucket) PushRoom(roomId string, wsMsg *types.WSMessage) {
+// 推送给某个房间的所有用户, 跳过被过滤器排除的连接
+func (bucket *Bucket) PushRoom(roomId string, wsMsg *types.WSMessage, filter *pushFilter) (reached int) {
 	var (
 		room    *Room
 		existed bool
@@ -130,5 +173,58 @@ func (bucket *Bucket) PushRoom(roomId string, wsMsg *types.WSMessage) {
 	}
 
 	// 向房间做推送
-	room.Push(wsMsg)
+	return room.Push(wsMsg, filter)
+}
+
+// 推送给多个房间的所有用户, 同时加入多个房间的连接只收到一次
+func (bucket *Bucket) PushRooms(roomIds []string, wsMsg *types.WSMessage, filter *pushFilter) (reached int) {
+	var (
+		roomId  string
+		room    *Room
+		rooms   []*Room
+		existed bool
+		pushed  map[uint64]bool
+	)
+
+	// 锁Bucket
+	bucket.rwMutex.RLock()
+	for _, roomId = range roomIds {
+		if room, existed = bucket.rooms[roomId]; existed {
+			rooms = append(rooms, room)
+		}
+	}
+	bucket.rwMutex.RUnlock()
+
+	// 房间都不存在
+	if len(rooms) == 0 {
+		return
+	}
+
+	// 按连接去重推送
+	pushed = make(map[uint64]bool)
+	for _, room = range rooms {
+		reached += room.PushOnce(wsMsg, pushed, filter)
+	}
+	return
+}
+
+// 推送给某个用户的所有连接, 跳过被过滤器排除的连接
+func (bucket *Bucket) PushUser(identity string, wsMsg *types.WSMessage, filter *pushFilter) (reached int) {
+	var (
+		wsConn *WSConnection
+	)
+
+	// 锁Bucket
+	bucket.rwMutex.RLock()
+	defer bucket.rwMutex.RUnlock()
+
+	for _, wsConn = range bucket.users[identity] {
+		if filter.excluded(wsConn) {
+			continue
+		}
+		if wsConn.SendMessage(wsMsg) == nil {
+			reached++
+		}
+	}
+	return
 }
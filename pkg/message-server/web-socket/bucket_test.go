@@ -0,0 +1,107 @@
+package web_socket
+
+import (
+	"message-center/pkg/types"
+	"testing"
+)
+
+// 连接的发送队列有缓冲, 推送后可以数出收到的消息
+func newBufferedTestConn(connId uint64) *WSConnection {
+	wsConn := newTestConn(connId)
+	wsConn.outChan = make(chan *types.WSMessage, 8)
+	return wsConn
+}
+
+func TestBucketPushRoomsOnce(t *testing.T) {
+	var (
+		wsMsg = &types.WSMessage{MessageData: []byte(`{"type":"PUSH"}`)}
+	)
+	cases := []struct {
+		name        string
+		joined      []string // 连接加入的房间
+		targets     []string // 推送的房间
+		wantReceive int
+	}{
+		{"加入全部目标房间只收到一次", []string{"a", "b", "c"}, []string{"a", "b", "c"}, 1},
+		{"加入部分目标房间只收到一次", []string{"a", "c", "d"}, []string{"a", "b", "c"}, 1},
+		{"只加入一个目标房间", []string{"b", "d"}, []string{"a", "b"}, 1},
+		{"没有加入目标房间", []string{"d"}, []string{"a", "b"}, 0},
+		{"目标房间都不存在", []string{"a"}, []string{"x", "y"}, 0},
+	}
+	for _, c := range cases {
+		var (
+			bucket = InitBucket(0, InitRoomIndex())
+			wsConn = newBufferedTestConn(1)
+			other  = newBufferedTestConn(2) // 只在房间a的另一个连接
+		)
+		bucket.AddConn(wsConn)
+		bucket.AddConn(other)
+		for _, roomId := range c.joined {
+			_ = bucket.JoinRoom(roomId, wsConn)
+		}
+		_ = bucket.JoinRoom("a", other)
+
+		reached := bucket.PushRooms(c.targets, wsMsg, nil)
+		if len(wsConn.outChan) != c.wantReceive {
+			t.Errorf("%s: 收到%d条, want %d", c.name, len(wsConn.outChan), c.wantReceive)
+		}
+		wantReached := c.wantReceive + len(other.outChan)
+		if reached != wantReached {
+			t.Errorf("%s: reached=%d, want %d", c.name, reached, wantReached)
+		}
+	}
+}
+
+func TestBucketPushExclude(t *testing.T) {
+	var (
+		wsMsg = &types.WSMessage{MessageData: []byte(`{"type":"PUSH"}`)}
+	)
+	cases := []struct {
+		name    string
+		exclude *types.PushExclude
+		want    []bool // 连接1(alice, web), 2(bob, admin), 3(无用户和标签)是否收到
+	}{
+		{"不排除", nil, []bool{true, true, true}},
+		{"排除连接ID", &types.PushExclude{ConnIds: []uint64{1}}, []bool{false, true, true}},
+		{"排除用户", &types.PushExclude{Identities: []string{"bob"}}, []bool{true, false, true}},
+		{"排除标签", &types.PushExclude{Tags: []string{"web"}}, []bool{false, true, true}},
+		{"命中任意一项即排除", &types.PushExclude{ConnIds: []uint64{3}, Tags: []string{"admin"}}, []bool{true, false, false}},
+		{"空用户不匹配没有用户的连接", &types.PushExclude{Identities: []string{""}}, []bool{true, true, true}},
+	}
+	for _, c := range cases {
+		for _, pushType := range []string{"room", "rooms", "all"} {
+			var (
+				bucket  = InitBucket(0, InitRoomIndex())
+				wsConns = []*WSConnection{newBufferedTestConn(1), newBufferedTestConn(2), newBufferedTestConn(3)}
+				filter  = newPushFilter(c.exclude)
+				reached int
+			)
+			wsConns[0].identity, wsConns[0].tags["web"] = "alice", true
+			wsConns[1].identity, wsConns[1].tags["admin"] = "bob", true
+			for _, wsConn := range wsConns {
+				bucket.AddConn(wsConn)
+				_ = bucket.JoinRoom("r", wsConn)
+			}
+			switch pushType {
+			case "room":
+				reached = bucket.PushRoom("r", wsMsg, filter)
+			case "rooms":
+				reached = bucket.PushRooms([]string{"r", "x"}, wsMsg, filter)
+			case "all":
+				reached = bucket.PushAll(wsMsg, filter)
+			}
+			wantReached := 0
+			for connIdx, wsConn := range wsConns {
+				if received := len(wsConn.outChan) == 1; received != c.want[connIdx] {
+					t.Errorf("%s(%s): 连接%d收到=%v", c.name, pushType, wsConn.connId, received)
+				}
+				if c.want[connIdx] {
+					wantReached++
+				}
+			}
+			if reached != wantReached {
+				t.Errorf("%s(%s): reached=%d, want %d", c.name, pushType, reached, wantReached)
+			}
+		}
+	}
+}
@@ -19,19 +19,31 @@ type WSConnection struct {
 	isClosed          bool                  // 处于关闭状态时，连接已关闭
 	lastHeartbeatTime time.Time             // 最近一次心跳时间
 	rooms             map[string]bool       // 加入了哪些房间
+	identity          string                // 用户标识, 握手时通过uid参数指定
+	tags              map[string]bool       // 连接标签, 握手时通过tags参数指定
 }
 
 // 初始化单个socket连接，
-func InitWSConnection(connId uint64, wsSocket *websocket.Conn) (wsConnection *WSConnection) {
+func InitWSConnection(connId uint64, wsSocket *websocket.Conn, identity string, tags []string) (wsConnection *WSConnection) {
+	var (
+		tag string
+	)
 	wsConnection = &WSConnection{
 		wsSocket:          wsSocket,
 		connId:            connId,
-		inChan:            make(chan *types.WSMessage, config.GlobalServerConfig.WsInChannelSize),
-		outChan:           make(chan *types.WSMessage, config.GlobalServerConfig.WsOutChannelSize),
+		identity:          identity,
+		tags:              make(map[string]bool),
+		inChan:            make(chan *types.WSMessage, config.GlobalServerConfig().WsInChannelSize),
+		outChan:           make(chan *types.WSMessage, config.GlobalServerConfig().WsOutChannelSize),
 		closeChan:         make(chan byte),
 		lastHeartbeatTime: time.Now(),
 		rooms:             make(map[string]bool),
 	}
+	for _, tag = range tags {
+		if tag != "" {
+			wsConnection.tags[tag] = true
+		}
+	}
 
 	go wsConnection.readLoop()
 	go wsConnection.writeLoop()
@@ -128,7 +140,7 @@ func (wsConnection *WSConnection) IsAlive() bool {
 	defer wsConnection.mutex.Unlock()
 
 	// 连接已关闭 或者 太久没有心跳
-	if wsConnection.isClosed || now.Sub(wsConnection.lastHeartbeatTime) > time.Duration(config.GlobalServerConfig.WsHeartbeatInterval)*time.Second {
+	if wsConnection.isClosed || now.Sub(wsConnection.lastHeartbeatTime) > time.Duration(config.GlobalServerConfig().WsHeartbeatInterval)*time.Second {
 		return false
 	}
 	return true
@@ -4,6 +4,8 @@ import (
 	"message-center/cmd/message/config"
 	"message-center/pkg/types"
 	"message-center/utils"
+	"sync/atomic"
+	"time"
 )
 
 type SocketConnectManager interface {
@@ -15,10 +17,16 @@ type SocketConnectManager interface {
 	JoinRoom(roomId string, connection *WSConnection) error
 	// 离开房间
 	LeaveRoom(roomId string, connection *WSConnection) error
-	// 向指定房间推送消息
-	PushRoom(roomId string, message *types.BizMessage) error
+	// 向指定房间推送消息, 推送完成后通知deliveries
+	PushRoom(roomId string, message *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) error
+	// 向多个房间推送消息, 每个连接只推送一次
+	PushRooms(roomIds []string, message *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) error
+	// 向指定用户的所有连接推送消息
+	PushUser(identity string, message *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) error
 	// 向所有连接推送消息
-	PushAll(message *types.BizMessage) error
+	PushAll(message *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) error
+	// 房间订阅摘要
+	RoomDigest(epoch int64, version uint64, wait time.Duration) *types.RoomDigest
 	// 获取桶
 	GetBucket(connection *WSConnection) *Bucket
 	// 关闭
@@ -29,18 +37,37 @@ type SocketConnectManager interface {
 type PushJob struct {
 	pushType int               // 推送类型
 	roomId   string            // 房间ID
+	roomIds  []string          // 多房间推送的房间ID列表
+	identity string            // 用户推送的用户标识
 	bizMsg   *types.BizMessage // 未序列化的业务消息
 	wsMsg    *types.WSMessage  // 已序列化的业务消息
+	filter   *pushFilter       // 推送排除过滤器, nil表示不排除
+
+	deliveries []*Delivery // 等待送达结果的推送
+	pending    int32       // 原子操作, 尚未推送完成的Bucket数
+	reached    int64       // 原子操作, 写入发送队列的连接数
+}
+
+// 一个Bucket推送完成, 所有Bucket完成后通知等待方
+func (pushJob *PushJob) bucketDone(reached int) {
+	atomic.AddInt64(&pushJob.reached, int64(reached))
+	if atomic.AddInt32(&pushJob.pending, -1) == 0 {
+		completeDeliveries(pushJob.deliveries, int(atomic.LoadInt64(&pushJob.reached)))
+	}
 }
 
 // 建立的socket连接管理器，负责检查连接是否存活
 // 根据配置buckets数量，初始化桶
 // 根据配置job数量，初始化job
 type ConnectionManager struct {
-	buckets      []*Bucket
-	jobChan      []chan *PushJob // 每个Bucket对应一个Job Queue
-	dispatchChan chan *PushJob   // 待分发消息队列
-	stopChan     chan byte       // 关闭
+	buckets       []*Bucket
+	jobChan       [][]chan *PushJob // 每个Bucket对应一组Job Queue, 有序模式下每个发送协程一个队列
+	roomIndex     *RoomIndex        // 房间 -> Bucket索引
+	allBucketIdxs []int             // 所有Bucket下标, 广播时使用
+	dispatchChan  []chan *PushJob   // 待分发消息队列, 有序模式下每个分发协程一个队列
+	ordered       bool              // 有序模式: 按房间hash分区, 同一房间的推送由同一协程串行处理
+	roundRobin    uint32            // 原子操作, 有序模式下多房间推送和广播轮流进入各个队列
+	stopChan      chan byte         // 关闭
 }
 
 // 初始化Buckets、job
@@ -53,27 +80,80 @@ func InitConnectManager() error {
 	)
 
 	connMgr = &ConnectionManager{
-		buckets:      make([]*Bucket, config.GlobalServerConfig.BucketCount),
-		jobChan:      make([]chan *PushJob, config.GlobalServerConfig.BucketCount),
-		dispatchChan: make(chan *PushJob, config.GlobalServerConfig.DispatchChannelSize),
-		stopChan:     make(chan byte, 1),
+		buckets:   make([]*Bucket, config.GlobalServerConfig().BucketCount),
+		jobChan:   make([][]chan *PushJob, config.GlobalServerConfig().BucketCount),
+		roomIndex: InitRoomIndex(),
+		ordered:   config.GlobalServerConfig().BucketJobOrdered,
+		stopChan:  make(chan byte, 1),
 	}
+	// 待分发队列
+	connMgr.dispatchChan = connMgr.initQueues(config.GlobalServerConfig().DispatchWorkerCount, config.GlobalServerConfig().DispatchChannelSize)
 	for bucketIdx, _ = range connMgr.buckets {
-		connMgr.buckets[bucketIdx] = InitBucket(bucketIdx)                                               // 初始化Bucket
-		connMgr.jobChan[bucketIdx] = make(chan *PushJob, config.GlobalServerConfig.BucketJobChannelSize) // Bucket的Job队列
+		connMgr.allBucketIdxs = append(connMgr.allBucketIdxs, bucketIdx)
+		// 初始化Bucket
+		connMgr.buckets[bucketIdx] = InitBucket(bucketIdx, connMgr.roomIndex)
+		// Bucket的Job队列
+		connMgr.jobChan[bucketIdx] = connMgr.initQueues(config.GlobalServerConfig().BucketJobWorkerCount, config.GlobalServerConfig().BucketJobChannelSize)
 		// 为每个Buckets启动job，负责监听channel，然后推送消息
-		for jobWorkerIdx = 0; jobWorkerIdx < config.GlobalServerConfig.BucketJobWorkerCount; jobWorkerIdx++ {
+		for jobWorkerIdx = 0; jobWorkerIdx < config.GlobalServerConfig().BucketJobWorkerCount; jobWorkerIdx++ {
 			go connMgr.jobWorkerMain(jobWorkerIdx, bucketIdx)
 		}
 	}
 	GlobalSocketConnectionManager = connMgr
 	// 初始化分发协程, 用于将消息扇出给各个Bucket
-	for dispatchWorkerIdx = 0; dispatchWorkerIdx < config.GlobalServerConfig.DispatchWorkerCount; dispatchWorkerIdx++ {
+	for dispatchWorkerIdx = 0; dispatchWorkerIdx < config.GlobalServerConfig().DispatchWorkerCount; dispatchWorkerIdx++ {
 		go connMgr.dispatchWorkerMain(dispatchWorkerIdx)
 	}
 	return nil
 }
 
+// 普通模式下所有协程共用一个队列; 有序模式下每个协程一个队列, 容量均分
+func (connMgr *ConnectionManager) initQueues(workerCount int, channelSize int) (queues []chan *PushJob) {
+	var (
+		queueIdx int
+	)
+	if !connMgr.ordered || workerCount <= 1 {
+		return []chan *PushJob{make(chan *PushJob, channelSize)}
+	}
+	if channelSize = channelSize / workerCount; channelSize < 1 {
+		channelSize = 1
+	}
+	queues = make([]chan *PushJob, workerCount)
+	for queueIdx, _ = range queues {
+		queues[queueIdx] = make(chan *PushJob, channelSize)
+	}
+	return
+}
+
+// 按推送目标选择队列, 同一房间或同一用户的推送总是进入同一队列, 保证按顺序送达
+// 多房间推送和广播跨越多个分区, 不保证与单房间推送之间的顺序, 轮流进入各个队列分摊负载
+func (connMgr *ConnectionManager) selectQueue(queues []chan *PushJob, pushJob *PushJob) chan *PushJob {
+	if len(queues) == 1 {
+		return queues[0]
+	}
+	if pushJob.pushType == types.PUSH_TYPE_ROOM {
+		return queues[roomHash(pushJob.roomId, len(queues))]
+	} else if pushJob.pushType == types.PUSH_TYPE_USER {
+		return queues[roomHash(pushJob.identity, len(queues))]
+	}
+	return queues[atomic.AddUint32(&connMgr.roundRobin, 1)%uint32(len(queues))]
+}
+
+// 放入待分发队列, 队列已满时不等待
+func (connMgr *ConnectionManager) dispatch(pushJob *PushJob) (err error) {
+	select {
+	case connMgr.selectQueue(connMgr.dispatchChan, pushJob) <- pushJob:
+	default:
+		err = utils.DisPatchChannelFull
+	}
+	return
+}
+
+// 房间订阅摘要, 供logic按订阅路由推送
+func (connMgr *ConnectionManager) RoomDigest(epoch int64, version uint64, wait time.Duration) *types.RoomDigest {
+	return connMgr.roomIndex.Digest(epoch, version, wait)
+}
+
 func (connMgr *ConnectionManager) GetBucket(wsConnection *WSConnection) (bucket *Bucket) {
 	bucket = connMgr.buckets[wsConnection.connId%uint64(len(connMgr.buckets))]
 	return
@@ -119,7 +199,7 @@ func (connMgr *ConnectionManager) LeaveRoom(roomId string, wsConn *WSConnection)
 }
 
 // 向所有在线用户发送消息
-func (connMgr *ConnectionManager) PushAll(bizMsg *types.BizMessage) (err error) {
+func (connMgr *ConnectionManager) PushAll(bizMsg *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) (err error) {
 	var (
 		pushJob *PushJob
 	)
@@ -127,18 +207,16 @@ func (connMgr *ConnectionManager) PushAll(bizMsg *types.BizMessage) (err error)
 	pushJob = &PushJob{
 		pushType: types.PUSH_TYPE_ALL,
 		bizMsg:   bizMsg,
-	}
+		filter:   newPushFilter(exclude),
 
-	select {
-	case connMgr.dispatchChan <- pushJob:
-	default:
-		err = utils.DisPatchChannelFull
+		deliveries: deliveries,
 	}
-	return
+
+	return connMgr.dispatch(pushJob)
 }
 
 // 向指定房间发送消息
-func (connMgr *ConnectionManager) PushRoom(roomId string, bizMsg *types.BizMessage) (err error) {
+func (connMgr *ConnectionManager) PushRoom(roomId string, bizMsg *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) (err error) {
 	var (
 		pushJob *PushJob
 	)
@@ -147,36 +225,87 @@ func (connMgr *ConnectionManager) PushRoom(roomId string, bizMsg *types.BizMessa
 		pushType: types.PUSH_TYPE_ROOM,
 		bizMsg:   bizMsg,
 		roomId:   roomId,
+		filter:   newPushFilter(exclude),
+
+		deliveries: deliveries,
 	}
 
-	select {
-	case connMgr.dispatchChan <- pushJob:
-	default:
-		err = utils.DisPatchChannelFull
+	return connMgr.dispatch(pushJob)
+}
+
+// 向多个房间发送消息
+func (connMgr *ConnectionManager) PushRooms(roomIds []string, bizMsg *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) (err error) {
+	var (
+		pushJob *PushJob
+	)
+
+	pushJob = &PushJob{
+		pushType: types.PUSH_TYPE_ROOMS,
+		bizMsg:   bizMsg,
+		roomIds:  roomIds,
+		filter:   newPushFilter(exclude),
+
+		deliveries: deliveries,
 	}
-	return
+
+	return connMgr.dispatch(pushJob)
+}
+
+// 向指定用户发送消息
+func (connMgr *ConnectionManager) PushUser(identity string, bizMsg *types.BizMessage, exclude *types.PushExclude, deliveries []*Delivery) (err error) {
+	var (
+		pushJob *PushJob
+	)
+
+	pushJob = &PushJob{
+		pushType: types.PUSH_TYPE_USER,
+		bizMsg:   bizMsg,
+		identity: identity,
+		filter:   newPushFilter(exclude),
+
+		deliveries: deliveries,
+	}
+
+	return connMgr.dispatch(pushJob)
 }
 
 // 消息分发到Bucket
 func (connMgr *ConnectionManager) dispatchWorkerMain(dispatchWorkerIdx int) {
 	var (
-		bucketIdx int
-		pushJob   *PushJob
-		err       error
+		bucketIdx    int
+		bucketIdxs   []int
+		pushJob      *PushJob
+		err          error
+		dispatchChan = connMgr.dispatchChan[dispatchWorkerIdx%len(connMgr.dispatchChan)]
 	)
 	for {
 		select {
 		case <-connMgr.stopChan:
 			return
-		case pushJob = <-connMgr.dispatchChan:
+		case pushJob = <-dispatchChan:
 
+			// 房间推送只分发给有订阅者的Bucket, 广播和用户推送分发给所有Bucket
+			if pushJob.pushType == types.PUSH_TYPE_ROOM {
+				bucketIdxs = connMgr.roomIndex.Buckets(pushJob.roomId)
+			} else if pushJob.pushType == types.PUSH_TYPE_ROOMS {
+				bucketIdxs = connMgr.roomIndex.Buckets(pushJob.roomIds...)
+			} else {
+				bucketIdxs = connMgr.allBucketIdxs
+			}
+			// 房间在本机没有订阅者
+			if len(bucketIdxs) == 0 {
+				completeDeliveries(pushJob.deliveries, 0)
+				continue
+			}
 			// 序列化
 			if pushJob.wsMsg, err = types.EncodeWSMessage(pushJob.bizMsg); err != nil {
+				completeDeliveries(pushJob.deliveries, 0)
 				continue
 			}
-			// 分发给所有Bucket, 若Bucket拥塞则等待
-			for bucketIdx, _ = range connMgr.buckets {
-				connMgr.jobChan[bucketIdx] <- pushJob
+			pushJob.pending = int32(len(bucketIdxs))
+			// 若Bucket拥塞则等待
+			for _, bucketIdx = range bucketIdxs {
+				connMgr.selectQueue(connMgr.jobChan[bucketIdx], pushJob) <- pushJob
 			}
 		}
 	}
@@ -186,25 +315,38 @@ func (connMgr *ConnectionManager) dispatchWorkerMain(dispatchWorkerIdx int) {
 func (connMgr *ConnectionManager) jobWorkerMain(jobWorkerIdx int, bucketIdx int) {
 	var (
 		bucket  = connMgr.buckets[bucketIdx]
+		jobChan = connMgr.jobChan[bucketIdx][jobWorkerIdx%len(connMgr.jobChan[bucketIdx])]
 		pushJob *PushJob
+		reached int
 	)
 
 	for {
 		select {
 		case <-connMgr.stopChan:
 			return
-		case pushJob = <-connMgr.jobChan[bucketIdx]: // 从Bucket的job queue取出一个任务
+		case pushJob = <-jobChan: // 从Bucket的job queue取出一个任务
+			reached = 0
 			if pushJob.pushType == types.PUSH_TYPE_ALL {
-				bucket.PushAll(pushJob.wsMsg)
+				reached = bucket.PushAll(pushJob.wsMsg, pushJob.filter)
 			} else if pushJob.pushType == types.PUSH_TYPE_ROOM {
-				bucket.PushRoom(pushJob.roomId, pushJob.wsMsg)
+				reached = bucket.PushRoom(pushJob.roomId, pushJob.wsMsg, pushJob.filter)
+			} else if pushJob.pushType == types.PUSH_TYPE_ROOMS {
+				reached = bucket.PushRooms(pushJob.roomIds, pushJob.wsMsg, pushJob.filter)
+			} else if pushJob.pushType == types.PUSH_TYPE_USER {
+				reached = bucket.PushUser(pushJob.identity, pushJob.wsMsg, pushJob.filter)
 			}
+			pushJob.bucketDone(reached)
 		}
 	}
 }
 
 func (connMgr *ConnectionManager) ConnectManagerClose() {
+	var (
+		dispatchChan chan *PushJob
+	)
 	connMgr.buckets = nil
-	close(connMgr.dispatchChan)
+	for _, dispatchChan = range connMgr.dispatchChan {
+		close(dispatchChan)
+	}
 	close(connMgr.stopChan)
 }
@@ -0,0 +1,131 @@
+package web_socket
+
+import (
+	"encoding/json"
+	"message-center/cmd/message/config"
+	"message-center/pkg/types"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func queueIndex(queues []chan *PushJob, queue chan *PushJob) int {
+	for queueIdx := range queues {
+		if queues[queueIdx] == queue {
+			return queueIdx
+		}
+	}
+	return -1
+}
+
+func TestInitQueues(t *testing.T) {
+	cases := []struct {
+		name        string
+		ordered     bool
+		workerCount int
+		channelSize int
+		wantQueues  int
+		wantCap     int
+	}{
+		{"普通模式共用一个队列", false, 4, 100, 1, 100},
+		{"有序模式每个协程一个队列, 容量均分", true, 4, 100, 4, 25},
+		{"有序模式单协程", true, 1, 100, 1, 100},
+		{"容量不足时至少为1", true, 8, 4, 8, 1},
+	}
+	for _, c := range cases {
+		connMgr := &ConnectionManager{ordered: c.ordered}
+		queues := connMgr.initQueues(c.workerCount, c.channelSize)
+		if len(queues) != c.wantQueues || cap(queues[0]) != c.wantCap {
+			t.Errorf("%s: queues=%d cap=%d, want %d/%d", c.name, len(queues), cap(queues[0]), c.wantQueues, c.wantCap)
+		}
+	}
+}
+
+func TestSelectQueueOrdered(t *testing.T) {
+	var (
+		connMgr = &ConnectionManager{ordered: true}
+		queues  = connMgr.initQueues(8, 800)
+	)
+	cases := []struct {
+		name    string
+		pushJob *PushJob
+		ordered bool // 同一目标是否总是进入同一队列
+	}{
+		{"单房间推送按房间分区", &PushJob{pushType: types.PUSH_TYPE_ROOM, roomId: "room-a"}, true},
+		{"用户推送按用户分区", &PushJob{pushType: types.PUSH_TYPE_USER, identity: "user-a"}, true},
+		{"多房间推送轮流进入各个队列", &PushJob{pushType: types.PUSH_TYPE_ROOMS, roomIds: []string{"room-a", "room-b"}}, false},
+		{"广播轮流进入各个队列", &PushJob{pushType: types.PUSH_TYPE_ALL}, false},
+	}
+	for _, c := range cases {
+		seen := make(map[int]bool)
+		for i := 0; i < len(queues); i++ {
+			seen[queueIndex(queues, connMgr.selectQueue(queues, c.pushJob))] = true
+		}
+		if c.ordered && len(seen) != 1 {
+			t.Errorf("%s: 进入了%d个队列, 应只进入一个", c.name, len(seen))
+		}
+		if !c.ordered && len(seen) != len(queues) {
+			t.Errorf("%s: 进入了%d个队列, 应轮流进入全部%d个", c.name, len(seen), len(queues))
+		}
+	}
+
+	// 同一房间的单房间推送与按房间hash的结果一致
+	if got := queueIndex(queues, connMgr.selectQueue(queues, &PushJob{pushType: types.PUSH_TYPE_ROOM, roomId: "room-a"})); got != roomHash("room-a", len(queues)) {
+		t.Errorf("room-a进入队列%d, want %d", got, roomHash("room-a", len(queues)))
+	}
+}
+
+// 稀疏房间的推送经ConnectionManager分发到Bucket并写入连接, 每次推送等待所有Bucket完成
+// indexed只分发给持有房间的Bucket; full-scan把房间登记到所有Bucket, 与加索引前每条消息扇出到所有Bucket相同
+func BenchmarkDispatchSparseRoom(b *testing.B) {
+	var (
+		bizMsg   = &types.BizMessage{Type: "PUSH", Data: json.RawMessage(`{"Items":[{"type":"PUSH"}]}`)}
+		original = GlobalSocketConnectionManager
+	)
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		GlobalSocketConnectionManager = original
+	}()
+
+	for _, bucketCount := range []int{512, 1024, 2048} {
+		for _, mode := range []string{"indexed", "full-scan"} {
+			config.GlobalServerConfig().BucketCount = bucketCount
+			if err := InitConnectManager(); err != nil {
+				b.Fatal(err)
+			}
+			connMgr := GlobalSocketConnectionManager
+
+			// 8192个连接, 只有4个加入room-7
+			for connIdx := 0; connIdx < 8192; connIdx++ {
+				wsConn := newTestConn(uint64(connIdx))
+				connMgr.AddConn(wsConn)
+				if connIdx%2048 == 7 {
+					_ = connMgr.JoinRoom("room-7", wsConn)
+				}
+			}
+			if mode == "full-scan" {
+				for bucketIdx := range connMgr.buckets {
+					connMgr.roomIndex.add("room-7", bucketIdx)
+				}
+			}
+
+			b.Run(mode+"/buckets="+strconv.Itoa(bucketCount), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					delivery := NewDelivery(1)
+					if err := connMgr.PushRoom("room-7", bizMsg, nil, []*Delivery{delivery}); err != nil {
+						b.Fatal(err)
+					}
+					if _, done := delivery.Wait(time.Second); !done {
+						b.Fatal("推送未完成")
+					}
+				}
+			})
+			// 只停止协程, 不关闭分发队列
+			close(connMgr.stopChan)
+		}
+	}
+}
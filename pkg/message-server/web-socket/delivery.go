@@ -0,0 +1,91 @@
+package web_socket
+
+import (
+	"sync"
+	"time"
+)
+
+// 等待推送送达: 一次推送的每条消息经合并、分发后写入连接发送队列, 全部完成后返回送达的连接数
+// 多条消息可能被合并到不同批次, 送达连接数取各批次的最大值
+type Delivery struct {
+	mutex    sync.Mutex
+	total    int // 推送的消息数
+	queued   int // 已进入合并批次或已丢弃的消息数
+	pending  int // 尚未完成的消息数
+	reached  int // 送达的连接数
+	doneChan chan byte
+}
+
+func NewDelivery(count int) (delivery *Delivery) {
+	delivery = &Delivery{
+		total:    count,
+		pending:  count,
+		doneChan: make(chan byte),
+	}
+	if count <= 0 {
+		close(delivery.doneChan)
+	}
+	return
+}
+
+// 一条消息已写入reached个连接的发送队列, 未能推送时reached为0
+func (delivery *Delivery) complete(reached int) {
+	if delivery == nil {
+		return
+	}
+	delivery.mutex.Lock()
+	defer delivery.mutex.Unlock()
+
+	if delivery.pending <= 0 {
+		return
+	}
+	if reached > delivery.reached {
+		delivery.reached = reached
+	}
+	if delivery.pending--; delivery.pending == 0 {
+		close(delivery.doneChan)
+	}
+}
+
+// 消息未进入合并队列
+func (delivery *Delivery) Drop() {
+	if delivery == nil {
+		return
+	}
+	delivery.mutex.Lock()
+	delivery.queued++
+	delivery.mutex.Unlock()
+	delivery.complete(0)
+}
+
+// 一条消息已进入合并批次, 推送的所有消息都已进入时返回true, 由合并worker立即提交批次
+func (delivery *Delivery) enqueue() bool {
+	delivery.mutex.Lock()
+	defer delivery.mutex.Unlock()
+
+	delivery.queued++
+	return delivery.queued >= delivery.total
+}
+
+// 等待所有消息完成, 超时返回已统计的连接数和false
+func (delivery *Delivery) Wait(timeout time.Duration) (reached int, done bool) {
+	select {
+	case <-delivery.doneChan:
+		done = true
+	case <-time.After(timeout):
+	}
+	delivery.mutex.Lock()
+	defer delivery.mutex.Unlock()
+
+	return delivery.reached, done
+}
+
+// 一批消息的所有等待方
+func completeDeliveries(deliveries []*Delivery, reached int) {
+	var (
+		delivery *Delivery
+	)
+	for _, delivery = range deliveries {
+		delivery.complete(reached)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -27,6 +28,7 @@ var (
 )
 
 // 创建连接，客户端通过发起ws://0.0.0.0：7777/connect请求创建一个新的socket连接
+// 可选参数uid指定用户标识, tags指定逗号分隔的连接标签, 用于推送时排除
 func InitSocketEndpoint() error {
 	var (
 		mux      *http.ServeMux
@@ -41,13 +43,13 @@ func InitSocketEndpoint() error {
 
 	// HTTP服务
 	server = &http.Server{
-		ReadTimeout:  time.Duration(config.GlobalServerConfig.WsReadTimeout) * time.Millisecond,
-		WriteTimeout: time.Duration(config.GlobalServerConfig.WsWriteTimeout) * time.Millisecond,
+		ReadTimeout:  time.Duration(config.GlobalServerConfig().WsReadTimeout) * time.Millisecond,
+		WriteTimeout: time.Duration(config.GlobalServerConfig().WsWriteTimeout) * time.Millisecond,
 		Handler:      mux,
 	}
 
 	// 监听端口
-	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalServerConfig.WsPort)); err != nil {
+	if listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.GlobalServerConfig().WsPort)); err != nil {
 		return err
 	}
 
@@ -71,8 +73,15 @@ func handleConnect(resp http.ResponseWriter, req *http.Request) {
 		wsSocket *websocket.Conn
 		connId   uint64
 		wsConn   *WSConnection
+		identity string
+		tags     []string
 	)
 
+	identity = req.URL.Query().Get("uid")
+	if req.URL.Query().Get("tags") != "" {
+		tags = strings.Split(req.URL.Query().Get("tags"), ",")
+	}
+
 	// WebSocket握手
 	if wsSocket, err = wsUpgrader.Upgrade(resp, req, nil); err != nil {
 		return
@@ -82,7 +91,7 @@ func handleConnect(resp http.ResponseWriter, req *http.Request) {
 	connId = atomic.AddUint64(&GlobalSocketEndpoint.curConnId, 1)
 
 	// 初始化WebSocket的读写协程
-	wsConn = InitWSConnection(connId, wsSocket)
+	wsConn = InitWSConnection(connId, wsSocket, identity, tags)
 
 	// 开始处理websocket消息
 	wsConn.WSHandle()
@@ -0,0 +1,61 @@
+package web_socket
+
+import (
+	"message-center/pkg/types"
+)
+
+// 推送排除过滤器, 由types.PushExclude构建, 便于推送时快速判断
+type pushFilter struct {
+	connIds    map[uint64]bool
+	identities map[string]bool
+	tags       map[string]bool
+}
+
+// 排除条件为空时返回nil, nil过滤器不排除任何连接
+func newPushFilter(exclude *types.PushExclude) (filter *pushFilter) {
+	var (
+		connId   uint64
+		identity string
+		tag      string
+	)
+	if exclude.IsEmpty() {
+		return
+	}
+	filter = &pushFilter{
+		connIds:    make(map[uint64]bool),
+		identities: make(map[string]bool),
+		tags:       make(map[string]bool),
+	}
+	for _, connId = range exclude.ConnIds {
+		filter.connIds[connId] = true
+	}
+	for _, identity = range exclude.Identities {
+		filter.identities[identity] = true
+	}
+	for _, tag = range exclude.Tags {
+		filter.tags[tag] = true
+	}
+	return
+}
+
+// 连接是否被排除
+func (filter *pushFilter) excluded(wsConn *WSConnection) bool {
+	var (
+		tag string
+	)
+	if filter == nil {
+		return false
+	}
+	if filter.connIds[wsConn.connId] {
+		return true
+	}
+	if wsConn.identity != "" && filter.identities[wsConn.identity] {
+		return true
+	}
+	for tag, _ = range wsConn.tags {
+		if filter.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
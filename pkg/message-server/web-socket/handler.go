@@ -82,7 +82,7 @@ func (wsConnection *WSConnection) WSHandle() {
 				return
 			}
 			// socket缓冲区写满不是致命错误
-			if err = wsConnection.SendMessage(&types.WSMessage{websocket.TextMessage, buf}); err != nil {
+			if err = wsConnection.SendMessage(&types.WSMessage{MessageType: websocket.TextMessage, MessageData: buf}); err != nil {
 				if err != utils.SendMessageFull {
 					return
 				} else {
@@ -99,7 +99,7 @@ func (wsConnection *WSConnection) heartbeatChecker() {
 	var (
 		timer *time.Timer
 	)
-	timer = time.NewTimer(time.Duration(config.GlobalServerConfig.WsHeartbeatInterval) * time.Second)
+	timer = time.NewTimer(time.Duration(config.GlobalServerConfig().WsHeartbeatInterval) * time.Second)
 	for {
 		select {
 		case <-timer.C:
@@ -107,7 +107,7 @@ func (wsConnection *WSConnection) heartbeatChecker() {
 				wsConnection.Close()
 				return
 			}
-			timer.Reset(time.Duration(config.GlobalServerConfig.WsHeartbeatInterval) * time.Second)
+			timer.Reset(time.Duration(config.GlobalServerConfig().WsHeartbeatInterval) * time.Second)
 		case <-wsConnection.closeChan:
 			timer.Stop()
 			return
@@ -146,7 +146,7 @@ func (wsConnection *WSConnection) handleJoin(bizReq *types.BizMessage) (bizResp
 		err = utils.RoomIdInvalid
 		return
 	}
-	if len(wsConnection.rooms) >= config.GlobalServerConfig.MaxJoinRoom {
+	if len(wsConnection.rooms) >= config.GlobalServerConfig().MaxJoinRoom {
 		// 超过了房间数量限制, 忽略这个请求
 		return
 	}
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"message-center/cmd/message/config"
 	"message-center/pkg/types"
+	"strings"
 )
 
 // 广播消息、房间消息的合并
 type MessageMerge struct {
 	roomWorkers     []*MergeWorker // 房间合并
+	roomsWorkers    []*MergeWorker // 多房间合并
+	userWorkers     []*MergeWorker // 用户合并
 	broadcastWorker *MergeWorker   // 广播合并
 	stopChan        chan byte      // 关闭
 }
@@ -20,11 +23,15 @@ func InitMessageMerger() error {
 	)
 
 	merger = &MessageMerge{
-		roomWorkers: make([]*MergeWorker, config.GlobalServerConfig.MergerWorkerCount),
-		stopChan:    make(chan byte, 1),
+		roomWorkers:  make([]*MergeWorker, config.GlobalServerConfig().MergerWorkerCount),
+		roomsWorkers: make([]*MergeWorker, config.GlobalServerConfig().MergerWorkerCount),
+		userWorkers:  make([]*MergeWorker, config.GlobalServerConfig().MergerWorkerCount),
+		stopChan:     make(chan byte, 1),
 	}
-	for workerIdx = 0; workerIdx < config.GlobalServerConfig.MergerWorkerCount; workerIdx++ {
+	for workerIdx = 0; workerIdx < config.GlobalServerConfig().MergerWorkerCount; workerIdx++ {
 		merger.roomWorkers[workerIdx] = initMergeWorker(types.PUSH_TYPE_ROOM, merger.stopChan)
+		merger.roomsWorkers[workerIdx] = initMergeWorker(types.PUSH_TYPE_ROOMS, merger.stopChan)
+		merger.userWorkers[workerIdx] = initMergeWorker(types.PUSH_TYPE_USER, merger.stopChan)
 	}
 	merger.broadcastWorker = initMergeWorker(types.PUSH_TYPE_ALL, merger.stopChan)
 
@@ -33,22 +40,48 @@ func InitMessageMerger() error {
 	return nil
 }
 
-// 广播合并推送
-func (merger *MessageMerge) PushAll(msg *json.RawMessage) (err error) {
-	return merger.broadcastWorker.pushAll(msg)
+// 广播合并推送, delivery不为nil时在消息推送到连接后通知
+func (merger *MessageMerge) PushAll(msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return merger.broadcastWorker.pushAll(msg, exclude, delivery)
 }
 
 // 房间合并推送
-func (merger *MessageMerge) PushRoom(room string, msg *json.RawMessage) (err error) {
+func (merger *MessageMerge) PushRoom(room string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
 	// 计算room hash到某个worker
+	return merger.roomWorkers[roomHash(room, len(merger.roomWorkers))].pushRoom(room, msg, exclude, delivery)
+}
+
+// 计算room hash到[0, count)
+func roomHash(room string, count int) int {
 	var (
-		workerIdx uint32 = 0
-		ch        byte
+		hash uint32 = 0
+		ch   byte
 	)
 	for _, ch = range []byte(room) {
-		workerIdx = (workerIdx + uint32(ch)*33) % uint32(config.GlobalServerConfig.MergerWorkerCount)
+		hash = (hash + uint32(ch)*33) % uint32(count)
+	}
+	return int(hash)
+}
+
+// 多房间合并推送, rooms需已排序去重
+func (merger *MessageMerge) PushRooms(rooms []string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	// 计算房间列表的hash到某个worker, 相同的房间列表进入同一个worker才能合并
+	return merger.roomsWorkers[roomHash(strings.Join(rooms, "\n"), len(merger.roomsWorkers))].pushRooms(rooms, msg, exclude, delivery)
+}
+
+// 用户合并推送
+func (merger *MessageMerge) PushUser(identity string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return merger.userWorkers[roomHash(identity, len(merger.userWorkers))].pushUser(identity, msg, exclude, delivery)
+}
+
+// 合并服务是否已关闭
+func (merger *MessageMerge) IsClosed() bool {
+	select {
+	case <-merger.stopChan:
+		return true
+	default:
+		return false
 	}
-	return merger.roomWorkers[workerIdx].pushRoom(room, msg)
 }
 
 func (merger *MessageMerge) MergeClose() {
@@ -13,8 +13,10 @@ type RoomInterface interface {
 	Leave(connection *WSConnection) error
 	// 房间内连接个数
 	Count() int
-	// 推送消息
-	Push(message *types.WSMessage)
+	// 推送消息, 跳过被过滤器排除的连接, 返回写入发送队列的连接数
+	Push(message *types.WSMessage, filter *pushFilter) (reached int)
+	// 推送消息, 跳过已推送过和被过滤器排除的连接, 返回写入发送队列的连接数
+	PushOnce(message *types.WSMessage, pushed map[uint64]bool, filter *pushFilter) (reached int)
 }
 
 // 房间
@@ -73,7 +75,8 @@ func (room *Room) Count() int {
 	return len(room.id2Conn)
 }
 
-func (room *Room) Push(wsMsg *types.WSMessage) {
+// 返回写入发送队列的连接数
+func (room *Room) Push(wsMsg *types.WSMessage, filter *pushFilter) (reached int) {
 	var (
 		wsConn *WSConnection
 	)
@@ -81,6 +84,36 @@ func (room *Room) Push(wsMsg *types.WSMessage) {
 	defer room.rwMutex.RUnlock()
 
 	for _, wsConn = range room.id2Conn {
-		wsConn.SendMessage(wsMsg)
+		if filter.excluded(wsConn) {
+			continue
+		}
+		if wsConn.SendMessage(wsMsg) == nil {
+			reached++
+		}
 	}
+	return
+}
+
+// 多房间推送时, 同一连接可能加入了多个目标房间, 通过pushed记录已推送的连接, 保证只推送一次
+func (room *Room) PushOnce(wsMsg *types.WSMessage, pushed map[uint64]bool, filter *pushFilter) (reached int) {
+	var (
+		connId uint64
+		wsConn *WSConnection
+	)
+	room.rwMutex.RLock()
+	defer room.rwMutex.RUnlock()
+
+	for connId, wsConn = range room.id2Conn {
+		if pushed[connId] {
+			continue
+		}
+		pushed[connId] = true
+		if filter.excluded(wsConn) {
+			continue
+		}
+		if wsConn.SendMessage(wsMsg) == nil {
+			reached++
+		}
+	}
+	return
 }
@@ -0,0 +1,153 @@
+package web_socket
+
+import (
+	"message-center/pkg/types"
+	"sync"
+	"time"
+)
+
+// 最多保留的增量变化条数, 落后更多的订阅方需要全量同步
+const maxRoomChanges = 4096
+
+// 房间 -> Bucket的成员索引
+// Bucket新建/删除房间时更新, 房间推送据此只分发给有订阅者的Bucket, 避免每条消息扇出到所有Bucket
+// 同时记录房间增删的版本和增量变化, 供logic按订阅路由推送
+type RoomIndex struct {
+	rwMutex      sync.RWMutex
+	room2Buckets map[string]map[int]bool // key=房间ID, value=持有该房间的Bucket下标
+	epoch        int64                   // 启动时间, 标识本次运行
+	version      uint64                  // 房间列表版本
+	changes      []types.RoomChange      // 增量变化, changes[i]对应版本baseVersion+i+1
+	baseVersion  uint64
+	notifyChan   chan byte // 版本变化时关闭并重建, 用于等待变化
+}
+
+func InitRoomIndex() (roomIndex *RoomIndex) {
+	roomIndex = &RoomIndex{
+		room2Buckets: make(map[string]map[int]bool),
+		epoch:        time.Now().UnixNano(),
+		notifyChan:   make(chan byte),
+	}
+	return
+}
+
+// Bucket中建立了房间
+func (roomIndex *RoomIndex) add(roomId string, bucketIdx int) {
+	var (
+		buckets map[int]bool
+		existed bool
+	)
+	roomIndex.rwMutex.Lock()
+	defer roomIndex.rwMutex.Unlock()
+
+	if buckets, existed = roomIndex.room2Buckets[roomId]; !existed {
+		buckets = make(map[int]bool)
+		roomIndex.room2Buckets[roomId] = buckets
+		roomIndex.changed(roomId, true)
+	}
+	buckets[bucketIdx] = true
+}
+
+// Bucket中的房间已为空
+func (roomIndex *RoomIndex) remove(roomId string, bucketIdx int) {
+	var (
+		buckets map[int]bool
+		existed bool
+	)
+	roomIndex.rwMutex.Lock()
+	defer roomIndex.rwMutex.Unlock()
+
+	if buckets, existed = roomIndex.room2Buckets[roomId]; !existed {
+		return
+	}
+	delete(buckets, bucketIdx)
+	if len(buckets) == 0 {
+		delete(roomIndex.room2Buckets, roomId)
+		roomIndex.changed(roomId, false)
+	}
+}
+
+// 记录房间增删, 需持有写锁
+func (roomIndex *RoomIndex) changed(roomId string, join bool) {
+	roomIndex.version++
+	roomIndex.changes = append(roomIndex.changes, types.RoomChange{Room: roomId, Join: join})
+	if len(roomIndex.changes) > maxRoomChanges {
+		roomIndex.baseVersion += maxRoomChanges / 2
+		roomIndex.changes = append([]types.RoomChange{}, roomIndex.changes[maxRoomChanges/2:]...)
+	}
+	close(roomIndex.notifyChan)
+	roomIndex.notifyChan = make(chan byte)
+}
+
+// 持有这些房间的Bucket下标, 多个房间时取并集
+func (roomIndex *RoomIndex) Buckets(roomIds ...string) (bucketIdxs []int) {
+	var (
+		roomId    string
+		bucketIdx int
+		seen      map[int]bool
+	)
+	roomIndex.rwMutex.RLock()
+	defer roomIndex.rwMutex.RUnlock()
+
+	if len(roomIds) == 1 {
+		for bucketIdx, _ = range roomIndex.room2Buckets[roomIds[0]] {
+			bucketIdxs = append(bucketIdxs, bucketIdx)
+		}
+		return
+	}
+
+	seen = make(map[int]bool)
+	for _, roomId = range roomIds {
+		for bucketIdx, _ = range roomIndex.room2Buckets[roomId] {
+			if !seen[bucketIdx] {
+				seen[bucketIdx] = true
+				bucketIdxs = append(bucketIdxs, bucketIdx)
+			}
+		}
+	}
+	return
+}
+
+// 订阅方已同步到epoch/version, 返回之后的增量变化; 无法增量同步时返回全量房间列表
+// 版本没有变化时最多等待wait
+func (roomIndex *RoomIndex) Digest(epoch int64, version uint64, wait time.Duration) (digest *types.RoomDigest) {
+	var (
+		notifyChan chan byte
+		unchanged  bool
+		timer      *time.Timer
+		roomId     string
+	)
+
+	roomIndex.rwMutex.RLock()
+	notifyChan = roomIndex.notifyChan
+	unchanged = epoch == roomIndex.epoch && version == roomIndex.version
+	roomIndex.rwMutex.RUnlock()
+
+	// 等待变化
+	if unchanged && wait > 0 {
+		timer = time.NewTimer(wait)
+		select {
+		case <-notifyChan:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	roomIndex.rwMutex.RLock()
+	defer roomIndex.rwMutex.RUnlock()
+
+	digest = &types.RoomDigest{
+		Epoch:   roomIndex.epoch,
+		Version: roomIndex.version,
+	}
+	// 同一次运行, 且增量变化还在保留范围内
+	if epoch == roomIndex.epoch && version >= roomIndex.baseVersion && version <= roomIndex.version {
+		digest.Changes = append(digest.Changes, roomIndex.changes[version-roomIndex.baseVersion:]...)
+		return
+	}
+	digest.Full = true
+	for roomId, _ = range roomIndex.room2Buckets {
+		digest.Rooms = append(digest.Rooms, roomId)
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package web_socket
+
+import (
+	"message-center/pkg/types"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 不启动读写协程的连接, 发送队列无缓冲, 推送立即返回
+func newTestConn(connId uint64) *WSConnection {
+	return &WSConnection{
+		connId:    connId,
+		outChan:   make(chan *types.WSMessage),
+		closeChan: make(chan byte),
+		rooms:     make(map[string]bool),
+		tags:      make(map[string]bool),
+	}
+}
+
+// bucketCount个Bucket, connCount个连接按连接ID打散, 第i个连接加入房间room-(i%roomCount)
+func newTestBuckets(bucketCount int, connCount int, roomCount int) (buckets []*Bucket, roomIndex *RoomIndex) {
+	var (
+		bucketIdx int
+		connIdx   int
+		wsConn    *WSConnection
+	)
+	roomIndex = InitRoomIndex()
+	buckets = make([]*Bucket, bucketCount)
+	for bucketIdx, _ = range buckets {
+		buckets[bucketIdx] = InitBucket(bucketIdx, roomIndex)
+	}
+	for connIdx = 0; connIdx < connCount; connIdx++ {
+		wsConn = newTestConn(uint64(connIdx))
+		buckets[connIdx%bucketCount].AddConn(wsConn)
+		_ = buckets[connIdx%bucketCount].JoinRoom("room-"+strconv.Itoa(connIdx%roomCount), wsConn)
+	}
+	return
+}
+
+func sortedBuckets(roomIndex *RoomIndex, roomIds ...string) []int {
+	bucketIdxs := roomIndex.Buckets(roomIds...)
+	sort.Ints(bucketIdxs)
+	return bucketIdxs
+}
+
+func TestRoomIndexBuckets(t *testing.T) {
+	var (
+		buckets, roomIndex = newTestBuckets(4, 8, 4)
+	)
+	// room-0: 连接0和4, 都在Bucket 0; room-1: 连接1和5, 都在Bucket 1
+	cases := []struct {
+		name  string
+		rooms []string
+		want  []int
+	}{
+		{"单房间", []string{"room-0"}, []int{0}},
+		{"多房间取并集", []string{"room-0", "room-1"}, []int{0, 1}},
+		{"重复房间只计一次", []string{"room-2", "room-2"}, []int{2}},
+		{"没有订阅者", []string{"room-x"}, nil},
+	}
+	for _, c := range cases {
+		if got := sortedBuckets(roomIndex, c.rooms...); !equalInts(got, c.want) {
+			t.Errorf("%s: Buckets(%v) = %v, want %v", c.name, c.rooms, got, c.want)
+		}
+	}
+
+	// 房间最后一个连接离开后从索引中删除
+	_ = buckets[0].LeaveRoom("room-0", buckets[0].id2Conn[0])
+	if got := sortedBuckets(roomIndex, "room-0"); !equalInts(got, []int{0}) {
+		t.Errorf("还有连接时不应删除: %v", got)
+	}
+	_ = buckets[0].LeaveRoom("room-0", buckets[0].id2Conn[4])
+	if got := sortedBuckets(roomIndex, "room-0"); len(got) != 0 {
+		t.Errorf("房间为空后应从索引删除: %v", got)
+	}
+}
+
+func TestRoomIndexDigest(t *testing.T) {
+	var (
+		roomIndex = InitRoomIndex()
+		digest    *types.RoomDigest
+	)
+	roomIndex.add("a", 0)
+	roomIndex.add("a", 1) // 已有的房间不产生变化
+	roomIndex.add("b", 0)
+
+	cases := []struct {
+		name        string
+		epoch       int64
+		version     uint64
+		wantFull    bool
+		wantChanges int
+	}{
+		{"首次同步返回全量", 0, 0, true, 0},
+		{"增量同步", roomIndex.epoch, 1, false, 1},
+		{"epoch变化返回全量", roomIndex.epoch + 1, 1, true, 0},
+		{"版本超前返回全量", roomIndex.epoch, 10, true, 0},
+	}
+	for _, c := range cases {
+		digest = roomIndex.Digest(c.epoch, c.version, 0)
+		if digest.Full != c.wantFull || len(digest.Changes) != c.wantChanges || digest.Version != 2 {
+			t.Errorf("%s: full=%v changes=%d version=%d", c.name, digest.Full, len(digest.Changes), digest.Version)
+		}
+		if digest.Full && len(digest.Rooms) != 2 {
+			t.Errorf("%s: 全量房间数=%d, want 2", c.name, len(digest.Rooms))
+		}
+	}
+
+	// 没有变化时挂起, 有变化时立即返回
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		roomIndex.remove("b", 0)
+	}()
+	digest = roomIndex.Digest(roomIndex.epoch, 2, time.Second)
+	if digest.Version != 3 || len(digest.Changes) != 1 || digest.Changes[0].Join {
+		t.Errorf("等待变化: %+v", digest)
+	}
+
+	// 连接JOIN使房间有了第一个订阅者时立即唤醒
+	bucket := InitBucket(0, roomIndex)
+	wsConn := newTestConn(1)
+	bucket.AddConn(wsConn)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = bucket.JoinRoom("c", wsConn)
+	}()
+	start := time.Now()
+	digest = roomIndex.Digest(roomIndex.epoch, 3, time.Second)
+	if digest.Version != 4 || len(digest.Changes) != 1 || !digest.Changes[0].Join || digest.Changes[0].Room != "c" {
+		t.Errorf("JOIN唤醒: %+v", digest)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("JOIN后没有立即唤醒: %v", time.Since(start))
+	}
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -6,18 +6,31 @@ import (
 	"message-center/cmd/message/config"
 	"message-center/pkg/types"
 	"message-center/utils"
+	"strings"
 	"time"
 )
 
 type PushBatch struct {
 	items       []*json.RawMessage
 	commitTimer *time.Timer
-	room        string // 按room合并
+	key         string             // 合并key, 推送目标相同的消息才会合并
+	excludeKey  string             // 排除条件的规范化表示, 同一目标的排除条件变化时先提交之前的批次
+	room        string             // 按room合并
+	rooms       []string           // 多房间推送的房间列表
+	identity    string             // 按用户合并
+	exclude     *types.PushExclude // 推送排除条件
+	deliveries  []*Delivery        // 等待送达结果的推送
 }
 
 type PushContext struct {
-	msg  *json.RawMessage
-	room string // 按room合并
+	msg        *json.RawMessage
+	key        string             // 合并key
+	excludeKey string             // 排除条件的规范化表示
+	room       string             // 按room合并
+	rooms      []string           // 多房间推送的房间列表
+	identity   string             // 按用户合并
+	exclude    *types.PushExclude // 推送排除条件
+	delivery   *Delivery          // 等待送达结果, nil表示不等待
 }
 
 type MergeWorker struct {
@@ -26,17 +39,16 @@ type MergeWorker struct {
 	contextChan chan *PushContext
 	timeoutChan chan *PushBatch
 
-	room2Batch map[string]*PushBatch // room合并
-	allBatch   *PushBatch            // 广播合并
-	stopChan   chan byte
+	key2Batch map[string]*PushBatch // 按合并key合并: 房间/房间列表/用户/广播
+	stopChan  chan byte
 }
 
 func initMergeWorker(mergeType int, stopChan chan byte) (worker *MergeWorker) {
 	worker = &MergeWorker{
 		mergeType:   mergeType,
-		room2Batch:  make(map[string]*PushBatch),
-		contextChan: make(chan *PushContext, config.GlobalServerConfig.MergerChannelSize),
-		timeoutChan: make(chan *PushBatch, config.GlobalServerConfig.MergerChannelSize),
+		key2Batch:   make(map[string]*PushBatch),
+		contextChan: make(chan *PushContext, config.GlobalServerConfig().MergerChannelSize),
+		timeoutChan: make(chan *PushBatch, config.GlobalServerConfig().MergerChannelSize),
 		stopChan:    stopChan,
 	}
 	go worker.mergeWorkerMain()
@@ -58,54 +70,56 @@ func (worker *MergeWorker) mergeWorkerMain() {
 			return
 		case context = <-worker.contextChan:
 			isCreated = false
-			// 按房间合并
-			if worker.mergeType == types.PUSH_TYPE_ROOM {
-				if batch, existed = worker.room2Batch[context.room]; !existed {
-					batch = &PushBatch{room: context.room}
-					worker.room2Batch[context.room] = batch
-					isCreated = true
+			// 同一目标的排除条件变化时先提交之前的批次, 保持同一目标的消息顺序
+			if batch, existed = worker.key2Batch[context.key]; existed && batch.excludeKey != context.excludeKey {
+				batch.commitTimer.Stop()
+				if err := worker.commitBatch(batch); err != nil {
+					logrus.Warn("提交批次失败")
 				}
-			} else if worker.mergeType == types.PUSH_TYPE_ALL { // 广播合并
-				batch = worker.allBatch
-				if batch == nil {
-					batch = &PushBatch{}
-					worker.allBatch = batch
-					isCreated = true
+				existed = false
+			}
+			// 按合并key合并
+			if !existed {
+				batch = &PushBatch{
+					key:        context.key,
+					excludeKey: context.excludeKey,
+					room:       context.room,
+					rooms:      context.rooms,
+					identity:   context.identity,
+					exclude:    context.exclude,
 				}
+				worker.key2Batch[context.key] = batch
+				isCreated = true
 			}
 
 			// 合并消息
 			batch.items = append(batch.items, context.msg)
+			if context.delivery != nil {
+				batch.deliveries = append(batch.deliveries, context.delivery)
+			}
 
 			// 新建批次, 启动超时自动提交
 			if isCreated {
-				batch.commitTimer = time.AfterFunc(time.Duration(config.GlobalServerConfig.MaxMergerDelay)*time.Millisecond, worker.autoCommit(batch))
+				batch.commitTimer = time.AfterFunc(time.Duration(config.GlobalServerConfig().MaxMergerDelay)*time.Millisecond, worker.autoCommit(batch))
 			}
 
-			// 批次未满, 继续等待下次提交
-			if len(batch.items) < config.GlobalServerConfig.MaxMergerBatchSize {
+			// 批次未满且没有等待送达的推送全部进入批次, 继续等待下次提交
+			// 等待送达的推送的所有消息合并在同一批次, 最后一条进入后立即提交, 不等待合并延迟; 有消息丢弃时由超时提交
+			if len(batch.items) < config.GlobalServerConfig().MaxMergerBatchSize && (context.delivery == nil || !context.delivery.enqueue()) {
 				continue
 			}
 
-			// 批次已满, 取消超时自动提交
+			// 批次已满或等待送达的推送已全部进入, 取消超时自动提交
 			batch.commitTimer.Stop()
 		case timeoutBatch = <-worker.timeoutChan:
-			if worker.mergeType == types.PUSH_TYPE_ROOM {
-				// 定时器触发时, 批次已被提交
-				if batch, existed = worker.room2Batch[timeoutBatch.room]; !existed {
-					continue
-				}
+			// 定时器触发时, 批次已被提交
+			if batch, existed = worker.key2Batch[timeoutBatch.key]; !existed {
+				continue
+			}
 
-				// 定时器触发时, 前一个批次已提交, 下一个批次已建立
-				if batch != timeoutBatch {
-					continue
-				}
-			} else if worker.mergeType == types.PUSH_TYPE_ALL {
-				batch = worker.allBatch
-				// 定时器触发时, 批次已被提交
-				if timeoutBatch != batch {
-					continue
-				}
+			// 定时器触发时, 前一个批次已提交, 下一个批次已建立
+			if batch != timeoutBatch {
+				continue
 			}
 		}
 		// 提交批次
@@ -129,9 +143,18 @@ func (worker *MergeWorker) commitBatch(batch *PushBatch) (err error) {
 		buf         []byte
 	)
 
+	delete(worker.key2Batch, batch.key)
+
 	bizPushData = &types.BizPushData{
 		Items: batch.items,
 	}
+	// 批次未能提交时, 等待方不再等待
+	defer func() {
+		if err != nil {
+			completeDeliveries(batch.deliveries, 0)
+		}
+	}()
+
 	if buf, err = json.Marshal(*bizPushData); err != nil {
 		return
 	}
@@ -143,23 +166,18 @@ func (worker *MergeWorker) commitBatch(batch *PushBatch) (err error) {
 
 	// 打包发送
 	if worker.mergeType == types.PUSH_TYPE_ROOM {
-		delete(worker.room2Batch, batch.room)
-		err = GlobalSocketConnectionManager.PushRoom(batch.room, bizMessage)
+		err = GlobalSocketConnectionManager.PushRoom(batch.room, bizMessage, batch.exclude, batch.deliveries)
+	} else if worker.mergeType == types.PUSH_TYPE_ROOMS {
+		err = GlobalSocketConnectionManager.PushRooms(batch.rooms, bizMessage, batch.exclude, batch.deliveries)
+	} else if worker.mergeType == types.PUSH_TYPE_USER {
+		err = GlobalSocketConnectionManager.PushUser(batch.identity, bizMessage, batch.exclude, batch.deliveries)
 	} else if worker.mergeType == types.PUSH_TYPE_ALL {
-		worker.allBatch = nil
-		err = GlobalSocketConnectionManager.PushAll(bizMessage)
+		err = GlobalSocketConnectionManager.PushAll(bizMessage, batch.exclude, batch.deliveries)
 	}
 	return
 }
 
-func (worker *MergeWorker) pushRoom(room string, msg *json.RawMessage) (err error) {
-	var (
-		context *PushContext
-	)
-	context = &PushContext{
-		room: room,
-		msg:  msg,
-	}
+func (worker *MergeWorker) pushContext(context *PushContext) (err error) {
 	select {
 	case worker.contextChan <- context:
 
@@ -169,18 +187,45 @@ func (worker *MergeWorker) pushRoom(room string, msg *json.RawMessage) (err erro
 	return
 }
 
-func (worker *MergeWorker) pushAll(msg *json.RawMessage) (err error) {
-	var (
-		context *PushContext
-	)
-	context = &PushContext{
-		msg: msg,
-	}
-	select {
-	case worker.contextChan <- context:
+func (worker *MergeWorker) pushRoom(room string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return worker.pushContext(&PushContext{
+		key:        room,
+		excludeKey: exclude.Key(),
+		room:       room,
+		msg:        msg,
+		exclude:    exclude,
+		delivery:   delivery,
+	})
+}
 
-	default:
-		err = utils.MergeChannelFull
-	}
-	return
+// rooms需已排序去重, 相同房间列表的消息才会被合并到一起
+func (worker *MergeWorker) pushRooms(rooms []string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return worker.pushContext(&PushContext{
+		key:        strings.Join(rooms, "\n"),
+		excludeKey: exclude.Key(),
+		rooms:      rooms,
+		msg:        msg,
+		exclude:    exclude,
+		delivery:   delivery,
+	})
+}
+
+func (worker *MergeWorker) pushUser(identity string, msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return worker.pushContext(&PushContext{
+		key:        identity,
+		excludeKey: exclude.Key(),
+		identity:   identity,
+		msg:        msg,
+		exclude:    exclude,
+		delivery:   delivery,
+	})
+}
+
+func (worker *MergeWorker) pushAll(msg *json.RawMessage, exclude *types.PushExclude, delivery *Delivery) (err error) {
+	return worker.pushContext(&PushContext{
+		excludeKey: exclude.Key(),
+		msg:        msg,
+		exclude:    exclude,
+		delivery:   delivery,
+	})
 }
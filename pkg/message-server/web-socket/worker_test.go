@@ -0,0 +1,73 @@
+package web_socket
+
+import (
+	"encoding/json"
+	"message-center/cmd/message/config"
+	"message-center/pkg/types"
+	"os"
+	"testing"
+	"time"
+)
+
+// 同一房间排除条件不同的消息不合并, 且按推送顺序提交
+func TestMergeWorkerKeepsRoomOrder(t *testing.T) {
+	var (
+		stopChan = make(chan byte)
+		connMgr  = &ConnectionManager{dispatchChan: []chan *PushJob{make(chan *PushJob, 16)}}
+		original = GlobalSocketConnectionManager
+		bob      = &types.PushExclude{Identities: []string{"bob"}}
+	)
+	os.Unsetenv("CONFIG")
+	if err := config.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.GlobalServerConfig().MaxMergerDelay = 20
+	GlobalSocketConnectionManager = connMgr
+	defer func() {
+		close(stopChan)
+		GlobalSocketConnectionManager = original
+	}()
+
+	pushes := []struct {
+		msg     string
+		exclude *types.PushExclude
+	}{
+		{`1`, nil},
+		{`2`, bob},
+		{`3`, &types.PushExclude{Identities: []string{"bob"}}}, // 排除条件相同, 与上一条合并
+		{`4`, nil},
+	}
+	worker := initMergeWorker(types.PUSH_TYPE_ROOM, stopChan)
+	for _, push := range pushes {
+		msg := json.RawMessage(push.msg)
+		if err := worker.pushRoom("room-a", &msg, push.exclude, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantBatches := []struct {
+		items    string
+		excluded bool
+	}{
+		{`[1]`, false},
+		{`[2,3]`, true},
+		{`[4]`, false},
+	}
+	for batchIdx, want := range wantBatches {
+		var (
+			pushJob  *PushJob
+			pushData struct{ Items json.RawMessage }
+		)
+		select {
+		case pushJob = <-connMgr.dispatchChan[0]:
+		case <-time.After(time.Second):
+			t.Fatalf("第%d批未提交", batchIdx)
+		}
+		if err := json.Unmarshal(pushJob.bizMsg.Data, &pushData); err != nil {
+			t.Fatal(err)
+		}
+		if string(pushData.Items) != want.items || pushJob.roomId != "room-a" || (pushJob.filter != nil) != want.excluded {
+			t.Errorf("第%d批: items=%s room=%s filter=%v", batchIdx, pushData.Items, pushJob.roomId, pushJob.filter)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/go-stomp/stomp"
 	"github.com/sirupsen/logrus"
 	"message-center/pkg/configuration"
+	"sync"
+	"time"
 )
 
 type MqControllerInterface interface {
@@ -13,6 +15,10 @@ type MqControllerInterface interface {
 	ActiveReConnect() error
 	// topic active mq send message
 	SendMessage(topic string, message []byte) error
+	// 复用长连接向topic发布消息, 失败时重连一次
+	Publish(topic string, message []byte) error
+	// 订阅topic, 断线后自动重连, 直到stopChan关闭
+	Subscribe(topic string, handler func(message []byte), stopChan chan byte)
 }
 
 type MqController struct {
@@ -20,8 +26,14 @@ type MqController struct {
 	activeUsername  string
 	activePassword  string
 	activeStompConn *stomp.Conn // activemq
+
+	publishMutex sync.Mutex
+	publishConn  *stomp.Conn // Publish复用的长连接
 }
 
+// 订阅断线后的重连间隔
+const subscribeRetryInterval = 3 * time.Second
+
 func (mc *MqController) Initialize(dcl configuration.ConfigurationLoader) {
 	MqConnectionStr := dcl.GetField("DevOps.Mgmt.API", "MQ_ConnectionStr")
 	MqUsername := dcl.GetField("DevOps.Mgmt.API", "MQ_Username")
@@ -31,22 +43,31 @@ func (mc *MqController) Initialize(dcl configuration.ConfigurationLoader) {
 }
 
 func (mc *MqController) InitializeByConfig(connectionStr, username, password string) {
+	mc.Configure(connectionStr, username, password)
+	_ = mc.ActiveReConnect()
+}
+
+// 只设置连接参数, 不建立连接, 供Publish/Subscribe按需连接
+func (mc *MqController) Configure(connectionStr, username, password string) {
 	mc.connectionStr = connectionStr
 	mc.activeUsername = username
 	mc.activePassword = password
-	_ = mc.ActiveReConnect()
 }
 
 func (mc *MqController) ActiveReConnect() error {
 	var err error
-	mc.activeStompConn, err = stomp.Dial("tcp", mc.connectionStr,
+	mc.activeStompConn, err = mc.dial()
+	return err
+}
+
+func (mc *MqController) dial() (*stomp.Conn, error) {
+	return stomp.Dial("tcp", mc.connectionStr,
 		stomp.ConnOpt.Login(mc.activeUsername, mc.activePassword),
 		stomp.ConnOpt.AcceptVersion(stomp.V11),
 		stomp.ConnOpt.AcceptVersion(stomp.V12),
 		// stomp.ConnOpt.Host("dragon"),
 		// stomp.ConnOpt.Header("nonce", "B256B26D320A")
 	)
-	return err
 }
 
 func (mc *MqController) SendMessage(topic string, message []byte) error {
@@ -65,3 +86,81 @@ func (mc *MqController) SendMessage(topic string, message []byte) error {
 	}
 	return nil
 }
+
+func (mc *MqController) Publish(topic string, message []byte) (err error) {
+	var (
+		retry int
+	)
+	mc.publishMutex.Lock()
+	defer mc.publishMutex.Unlock()
+
+	for retry = 0; retry < 2; retry++ {
+		if mc.publishConn == nil {
+			if mc.publishConn, err = mc.dial(); err != nil {
+				mc.publishConn = nil
+				logrus.Errorf("连接activemq失败：%s-%s", mc.connectionStr, mc.activeUsername)
+				return
+			}
+		}
+		if err = mc.publishConn.Send("/topic/"+topic, "application/json", message); err == nil {
+			return
+		}
+		// 连接已失效, 丢弃后重连
+		_ = mc.publishConn.Disconnect()
+		mc.publishConn = nil
+	}
+	return
+}
+
+func (mc *MqController) Subscribe(topic string, handler func(message []byte), stopChan chan byte) {
+	var (
+		conn *stomp.Conn
+		sub  *stomp.Subscription
+		msg  *stomp.Message
+		err  error
+	)
+	for {
+		if conn, err = mc.dial(); err == nil {
+			if sub, err = conn.Subscribe("/topic/"+topic, stomp.AckAuto); err != nil {
+				_ = conn.Disconnect()
+			}
+		}
+		if err != nil {
+			logrus.Warnf("订阅activemq失败：%s-%s, %v", mc.connectionStr, topic, err)
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(subscribeRetryInterval):
+				continue
+			}
+		}
+
+	RECEIVE:
+		for {
+			select {
+			case <-stopChan:
+				_ = sub.Unsubscribe()
+				_ = conn.Disconnect()
+				return
+			case msg = <-sub.C:
+				// 订阅通道关闭或出错, 重新连接
+				if msg == nil || msg.Err != nil {
+					break RECEIVE
+				}
+				handler(msg.Body)
+			}
+		}
+		logrus.Warnf("activemq订阅断开, 重新连接：%s-%s", mc.connectionStr, topic)
+		_ = conn.MustDisconnect()
+	}
+}
+
+func (mc *MqController) Close() {
+	mc.publishMutex.Lock()
+	defer mc.publishMutex.Unlock()
+
+	if mc.publishConn != nil {
+		_ = mc.publishConn.Disconnect()
+		mc.publishConn = nil
+	}
+}
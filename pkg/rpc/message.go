@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"encoding/json"
+	"message-center/pkg/types"
+)
+
+// message.pb.go由message.proto生成, 需要protoc和protoc-gen-go v1.3.3(与go.mod中的github.com/golang/protobuf一致)
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. message.proto
+
+// 流式推送事件类型
+const (
+	STREAM_EVENT_ACK     = "ACK"
+	STREAM_EVENT_CLOSING = "CLOSING"
+)
+
+// 推送排除条件转换, 条件为空时返回nil
+func NewExclude(exclude *types.PushExclude) *Exclude {
+	if exclude.IsEmpty() {
+		return nil
+	}
+	return &Exclude{ConnIds: exclude.ConnIds, Identities: exclude.Identities, Tags: exclude.Tags}
+}
+
+func (m *Exclude) PushExclude() *types.PushExclude {
+	if m == nil {
+		return nil
+	}
+	return &types.PushExclude{ConnIds: m.ConnIds, Identities: m.Identities, Tags: m.Tags}
+}
+
+// 消息数组转换, 每条消息保持原样
+func NewItems(msgArr []json.RawMessage) (items [][]byte) {
+	var (
+		msgIdx int
+	)
+	items = make([][]byte, len(msgArr))
+	for msgIdx, _ = range msgArr {
+		items[msgIdx] = msgArr[msgIdx]
+	}
+	return
+}
+
+func (m *PushRequest) MsgArr() (msgArr []json.RawMessage) {
+	var (
+		itemIdx int
+	)
+	msgArr = make([]json.RawMessage, len(m.Items))
+	for itemIdx, _ = range m.Items {
+		msgArr[itemIdx] = m.Items[itemIdx]
+	}
+	return
+}
+
+func NewPushReply(pushResp *types.PushResponse) *PushReply {
+	return &PushReply{Code: pushResp.Code, Message: pushResp.Message, Accepted: int32(pushResp.Accepted), Dropped: int32(pushResp.Dropped), Reached: int32(pushResp.Reached)}
+}
+
+func (m *PushReply) PushResponse() *types.PushResponse {
+	return &types.PushResponse{Code: m.Code, Message: m.Message, Accepted: int(m.Accepted), Dropped: int(m.Dropped), Reached: int(m.Reached)}
+}
@@ -0,0 +1,659 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: message.proto
+
+package rpc
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// 推送排除条件, 对应types.PushExclude
+type Exclude struct {
+	ConnIds              []uint64 `protobuf:"varint,1,rep,packed,name=conn_ids,json=connIds,proto3" json:"conn_ids,omitempty"`
+	Identities           []string `protobuf:"bytes,2,rep,name=identities,proto3" json:"identities,omitempty"`
+	Tags                 []string `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Exclude) Reset()         { *m = Exclude{} }
+func (m *Exclude) String() string { return proto.CompactTextString(m) }
+func (*Exclude) ProtoMessage()    {}
+func (*Exclude) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33c57e4bae7b9afd, []int{0}
+}
+
+func (m *Exclude) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Exclude.Unmarshal(m, b)
+}
+func (m *Exclude) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Exclude.Marshal(b, m, deterministic)
+}
+func (m *Exclude) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Exclude.Merge(m, src)
+}
+func (m *Exclude) XXX_Size() int {
+	return xxx_messageInfo_Exclude.Size(m)
+}
+func (m *Exclude) XXX_DiscardUnknown() {
+	xxx_messageInfo_Exclude.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Exclude proto.InternalMessageInfo
+
+func (m *Exclude) GetConnIds() []uint64 {
+	if m != nil {
+		return m.ConnIds
+	}
+	return nil
+}
+
+func (m *Exclude) GetIdentities() []string {
+	if m != nil {
+		return m.Identities
+	}
+	return nil
+}
+
+func (m *Exclude) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+// 推送请求, push_type对应types.PUSH_TYPE_*
+// items每一项是一条业务消息的json, message server不再解析
+type PushRequest struct {
+	PushType int32    `protobuf:"varint,1,opt,name=push_type,json=pushType,proto3" json:"push_type,omitempty"`
+	Room     string   `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	Rooms    []string `protobuf:"bytes,3,rep,name=rooms,proto3" json:"rooms,omitempty"`
+	User     string   `protobuf:"bytes,4,opt,name=user,proto3" json:"user,omitempty"`
+	Exclude  *Exclude `protobuf:"bytes,5,opt,name=exclude,proto3" json:"exclude,omitempty"`
+	Items    [][]byte `protobuf:"bytes,6,rep,name=items,proto3" json:"items,omitempty"`
+	Wait     bool     `protobuf:"varint,7,opt,name=wait,proto3" json:"wait,omitempty"`
+	// 推送ID, logic重试同一推送时保持不变, message server在去重窗口内只处理一次
+	PushId               string   `protobuf:"bytes,8,opt,name=push_id,json=pushId,proto3" json:"push_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PushRequest) Reset()         { *m = PushRequest{} }
+func (m *PushRequest) String() string { return proto.CompactTextString(m) }
+func (*PushRequest) ProtoMessage()    {}
+func (*PushRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33c57e4bae7b9afd, []int{1}
+}
+
+func (m *PushRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PushRequest.Unmarshal(m, b)
+}
+func (m *PushRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PushRequest.Marshal(b, m, deterministic)
+}
+func (m *PushRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PushRequest.Merge(m, src)
+}
+func (m *PushRequest) XXX_Size() int {
+	return xxx_messageInfo_PushRequest.Size(m)
+}
+func (m *PushRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_PushRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PushRequest proto.InternalMessageInfo
+
+func (m *PushRequest) GetPushType() int32 {
+	if m != nil {
+		return m.PushType
+	}
+	return 0
+}
+
+func (m *PushRequest) GetRoom() string {
+	if m != nil {
+		return m.Room
+	}
+	return ""
+}
+
+func (m *PushRequest) GetRooms() []string {
+	if m != nil {
+		return m.Rooms
+	}
+	return nil
+}
+
+func (m *PushRequest) GetUser() string {
+	if m != nil {
+		return m.User
+	}
+	return ""
+}
+
+func (m *PushRequest) GetExclude() *Exclude {
+	if m != nil {
+		return m.Exclude
+	}
+	return nil
+}
+
+func (m *PushRequest) GetItems() [][]byte {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+func (m *PushRequest) GetWait() bool {
+	if m != nil {
+		return m.Wait
+	}
+	return false
+}
+
+func (m *PushRequest) GetPushId() string {
+	if m != nil {
+		return m.PushId
+	}
+	return ""
+}
+
+// 推送结果, 对应types.PushResponse
+type PushReply struct {
+	Code                 string   `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message              string   `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Accepted             int32    `protobuf:"varint,3,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Dropped              int32    `protobuf:"varint,4,opt,name=dropped,proto3" json:"dropped,omitempty"`
+	Reached              int32    `protobuf:"varint,5,opt,name=reached,proto3" json:"reached,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PushReply) Reset()         { *m = PushReply{} }
+func (m *PushReply) String() string { return proto.CompactTextString(m) }
+func (*PushReply) ProtoMessage()    {}
+func (*PushReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33c57e4bae7b9afd, []int{2}
+}
+
+func (m *PushReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PushReply.Unmarshal(m, b)
+}
+func (m *PushReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PushReply.Marshal(b, m, deterministic)
+}
+func (m *PushReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PushReply.Merge(m, src)
+}
+func (m *PushReply) XXX_Size() int {
+	return xxx_messageInfo_PushReply.Size(m)
+}
+func (m *PushReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_PushReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PushReply proto.InternalMessageInfo
+
+func (m *PushReply) GetCode() string {
+	if m != nil {
+		return m.Code
+	}
+	return ""
+}
+
+func (m *PushReply) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *PushReply) GetAccepted() int32 {
+	if m != nil {
+		return m.Accepted
+	}
+	return 0
+}
+
+func (m *PushReply) GetDropped() int32 {
+	if m != nil {
+		return m.Dropped
+	}
+	return 0
+}
+
+func (m *PushReply) GetReached() int32 {
+	if m != nil {
+		return m.Reached
+	}
+	return 0
+}
+
+// 流式推送: 一批推送请求
+type StreamRequest struct {
+	Seq                  uint64         `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Pushes               []*PushRequest `protobuf:"bytes,2,rep,name=pushes,proto3" json:"pushes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *StreamRequest) Reset()         { *m = StreamRequest{} }
+func (m *StreamRequest) String() string { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()    {}
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33c57e4bae7b9afd, []int{3}
+}
+
+func (m *StreamRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamRequest.Unmarshal(m, b)
+}
+func (m *StreamRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamRequest.Marshal(b, m, deterministic)
+}
+func (m *StreamRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamRequest.Merge(m, src)
+}
+func (m *StreamRequest) XXX_Size() int {
+	return xxx_messageInfo_StreamRequest.Size(m)
+}
+func (m *StreamRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamRequest proto.InternalMessageInfo
+
+func (m *StreamRequest) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *StreamRequest) GetPushes() []*PushRequest {
+	if m != nil {
+		return m.Pushes
+	}
+	return nil
+}
+
+// 流式推送: message server发回的事件
+// ACK: seq对应批次的处理结果, replies与pushes一一对应
+// CLOSING: message server即将关闭, logic应停止在该流上发送
+type StreamEvent struct {
+	Type                 string       `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Seq                  uint64       `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	Replies              []*PushReply `protobuf:"bytes,3,rep,name=replies,proto3" json:"replies,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *StreamEvent) Reset()         { *m = StreamEvent{} }
+func (m *StreamEvent) String() string { return proto.CompactTextString(m) }
+func (*StreamEvent) ProtoMessage()    {}
+func (*StreamEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33c57e4bae7b9afd, []int{4}
+}
+
+func (m *StreamEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamEvent.Unmarshal(m, b)
+}
+func (m *StreamEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamEvent.Marshal(b, m, deterministic)
+}
+func (m *StreamEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamEvent.Merge(m, src)
+}
+func (m *StreamEvent) XXX_Size() int {
+	return xxx_messageInfo_StreamEvent.Size(m)
+}
+func (m *StreamEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamEvent proto.InternalMessageInfo
+
+func (m *StreamEvent) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *StreamEvent) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *StreamEvent) GetReplies() []*PushReply {
+	if m != nil {
+		return m.Replies
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Exclude)(nil), "messagecenter.Exclude")
+	proto.RegisterType((*PushRequest)(nil), "messagecenter.PushRequest")
+	proto.RegisterType((*PushReply)(nil), "messagecenter.PushReply")
+	proto.RegisterType((*StreamRequest)(nil), "messagecenter.StreamRequest")
+	proto.RegisterType((*StreamEvent)(nil), "messagecenter.StreamEvent")
+}
+
+func init() { proto.RegisterFile("message.proto", fileDescriptor_33c57e4bae7b9afd) }
+
+var fileDescriptor_33c57e4bae7b9afd = []byte{
+	// 492 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x54, 0x51, 0x8b, 0x13, 0x3d,
+	0x14, 0x25, 0x9d, 0xb6, 0x33, 0xbd, 0xfd, 0x0a, 0x1f, 0x41, 0x34, 0x8e, 0x8b, 0x0c, 0x7d, 0x9a,
+	0x17, 0xbb, 0x4b, 0x7d, 0xf4, 0x41, 0x57, 0x58, 0x61, 0x1f, 0x04, 0xc9, 0xba, 0x20, 0xbe, 0x2c,
+	0xe3, 0xe4, 0xd2, 0x0e, 0x4e, 0x3b, 0xd9, 0x24, 0x5d, 0xed, 0x4f, 0xf0, 0x47, 0x8a, 0x7f, 0x45,
+	0x6e, 0x32, 0x81, 0xee, 0xb2, 0xfa, 0xb0, 0x3e, 0xcd, 0x3d, 0xc9, 0xc9, 0xb9, 0xf7, 0xe4, 0x84,
+	0x81, 0xd9, 0x06, 0xad, 0xad, 0x56, 0xb8, 0xd0, 0xa6, 0x73, 0x1d, 0x8f, 0xb0, 0xc6, 0xad, 0x43,
+	0x33, 0xff, 0x04, 0xe9, 0xd9, 0xf7, 0xba, 0xdd, 0x29, 0xe4, 0x4f, 0x21, 0xab, 0xbb, 0xed, 0xf6,
+	0xaa, 0x51, 0x56, 0xb0, 0x22, 0x29, 0x87, 0x32, 0x25, 0x7c, 0xae, 0x2c, 0x7f, 0x0e, 0xd0, 0x28,
+	0xdc, 0xba, 0xc6, 0x35, 0x68, 0xc5, 0xa0, 0x48, 0xca, 0x89, 0x3c, 0x58, 0xe1, 0x1c, 0x86, 0xae,
+	0x5a, 0x59, 0x91, 0xf8, 0x1d, 0x5f, 0xcf, 0x7f, 0x32, 0x98, 0x7e, 0xd8, 0xd9, 0xb5, 0xc4, 0xeb,
+	0x1d, 0x5a, 0xc7, 0x9f, 0xc1, 0x44, 0xef, 0xec, 0xfa, 0xca, 0xed, 0x35, 0x0a, 0x56, 0xb0, 0x72,
+	0x24, 0x33, 0x5a, 0xf8, 0xb8, 0xd7, 0x48, 0x02, 0xa6, 0xeb, 0x36, 0x62, 0x50, 0x30, 0x12, 0xa0,
+	0x9a, 0x3f, 0x82, 0x11, 0x7d, 0xa3, 0x6a, 0x00, 0xc4, 0xdc, 0x59, 0x34, 0x62, 0x18, 0x98, 0x54,
+	0xf3, 0x13, 0x48, 0x31, 0x98, 0x10, 0xa3, 0x82, 0x95, 0xd3, 0xe5, 0xe3, 0xc5, 0x2d, 0x97, 0x8b,
+	0xde, 0xa2, 0x8c, 0x34, 0xd2, 0x6e, 0x1c, 0x6e, 0xac, 0x18, 0x17, 0x49, 0xf9, 0x9f, 0x0c, 0x80,
+	0xb4, 0xbf, 0x55, 0x8d, 0x13, 0x69, 0xc1, 0xca, 0x4c, 0xfa, 0x9a, 0x3f, 0x81, 0xd4, 0x8f, 0xdd,
+	0x28, 0x91, 0xf9, 0x96, 0x63, 0x82, 0xe7, 0x6a, 0xfe, 0x83, 0xc1, 0x24, 0xf8, 0xd3, 0xed, 0x9e,
+	0x8e, 0xd6, 0x9d, 0x0a, 0xc6, 0x26, 0xd2, 0xd7, 0x5c, 0x40, 0xda, 0x8f, 0xd1, 0xfb, 0x8a, 0x90,
+	0xe7, 0x90, 0x55, 0x75, 0x8d, 0xda, 0xa1, 0x12, 0x49, 0xb8, 0x8a, 0x88, 0xe9, 0x94, 0x32, 0x9d,
+	0xd6, 0xa8, 0xbc, 0xc7, 0x91, 0x8c, 0x90, 0x76, 0x0c, 0x56, 0xf5, 0x1a, 0x95, 0xb7, 0x39, 0x92,
+	0x11, 0xce, 0x2f, 0x61, 0x76, 0xe1, 0x0c, 0x56, 0x9b, 0x78, 0xd9, 0xff, 0x43, 0x62, 0xf1, 0xda,
+	0x4f, 0x33, 0x94, 0x54, 0xf2, 0x25, 0xf8, 0xc1, 0xfb, 0xf8, 0xa6, 0xcb, 0xfc, 0xce, 0x15, 0x1d,
+	0x44, 0x25, 0x7b, 0xe6, 0x7c, 0x05, 0xd3, 0x20, 0x7b, 0x76, 0x83, 0x5b, 0xe7, 0x53, 0x8e, 0xe1,
+	0x51, 0xca, 0x14, 0x5c, 0xdf, 0x68, 0x70, 0xd8, 0x28, 0x35, 0xa8, 0xdb, 0x06, 0x43, 0x70, 0xd3,
+	0xa5, 0xb8, 0xb7, 0x93, 0x6e, 0xf7, 0x32, 0x12, 0x97, 0xbf, 0x06, 0x30, 0x7b, 0x1f, 0x48, 0x17,
+	0x68, 0x6e, 0xd0, 0xf0, 0xd7, 0x90, 0x12, 0xef, 0xb4, 0x6d, 0xf9, 0x5f, 0x26, 0xcd, 0xff, 0xa8,
+	0xcd, 0xdf, 0x40, 0xe6, 0x01, 0xbd, 0xa4, 0x87, 0x29, 0x9c, 0xf6, 0xf9, 0xfa, 0x67, 0xf7, 0x4f,
+	0x43, 0x5c, 0xd2, 0x23, 0x7d, 0x98, 0xc2, 0x3b, 0x18, 0x87, 0x08, 0xf8, 0xd1, 0x1d, 0xce, 0xad,
+	0xc0, 0xf3, 0xfc, 0xde, 0x5d, 0x9f, 0x5b, 0xc9, 0x4e, 0xd8, 0xdb, 0xa3, 0xcf, 0x79, 0x4f, 0x78,
+	0x11, 0x18, 0xc7, 0xfa, 0xeb, 0xea, 0xd8, 0xe8, 0xfa, 0x95, 0xd1, 0xf5, 0x97, 0xb1, 0xff, 0x37,
+	0xbc, 0xfc, 0x3d, 0x00, 0x4a, 0x2a, 0x4d, 0x82, 0x2c, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// MessageServerClient is the client API for MessageServer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type MessageServerClient interface {
+	PushAll(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error)
+	PushRoom(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error)
+	PushRooms(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error)
+	PushUser(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error)
+	Stream(ctx context.Context, opts ...grpc.CallOption) (MessageServer_StreamClient, error)
+}
+
+type messageServerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessageServerClient(cc grpc.ClientConnInterface) MessageServerClient {
+	return &messageServerClient{cc}
+}
+
+func (c *messageServerClient) PushAll(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error) {
+	out := new(PushReply)
+	err := c.cc.Invoke(ctx, "/messagecenter.MessageServer/PushAll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServerClient) PushRoom(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error) {
+	out := new(PushReply)
+	err := c.cc.Invoke(ctx, "/messagecenter.MessageServer/PushRoom", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServerClient) PushRooms(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error) {
+	out := new(PushReply)
+	err := c.cc.Invoke(ctx, "/messagecenter.MessageServer/PushRooms", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServerClient) PushUser(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushReply, error) {
+	out := new(PushReply)
+	err := c.cc.Invoke(ctx, "/messagecenter.MessageServer/PushUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServerClient) Stream(ctx context.Context, opts ...grpc.CallOption) (MessageServer_StreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_MessageServer_serviceDesc.Streams[0], "/messagecenter.MessageServer/Stream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &messageServerStreamClient{stream}
+	return x, nil
+}
+
+type MessageServer_StreamClient interface {
+	Send(*StreamRequest) error
+	Recv() (*StreamEvent, error)
+	grpc.ClientStream
+}
+
+type messageServerStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *messageServerStreamClient) Send(m *StreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *messageServerStreamClient) Recv() (*StreamEvent, error) {
+	m := new(StreamEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MessageServerServer is the server API for MessageServer service.
+type MessageServerServer interface {
+	PushAll(context.Context, *PushRequest) (*PushReply, error)
+	PushRoom(context.Context, *PushRequest) (*PushReply, error)
+	PushRooms(context.Context, *PushRequest) (*PushReply, error)
+	PushUser(context.Context, *PushRequest) (*PushReply, error)
+	Stream(MessageServer_StreamServer) error
+}
+
+// UnimplementedMessageServerServer can be embedded to have forward compatible implementations.
+type UnimplementedMessageServerServer struct {
+}
+
+func (*UnimplementedMessageServerServer) PushAll(ctx context.Context, req *PushRequest) (*PushReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushAll not implemented")
+}
+func (*UnimplementedMessageServerServer) PushRoom(ctx context.Context, req *PushRequest) (*PushReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushRoom not implemented")
+}
+func (*UnimplementedMessageServerServer) PushRooms(ctx context.Context, req *PushRequest) (*PushReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushRooms not implemented")
+}
+func (*UnimplementedMessageServerServer) PushUser(ctx context.Context, req *PushRequest) (*PushReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushUser not implemented")
+}
+func (*UnimplementedMessageServerServer) Stream(srv MessageServer_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+
+func RegisterMessageServerServer(s *grpc.Server, srv MessageServerServer) {
+	s.RegisterService(&_MessageServer_serviceDesc, srv)
+}
+
+func _MessageServer_PushAll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServerServer).PushAll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/messagecenter.MessageServer/PushAll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServerServer).PushAll(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageServer_PushRoom_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServerServer).PushRoom(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/messagecenter.MessageServer/PushRoom",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServerServer).PushRoom(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageServer_PushRooms_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServerServer).PushRooms(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/messagecenter.MessageServer/PushRooms",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServerServer).PushRooms(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageServer_PushUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServerServer).PushUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/messagecenter.MessageServer/PushUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServerServer).PushUser(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageServer_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MessageServerServer).Stream(&messageServerStreamServer{stream})
+}
+
+type MessageServer_StreamServer interface {
+	Send(*StreamEvent) error
+	Recv() (*StreamRequest, error)
+	grpc.ServerStream
+}
+
+type messageServerStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *messageServerStreamServer) Send(m *StreamEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *messageServerStreamServer) Recv() (*StreamRequest, error) {
+	m := new(StreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _MessageServer_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "messagecenter.MessageServer",
+	HandlerType: (*MessageServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PushAll",
+			Handler:    _MessageServer_PushAll_Handler,
+		},
+		{
+			MethodName: "PushRoom",
+			Handler:    _MessageServer_PushRoom_Handler,
+		},
+		{
+			MethodName: "PushRooms",
+			Handler:    _MessageServer_PushRooms_Handler,
+		},
+		{
+			MethodName: "PushUser",
+			Handler:    _MessageServer_PushUser_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _MessageServer_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "message.proto",
+}
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"message-center/pkg/types"
+	"testing"
+)
+
+func TestExcludeConversion(t *testing.T) {
+	cases := []struct {
+		name    string
+		exclude *types.PushExclude
+		wantNil bool
+	}{
+		{"没有排除条件", nil, true},
+		{"空的排除条件", &types.PushExclude{}, true},
+		{"保留所有条件", &types.PushExclude{ConnIds: []uint64{1, 2}, Identities: []string{"user-a"}, Tags: []string{"bot"}}, false},
+	}
+	for _, c := range cases {
+		// 经过nil的*Exclude转换回来仍为nil
+		got := NewExclude(c.exclude).PushExclude()
+		if (got == nil) != c.wantNil {
+			t.Errorf("%s: PushExclude = %+v", c.name, got)
+			continue
+		}
+		if got != nil && (len(got.ConnIds) != 2 || got.ConnIds[1] != 2 || got.Identities[0] != "user-a" || got.Tags[0] != "bot") {
+			t.Errorf("%s: PushExclude = %+v", c.name, got)
+		}
+	}
+}
+
+// 一批推送经过proto编解码后保持不变, 每条消息保持原样
+func TestStreamRequestRoundTrip(t *testing.T) {
+	var (
+		msgArr  = []json.RawMessage{json.RawMessage(`{"a":1}`), json.RawMessage(`"text"`), json.RawMessage(`[]`)}
+		request = &StreamRequest{Seq: 42, Pushes: []*PushRequest{
+			{PushType: types.PUSH_TYPE_ROOM, Room: "room-a", Items: NewItems(msgArr), Exclude: NewExclude(&types.PushExclude{ConnIds: []uint64{7}})},
+			{PushType: types.PUSH_TYPE_ROOMS, Rooms: []string{"room-a", "room-b"}, Items: NewItems(msgArr[:1])},
+			{PushType: types.PUSH_TYPE_USER, User: "user-a", Items: NewItems(nil)},
+		}}
+		decoded = &StreamRequest{}
+	)
+	buf, err := proto.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = proto.Unmarshal(buf, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Seq != request.Seq || len(decoded.Pushes) != len(request.Pushes) {
+		t.Fatalf("decoded = %v", decoded)
+	}
+	for pushIdx, push := range decoded.Pushes {
+		want := request.Pushes[pushIdx]
+		if push.PushType != want.PushType || push.Room != want.Room || push.User != want.User || len(push.Rooms) != len(want.Rooms) {
+			t.Errorf("第%d个推送: %v", pushIdx, push)
+		}
+		got := push.MsgArr()
+		if len(got) != len(want.Items) {
+			t.Errorf("第%d个推送: %d条消息, want %d", pushIdx, len(got), len(want.Items))
+			continue
+		}
+		for msgIdx := range got {
+			if string(got[msgIdx]) != string(msgArr[msgIdx]) {
+				t.Errorf("第%d个推送第%d条消息: %s", pushIdx, msgIdx, got[msgIdx])
+			}
+		}
+	}
+	if exclude := decoded.Pushes[0].Exclude.PushExclude(); exclude == nil || exclude.ConnIds[0] != 7 {
+		t.Errorf("exclude = %+v", exclude)
+	}
+	if exclude := decoded.Pushes[1].Exclude.PushExclude(); exclude != nil {
+		t.Errorf("未设置排除条件时应为nil: %+v", exclude)
+	}
+}
+
+func TestPushReplyConversion(t *testing.T) {
+	cases := []struct {
+		name     string
+		pushResp *types.PushResponse
+	}{
+		{"全部接收", &types.PushResponse{Code: types.PUSH_CODE_OK, Accepted: 3}},
+		{"部分丢弃", &types.PushResponse{Code: types.PUSH_CODE_PARTIAL, Message: "channel full", Accepted: 1, Dropped: 2}},
+	}
+	for _, c := range cases {
+		var (
+			decoded = &PushReply{}
+		)
+		buf, err := proto.Marshal(NewPushReply(c.pushResp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = proto.Unmarshal(buf, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.PushResponse(); *got != *c.pushResp {
+			t.Errorf("%s: PushResponse = %+v, want %+v", c.name, got, c.pushResp)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 推送接口错误码
+const (
+	PUSH_CODE_OK              = "OK"              // 全部接收
+	PUSH_CODE_PARTIAL         = "PARTIAL_DROPPED" // 部分消息因队列已满被丢弃, 不应整体重试
+	PUSH_CODE_BAD_METHOD      = "METHOD_NOT_ALLOWED"
+	PUSH_CODE_INVALID_FORM    = "INVALID_FORM"
+	PUSH_CODE_INVALID_ROOM    = "INVALID_ROOM"
+	PUSH_CODE_INVALID_USER    = "INVALID_USER"
+	PUSH_CODE_INVALID_ITEMS   = "INVALID_ITEMS"
+	PUSH_CODE_INVALID_EXCLUDE = "INVALID_EXCLUDE"
+	PUSH_CODE_CHANNEL_FULL    = "CHANNEL_FULL"   // 队列已满, 稍后重试
+	PUSH_CODE_UNAVAILABLE     = "UNAVAILABLE"    // 服务不可用(关闭中或没有可用的message server)
+	PUSH_CODE_UNAUTHORIZED    = "UNAUTHORIZED"   // api key或签名不合法
+	PUSH_CODE_FORBIDDEN       = "FORBIDDEN"      // api key无权推送到目标房间或全量推送
+	PUSH_CODE_WAIT_TIMEOUT    = "WAIT_TIMEOUT"   // 已接收, 等待送达超时
+	PUSH_CODE_PARTIAL_FAILED  = "PARTIAL_FAILED" // 等待送达时部分message server推送失败, 见servers
+	PUSH_CODE_FAILED          = "FAILED"         // 等待送达时所有message server都推送失败
+	PUSH_CODE_NOT_FOUND       = "NOT_FOUND"      // 定时推送不存在
+	PUSH_CODE_NOT_PENDING     = "NOT_PENDING"    // 定时推送已分发或已取消
+)
+
+// 推送接口响应
+type PushResponse struct {
+	Code     string `json:"code"`              // 错误码
+	Message  string `json:"message,omitempty"` // 错误描述
+	Accepted int    `json:"accepted"`          // 接收的消息条数
+	Dropped  int    `json:"dropped"`           // 丢弃的消息条数
+	Reached  int    `json:"reached,omitempty"` // 等待送达时, 消息写入发送队列的连接数
+}
+
+// 以json格式输出推送接口响应
+func WritePushResponse(resp http.ResponseWriter, status int, pushResp *PushResponse) {
+	var (
+		buf []byte
+		err error
+	)
+	if buf, err = json.Marshal(pushResp); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	_, _ = resp.Write(buf)
+}
+
+// 解析推送接口的公共参数items和exclude, 参数不合法时直接响应400
+func ParsePushForm(resp http.ResponseWriter, req *http.Request) (msgArr []json.RawMessage, exclude *PushExclude, ok bool) {
+	var (
+		err error
+	)
+	if req.Method != http.MethodPost {
+		WritePushResponse(resp, http.StatusMethodNotAllowed, &PushResponse{Code: PUSH_CODE_BAD_METHOD})
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		WritePushResponse(resp, http.StatusBadRequest, &PushResponse{Code: PUSH_CODE_INVALID_FORM, Message: err.Error()})
+		return
+	}
+
+	if exclude, err = DecodePushExclude(req.PostForm.Get("exclude")); err != nil {
+		WritePushResponse(resp, http.StatusBadRequest, &PushResponse{Code: PUSH_CODE_INVALID_EXCLUDE, Message: err.Error()})
+		return
+	}
+
+	if err = json.Unmarshal([]byte(req.PostForm.Get("items")), &msgArr); err != nil {
+		WritePushResponse(resp, http.StatusBadRequest, &PushResponse{Code: PUSH_CODE_INVALID_ITEMS, Message: err.Error()})
+		return
+	}
+	ok = true
+	return
+}
+
+// 推送排除条件, 命中任意一项的连接不会收到推送
+type PushExclude struct {
+	ConnIds    []uint64 `json:"connIds"`    // 排除的连接ID
+	Identities []string `json:"identities"` // 排除的用户标识
+	Tags       []string `json:"tags"`       // 排除带有这些标签的连接
+}
+
+// 解析推送接口的exclude参数, 为空时返回nil
+func DecodePushExclude(buf string) (*PushExclude, error) {
+	if buf == "" {
+		return nil, nil
+	}
+	exclude := PushExclude{}
+	if err := json.Unmarshal([]byte(buf), &exclude); err != nil {
+		return nil, err
+	}
+	if exclude.IsEmpty() {
+		return nil, nil
+	}
+	return &exclude, nil
+}
+
+func (exclude *PushExclude) IsEmpty() bool {
+	return exclude == nil || (len(exclude.ConnIds) == 0 && len(exclude.Identities) == 0 && len(exclude.Tags) == 0)
+}
+
+// 排除条件的规范化表示, 排除条件相同的消息才能合并推送
+// 每个值按长度前缀编码, 值中的分隔符不会使不同的条件得到相同的表示
+func (exclude *PushExclude) Key() string {
+	var (
+		connIds    []string
+		identities []string
+		tags       []string
+		key        strings.Builder
+	)
+	if exclude.IsEmpty() {
+		return ""
+	}
+	for _, connId := range exclude.ConnIds {
+		connIds = append(connIds, strconv.FormatUint(connId, 10))
+	}
+	identities = append(identities, exclude.Identities...)
+	tags = append(tags, exclude.Tags...)
+	sort.Strings(connIds)
+	sort.Strings(identities)
+	sort.Strings(tags)
+	for groupIdx, values := range [][]string{connIds, identities, tags} {
+		if groupIdx > 0 {
+			key.WriteByte('|')
+		}
+		for _, value := range values {
+			key.WriteString(strconv.Itoa(len(value)))
+			key.WriteByte(':')
+			key.WriteString(value)
+		}
+	}
+	return key.String()
+}
+
+// 房间订阅变化
+type RoomChange struct {
+	Room string `json:"room"`
+	Join bool   `json:"join"` // true: 房间有了第一个订阅者, false: 房间最后一个订阅者离开
+}
+
+// message server的房间订阅摘要, logic据此只向有订阅者的message server推送房间消息
+// Full为true时Rooms为全量房间列表, 否则Changes为从请求的版本到Version之间的增量变化
+type RoomDigest struct {
+	Epoch   int64        `json:"epoch"`   // message server启动时间, 变化说明message server重启过, 需要全量同步
+	Version uint64       `json:"version"` // 房间列表版本, 每次房间增删加1
+	Full    bool         `json:"full"`
+	Rooms   []string     `json:"rooms,omitempty"`
+	Changes []RoomChange `json:"changes,omitempty"`
+}
+
+// 推送请求的通用表示, 用于消息队列和进程内等非HTTP通道
+type PushEnvelope struct {
+	PushType int             `json:"pushType"`
+	Room     string          `json:"room,omitempty"`
+	Rooms    []string        `json:"rooms,omitempty"`
+	User     string          `json:"user,omitempty"`
+	Exclude  *PushExclude    `json:"exclude,omitempty"`
+	Items    json.RawMessage `json:"items"`              // 消息数组, 保持logic序列化后的原样
+	Wait     bool            `json:"wait,omitempty"`     // 等待消息推送到连接后再回复
+	Priority bool            `json:"priority,omitempty"` // 高优先级, logic重放溢出队列时保留
+	ExpireAt int64           `json:"expireAt,omitempty"` // 过期时间, unix毫秒, 0表示不过期; logic重放溢出队列时丢弃已过期的推送
+}
+
+// 批量推送请求, POST /push/batch的json请求体
+type PushBatch struct {
+	Pushes []*PushEnvelope `json:"pushes"`
+}
+
+// 批量推送响应, Replies与请求中的Pushes一一对应
+// 请求本身无法处理时Code不为OK, Replies为空
+type PushBatchResponse struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Replies []*PushResponse `json:"replies,omitempty"`
+}
+
+// 错误码对应的HTTP状态码
+func PushStatus(code string) int {
+	switch code {
+	case PUSH_CODE_OK, PUSH_CODE_PARTIAL, PUSH_CODE_PARTIAL_FAILED:
+		return http.StatusOK
+	case PUSH_CODE_FAILED:
+		return http.StatusBadGateway
+	case PUSH_CODE_WAIT_TIMEOUT:
+		return http.StatusAccepted
+	case PUSH_CODE_BAD_METHOD:
+		return http.StatusMethodNotAllowed
+	case PUSH_CODE_CHANNEL_FULL:
+		return http.StatusTooManyRequests
+	case PUSH_CODE_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	case PUSH_CODE_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case PUSH_CODE_FORBIDDEN:
+		return http.StatusForbidden
+	case PUSH_CODE_NOT_FOUND:
+		return http.StatusNotFound
+	case PUSH_CODE_NOT_PENDING:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
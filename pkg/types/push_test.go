@@ -0,0 +1,114 @@
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushExcludeKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		a     *PushExclude
+		b     *PushExclude
+		equal bool
+	}{
+		{"没有排除条件和空的排除条件相同", nil, &PushExclude{}, true},
+		{"与顺序无关", &PushExclude{ConnIds: []uint64{2, 1}, Tags: []string{"b", "a"}}, &PushExclude{ConnIds: []uint64{1, 2}, Tags: []string{"a", "b"}}, true},
+		{"值中的逗号不与多个值混淆", &PushExclude{Identities: []string{"a,b"}}, &PushExclude{Identities: []string{"a", "b"}}, false},
+		{"值中的竖线不与分组混淆", &PushExclude{Identities: []string{"a|b"}}, &PushExclude{Identities: []string{"a"}, Tags: []string{"b"}}, false},
+		{"值中的长度前缀不与多个值混淆", &PushExclude{Tags: []string{"1:a"}}, &PushExclude{Tags: []string{"a", "a"}}, false},
+		{"用户和标签不混淆", &PushExclude{Identities: []string{"admin"}}, &PushExclude{Tags: []string{"admin"}}, false},
+		{"连接ID不同", &PushExclude{ConnIds: []uint64{1}}, &PushExclude{ConnIds: []uint64{11}}, false},
+	}
+	for _, c := range cases {
+		if got := c.a.Key() == c.b.Key(); got != c.equal {
+			t.Errorf("%s: %q与%q相同=%v, want %v", c.name, c.a.Key(), c.b.Key(), got, c.equal)
+		}
+	}
+}
+
+func TestParsePushForm(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		body        string
+		wantStatus  int // 0表示解析成功
+		wantCode    string
+		wantItems   int
+		wantExclude bool
+	}{
+		{"items和exclude", http.MethodPost, `items=[{"a":1},"b"]&exclude={"identities":["bob"]}`, 0, "", 2, true},
+		{"空的exclude视为不排除", http.MethodPost, `items=[1]&exclude={}`, 0, "", 1, false},
+		{"只接受POST", http.MethodGet, "", http.StatusMethodNotAllowed, PUSH_CODE_BAD_METHOD, 0, false},
+		{"exclude格式错误", http.MethodPost, `items=[1]&exclude=bob`, http.StatusBadRequest, PUSH_CODE_INVALID_EXCLUDE, 0, false},
+		{"items格式错误", http.MethodPost, `items={"a":1}`, http.StatusBadRequest, PUSH_CODE_INVALID_ITEMS, 0, false},
+		{"缺少items", http.MethodPost, `room=a`, http.StatusBadRequest, PUSH_CODE_INVALID_ITEMS, 0, false},
+	}
+	for _, c := range cases {
+		var (
+			req  = httptest.NewRequest(c.method, "/push/room", strings.NewReader(c.body))
+			resp = httptest.NewRecorder()
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		msgArr, exclude, ok := ParsePushForm(resp, req)
+		if c.wantStatus == 0 {
+			if !ok || len(msgArr) != c.wantItems || (exclude != nil) != c.wantExclude {
+				t.Errorf("%s: ok=%v items=%d exclude=%+v %s", c.name, ok, len(msgArr), exclude, resp.Body.String())
+			}
+			continue
+		}
+		if ok || resp.Code != c.wantStatus || !strings.Contains(resp.Body.String(), `"code":"`+c.wantCode+`"`) {
+			t.Errorf("%s: ok=%v %d %s", c.name, ok, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestWritePushResponse(t *testing.T) {
+	cases := []struct {
+		name       string
+		pushResp   *PushResponse
+		wantStatus int
+		wantBody   map[string]interface{} // 数字按json解析为float64
+	}{
+		{"全部接收", &PushResponse{Code: PUSH_CODE_OK, Accepted: 2},
+			http.StatusOK, map[string]interface{}{"code": PUSH_CODE_OK, "accepted": 2.0, "dropped": 0.0}},
+		{"部分丢弃仍为200", &PushResponse{Code: PUSH_CODE_PARTIAL, Message: "merge channel full", Accepted: 1, Dropped: 1},
+			http.StatusOK, map[string]interface{}{"code": PUSH_CODE_PARTIAL, "message": "merge channel full", "accepted": 1.0, "dropped": 1.0}},
+		{"队列已满为429", &PushResponse{Code: PUSH_CODE_CHANNEL_FULL, Dropped: 3},
+			http.StatusTooManyRequests, map[string]interface{}{"code": PUSH_CODE_CHANNEL_FULL, "accepted": 0.0, "dropped": 3.0}},
+		{"服务不可用为503", &PushResponse{Code: PUSH_CODE_UNAVAILABLE, Dropped: 1},
+			http.StatusServiceUnavailable, map[string]interface{}{"code": PUSH_CODE_UNAVAILABLE, "accepted": 0.0, "dropped": 1.0}},
+		{"参数错误为400", &PushResponse{Code: PUSH_CODE_INVALID_ROOM, Message: "room invalid"},
+			http.StatusBadRequest, map[string]interface{}{"code": PUSH_CODE_INVALID_ROOM, "message": "room invalid", "accepted": 0.0, "dropped": 0.0}},
+		{"等待送达超时为202", &PushResponse{Code: PUSH_CODE_WAIT_TIMEOUT, Accepted: 1},
+			http.StatusAccepted, map[string]interface{}{"code": PUSH_CODE_WAIT_TIMEOUT, "accepted": 1.0, "dropped": 0.0}},
+		{"等待送达时返回连接数", &PushResponse{Code: PUSH_CODE_OK, Accepted: 1, Reached: 5},
+			http.StatusOK, map[string]interface{}{"code": PUSH_CODE_OK, "accepted": 1.0, "dropped": 0.0, "reached": 5.0}},
+	}
+	for _, c := range cases {
+		var (
+			resp = httptest.NewRecorder()
+			body map[string]interface{}
+		)
+		WritePushResponse(resp, PushStatus(c.pushResp.Code), c.pushResp)
+		if resp.Code != c.wantStatus || resp.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: status=%d content-type=%s", c.name, resp.Code, resp.Header().Get("Content-Type"))
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// 为空的message和reached不输出
+		if len(body) != len(c.wantBody) {
+			t.Errorf("%s: body=%v, want %v", c.name, body, c.wantBody)
+			continue
+		}
+		for key, want := range c.wantBody {
+			if body[key] != want {
+				t.Errorf("%s: %s=%v, want %v", c.name, key, body[key], want)
+			}
+		}
+	}
+}
@@ -7,8 +7,10 @@ import (
 
 // 推送类型
 const (
-	PUSH_TYPE_ROOM = 1 // 推送房间
-	PUSH_TYPE_ALL  = 2 // 推送在线
+	PUSH_TYPE_ROOM  = 1 // 推送房间
+	PUSH_TYPE_ALL   = 2 // 推送在线
+	PUSH_TYPE_ROOMS = 3 // 推送多个房间, 同一连接只推送一次
+	PUSH_TYPE_USER  = 4 // 推送用户, 即握手时uid相同的所有连接
 )
 
 // websocket Message对象
@@ -1,6 +1,9 @@
 package utils
 
-import "errors"
+import (
+	"errors"
+	"sort"
+)
 
 var (
 	ConnectionLossError = errors.New("connection loss")
@@ -13,6 +16,8 @@ var (
 
 	RoomIdInvalid = errors.New("room id invalid")
 
+	UserIdInvalid = errors.New("user id invalid")
+
 	DisPatchChannelFull = errors.New("dispatch channel full")
 
 	MergeChannelFull = errors.New("merge channel full")
@@ -20,6 +25,56 @@ var (
 	CertInvalid = errors.New("cert invalid")
 
 	LogicDisPatchChannelFull = errors.New("logic dispatch channel full")
+
+	LogicConnectClosed = errors.New("logic connect manager closed")
+
+	MessageServerStatusError = errors.New("message server response status error")
+
+	BackboneInvalid = errors.New("backbone type invalid")
+
+	BackboneReceiverMissing = errors.New("in-process message server not registered")
+
+	ApiKeyInvalid = errors.New("api key invalid")
+
+	SignatureInvalid = errors.New("signature invalid")
+
+	TimestampExpired = errors.New("timestamp expired")
+
+	NonceReplayed = errors.New("nonce replayed")
+
+	ScopeForbidden = errors.New("api key scope forbidden")
+
+	WaitTimeout = errors.New("wait for delivery timeout")
+
+	PushServerFailed = errors.New("push failed on some message servers, see servers")
+
+	ItemsInvalid = errors.New("items invalid")
+
+	PriorityInvalid = errors.New("priority invalid")
+
+	TtlInvalid = errors.New("ttl invalid")
+
+	DeliverAtInvalid = errors.New("deliverAt or delay invalid")
+
+	ScheduledPushWait = errors.New("scheduled push cannot wait for delivery")
+
+	SchedulerUnavailable = errors.New("push scheduler unavailable")
+
+	ScheduledPushNotFound = errors.New("scheduled push not found")
+
+	ScheduledPushNotPending = errors.New("scheduled push is dispatching, dispatched or cancelled")
+
+	ChannelUrlMissing = errors.New("channel url not configured")
+
+	WebhookNoSubscription = errors.New("no webhook subscription")
+
+	SocketOutcomeTimeout = errors.New("wait for socket push outcome timeout")
+
+	DeadLetterNotFound = errors.New("dead letter not found")
+
+	DeadLetterRedriven = errors.New("dead letter already redriven")
+
+	MessageLeased = errors.New("message is being processed, try again later")
 )
 
 func Contains(arr []string, value string) bool {
@@ -30,3 +85,20 @@ func Contains(arr []string, value string) bool {
 	}
 	return false
 }
+
+// 去除空值和重复值, 返回排序后的结果
+func SortedUnique(arr []string) []string {
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+	for i := 0; i < len(arr); i++ {
+		if arr[i] == "" || seen[arr[i]] {
+			continue
+		}
+		seen[arr[i]] = true
+		result = append(result, arr[i])
+	}
+	sort.Strings(result)
+	return result
+}